@@ -0,0 +1,863 @@
+package main
+
+/*
+ Alert delivery channels. An alert action with an ActionType other than ""
+ is delivered to the named channel: a generic webhook, SMTP email, ntfy,
+ Gotify or a syslog (RFC 5424) server. Deliveries are retried with backoff
+ and recorded in a delivery log.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var AlertChannelsFile = TEST_PREFIX + "/configs/base/alert_channels.json"
+var AlertDeliveryLogFile = TEST_PREFIX + "/state/api/alert_deliveries.json"
+
+var AlertChannelTypes = []string{"webhook", "smtp", "ntfy", "gotify", "syslog"}
+
+const alertDeliveryLogLimit = 200
+const alertChannelWorkers = 4
+const alertChannelDefaultAttempts = 3
+const alertChannelMaxAttempts = 10
+const alertSecretMask = "**"
+
+// bounds an smtp delivery, from dialing to QUIT
+var alertSMTPTimeout = 30 * time.Second
+
+type AlertChannel struct {
+	Name        string
+	Type        string //webhook | smtp | ntfy | gotify | syslog
+	Disabled    bool
+	MaxAttempts int `json:",omitempty"`
+
+	//webhook, ntfy topic url, gotify server url
+	URL          string            `json:",omitempty"`
+	Method       string            `json:",omitempty"`
+	Headers      map[string]string `json:",omitempty"`
+	BodyTemplate string            `json:",omitempty"` //text/template producing the json body
+	HMACSecret   string            `json:",omitempty"` //signs the body into X-SPR-Signature
+	Token        string            `json:",omitempty"` //ntfy access token, gotify application token
+
+	//smtp
+	SMTPServer string   `json:",omitempty"` //host:port
+	TLS        bool     `json:",omitempty"` //implicit tls, otherwise STARTTLS when offered
+	Username   string   `json:",omitempty"`
+	Password   string   `json:",omitempty"`
+	From       string   `json:",omitempty"`
+	To         []string `json:",omitempty"`
+
+	//syslog
+	SyslogServer   string `json:",omitempty"` //host:port
+	SyslogProtocol string `json:",omitempty"` //udp | tcp
+	Facility       int    `json:",omitempty"`
+}
+
+// the message handed to a channel
+type AlertMessage struct {
+	Time             time.Time
+	Topic            string
+	RuleId           string
+	Title            string
+	Body             string
+	NotificationType string
+	Info             map[string]interface{}
+}
+
+type AlertDelivery struct {
+	Time     time.Time
+	Channel  string
+	Type     string
+	Topic    string
+	RuleId   string
+	Attempts int
+	Success  bool
+	Error    string `json:",omitempty"`
+}
+
+type alertChannelJob struct {
+	channel AlertChannel
+	message AlertMessage
+}
+
+var AlertChannelsmtx sync.RWMutex
+var gAlertChannels = []AlertChannel{}
+
+var AlertDeliverymtx sync.Mutex
+var gAlertDeliveries = []AlertDelivery{}
+var gAlertDeliveriesLoaded = false
+
+var gAlertChannelQueue = make(chan alertChannelJob, 256)
+var gAlertChannelWorkersOnce sync.Once
+
+// delay before a retry, replaced in tests
+var alertRetryDelay = func(attempt int) time.Duration {
+	delay := time.Duration(1<<uint(attempt-1)) * 2 * time.Second
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	return delay
+}
+
+var validAlertChannelName = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,64}$`).MatchString
+
+var alertTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func validHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validHostPort(value string) bool {
+	host, port, err := net.SplitHostPort(value)
+	return err == nil && host != "" && port != ""
+}
+
+func (c *AlertChannel) Validate() error {
+	if !validAlertChannelName(c.Name) {
+		return fmt.Errorf("Invalid channel Name")
+	}
+
+	if !slices.Contains(AlertChannelTypes, c.Type) {
+		return fmt.Errorf("Invalid channel Type, expected one of %s", strings.Join(AlertChannelTypes, ", "))
+	}
+
+	if c.MaxAttempts < 0 || c.MaxAttempts > alertChannelMaxAttempts {
+		return fmt.Errorf("MaxAttempts must be between 0 and %d", alertChannelMaxAttempts)
+	}
+
+	for key, value := range c.Headers {
+		if key == "" || strings.ContainsAny(key+value, "\r\n") || strings.ContainsAny(key, " :") {
+			return fmt.Errorf("Invalid header %q", key)
+		}
+	}
+
+	switch c.Type {
+	case "webhook":
+		if !validHTTPURL(c.URL) {
+			return fmt.Errorf("webhook requires an http(s) URL")
+		}
+		if c.Method == "" {
+			c.Method = http.MethodPost
+		}
+		if c.Method != http.MethodPost && c.Method != http.MethodPut {
+			return fmt.Errorf("webhook Method must be POST or PUT")
+		}
+		if c.BodyTemplate != "" {
+			_, err := renderAlertWebhookBody(c.BodyTemplate, AlertMessage{Info: map[string]interface{}{}})
+			if err != nil {
+				return err
+			}
+		}
+	case "ntfy", "gotify":
+		if !validHTTPURL(c.URL) {
+			return fmt.Errorf("%s requires an http(s) URL", c.Type)
+		}
+	case "smtp":
+		if !validHostPort(c.SMTPServer) {
+			return fmt.Errorf("smtp requires SMTPServer as host:port")
+		}
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			return fmt.Errorf("Invalid From address")
+		}
+		if len(c.To) == 0 {
+			return fmt.Errorf("smtp requires at least one To address")
+		}
+		for _, to := range c.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("Invalid To address %s", to)
+			}
+		}
+	case "syslog":
+		if !validHostPort(c.SyslogServer) {
+			return fmt.Errorf("syslog requires SyslogServer as host:port")
+		}
+		if c.SyslogProtocol == "" {
+			c.SyslogProtocol = "udp"
+		}
+		if c.SyslogProtocol != "udp" && c.SyslogProtocol != "tcp" {
+			return fmt.Errorf("SyslogProtocol must be udp or tcp")
+		}
+		if c.Facility < 0 || c.Facility > 23 {
+			return fmt.Errorf("Facility must be between 0 and 23")
+		}
+	}
+
+	return nil
+}
+
+func loadAlertChannels() {
+	//assumes lock is held
+	data, err := ioutil.ReadFile(AlertChannelsFile)
+	if err != nil {
+		return
+	}
+	channels := []AlertChannel{}
+	err = json.Unmarshal(data, &channels)
+	if err != nil {
+		log.Println("failed to parse alert channels", err)
+		return
+	}
+	gAlertChannels = channels
+}
+
+func saveAlertChannels() error {
+	//assumes lock is held
+	return saveFileJSON(AlertChannelsFile, gAlertChannels)
+}
+
+func alertChannelByName(name string) (AlertChannel, bool) {
+	AlertChannelsmtx.Lock()
+	defer AlertChannelsmtx.Unlock()
+	loadAlertChannels()
+	for _, channel := range gAlertChannels {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+	return AlertChannel{}, false
+}
+
+func maskAlertChannel(c AlertChannel) AlertChannel {
+	if c.Password != "" {
+		c.Password = alertSecretMask
+	}
+	if c.HMACSecret != "" {
+		c.HMACSecret = alertSecretMask
+	}
+	if c.Token != "" {
+		c.Token = alertSecretMask
+	}
+	return c
+}
+
+// keepAlertChannelSecrets carries over secrets a client sent back masked
+func keepAlertChannelSecrets(c *AlertChannel, previous AlertChannel) {
+	if c.Password == alertSecretMask {
+		c.Password = previous.Password
+	}
+	if c.HMACSecret == alertSecretMask {
+		c.HMACSecret = previous.HMACSecret
+	}
+	if c.Token == alertSecretMask {
+		c.Token = previous.Token
+	}
+}
+
+var alertPlaceholder = regexp.MustCompile(`\{\{\s*([^{}#\s]+)\s*(?:#(Device|Interface))?\s*\}\}`)
+
+func alertEventValue(event interface{}, path string) (interface{}, bool) {
+	current := event
+	for _, key := range strings.Split(path, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = fields[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// renderAlertMessage fills in {{Field.Path}} placeholders of alert titles
+// and bodies, as the UI does. {{Field#Device}} resolves an IP or MAC to a
+// device name
+func renderAlertMessage(text string, event interface{}, devices map[string]DeviceEntry) string {
+	return alertPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		match := alertPlaceholder.FindStringSubmatch(placeholder)
+		value, exists := alertEventValue(event, match[1])
+		if !exists {
+			return ""
+		}
+
+		str := fmt.Sprint(value)
+		if match[2] == "Device" {
+			for _, dev := range devices {
+				if (dev.RecentIP != "" && dev.RecentIP == str) || (dev.MAC != "" && equalMAC(dev.MAC, str)) {
+					if dev.Name != "" {
+						return dev.Name
+					}
+					break
+				}
+			}
+		}
+		return str
+	})
+}
+
+func newAlertMessage(topic string, event interface{}, action ActionConfig, info map[string]interface{}) AlertMessage {
+	devices := readDevicesSnapshot()
+	ruleId, _ := info["RuleId"].(string)
+	return AlertMessage{
+		Time:             time.Now().UTC(),
+		Topic:            topic,
+		RuleId:           ruleId,
+		Title:            renderAlertMessage(action.MessageTitle, event, devices),
+		Body:             renderAlertMessage(action.MessageBody, event, devices),
+		NotificationType: action.NotificationType,
+		Info:             info,
+	}
+}
+
+func renderAlertWebhookBody(bodyTemplate string, message AlertMessage) ([]byte, error) {
+	if bodyTemplate == "" {
+		return json.Marshal(message)
+	}
+
+	tmpl, err := template.New("body").Funcs(alertTemplateFuncs).Option("missingkey=zero").Parse(bodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid BodyTemplate: %v", err)
+	}
+
+	var body bytes.Buffer
+	err = tmpl.Execute(&body, message)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid BodyTemplate: %v", err)
+	}
+
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("BodyTemplate did not produce valid json")
+	}
+
+	return body.Bytes(), nil
+}
+
+func signAlertBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendAlertHTTP(req *http.Request) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", req.URL.Host, resp.StatusCode)
+	}
+	return nil
+}
+
+func sendAlertWebhook(c AlertChannel, message AlertMessage) error {
+	body, err := renderAlertWebhookBody(c.BodyTemplate, message)
+	if err != nil {
+		return err
+	}
+
+	method := c.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequest(method, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+	if c.HMACSecret != "" {
+		req.Header.Set("X-SPR-Signature", signAlertBody(c.HMACSecret, body))
+	}
+
+	return sendAlertHTTP(req)
+}
+
+func alertMessageText(message AlertMessage) string {
+	if message.Body != "" {
+		return message.Body
+	}
+	if message.Title != "" {
+		return message.Title
+	}
+	return message.Topic
+}
+
+func sendAlertNtfy(c AlertChannel, message AlertMessage) error {
+	req, err := http.NewRequest(http.MethodPost, c.URL, strings.NewReader(alertMessageText(message)))
+	if err != nil {
+		return err
+	}
+	if message.Title != "" {
+		req.Header.Set("Title", message.Title)
+	}
+	if message.NotificationType != "" {
+		req.Header.Set("Tags", message.NotificationType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return sendAlertHTTP(req)
+}
+
+func sendAlertGotify(c AlertChannel, message AlertMessage) error {
+	priority := 5
+	if message.NotificationType == "error" {
+		priority = 8
+	}
+
+	title := message.Title
+	if title == "" {
+		title = message.Topic
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"title":    title,
+		"message":  alertMessageText(message),
+		"priority": priority,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", c.Token)
+	return sendAlertHTTP(req)
+}
+
+func stripHeaderValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+func alertEmail(c AlertChannel, message AlertMessage) []byte {
+	subject := message.Title
+	if subject == "" {
+		subject = "SPR alert: " + message.Topic
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", stripHeaderValue(c.From))
+	fmt.Fprintf(&msg, "To: %s\r\n", stripHeaderValue(strings.Join(c.To, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", stripHeaderValue(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", message.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(alertMessageText(message) + "\r\n")
+	fmt.Fprintf(&msg, "\r\nTopic: %s\r\n", message.Topic)
+	return msg.Bytes()
+}
+
+func sendAlertSMTP(c AlertChannel, message AlertMessage) error {
+	host, _, _ := net.SplitHostPort(c.SMTPServer)
+
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return err
+	}
+	to := []string{}
+	for _, entry := range c.To {
+		address, err := mail.ParseAddress(entry)
+		if err != nil {
+			return err
+		}
+		to = append(to, address.Address)
+	}
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+
+	var conn net.Conn
+	if c.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: alertSMTPTimeout}, "tcp", c.SMTPServer, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", c.SMTPServer, alertSMTPTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	//bounds the whole exchange, a stalled server can not hang delivery
+	conn.SetDeadline(time.Now().Add(alertSMTPTimeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !c.TLS {
+		//upgrade like smtp.SendMail does when the server offers it
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err = client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(alertEmail(c, message)); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func syslogSeverity(notificationType string) int {
+	switch notificationType {
+	case "error":
+		return 3
+	case "warning":
+		return 4
+	case "info", "success":
+		return 6
+	}
+	return 5
+}
+
+// syslogToken makes a value fit an RFC 5424 header field
+func syslogToken(value string, limit int) string {
+	token := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(token) > limit {
+		token = token[:limit]
+	}
+	if token == "" {
+		return "-"
+	}
+	return token
+}
+
+func formatSyslogMessage(c AlertChannel, message AlertMessage, hostname string) string {
+	priority := c.Facility*8 + syslogSeverity(message.NotificationType)
+
+	text := alertMessageText(message)
+	if message.Title != "" && message.Body != "" {
+		text = message.Title + ": " + message.Body
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s spr %d %s - %s",
+		priority,
+		message.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogToken(hostname, 255),
+		os.Getpid(),
+		syslogToken(message.Topic, 32),
+		text)
+}
+
+func sendAlertSyslog(c AlertChannel, message AlertMessage) error {
+	hostname, _ := os.Hostname()
+	line := formatSyslogMessage(c, message, hostname)
+
+	protocol := c.SyslogProtocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+
+	conn, err := net.DialTimeout(protocol, c.SyslogServer, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if protocol == "tcp" {
+		//octet counting framing, RFC 6587
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	_, err = conn.Write([]byte(line))
+	return err
+}
+
+func sendAlertChannel(c AlertChannel, message AlertMessage) error {
+	switch c.Type {
+	case "webhook":
+		return sendAlertWebhook(c, message)
+	case "ntfy":
+		return sendAlertNtfy(c, message)
+	case "gotify":
+		return sendAlertGotify(c, message)
+	case "smtp":
+		return sendAlertSMTP(c, message)
+	case "syslog":
+		return sendAlertSyslog(c, message)
+	}
+	return fmt.Errorf("unknown channel type %s", c.Type)
+}
+
+func loadAlertDeliveriesLocked() {
+	if gAlertDeliveriesLoaded {
+		return
+	}
+	gAlertDeliveriesLoaded = true
+	data, err := ioutil.ReadFile(AlertDeliveryLogFile)
+	if err == nil {
+		json.Unmarshal(data, &gAlertDeliveries)
+	}
+}
+
+func recordAlertDelivery(delivery AlertDelivery) {
+	AlertDeliverymtx.Lock()
+	defer AlertDeliverymtx.Unlock()
+	loadAlertDeliveriesLocked()
+
+	gAlertDeliveries = append([]AlertDelivery{delivery}, gAlertDeliveries...)
+	if len(gAlertDeliveries) > alertDeliveryLogLimit {
+		gAlertDeliveries = gAlertDeliveries[:alertDeliveryLogLimit]
+	}
+
+	err := saveFileJSON(AlertDeliveryLogFile, gAlertDeliveries)
+	if err != nil {
+		log.Println("failed to save alert delivery log", err)
+	}
+}
+
+// deliverAlert sends a message to a channel, retrying with backoff
+func deliverAlert(c AlertChannel, message AlertMessage) AlertDelivery {
+	attempts := c.MaxAttempts
+	if attempts == 0 {
+		attempts = alertChannelDefaultAttempts
+	}
+
+	delivery := AlertDelivery{
+		Channel: c.Name,
+		Type:    c.Type,
+		Topic:   message.Topic,
+		RuleId:  message.RuleId,
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		delivery.Attempts = attempt
+		err = sendAlertChannel(c, message)
+		if err == nil {
+			break
+		}
+		if attempt < attempts {
+			time.Sleep(alertRetryDelay(attempt))
+		}
+	}
+
+	delivery.Time = time.Now().UTC()
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Println("alert delivery to", c.Name, "failed:", err)
+	}
+
+	recordAlertDelivery(delivery)
+	return delivery
+}
+
+func alertChannelWorker() {
+	for job := range gAlertChannelQueue {
+		deliverAlert(job.channel, job.message)
+	}
+}
+
+// queueAlertDelivery hands an alert to the delivery workers without blocking
+// event processing. Alerts are dropped while the queue is full
+func queueAlertDelivery(channelName string, message AlertMessage) {
+	gAlertChannelWorkersOnce.Do(func() {
+		for i := 0; i < alertChannelWorkers; i++ {
+			go alertChannelWorker()
+		}
+	})
+
+	channel, exists := alertChannelByName(channelName)
+	if !exists {
+		log.Println("alert channel not found", channelName)
+		return
+	}
+
+	if channel.Disabled {
+		return
+	}
+
+	select {
+	case gAlertChannelQueue <- alertChannelJob{channel, message}:
+	default:
+		recordAlertDelivery(AlertDelivery{
+			Time:    time.Now().UTC(),
+			Channel: channel.Name,
+			Type:    channel.Type,
+			Topic:   message.Topic,
+			RuleId:  message.RuleId,
+			Error:   "delivery queue full",
+		})
+	}
+}
+
+func getAlertChannels(w http.ResponseWriter, r *http.Request) {
+	AlertChannelsmtx.Lock()
+	defer AlertChannelsmtx.Unlock()
+	loadAlertChannels()
+
+	channels := []AlertChannel{}
+	for _, channel := range gAlertChannels {
+		channels = append(channels, maskAlertChannel(channel))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+func modifyAlertChannel(w http.ResponseWriter, r *http.Request) {
+	channel := AlertChannel{}
+	if r.Method == http.MethodDelete {
+		channel.Name = mux.Vars(r)["name"]
+
+		//channels in use by alert rules can not be removed. the rules stay
+		//locked until the channel is gone, so none can start using it.
+		//same order as rule validation: settings, then channels
+		AlertSettingsmtx.RLock()
+		defer AlertSettingsmtx.RUnlock()
+		for _, rule := range gAlertsConfig {
+			for _, action := range rule.Actions {
+				if action.ActionType != "" && action.Channel == channel.Name {
+					http.Error(w, "Channel is used by alert "+rule.Name, 400)
+					return
+				}
+			}
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&channel)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	AlertChannelsmtx.Lock()
+	defer AlertChannelsmtx.Unlock()
+	loadAlertChannels()
+
+	index := -1
+	for i, entry := range gAlertChannels {
+		if entry.Name == channel.Name {
+			index = i
+			break
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		if index == -1 {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		gAlertChannels = append(gAlertChannels[:index], gAlertChannels[index+1:]...)
+	} else {
+		if index >= 0 {
+			keepAlertChannelSecrets(&channel, gAlertChannels[index])
+		}
+
+		err := channel.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		if index >= 0 {
+			gAlertChannels[index] = channel
+		} else {
+			gAlertChannels = append(gAlertChannels, channel)
+		}
+	}
+
+	err := saveAlertChannels()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	channels := []AlertChannel{}
+	for _, entry := range gAlertChannels {
+		channels = append(channels, maskAlertChannel(entry))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+func testAlertChannel(w http.ResponseWriter, r *http.Request) {
+	channel, exists := alertChannelByName(mux.Vars(r)["name"])
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	message := AlertMessage{
+		Time:             time.Now().UTC(),
+		Topic:            "alerts:test",
+		Title:            "SPR test alert",
+		Body:             "Test delivery for channel " + channel.Name,
+		NotificationType: "info",
+		Info:             map[string]interface{}{},
+	}
+
+	//a single attempt, so the result is immediate
+	channel.MaxAttempts = 1
+	delivery := deliverAlert(channel, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func getAlertDeliveries(w http.ResponseWriter, r *http.Request) {
+	AlertDeliverymtx.Lock()
+	defer AlertDeliverymtx.Unlock()
+	loadAlertDeliveriesLocked()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gAlertDeliveries)
+}
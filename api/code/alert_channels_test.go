@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertChannelValidate(t *testing.T) {
+	valid := []AlertChannel{
+		{Name: "hook", Type: "webhook", URL: "https://example.com/hook", BodyTemplate: `{"text": {{json .Title}}}`},
+		{Name: "mail", Type: "smtp", SMTPServer: "mail.example.com:587", From: "spr@example.com", To: []string{"Admin <admin@example.com>"}},
+		{Name: "ntfy", Type: "ntfy", URL: "https://ntfy.sh/spr"},
+		{Name: "logs", Type: "syslog", SyslogServer: "192.168.2.5:514", Facility: 16},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+		}
+	}
+
+	invalid := []AlertChannel{
+		{Name: "bad name", Type: "webhook", URL: "https://example.com"},
+		{Name: "pager", Type: "pager"},
+		{Name: "hook", Type: "webhook", URL: "ftp://example.com"},
+		{Name: "hook", Type: "webhook", URL: "https://example.com", BodyTemplate: `{{.Title}}`},
+		{Name: "hook", Type: "webhook", URL: "https://example.com", Headers: map[string]string{"X-A": "b\r\nX-Evil: 1"}},
+		{Name: "mail", Type: "smtp", SMTPServer: "mail.example.com", From: "spr@example.com", To: []string{"admin@example.com"}},
+		{Name: "mail", Type: "smtp", SMTPServer: "mail.example.com:25", From: "spr@example.com"},
+		{Name: "logs", Type: "syslog", SyslogServer: "192.168.2.5:514", SyslogProtocol: "tls"},
+		{Name: "logs", Type: "syslog", SyslogServer: "192.168.2.5:514", MaxAttempts: 100},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestKeepAlertChannelSecrets(t *testing.T) {
+	previous := AlertChannel{Name: "hook", HMACSecret: "secret", Token: "token"}
+
+	masked := maskAlertChannel(previous)
+	if masked.HMACSecret != alertSecretMask || masked.Token != alertSecretMask {
+		t.Fatalf("secrets were not masked: %+v", masked)
+	}
+
+	masked.Token = "new"
+	keepAlertChannelSecrets(&masked, previous)
+	if masked.HMACSecret != "secret" || masked.Token != "new" {
+		t.Errorf("unexpected secrets %+v", masked)
+	}
+}
+
+func TestRenderAlertMessage(t *testing.T) {
+	devices := map[string]DeviceEntry{
+		"aa:bb:cc:dd:ee:ff": {Name: "tv", MAC: "aa:bb:cc:dd:ee:ff", RecentIP: "192.168.2.6"},
+	}
+	event := map[string]interface{}{
+		"Src":    map[string]interface{}{"IP": "192.168.2.6"},
+		"Reason": "blocked",
+	}
+
+	got := renderAlertMessage("{{Src.IP#Device}} ({{Src.IP}}) was {{Reason}}{{Missing}}", event, devices)
+	if got != "tv (192.168.2.6) was blocked" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	message := AlertMessage{
+		Time:             time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC),
+		Topic:            "nft:drop:input",
+		Title:            "Dropped",
+		Body:             "input traffic",
+		NotificationType: "warning",
+	}
+
+	got := formatSyslogMessage(AlertChannel{Facility: 16}, message, "spr router")
+	want := "<132>1 2026-10-14T12:00:00.000000Z sprrouter spr "
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, " nft:drop:input - Dropped: input traffic") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDeliverAlertWebhook(t *testing.T) {
+	oldLogFile := AlertDeliveryLogFile
+	oldDelay := alertRetryDelay
+	AlertDeliverymtx.Lock()
+	oldDeliveries, oldLoaded := gAlertDeliveries, gAlertDeliveriesLoaded
+	gAlertDeliveries, gAlertDeliveriesLoaded = []AlertDelivery{}, true
+	AlertDeliverymtx.Unlock()
+	t.Cleanup(func() {
+		AlertDeliveryLogFile = oldLogFile
+		alertRetryDelay = oldDelay
+		AlertDeliverymtx.Lock()
+		gAlertDeliveries, gAlertDeliveriesLoaded = oldDeliveries, oldLoaded
+		AlertDeliverymtx.Unlock()
+	})
+	AlertDeliveryLogFile = filepath.Join(t.TempDir(), "alert_deliveries.json")
+	alertRetryDelay = func(int) time.Duration { return 0 }
+
+	requests := 0
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "busy", 503)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-SPR-Signature")
+	}))
+	defer server.Close()
+
+	channel := AlertChannel{
+		Name:         "hook",
+		Type:         "webhook",
+		URL:          server.URL,
+		HMACSecret:   "secret",
+		BodyTemplate: `{"title": {{json .Title}}, "topic": {{json .Topic}}}`,
+	}
+	delivery := deliverAlert(channel, AlertMessage{Topic: "dns:block:event", Title: `say "hi"`})
+
+	if !delivery.Success || delivery.Attempts != 2 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+
+	payload := map[string]string{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload["title"] != `say "hi"` {
+		t.Errorf("unexpected body %s", body)
+	}
+	if signature != signAlertBody("secret", body) {
+		t.Errorf("unexpected signature %s", signature)
+	}
+
+	server.Close()
+	failed := deliverAlert(AlertChannel{Name: "hook", Type: "webhook", URL: server.URL, MaxAttempts: 2}, AlertMessage{})
+	if failed.Success || failed.Attempts != 2 || failed.Error == "" {
+		t.Errorf("unexpected delivery %+v", failed)
+	}
+
+	AlertDeliverymtx.Lock()
+	defer AlertDeliverymtx.Unlock()
+	if len(gAlertDeliveries) != 2 || gAlertDeliveries[0].Success || !gAlertDeliveries[1].Success {
+		t.Errorf("unexpected delivery log %+v", gAlertDeliveries)
+	}
+}
+
+func TestSendAlertSMTPTimeout(t *testing.T) {
+	oldTimeout := alertSMTPTimeout
+	t.Cleanup(func() { alertSMTPTimeout = oldTimeout })
+	alertSMTPTimeout = 200 * time.Millisecond
+
+	// accepts and never sends a greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	channel := AlertChannel{
+		Name:       "mail",
+		Type:       "smtp",
+		SMTPServer: listener.Addr().String(),
+		From:       "spr@example.com",
+		To:         []string{"admin@example.com"},
+	}
+
+	start := time.Now()
+	err = sendAlertSMTP(channel, AlertMessage{Topic: "dns:block:event"})
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("delivery took %v", elapsed)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+/*
+ Alert throttling. A rule with a Throttle groups matching events by a key
+ built from JSONPath fields, and can require a number of events within a
+ window before alerting, suppress repeated alerts for the same key, and
+ batch alerts into a periodic digest. Suppressed event counts are added to
+ the alert Info.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+)
+
+const alertThrottleMaxSeconds = 7 * 24 * 60 * 60
+const alertThrottleMaxThreshold = 1000 //each group keeps up to this many event times
+const alertThrottleMinDigestSeconds = 60
+const alertThrottleMaxGroups = 1024
+const alertDigestBodyGroups = 10
+
+type AlertThrottle struct {
+	GroupBy          []string `json:",omitempty"` //JSONPath expressions building the grouping key, e.g. $.MAC
+	SuppressSeconds  int      `json:",omitempty"` //after alerting, suppress the same key for this long
+	Threshold        int      `json:",omitempty"` //only alert once this many events matched
+	ThresholdSeconds int      `json:",omitempty"` //within this many seconds
+	DigestSeconds    int      `json:",omitempty"` //collect alerts into a summary sent on this interval
+}
+
+type AlertDigestGroup struct {
+	GroupKey   string
+	Count      int
+	Suppressed int
+	First      time.Time
+	Last       time.Time
+}
+
+type AlertThrottleGroupState struct {
+	GroupKey   string
+	Pending    int //events counted towards the threshold
+	Suppressed int
+	LastAlert  time.Time
+	LastSeen   time.Time
+}
+
+type AlertThrottleState struct {
+	RuleId string
+	Name   string
+	Groups []AlertThrottleGroupState
+	Digest []AlertDigestGroup
+}
+
+type alertThrottleGroup struct {
+	events     []time.Time
+	suppressed int
+	lastAlert  time.Time
+	lastSeen   time.Time
+}
+
+type alertRuleThrottle struct {
+	config      AlertThrottle
+	groupBy     []gval.Evaluable
+	groups      map[string]*alertThrottleGroup
+	digest      map[string]*AlertDigestGroup
+	digestStart time.Time
+	digestTopic string
+}
+
+type alertDigest struct {
+	ruleKey string
+	topic   string
+	groups  []AlertDigestGroup
+}
+
+// rule id -> throttle state
+var gAlertThrottles = map[string]*alertRuleThrottle{}
+var AlertThrottlemtx sync.Mutex
+
+func (t *AlertThrottle) Validate() error {
+	for _, value := range []int{t.SuppressSeconds, t.ThresholdSeconds, t.DigestSeconds} {
+		if value < 0 || value > alertThrottleMaxSeconds {
+			return fmt.Errorf("Throttle values must be between 0 and %d", alertThrottleMaxSeconds)
+		}
+	}
+
+	if t.Threshold < 0 || t.Threshold > alertThrottleMaxThreshold {
+		return fmt.Errorf("Threshold must be between 0 and %d", alertThrottleMaxThreshold)
+	}
+
+	if t.Threshold > 1 && t.ThresholdSeconds == 0 {
+		return fmt.Errorf("Threshold requires ThresholdSeconds")
+	}
+
+	if t.DigestSeconds != 0 && t.DigestSeconds < alertThrottleMinDigestSeconds {
+		return fmt.Errorf("DigestSeconds must be at least %d", alertThrottleMinDigestSeconds)
+	}
+
+	builder := gval.Full(jsonpath.PlaceholderExtension())
+	for _, path := range t.GroupBy {
+		if path == "" {
+			return fmt.Errorf("GroupBy entries cannot be empty")
+		}
+		if _, err := builder.NewEvaluable(path); err != nil {
+			return fmt.Errorf("Invalid GroupBy %q: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+func alertRuleKey(rule AlertSetting) string {
+	if rule.RuleId != "" {
+		return rule.RuleId
+	}
+	return rule.Name
+}
+
+// compileGroupBy parses the GroupBy paths, an invalid path yields nil
+// and so an empty key part
+func compileGroupBy(groupBy []string) []gval.Evaluable {
+	builder := gval.Full(jsonpath.PlaceholderExtension())
+	paths := []gval.Evaluable{}
+	for _, expr := range groupBy {
+		path, err := builder.NewEvaluable(expr)
+		if err != nil {
+			path = nil
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// alertGroupKey joins the GroupBy values of an event
+func alertGroupKey(groupBy []gval.Evaluable, event interface{}) string {
+	parts := []string{}
+	for _, path := range groupBy {
+		value := interface{}(nil)
+		if path != nil {
+			value, _ = path(context.Background(), event)
+		}
+		if value == nil {
+			parts = append(parts, "")
+			continue
+		}
+		parts = append(parts, fmt.Sprint(value))
+	}
+	return strings.Join(parts, "|")
+}
+
+func ruleThrottleLocked(rule AlertSetting) *alertRuleThrottle {
+	key := alertRuleKey(rule)
+	t, exists := gAlertThrottles[key]
+	if !exists || !reflect.DeepEqual(t.config, *rule.Throttle) {
+		//start over when the rule changed
+		t = &alertRuleThrottle{
+			config:  *rule.Throttle,
+			groupBy: compileGroupBy(rule.Throttle.GroupBy),
+			groups:  map[string]*alertThrottleGroup{},
+			digest:  map[string]*AlertDigestGroup{},
+		}
+		gAlertThrottles[key] = t
+	}
+	return t
+}
+
+func (t *alertRuleThrottle) groupLocked(key string) *alertThrottleGroup {
+	group, exists := t.groups[key]
+	if exists {
+		return group
+	}
+
+	if len(t.groups) >= alertThrottleMaxGroups {
+		//evict the least recently seen key
+		oldest := ""
+		for k, g := range t.groups {
+			if oldest == "" || g.lastSeen.Before(t.groups[oldest].lastSeen) {
+				oldest = k
+			}
+		}
+		delete(t.groups, oldest)
+	}
+
+	group = &alertThrottleGroup{}
+	t.groups[key] = group
+	return group
+}
+
+// throttleAlert decides if a matched rule alerts now. When it does, the
+// returned fields are added to the alert Info
+func throttleAlert(rule AlertSetting, topic string, event interface{}, now time.Time) (bool, map[string]interface{}) {
+	if rule.Throttle == nil {
+		return true, nil
+	}
+
+	AlertThrottlemtx.Lock()
+	defer AlertThrottlemtx.Unlock()
+
+	t := ruleThrottleLocked(rule)
+	config := t.config
+
+	key := alertGroupKey(t.groupBy, event)
+	group := t.groupLocked(key)
+	group.lastSeen = now
+
+	count := 1
+	if config.Threshold > 1 {
+		since := now.Add(-time.Duration(config.ThresholdSeconds) * time.Second)
+		events := []time.Time{}
+		for _, seen := range group.events {
+			if seen.After(since) {
+				events = append(events, seen)
+			}
+		}
+		group.events = append(events, now)
+
+		if len(group.events) < config.Threshold {
+			return false, nil
+		}
+		count = len(group.events)
+		group.events = nil
+	}
+
+	if config.SuppressSeconds > 0 && !group.lastAlert.IsZero() &&
+		now.Sub(group.lastAlert) < time.Duration(config.SuppressSeconds)*time.Second {
+		group.suppressed++
+		return false, nil
+	}
+
+	suppressed := group.suppressed
+	group.suppressed = 0
+	group.lastAlert = now
+
+	if config.DigestSeconds > 0 {
+		entry, exists := t.digest[key]
+		if !exists {
+			entry = &AlertDigestGroup{GroupKey: key, First: now}
+			t.digest[key] = entry
+		}
+		if t.digestStart.IsZero() {
+			t.digestStart = now
+		}
+		entry.Count += count
+		entry.Suppressed += suppressed
+		entry.Last = now
+		t.digestTopic = topic
+		return false, nil
+	}
+
+	extra := map[string]interface{}{"Suppressed": suppressed}
+	if len(config.GroupBy) > 0 {
+		extra["GroupKey"] = key
+	}
+	if config.Threshold > 1 {
+		extra["Count"] = count
+	}
+	return true, extra
+}
+
+// collectAlertDigests returns the digests that are due, and drops state
+// of removed rules and idle groups
+func collectAlertDigests(rules []AlertSetting, now time.Time) []alertDigest {
+	AlertThrottlemtx.Lock()
+	defer AlertThrottlemtx.Unlock()
+
+	current := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Throttle != nil {
+			current[alertRuleKey(rule)] = true
+		}
+	}
+
+	digests := []alertDigest{}
+	for ruleKey, t := range gAlertThrottles {
+		if !current[ruleKey] {
+			delete(gAlertThrottles, ruleKey)
+			continue
+		}
+
+		config := t.config
+		if config.DigestSeconds > 0 && len(t.digest) > 0 &&
+			now.Sub(t.digestStart) >= time.Duration(config.DigestSeconds)*time.Second {
+			digests = append(digests, t.takeDigestLocked(ruleKey))
+		}
+
+		idle := time.Duration(max(config.SuppressSeconds, config.ThresholdSeconds, config.DigestSeconds)) * time.Second
+		for key, group := range t.groups {
+			if now.Sub(group.lastSeen) > idle {
+				delete(t.groups, key)
+			}
+		}
+	}
+
+	return digests
+}
+
+func (t *alertRuleThrottle) takeDigestLocked(ruleKey string) alertDigest {
+	digest := alertDigest{ruleKey: ruleKey, topic: t.digestTopic}
+	for key, entry := range t.digest {
+		//events suppressed since the last alert of a group belong to this digest too
+		if group, exists := t.groups[key]; exists {
+			entry.Suppressed += group.suppressed
+			group.suppressed = 0
+		}
+		digest.groups = append(digest.groups, *entry)
+	}
+	sort.Slice(digest.groups, func(i, j int) bool {
+		if digest.groups[i].Count != digest.groups[j].Count {
+			return digest.groups[i].Count > digest.groups[j].Count
+		}
+		return digest.groups[i].GroupKey < digest.groups[j].GroupKey
+	})
+
+	t.digest = map[string]*AlertDigestGroup{}
+	t.digestStart = time.Time{}
+	return digest
+}
+
+func sendAlertDigest(notifyChan chan<- Alert, storeChan chan<- Alert, rule AlertSetting, digest alertDigest) {
+	total, suppressed := 0, 0
+	lines := []string{}
+	for i, group := range digest.groups {
+		total += group.Count
+		suppressed += group.Suppressed
+		if i < alertDigestBodyGroups {
+			name := group.GroupKey
+			if name == "" {
+				name = digest.topic
+			}
+			lines = append(lines, fmt.Sprintf("%s: %d", name, group.Count+group.Suppressed))
+		}
+	}
+	if len(digest.groups) > alertDigestBodyGroups {
+		lines = append(lines, fmt.Sprintf("and %d more", len(digest.groups)-alertDigestBodyGroups))
+	}
+
+	summary := map[string]interface{}{
+		"Digest":     true,
+		"Name":       rule.Name,
+		"Total":      total,
+		"Suppressed": suppressed,
+		"Groups":     digest.groups,
+	}
+	extra := map[string]interface{}{"Digest": true, "Suppressed": suppressed, "Count": total}
+
+	for _, action := range rule.Actions {
+		action.MessageTitle = fmt.Sprintf("%s: %d alerts", rule.Name, total)
+		action.MessageBody = strings.Join(lines, "\n")
+		action.GrabEvent = true
+		action.GrabFields = nil
+		processAction(notifyChan, storeChan, digest.topic, summary, action, []interface{}{}, rule.RuleId, extra)
+	}
+}
+
+func alertDigestTick(notifyChan chan<- Alert, storeChan chan<- Alert, now time.Time) {
+	AlertSettingsmtx.RLock()
+	rules := append([]AlertSetting(nil), gAlertsConfig...)
+	AlertSettingsmtx.RUnlock()
+
+	for _, digest := range collectAlertDigests(rules, now) {
+		for _, rule := range rules {
+			if alertRuleKey(rule) == digest.ruleKey && !rule.Disabled {
+				sendAlertDigest(notifyChan, storeChan, rule, digest)
+				break
+			}
+		}
+	}
+}
+
+func alertDigestLoop(notifyChan chan<- Alert, storeChan chan<- Alert) {
+	ticker := time.NewTicker(15 * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			alertDigestTick(notifyChan, storeChan, time.Now())
+		}
+	}
+}
+
+func getAlertThrottleState(w http.ResponseWriter, r *http.Request) {
+	AlertSettingsmtx.RLock()
+	rules := append([]AlertSetting(nil), gAlertsConfig...)
+	AlertSettingsmtx.RUnlock()
+
+	AlertThrottlemtx.Lock()
+	states := []AlertThrottleState{}
+	for _, rule := range rules {
+		t, exists := gAlertThrottles[alertRuleKey(rule)]
+		if !exists || rule.Throttle == nil {
+			continue
+		}
+
+		state := AlertThrottleState{RuleId: rule.RuleId, Name: rule.Name, Groups: []AlertThrottleGroupState{}, Digest: []AlertDigestGroup{}}
+		for key, group := range t.groups {
+			state.Groups = append(state.Groups, AlertThrottleGroupState{key, len(group.events), group.suppressed, group.lastAlert, group.lastSeen})
+		}
+		for _, entry := range t.digest {
+			state.Digest = append(state.Digest, *entry)
+		}
+		sort.Slice(state.Groups, func(i, j int) bool { return state.Groups[i].GroupKey < state.Groups[j].GroupKey })
+		sort.Slice(state.Digest, func(i, j int) bool { return state.Digest[i].GroupKey < state.Digest[j].GroupKey })
+		states = append(states, state)
+	}
+	AlertThrottlemtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func resetAlertThrottles(t *testing.T) {
+	AlertThrottlemtx.Lock()
+	saved := gAlertThrottles
+	gAlertThrottles = map[string]*alertRuleThrottle{}
+	AlertThrottlemtx.Unlock()
+	t.Cleanup(func() {
+		AlertThrottlemtx.Lock()
+		gAlertThrottles = saved
+		AlertThrottlemtx.Unlock()
+	})
+}
+
+func TestAlertThrottleValidate(t *testing.T) {
+	valid := AlertThrottle{GroupBy: []string{"$.MAC"}, Threshold: 5, ThresholdSeconds: 60, DigestSeconds: 3600}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []AlertThrottle{
+		{Threshold: 5},
+		{Threshold: alertThrottleMaxThreshold + 1, ThresholdSeconds: 60},
+		{SuppressSeconds: -1},
+		{DigestSeconds: 10},
+		{GroupBy: []string{""}},
+		{GroupBy: []string{"$.["}},
+	}
+	for _, throttle := range invalid {
+		if err := throttle.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", throttle)
+		}
+	}
+}
+
+func TestAlertGroupKey(t *testing.T) {
+	event := map[string]interface{}{"MAC": "aa:bb:cc:dd:ee:ff", "Reason": "bad password"}
+	if got := alertGroupKey(compileGroupBy([]string{"$.MAC", "$.Reason"}), event); got != "aa:bb:cc:dd:ee:ff|bad password" {
+		t.Errorf("got %q", got)
+	}
+
+	// a path that does not compile is an empty part
+	if got := alertGroupKey(compileGroupBy([]string{"$.[", "$.MAC"}), event); got != "|aa:bb:cc:dd:ee:ff" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestThrottleAlertSuppress(t *testing.T) {
+	resetAlertThrottles(t)
+
+	rule := AlertSetting{RuleId: "suppress", Throttle: &AlertThrottle{GroupBy: []string{"$.MAC"}, SuppressSeconds: 60}}
+	a := map[string]interface{}{"MAC": "aa"}
+	b := map[string]interface{}{"MAC": "bb"}
+	now := time.Now()
+
+	if alert, _ := throttleAlert(rule, "auth:failure", a, now); !alert {
+		t.Fatal("the first event should alert")
+	}
+	if alert, _ := throttleAlert(rule, "auth:failure", a, now.Add(10*time.Second)); alert {
+		t.Fatal("a repeated event should be suppressed")
+	}
+	if alert, _ := throttleAlert(rule, "auth:failure", b, now.Add(20*time.Second)); !alert {
+		t.Fatal("other keys are not suppressed")
+	}
+
+	alert, extra := throttleAlert(rule, "auth:failure", a, now.Add(61*time.Second))
+	if !alert || extra["Suppressed"] != 1 || extra["GroupKey"] != "aa" {
+		t.Fatalf("unexpected alert %v %v", alert, extra)
+	}
+}
+
+func TestThrottleAlertThreshold(t *testing.T) {
+	resetAlertThrottles(t)
+
+	rule := AlertSetting{RuleId: "threshold", Throttle: &AlertThrottle{Threshold: 3, ThresholdSeconds: 60}}
+	now := time.Now()
+
+	results := []bool{}
+	for _, offset := range []int{0, 10, 100, 110, 120} {
+		alert, _ := throttleAlert(rule, "auth:failure", map[string]interface{}{}, now.Add(time.Duration(offset)*time.Second))
+		results = append(results, alert)
+	}
+
+	//the first two events age out before the third arrives
+	want := []bool{false, false, false, false, true}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Fatalf("got %v, want %v", results, want)
+		}
+	}
+}
+
+func TestAlertDigest(t *testing.T) {
+	resetAlertThrottles(t)
+
+	rule := AlertSetting{RuleId: "digest", Name: "logins", Throttle: &AlertThrottle{GroupBy: []string{"$.MAC"}, DigestSeconds: 300}}
+	now := time.Now()
+
+	for i, mac := range []string{"aa", "bb", "aa"} {
+		if alert, _ := throttleAlert(rule, "auth:failure", map[string]interface{}{"MAC": mac}, now.Add(time.Duration(i)*time.Second)); alert {
+			t.Fatal("digest rules do not alert immediately")
+		}
+	}
+
+	if digests := collectAlertDigests([]AlertSetting{rule}, now.Add(time.Minute)); len(digests) != 0 {
+		t.Fatalf("digest sent early: %+v", digests)
+	}
+
+	digests := collectAlertDigests([]AlertSetting{rule}, now.Add(301*time.Second))
+	if len(digests) != 1 || len(digests[0].groups) != 2 || digests[0].groups[0].GroupKey != "aa" || digests[0].groups[0].Count != 2 {
+		t.Fatalf("unexpected digests %+v", digests)
+	}
+
+	notifyChan := make(chan Alert, 1)
+	storeChan := make(chan Alert, 1)
+	rule.Actions = []ActionConfig{{StoreAlert: true}}
+	sendAlertDigest(notifyChan, storeChan, rule, digests[0])
+
+	stored := <-storeChan
+	if stored.Info["Title"] != "logins: 3 alerts" || stored.Info["Digest"] != true {
+		t.Errorf("unexpected digest alert %+v", stored.Info)
+	}
+
+	//state of removed rules is dropped
+	collectAlertDigests([]AlertSetting{}, now.Add(time.Hour))
+	AlertThrottlemtx.Lock()
+	defer AlertThrottlemtx.Unlock()
+	if len(gAlertThrottles) != 0 {
+		t.Errorf("throttle state was not dropped")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -64,6 +65,7 @@ type AlertSetting struct {
 	Name        string
 	Disabled    bool
 	RuleId      string
+	Throttle    *AlertThrottle `json:",omitempty"`
 }
 
 // conditions can stack onto the same event,
@@ -79,7 +81,8 @@ type ActionConfig struct {
 	MessageTitle     string `json:"MessageTitle,omitempty"`
 	MessageBody      string `json:"MessageBody,omitempty"`
 	NotificationType string `json:"NotificationType,omitempty"`
-	ActionType       string `json:"ActionType,omitempty"`
+	ActionType       string `json:"ActionType,omitempty"` //a delivery channel type, see AlertChannelTypes
+	Channel          string `json:"Channel,omitempty"`    //name of the delivery channel
 	GrabEvent        bool
 	GrabValues       bool
 	GrabFields       []string `json:"GrabFields,omitempty"`
@@ -110,6 +113,12 @@ func (a *AlertSetting) Validate() error {
 		return fmt.Errorf("Name cannot be empty")
 	}
 
+	if a.Throttle != nil {
+		if err := a.Throttle.Validate(); err != nil {
+			return fmt.Errorf("Invalid throttle: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -134,8 +143,19 @@ func (action *ActionConfig) Validate() error {
 	// ... (implement logic for validating StoreTopicSuffix)
 
 	// validate ActionType
+	if action.ActionType != "" {
+		if !slices.Contains(AlertChannelTypes, action.ActionType) {
+			return fmt.Errorf("Invalid ActionType, expected one of %s", strings.Join(AlertChannelTypes, ", "))
+		}
 
-	// ... (implement logic for validating ActionType)
+		channel, exists := alertChannelByName(action.Channel)
+		if !exists {
+			return fmt.Errorf("Unknown alert channel %q", action.Channel)
+		}
+		if channel.Type != action.ActionType {
+			return fmt.Errorf("Alert channel %s is not of type %s", action.Channel, action.ActionType)
+		}
+	}
 
 	// Attempt to compile regex patterns
 	for _, field := range action.GrabFields {
@@ -672,7 +692,7 @@ func grabReflect(fields []string, event interface{}) map[string]interface{} {
 	return newEvent
 }
 
-func processAction(notifyChan chan<- Alert, storeChan chan<- Alert, event_topic string, event interface{}, action ActionConfig, values []interface{}, RuleId string) {
+func processAction(notifyChan chan<- Alert, storeChan chan<- Alert, event_topic string, event interface{}, action ActionConfig, values []interface{}, RuleId string, extra map[string]interface{}) {
 	if gDebugPrintAlert {
 		fmt.Println("=== event ===")
 		fmt.Printf("%+v\n", event)
@@ -714,6 +734,11 @@ func processAction(notifyChan chan<- Alert, storeChan chan<- Alert, event_topic
 
 	Info["State"] = ""
 
+	//throttling details, such as the number of suppressed events
+	for key, value := range extra {
+		Info[key] = value
+	}
+
 	alert := Alert{Topic: topic, Info: Info}
 
 	if action.SendNotification {
@@ -724,6 +749,9 @@ func processAction(notifyChan chan<- Alert, storeChan chan<- Alert, event_topic
 		storeChan <- alert
 	}
 
+	if action.ActionType != "" {
+		queueAlertDelivery(action.Channel, newAlertMessage(event_topic, event, action, Info))
+	}
 }
 
 func isEmpty(x interface{}) bool {
@@ -815,8 +843,12 @@ func processEventAlerts(notifyChan chan<- Alert, storeChan chan<- Alert, topic s
 			}
 
 			if satisfied {
+				alert, extra := throttleAlert(rule, topic, event, time.Now())
+				if !alert {
+					continue
+				}
 				for _, action := range rule.Actions {
-					processAction(notifyChan, storeChan, topic, event, action, values, rule.RuleId)
+					processAction(notifyChan, storeChan, topic, event, action, values, rule.RuleId, extra)
 				}
 			}
 		}
@@ -908,6 +940,8 @@ func AlertsRunEventListener() {
 		return
 	}
 
+	go alertDigestLoop(notifyChan, storeChan)
+
 	//subscribe in-process: no socket round trip for our own events
 	gSprbusServer.HandleEventRaw("", busEvent)
 	select {}
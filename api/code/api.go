@@ -73,11 +73,27 @@ type MulticastAddress struct {
 	Description string
 }
 
+// allow a DNS-SD service type from devices in FromGroups to be seen by
+// devices in ToGroups. an empty list matches any device
+type MDNSServicePolicy struct {
+	Service    string //_airplay._tcp
+	FromGroups []string
+	ToGroups   []string
+	Disabled   bool
+}
+
+type MDNSGatewaySettings struct {
+	Enabled  bool
+	Policies []MDNSServicePolicy
+}
+
 type MulticastSettings struct {
 	Disabled             bool
 	Addresses            []MulticastAddress
 	DisableMDNSAdvertise bool
 	MDNSName             string
+	MDNSGateway          MDNSGatewaySettings
+	IPv6Migrated         bool `json:",omitempty"` //the IPv6 mDNS and SSDP groups were added
 }
 
 type APIConfig struct {
@@ -116,11 +132,14 @@ type DeviceEntry struct {
 	Type              string `json:",omitempty"`
 	MAC               string
 	WGPubKey          string
+	WGSubnets         []string `json:",omitempty"` //subnets routed through a wireguard site peer
 	VLANTag           string
 	RecentIP          string
+	RecentIPv6        []string `json:",omitempty"`
 	DNSCustom         string
 	PSKEntry          PSKEntry
 	Policies          []string
+	PolicySchedules   map[string][]TimeWindow `json:",omitempty"` //policy -> windows in which it applies
 	Groups            []string
 	DeviceTags        []string
 	DHCPFirstTime     string
@@ -487,6 +506,7 @@ type ReleaseInfo struct {
 	CustomChannel string
 	CustomVersion string
 	Current       string
+	Update        json.RawMessage `json:",omitempty"` //staged update outcome from superd
 }
 
 func releaseInfo(w http.ResponseWriter, r *http.Request) {
@@ -627,6 +647,22 @@ func loadMulticastJsonLocked() MulticastSettings {
 	return settings
 }
 
+var validMDNSService = regexp.MustCompile(`^_[a-zA-Z0-9\-]{1,63}\._(tcp|udp)$`).MatchString
+
+func validateMDNSGateway(gateway MDNSGatewaySettings) error {
+	for _, policy := range gateway.Policies {
+		if !validMDNSService(policy.Service) {
+			return fmt.Errorf("invalid mdns service type %q", policy.Service)
+		}
+		for _, group := range append(append([]string{}, policy.FromGroups...), policy.ToGroups...) {
+			if strings.TrimSpace(group) == "" {
+				return fmt.Errorf("empty group in mdns policy for %s", policy.Service)
+			}
+		}
+	}
+	return nil
+}
+
 func multicastSettings(w http.ResponseWriter, r *http.Request) {
 	Configmtx.Lock()
 	defer Configmtx.Unlock()
@@ -640,21 +676,32 @@ func multicastSettings(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, entry := range settings.Addresses {
-			saddr, err := net.ResolveUDPAddr("udp4", entry.Address)
-			if !strings.Contains(entry.Address, ":") || err != nil {
+			//ipv6 addresses are in brackets, [ff02::fb]:5353
+			saddr, err := net.ResolveUDPAddr("udp", entry.Address)
+			if !strings.Contains(entry.Address, ":") || err != nil || saddr.IP == nil {
 				http.Error(w, fmt.Errorf("failed to parse udp address ").Error(), 400)
 				return
 			}
 
 			_, multicastNet, _ := net.ParseCIDR("224.0.0.0/4")
+			_, multicastNet6, _ := net.ParseCIDR("ff00::/8")
 
 			//double check multicast range
-			if !multicastNet.Contains(saddr.IP) {
+			if !multicastNet.Contains(saddr.IP) && !(saddr.IP.To4() == nil && multicastNet6.Contains(saddr.IP)) {
 				http.Error(w, fmt.Errorf("Invalid multicast IP ").Error(), 400)
 				return
 			}
 		}
 
+		err = validateMDNSGateway(settings.MDNSGateway)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		//addresses removed by the user are not added back
+		settings.IPv6Migrated = true
+
 		saveMulticastJsonLocked(settings)
 		callSuperdRestart("", "multicast_udp_proxy")
 	} else {
@@ -1729,6 +1776,15 @@ func updateDevice(w http.ResponseWriter, r *http.Request, dev DeviceEntry, ident
 		}
 	}
 
+	for policy, schedules := range dev.PolicySchedules {
+		if !slices.Contains(ValidPolicyStrings, policy) {
+			return "Invalid policy name provided in PolicySchedules", 400
+		}
+		if err := validateSchedules(schedules); err != nil {
+			return err.Error(), 400
+		}
+	}
+
 	dev.Groups = normalizeStringSlice(dev.Groups)
 	dev.DeviceTags = normalizeStringSlice(dev.DeviceTags)
 
@@ -1875,6 +1931,15 @@ func updateDevice(w http.ResponseWriter, r *http.Request, dev DeviceEntry, ident
 			refreshPolicies = true
 		}
 
+		if dev.PolicySchedules != nil && !reflect.DeepEqual(val.PolicySchedules, dev.PolicySchedules) {
+			//an empty map clears the schedules
+			val.PolicySchedules = dev.PolicySchedules
+			if len(val.PolicySchedules) == 0 {
+				val.PolicySchedules = nil
+			}
+			refreshPolicies = true
+		}
+
 		if dev.Style.Icon != "" {
 			val.Style.Icon = dev.Style.Icon
 		}
@@ -2160,6 +2225,9 @@ func equalStringSlice(a []string, b []string) bool {
 var (
 	builtin_maps = []string{"internet_access", "dns_access", "lan_access", "ethernet_filter", "fwd_iface_wan"}
 
+	//ip6 counterparts of the device maps, keyed by the device /64
+	builtin_maps6 = []string{"internet_access6", "dns_access6", "lan_access6", "ethernet_filter6"}
+
 	ignore_groups = []string{"isolated", "lan", "wan", "dns", "api"}
 )
 
@@ -2178,6 +2246,10 @@ func getGroupVerdictMapNames() []string {
 		if skip == false {
 			custom_maps = append(custom_maps, z.Name+"_src_access")
 			custom_maps = append(custom_maps, z.Name+"_dst_access")
+			if isIPv6Enabled() {
+				custom_maps = append(custom_maps, z.Name+"_src_access6")
+				custom_maps = append(custom_maps, z.Name+"_dst_access6")
+			}
 		}
 	}
 	return custom_maps
@@ -2185,13 +2257,28 @@ func getGroupVerdictMapNames() []string {
 
 func getVerdictMapNames() []string {
 	custom_maps := getGroupVerdictMapNames()
-	return append(builtin_maps, custom_maps...)
+	maps := append([]string{}, builtin_maps...)
+	if isIPv6Enabled() {
+		maps = append(maps, builtin_maps6...)
+	}
+	return append(maps, custom_maps...)
 }
 
 type verdictEntry struct {
 	ipv4   string
 	ifname string
 	mac    string
+	ipv6   string
+}
+
+// keyIP returns the address part of the map key for this entry. IPv6
+// entries are device prefixes, so the prefix length is restored for the
+// interval end.
+func (e verdictEntry) keyIP() string {
+	if e.ipv6 != "" {
+		return e.ipv6 + "/" + strconv.Itoa(tinyNet6PrefixLen)
+	}
+	return e.ipv4
 }
 
 func getNFTVerdictMap(map_name string) []verdictEntry {
@@ -2280,20 +2367,20 @@ func getNFTVerdictMap(map_name string) []verdictEntry {
 				if len(g) > 2 {
 					third, third_ok := g[2].(string)
 					if third_ok && second_ok {
-						existing = append(existing, verdictEntry{first, second, third})
+						existing = append(existing, verdictEntry{first, second, third, ""})
 					}
 				} else {
 					if second_ok {
 						if map_name == "dhcp_access" {
 							// type ifname . ether_addr : verdict (no IP)
-							entry := verdictEntry{"", first, second}
+							entry := verdictEntry{"", first, second, ""}
 							existing = append(existing, entry)
 						} else if map_name == "fwd_iface_wan" {
-							existing = append(existing, verdictEntry{second, first, ""})
+							existing = append(existing, verdictEntry{second, first, "", ""})
 						} else {
 							// for _dst_access
 							// type ipv4_addr . ifname : verdict (no MAC)
-							existing = append(existing, verdictEntry{first, second, ""})
+							existing = append(existing, verdictEntry{first, second, "", ""})
 						}
 					}
 				}
@@ -2327,7 +2414,7 @@ func getNFTVerdictMap(map_name string) []verdictEntry {
 							mac_bytes[0], mac_bytes[1], mac_bytes[2],
 							mac_bytes[3], mac_bytes[4], mac_bytes[5])
 
-						entry := verdictEntry{"", ifname, mac}
+						entry := verdictEntry{"", ifname, mac, ""}
 						existing = append(existing, entry)
 					}
 				}
@@ -2335,6 +2422,13 @@ func getNFTVerdictMap(map_name string) []verdictEntry {
 			}
 		}
 	}
+
+	if isIPv6MapName(map_name) {
+		//the ip6 maps lead with an ipv6_addr
+		for i := range existing {
+			existing[i].ipv6, existing[i].ipv4 = existing[i].ipv4, ""
+		}
+	}
 	return existing
 }
 
@@ -3054,6 +3148,8 @@ func multicastSettingsSetupDone() {
 	//add SSDP and MDNS to proxy defaults
 	settings.Addresses = []MulticastAddress{MulticastAddress{Address: "224.0.0.251:5353"}}
 	settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "239.255.255.250:1900"})
+	settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "[ff02::fb]:5353"})
+	settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "[ff02::c]:1900"})
 
 	saveMulticastJsonLocked(settings)
 	Configmtx.Unlock()
@@ -3077,6 +3173,8 @@ func migrateMDNS() {
 		//add SSDP and MDNS to proxy defaults
 		settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "224.0.0.251:5353"})
 		settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "239.255.255.250:1900"})
+		settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "[ff02::fb]:5353"})
+		settings.Addresses = append(settings.Addresses, MulticastAddress{Address: "[ff02::c]:1900"})
 
 		//make sure config is loaded.
 		loadFirewallRules()
@@ -3090,9 +3188,50 @@ func migrateMDNS() {
 		FWmtx.Unlock()
 	}
 
+	addIPv6MulticastAddresses(&settings)
+
 	saveMulticastJsonLocked(settings)
 }
 
+// the IPv6 groups of the default mDNS and SSDP addresses
+var multicastIPv6Groups = map[string]string{
+	"224.0.0.251:5353":     "[ff02::fb]:5353",
+	"239.255.255.250:1900": "[ff02::c]:1900",
+}
+
+// addIPv6MulticastAddresses relays the IPv6 groups of mDNS and SSDP on
+// installs from before they were relayed, next to their IPv4 group
+func addIPv6MulticastAddresses(settings *MulticastSettings) {
+	if settings.IPv6Migrated {
+		return
+	}
+	settings.IPv6Migrated = true
+
+	configured := map[string]bool{}
+	for _, entry := range settings.Addresses {
+		configured[entry.Address] = true
+	}
+
+	addresses := []MulticastAddress{}
+	for _, entry := range settings.Addresses {
+		addresses = append(addresses, entry)
+
+		group, exists := multicastIPv6Groups[entry.Address]
+		if !exists || configured[group] {
+			continue
+		}
+		configured[group] = true
+
+		ipv6 := entry
+		ipv6.Address = group
+		if entry.Tags != nil {
+			ipv6.Tags = append([]string{}, entry.Tags...)
+		}
+		addresses = append(addresses, ipv6)
+	}
+	settings.Addresses = addresses
+}
+
 func migrateDevicePolicies() {
 	Groupsmtx.Lock()
 	defer Groupsmtx.Unlock()
@@ -3287,6 +3426,7 @@ func main() {
 
 	external_router_public.Use(setSecurityHeaders)
 	external_router_authenticated.Use(setSecurityHeaders)
+	external_router_authenticated.Use(configSnapshotMiddleware)
 	external_router_setup.Use(setSecurityHeaders)
 
 	//public websocket with internal authentication
@@ -3334,7 +3474,7 @@ func main() {
 	external_router_authenticated.HandleFunc("/firewall/endpoint", modifyEndpoint).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/firewall/multicast", modifyMulticast).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/firewall/icmp", modifyIcmp).Methods("PUT")
-	external_router_authenticated.HandleFunc("/firewall/custom_interface", modifyCustomInterfaceRules).Methods("PUT", "DELETE")
+	external_router_authenticated.HandleFunc("/firewall/custom_interface", commitConfirm(modifyCustomInterfaceRules)).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/firewall/enableTLS", enableTLS).Methods("GET", "PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/firewall/systemDnsOverride", systemDNSOverride).Methods("PUT")
 
@@ -3347,10 +3487,14 @@ func main() {
 	//traffic monitoring
 	external_router_authenticated.HandleFunc("/traffic/{name}", getDeviceTraffic).Methods("GET")
 	external_router_authenticated.HandleFunc("/traffic_history", getTrafficHistory).Methods("GET")
+	external_router_authenticated.HandleFunc("/metrics", getMetrics).Methods("GET")
 	external_router_authenticated.HandleFunc("/iptraffic", getIPTraffic).Methods("GET")
 	external_router_authenticated.HandleFunc("/traffic_insights/config", trafficInsightsConfigHandler).Methods("GET", "PUT")
 	external_router_authenticated.HandleFunc("/traffic_insights/overview", trafficInsightsOverviewHandler).Methods("GET")
 	external_router_authenticated.HandleFunc("/traffic_insights/device/{ip}", trafficInsightsDeviceHandler).Methods("GET")
+	external_router_authenticated.HandleFunc("/device_baselines/config", deviceBaselinesConfigHandler).Methods("GET", "PUT")
+	external_router_authenticated.HandleFunc("/device_baselines/device/{ip}", deviceBaselineHandler).Methods("GET")
+	external_router_authenticated.HandleFunc("/device_baselines/anomalies", deviceAnomaliesHandler).Methods("GET")
 
 	//network topology
 	external_router_authenticated.HandleFunc("/topology", showTopology).Methods("GET")
@@ -3368,13 +3512,27 @@ func main() {
 	external_router_authenticated.HandleFunc("/backup", doConfigsBackup).Methods("PUT", "OPTIONS")
 	external_router_authenticated.HandleFunc("/backup/{name}", applyJwtOtpCheck(getConfigsBackup)).Methods("GET", "DELETE", "OPTIONS")
 	external_router_authenticated.HandleFunc("/backup", getConfigsBackup).Methods("GET", "OPTIONS")
+	external_router_authenticated.HandleFunc("/config/history", getConfigHistory).Methods("GET")
+	external_router_authenticated.HandleFunc("/config/history/diff", getConfigHistoryDiff).Methods("GET")
+	external_router_authenticated.HandleFunc("/config/history/{id}/restore", applyJwtOtpCheck(restoreConfigSnapshot)).Methods("PUT")
+	external_router_authenticated.HandleFunc("/confirm", getPendingCommit).Methods("GET")
+	external_router_authenticated.HandleFunc("/confirm", confirmPendingCommit).Methods("PUT")
+	external_router_authenticated.HandleFunc("/confirm", rollbackPendingCommit).Methods("DELETE")
 	external_router_authenticated.HandleFunc("/info/{name}", getInfo).Methods("GET", "OPTIONS", "PUT")
 	external_router_authenticated.HandleFunc("/subnetConfig", getSetDhcpConfig).Methods("GET", "PUT", "OPTIONS")
+	external_router_authenticated.HandleFunc("/dhcp/leases", getDHCPLeases).Methods("GET")
 	external_router_authenticated.HandleFunc("/setup_done", finalizeSetup).Methods("PUT")
 
 	external_router_authenticated.HandleFunc("/dnsSettings", dnsSettings).Methods("GET", "PUT")
 	external_router_authenticated.HandleFunc("/dns/hostnames/{hostname}", dnsHostname).Methods("GET", "PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/multicastSettings", multicastSettings).Methods("GET", "PUT")
+	external_router_authenticated.HandleFunc("/packetLogsSettings", packetLogsSettings).Methods("GET", "PUT")
+
+	//classification auto-apply
+	external_router_authenticated.HandleFunc("/classify/autoapply/config", classifyAutoApplyConfigHandler).Methods("GET", "PUT")
+	external_router_authenticated.HandleFunc("/classify/autoapply/review", classifyReviewHandler).Methods("GET")
+	external_router_authenticated.HandleFunc("/classify/autoapply/review/{mac}", classifyReviewEntryHandler).Methods("PUT", "DELETE")
+	external_router_authenticated.HandleFunc("/classify/autoapply/audit", classifyAuditHandler).Methods("GET")
 	external_router_authenticated.HandleFunc("/customThemes", customThemes).Methods("GET", "PUT")
 
 	//updates, version, feature info
@@ -3452,13 +3610,13 @@ func main() {
 	//uplink management
 	external_router_authenticated.HandleFunc("/interfacesConfiguration", getInterfacesConfiguration).Methods("GET")
 	external_router_authenticated.HandleFunc("/uplink/wifi", getWpaSupplicantConfig).Methods("GET")
-	external_router_authenticated.HandleFunc("/uplink/wifi", updateWpaSupplicantConfig).Methods("PUT")
+	external_router_authenticated.HandleFunc("/uplink/wifi", commitConfirm(updateWpaSupplicantConfig)).Methods("PUT")
 	external_router_authenticated.HandleFunc("/uplink/ppp", getPPPConfig).Methods("GET")
-	external_router_authenticated.HandleFunc("/uplink/ppp", updatePPPConfig).Methods("PUT")
-	external_router_authenticated.HandleFunc("/uplink/ip", updateLinkIPConfig).Methods("PUT")
-	external_router_authenticated.HandleFunc("/link/config", updateLinkConfig).Methods("PUT")
-	external_router_authenticated.HandleFunc("/link/ip", updateLANLinkIPConfig).Methods("PUT")
-	external_router_authenticated.HandleFunc("/link/vlan/{interface}/{state}", updateLinkVlanTrunk).Methods("PUT")
+	external_router_authenticated.HandleFunc("/uplink/ppp", commitConfirm(updatePPPConfig)).Methods("PUT")
+	external_router_authenticated.HandleFunc("/uplink/ip", commitConfirm(updateLinkIPConfig)).Methods("PUT")
+	external_router_authenticated.HandleFunc("/link/config", commitConfirm(updateLinkConfig)).Methods("PUT")
+	external_router_authenticated.HandleFunc("/link/ip", commitConfirm(updateLANLinkIPConfig)).Methods("PUT")
+	external_router_authenticated.HandleFunc("/link/vlan/{interface}/{state}", commitConfirm(updateLinkVlanTrunk)).Methods("PUT")
 
 	//wan health monitoring
 	external_router_authenticated.HandleFunc("/wan/status", getWanStatus).Methods("GET")
@@ -3469,8 +3627,15 @@ func main() {
 	external_router_authenticated.HandleFunc("/wan/speedtest", getWanSpeedResults).Methods("GET")
 	external_router_authenticated.HandleFunc("/wan/speedtest/{interface}", runWanSpeedTest).Methods("PUT")
 
+	//bandwidth limits and quotas
+	external_router_authenticated.HandleFunc("/bandwidth/config", getBandwidthConfig).Methods("GET")
+	external_router_authenticated.HandleFunc("/bandwidth/config", updateBandwidthConfig).Methods("PUT")
+	external_router_authenticated.HandleFunc("/bandwidth/usage", getBandwidthUsage).Methods("GET")
+	external_router_authenticated.HandleFunc("/bandwidth/usage/{identity}/reset", resetBandwidthUsage).Methods("PUT")
+
 	//	external_router_authenticated.HandleFunc("/uplink/{interface}/bond", mangeBondInterface).Methods("PUT", "DELETE")
-	//	external_router_authenticated.HandleFunc("/uplink/loadBalance", setLoadBalanceStrategy).Methods("PUT")
+	external_router_authenticated.HandleFunc("/uplink/loadBalance", getLoadBalanceConfig).Methods("GET")
+	external_router_authenticated.HandleFunc("/uplink/loadBalance", setLoadBalanceConfig).Methods("PUT")
 
 	//iw list
 	external_router_authenticated.HandleFunc("/iw/{command:.*}", iwCommand).Methods("GET")
@@ -3483,6 +3648,8 @@ func main() {
 	external_router_authenticated.HandleFunc("/plugins_api/{name}", updatePlugins(external_router_authenticated, external_router_public)).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/plugins_api/{name}/restart", handleRestartPlugin).Methods("PUT")
 	external_router_authenticated.HandleFunc("/plugins_api/{name}/update_container", updatePluginContainer).Methods("PUT")
+	external_router_authenticated.HandleFunc("/plugin/health", handlePluginHealth).Methods("GET")
+	external_router_authenticated.HandleFunc("/plugin/health/config", handlePluginHealthConfig).Methods("GET", "PUT")
 	external_router_authenticated.HandleFunc("/plugin/ui_session", mintPluginUISession).Methods("PUT")
 	external_router_authenticated.HandleFunc("/plugin/ui_session/{session}", deletePluginUISession).Methods("DELETE")
 	//TBD: API Docs
@@ -3518,6 +3685,12 @@ func main() {
 	external_router_authenticated.HandleFunc("/alerts", getAlertSettings).Methods("GET")
 	external_router_authenticated.HandleFunc("/alerts", modifyAlertSettings).Methods("PUT")
 	external_router_authenticated.HandleFunc("/alerts/{index:[0-9]+}", modifyAlertSettings).Methods("DELETE", "PUT")
+	external_router_authenticated.HandleFunc("/alerts/channels", getAlertChannels).Methods("GET")
+	external_router_authenticated.HandleFunc("/alerts/channels", modifyAlertChannel).Methods("PUT")
+	external_router_authenticated.HandleFunc("/alerts/channels/{name}", modifyAlertChannel).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/alerts/channels/{name}/test", testAlertChannel).Methods("PUT")
+	external_router_authenticated.HandleFunc("/alerts/deliveries", getAlertDeliveries).Methods("GET")
+	external_router_authenticated.HandleFunc("/alerts/throttle", getAlertThrottleState).Methods("GET")
 	external_router_authenticated.HandleFunc("/alerts_register_ios", registerAlertDevice).Methods("DELETE", "PUT", "GET")
 	external_router_authenticated.HandleFunc("/alerts_mobile_proxy", alertsMobileProxySettings).Methods("PUT", "GET")
 	external_router_authenticated.HandleFunc("/alerts_test/{deviceToken:[0-9a-h]+}", testSendAlertDevice).Methods("PUT")
@@ -3538,9 +3711,12 @@ func main() {
 	// DHCP actions
 	unix_dhcpd_router.HandleFunc("/dhcpRequest", dhcpRequest).Methods("PUT")
 	unix_dhcpd_router.HandleFunc("/abstractDhcpRequest", abstractDhcpRequest).Methods("PUT")
+	unix_dhcpd_router.HandleFunc("/dhcpOptions/{mac}", dhcpOptions).Methods("GET")
 
 	// Wireguard actions
 	unix_wireguard_router.HandleFunc("/wireguardUpdate", wireguardUpdate).Methods("PUT", "DELETE")
+	unix_wireguard_router.HandleFunc("/wireguardPeerEvent", wireguardPeerEvent).Methods("PUT")
+	unix_wireguard_router.HandleFunc("/wireguardExpire", wireguardExpire).Methods("PUT")
 
 	os.Remove(UNIX_WIFID_LISTENER)
 	unixWifidListener, err := net.Listen("unix", UNIX_WIFID_LISTENER)
@@ -3581,18 +3757,34 @@ func main() {
 
 	initTrafficInsights()
 
+	// per device behavior baselines, anomaly: events
+	initDeviceBaselines()
+
 	initGeoBlock()
 
 	// parental controls: enforce persona time limits + block schedules
 	parentalControlLoop()
 
+	// time of day schedules for firewall rules and device policies
+	go scheduleLoop()
+
+	// per device rate limits and monthly quotas
+	initBandwidth()
+
 	// wan uplink health probes, outage tracking, failover
 	go wanHealthLoop()
 
+	// revert a change that was left unconfirmed across a restart
+	initCommitConfirm()
+
+	// uplink addresses for plugins
+	go publicUplinksLoop()
+
 	// alerts, connect to eventbus
 	go AlertsRunEventListener()
 	//listen and cache dns
 	go DNSEventListener()
+	go ClassifyEventListener()
 
 	// updates when enabled. not implemented yet
 	go runAutoUpdates()
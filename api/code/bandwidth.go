@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var BandwidthConfigPath = TEST_PREFIX + "/configs/base/bandwidth.json"
+var BandwidthStatePath = TEST_PREFIX + "/state/api/bandwidth.json"
+
+// BandwidthPolicy limits a device, or each device in a group. Rates are
+// in kilobits per second, 0 is unlimited.
+type BandwidthPolicy struct {
+	Device         string `json:",omitempty"` //MAC or wireguard public key
+	Group          string `json:",omitempty"`
+	EgressKbps     uint64 `json:",omitempty"`
+	IngressKbps    uint64 `json:",omitempty"`
+	MonthlyQuotaMB uint64 `json:",omitempty"`
+	QuotaAction    string `json:",omitempty"` //"" only notifies, "restrict" revokes wan access
+	ResetDay       int    `json:",omitempty"` //day of the month the quota resets, 1-28
+}
+
+type BandwidthConfig struct {
+	Policies []BandwidthPolicy
+}
+
+// BandwidthUsage is the uplink traffic of a device in the current quota period
+type BandwidthUsage struct {
+	Period      string
+	Bytes       uint64
+	QuotaBytes  uint64
+	Warned      bool
+	Exhausted   bool
+	Restricted  bool `json:",omitempty"` //wan was revoked, restore on reset
+	Quarantined bool `json:",omitempty"` //quarantine was added by the restriction
+	LastIP      string
+	LastWanIn   uint64
+	LastWanOut  uint64
+}
+
+type BandwidthState struct {
+	Devices map[string]*BandwidthUsage
+}
+
+var validQuotaActions = []string{"", "restrict"}
+
+const quotaWarnPercent = 90
+
+var Bandwidthmtx sync.Mutex
+var gBandwidthConfig = BandwidthConfig{}
+var gBandwidthState = BandwidthState{Devices: map[string]*BandwidthUsage{}}
+
+// the rules of each device in BANDWIDTH_LIMIT
+var gBandwidthLimited = map[string][]BandwidthLimit{}
+
+func (config *BandwidthConfig) Validate() error {
+	for i, policy := range config.Policies {
+		if (policy.Device == "") == (policy.Group == "") {
+			return fmt.Errorf("a bandwidth policy needs either a Device or a Group")
+		}
+		if isValidMAC(policy.Device) {
+			config.Policies[i].Device = trimLower(policy.Device)
+		} else if policy.Device != "" && !isValidWGPubKey(policy.Device) {
+			return fmt.Errorf("invalid Device %s", policy.Device)
+		}
+		config.Policies[i].Group = trimLower(policy.Group)
+
+		if !slices.Contains(validQuotaActions, policy.QuotaAction) {
+			return fmt.Errorf("invalid QuotaAction %s", policy.QuotaAction)
+		}
+		if policy.ResetDay < 0 || policy.ResetDay > 28 {
+			return fmt.Errorf("ResetDay must be between 1 and 28")
+		}
+		if policy.ResetDay == 0 {
+			config.Policies[i].ResetDay = 1
+		}
+	}
+	return nil
+}
+
+// bandwidthPolicyFor returns the policy of a device. A device policy takes
+// precedence, otherwise the first group policy the device is a member of
+func bandwidthPolicyFor(config BandwidthConfig, device DeviceEntry) (BandwidthPolicy, bool) {
+	for _, policy := range config.Policies {
+		if policy.Device != "" && (equalMAC(policy.Device, device.MAC) || policy.Device == device.WGPubKey) {
+			return policy, true
+		}
+	}
+	for _, policy := range config.Policies {
+		if policy.Group != "" && slices.Contains(device.Groups, policy.Group) {
+			return policy, true
+		}
+	}
+	return BandwidthPolicy{}, false
+}
+
+func deviceIdentity(device DeviceEntry) string {
+	if device.MAC != "" {
+		return device.MAC
+	}
+	return device.WGPubKey
+}
+
+func kbpsToBytes(kbps uint64) uint64 {
+	return kbps * 1000 / 8
+}
+
+// quotaPeriod returns the start date of the quota period containing now
+func quotaPeriod(now time.Time, resetDay int) string {
+	if resetDay < 1 {
+		resetDay = 1
+	}
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Day() < resetDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start.Format("2006-01-02")
+}
+
+// accountUsage adds the uplink bytes since the last reading. The counters
+// belong to an IP, so a changed IP or a reset counter starts a new baseline.
+func accountUsage(usage *BandwidthUsage, ip string, reading NetCount) {
+	if usage.LastIP == ip {
+		if reading.WanIn >= usage.LastWanIn {
+			usage.Bytes += reading.WanIn - usage.LastWanIn
+		} else {
+			usage.Bytes += reading.WanIn
+		}
+		if reading.WanOut >= usage.LastWanOut {
+			usage.Bytes += reading.WanOut - usage.LastWanOut
+		} else {
+			usage.Bytes += reading.WanOut
+		}
+	}
+	usage.LastIP = ip
+	usage.LastWanIn = reading.WanIn
+	usage.LastWanOut = reading.WanOut
+}
+
+func loadBandwidthConfig() {
+	data, err := os.ReadFile(BandwidthConfigPath)
+	if err != nil {
+		return
+	}
+	config := BandwidthConfig{}
+	if json.Unmarshal(data, &config) == nil {
+		gBandwidthConfig = config
+	}
+}
+
+func saveBandwidthConfig(config BandwidthConfig) error {
+	file, err := json.MarshalIndent(config, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(BandwidthConfigPath, file, 0600)
+}
+
+func loadBandwidthState() {
+	data, err := os.ReadFile(BandwidthStatePath)
+	if err != nil {
+		return
+	}
+	state := BandwidthState{}
+	if json.Unmarshal(data, &state) != nil {
+		return
+	}
+	if state.Devices == nil {
+		state.Devices = map[string]*BandwidthUsage{}
+	}
+	gBandwidthState = state
+}
+
+func saveBandwidthStateLocked() {
+	file, err := json.MarshalIndent(gBandwidthState, "", " ")
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(BandwidthStatePath, file, 0600); err != nil {
+		log.Println("failed to save bandwidth state", err)
+	}
+}
+
+// deviceBandwidthLimits returns the BANDWIDTH_LIMIT rules of a device
+func deviceBandwidthLimits(config BandwidthConfig, device DeviceEntry) []BandwidthLimit {
+	policy, exists := bandwidthPolicyFor(config, device)
+	if !exists || device.RecentIP == "" {
+		return nil
+	}
+
+	addrs := []string{device.RecentIP}
+	if device.MAC != "" {
+		if subnet6 := deviceIPv6Subnet(device.RecentIP); subnet6 != "" {
+			addrs = append(addrs, subnet6)
+		}
+	}
+
+	limits := []BandwidthLimit{}
+	for _, addr := range addrs {
+		if policy.EgressKbps != 0 {
+			limits = append(limits, BandwidthLimit{Addr: addr, BytesPerSecond: kbpsToBytes(policy.EgressKbps)})
+		}
+		if policy.IngressKbps != 0 {
+			limits = append(limits, BandwidthLimit{Addr: addr, Ingress: true, BytesPerSecond: kbpsToBytes(policy.IngressKbps)})
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return limits
+}
+
+// applyBandwidthLimits rebuilds the BANDWIDTH_LIMIT chain in one
+// transaction, each device gets its own rules and so its own rate
+func applyBandwidthLimits(devices map[string]DeviceEntry) {
+	Bandwidthmtx.Lock()
+	defer Bandwidthmtx.Unlock()
+
+	limited := map[string][]BandwidthLimit{}
+	for identity, device := range devices {
+		if limits := deviceBandwidthLimits(gBandwidthConfig, device); limits != nil {
+			limited[identity] = limits
+		}
+	}
+
+	err := ResetBandwidthLimitRules("inet", "filter", "BANDWIDTH_LIMIT", limited)
+	if err != nil {
+		log.Println("failed to rebuild BANDWIDTH_LIMIT", err)
+		return
+	}
+	gBandwidthLimited = limited
+}
+
+// refreshBandwidthLimits updates the rules of one device after it was
+// established or changed groups, the rest of the chain is left alone
+func refreshBandwidthLimits(device DeviceEntry) {
+	Bandwidthmtx.Lock()
+	defer Bandwidthmtx.Unlock()
+
+	identity := deviceIdentity(device)
+	limits := deviceBandwidthLimits(gBandwidthConfig, device)
+	if slices.Equal(limits, gBandwidthLimited[identity]) {
+		return
+	}
+
+	err := ReplaceBandwidthLimitRules("inet", "filter", "BANDWIDTH_LIMIT", identity, limits)
+	if err != nil {
+		log.Println("failed to update bandwidth limits", identity, err)
+		return
+	}
+
+	if limits == nil {
+		delete(gBandwidthLimited, identity)
+	} else {
+		gBandwidthLimited[identity] = limits
+	}
+}
+
+// setQuotaRestriction revokes or restores wan access for a device. A
+// restriction reports whether quarantine was added, a restore only removes
+// quarantine when removeQuarantine is set so a manual one stays.
+// exists is false when the device is gone
+func setQuotaRestriction(identity string, restrict bool, removeQuarantine bool) (exists bool, addedQuarantine bool) {
+	Groupsmtx.Lock()
+	defer Groupsmtx.Unlock()
+	Devicesmtx.Lock()
+	defer Devicesmtx.Unlock()
+
+	devices := getDevicesJson()
+	groups := getGroupsJson()
+
+	val, exists := devices[identity]
+	if !exists {
+		return false, false
+	}
+
+	policies := []string{}
+	for _, policy := range val.Policies {
+		if policy == "wan" {
+			continue
+		}
+		if policy == "quarantine" && !restrict && removeQuarantine {
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	if restrict {
+		if !slices.Contains(policies, "quarantine") {
+			policies = append(policies, "quarantine")
+			addedQuarantine = true
+		}
+	} else {
+		policies = append(policies, "wan")
+	}
+	val.Policies = policies
+
+	devices[identity] = val
+	saveDevicesJson(devices)
+
+	refreshDeviceGroupsAndPolicy(devices, groups, val)
+	SprbusPublish("device:groups:update", scrubDevice(val))
+
+	if restrict && val.RecentIP != "" {
+		//drop established flows, they would bypass the verdict maps
+		exec.Command("conntrack", "-D", "-s", val.RecentIP).Run()
+	}
+	return true, addedQuarantine
+}
+
+type quotaEvent struct {
+	topic      string
+	identity   string
+	device     DeviceEntry
+	usage      BandwidthUsage
+	action     string
+	restrict   bool
+	unrestrict bool
+	quarantine bool //remove quarantine when unrestricting
+}
+
+func bandwidthQuotaTick(readings map[string]*NetCount) {
+	now := time.Now()
+	devices := readDevicesSnapshot()
+	events := []quotaEvent{}
+
+	Bandwidthmtx.Lock()
+	for identity, device := range devices {
+		policy, exists := bandwidthPolicyFor(gBandwidthConfig, device)
+		if !exists || policy.MonthlyQuotaMB == 0 {
+			continue
+		}
+
+		usage, exists := gBandwidthState.Devices[identity]
+		if !exists {
+			usage = &BandwidthUsage{}
+			gBandwidthState.Devices[identity] = usage
+		}
+
+		period := quotaPeriod(now, policy.ResetDay)
+		if usage.Period != period {
+			if usage.Restricted {
+				events = append(events, quotaEvent{topic: "bandwidth:quota:reset", identity: identity, device: device,
+					unrestrict: true, quarantine: usage.Quarantined})
+			}
+			usage.Period = period
+			usage.Bytes = 0
+			usage.Warned = false
+			usage.Exhausted = false
+			usage.Restricted = false
+			usage.Quarantined = false
+		}
+
+		usage.QuotaBytes = policy.MonthlyQuotaMB * 1000 * 1000
+		if reading, exists := readings[device.RecentIP]; exists && device.RecentIP != "" {
+			accountUsage(usage, device.RecentIP, *reading)
+		}
+
+		if !usage.Warned && usage.Bytes*100 >= usage.QuotaBytes*quotaWarnPercent {
+			usage.Warned = true
+			events = append(events, quotaEvent{topic: "bandwidth:quota:warning", identity: identity, device: device, usage: *usage})
+		}
+
+		if !usage.Exhausted && usage.Bytes >= usage.QuotaBytes {
+			usage.Exhausted = true
+			restrict := policy.QuotaAction == "restrict" && slices.Contains(device.Policies, "wan")
+			usage.Restricted = restrict
+			events = append(events, quotaEvent{topic: "bandwidth:quota:exhausted", identity: identity, device: device,
+				usage: *usage, action: policy.QuotaAction, restrict: restrict})
+		}
+	}
+
+	//forget devices that no longer have a quota
+	for identity := range gBandwidthState.Devices {
+		device, exists := devices[identity]
+		if !exists {
+			delete(gBandwidthState.Devices, identity)
+			continue
+		}
+		policy, exists := bandwidthPolicyFor(gBandwidthConfig, device)
+		if (!exists || policy.MonthlyQuotaMB == 0) && !gBandwidthState.Devices[identity].Restricted {
+			delete(gBandwidthState.Devices, identity)
+		}
+	}
+
+	saveBandwidthStateLocked()
+	Bandwidthmtx.Unlock()
+
+	for _, event := range events {
+		if event.restrict {
+			_, added := setQuotaRestriction(event.identity, true, false)
+			recordQuarantine(event.identity, added)
+		} else if event.unrestrict {
+			setQuotaRestriction(event.identity, false, event.quarantine)
+		}
+
+		SprbusPublish(event.topic, map[string]interface{}{
+			"MAC":        event.device.MAC,
+			"Name":       event.device.Name,
+			"DeviceIP":   event.device.RecentIP,
+			"UsedBytes":  event.usage.Bytes,
+			"QuotaBytes": event.usage.QuotaBytes,
+			"Action":     event.action,
+		})
+	}
+}
+
+// recordQuarantine remembers whether a restriction added quarantine
+func recordQuarantine(identity string, added bool) {
+	Bandwidthmtx.Lock()
+	defer Bandwidthmtx.Unlock()
+
+	if usage, exists := gBandwidthState.Devices[identity]; exists && usage.Restricted {
+		usage.Quarantined = added
+		saveBandwidthStateLocked()
+	}
+}
+
+func initBandwidth() {
+	Bandwidthmtx.Lock()
+	loadBandwidthConfig()
+	loadBandwidthState()
+	Bandwidthmtx.Unlock()
+
+	applyBandwidthLimits(readDevicesSnapshot())
+}
+
+func getBandwidthConfig(w http.ResponseWriter, r *http.Request) {
+	Bandwidthmtx.Lock()
+	defer Bandwidthmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gBandwidthConfig)
+}
+
+func updateBandwidthConfig(w http.ResponseWriter, r *http.Request) {
+	config := BandwidthConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := config.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := saveBandwidthConfig(config); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	Bandwidthmtx.Lock()
+	gBandwidthConfig = config
+	Bandwidthmtx.Unlock()
+
+	applyBandwidthLimits(readDevicesSnapshot())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func getBandwidthUsage(w http.ResponseWriter, r *http.Request) {
+	Bandwidthmtx.Lock()
+	defer Bandwidthmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gBandwidthState.Devices)
+}
+
+// resetBandwidthUsage clears the usage of a device and lifts a restriction
+func resetBandwidthUsage(w http.ResponseWriter, r *http.Request) {
+	identity := mux.Vars(r)["identity"]
+	if isValidMAC(identity) {
+		identity = trimLower(identity)
+	}
+
+	Bandwidthmtx.Lock()
+	usage, exists := gBandwidthState.Devices[identity]
+	restricted, quarantined := false, false
+	if exists {
+		restricted, quarantined = usage.Restricted, usage.Quarantined
+		usage.Bytes = 0
+		usage.Warned = false
+		usage.Exhausted = false
+		usage.Restricted = false
+		usage.Quarantined = false
+		saveBandwidthStateLocked()
+	}
+	Bandwidthmtx.Unlock()
+
+	if !exists {
+		http.Error(w, "No usage for device", 404)
+		return
+	}
+
+	if restricted {
+		setQuotaRestriction(identity, false, quarantined)
+	}
+}
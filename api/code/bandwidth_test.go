@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriod(t *testing.T) {
+	tests := []struct {
+		now      time.Time
+		resetDay int
+		period   string
+	}{
+		{time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), 1, "2026-10-01"},
+		{time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), 15, "2026-10-15"},
+		{time.Date(2026, 10, 14, 23, 59, 0, 0, time.UTC), 15, "2026-09-15"},
+		{time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), 5, "2025-12-05"},
+		{time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), 0, "2026-03-01"},
+	}
+
+	for _, tt := range tests {
+		if got := quotaPeriod(tt.now, tt.resetDay); got != tt.period {
+			t.Errorf("%v day %d: got %s, want %s", tt.now, tt.resetDay, got, tt.period)
+		}
+	}
+}
+
+func TestAccountUsage(t *testing.T) {
+	usage := &BandwidthUsage{}
+
+	// the first reading is a baseline
+	accountUsage(usage, "192.168.2.2", NetCount{WanIn: 1000, WanOut: 500})
+	if usage.Bytes != 0 {
+		t.Fatalf("baseline counted %d bytes", usage.Bytes)
+	}
+
+	accountUsage(usage, "192.168.2.2", NetCount{WanIn: 1500, WanOut: 700})
+	if usage.Bytes != 700 {
+		t.Fatalf("expected 700 bytes, got %d", usage.Bytes)
+	}
+
+	// counters were reset, count them from zero
+	accountUsage(usage, "192.168.2.2", NetCount{WanIn: 100, WanOut: 50})
+	if usage.Bytes != 850 {
+		t.Fatalf("expected 850 bytes, got %d", usage.Bytes)
+	}
+
+	// a new IP has its own counters, rebaseline
+	accountUsage(usage, "192.168.2.6", NetCount{WanIn: 9000, WanOut: 9000})
+	if usage.Bytes != 850 || usage.LastIP != "192.168.2.6" {
+		t.Fatalf("new ip was not rebaselined: %+v", usage)
+	}
+}
+
+func TestBandwidthPolicyFor(t *testing.T) {
+	config := BandwidthConfig{
+		Policies: []BandwidthPolicy{
+			{Group: "kids", EgressKbps: 1000},
+			{Device: "aa:bb:cc:dd:ee:ff", EgressKbps: 5000},
+		},
+	}
+
+	policy, exists := bandwidthPolicyFor(config, DeviceEntry{MAC: "AA:BB:CC:DD:EE:FF", Groups: []string{"kids"}})
+	if !exists || policy.EgressKbps != 5000 {
+		t.Errorf("device policy should win, got %+v", policy)
+	}
+
+	policy, exists = bandwidthPolicyFor(config, DeviceEntry{MAC: "11:22:33:44:55:66", Groups: []string{"kids"}})
+	if !exists || policy.EgressKbps != 1000 {
+		t.Errorf("expected the group policy, got %+v", policy)
+	}
+
+	if _, exists = bandwidthPolicyFor(config, DeviceEntry{MAC: "11:22:33:44:55:66"}); exists {
+		t.Error("expected no policy")
+	}
+}
+
+func TestBandwidthConfigValidate(t *testing.T) {
+	config := BandwidthConfig{
+		Policies: []BandwidthPolicy{{Device: "AA:BB:CC:DD:EE:FF", MonthlyQuotaMB: 1000, QuotaAction: "restrict"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Policies[0].Device != "aa:bb:cc:dd:ee:ff" || config.Policies[0].ResetDay != 1 {
+		t.Errorf("config was not normalized: %+v", config.Policies[0])
+	}
+
+	invalid := []BandwidthPolicy{
+		{},
+		{Device: "aa:bb:cc:dd:ee:ff", Group: "kids"},
+		{Device: "junk"},
+		{Group: "kids", QuotaAction: "block"},
+		{Group: "kids", ResetDay: 31},
+	}
+	for _, policy := range invalid {
+		c := BandwidthConfig{Policies: []BandwidthPolicy{policy}}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", policy)
+		}
+	}
+}
+
+func TestDeviceBandwidthLimits(t *testing.T) {
+	config := BandwidthConfig{
+		Policies: []BandwidthPolicy{
+			{Group: "kids", EgressKbps: 800, IngressKbps: 1600},
+			{Group: "quota", MonthlyQuotaMB: 1000},
+		},
+	}
+	peer := "mUGrfPF+LmKfvGWk3xAcQ7YDHhUMgHRiXUOn6w1Fbls="
+
+	limits := deviceBandwidthLimits(config, DeviceEntry{WGPubKey: peer, RecentIP: "192.168.3.2", Groups: []string{"kids"}})
+	want := []BandwidthLimit{
+		{Addr: "192.168.3.2", BytesPerSecond: 100000},
+		{Addr: "192.168.3.2", Ingress: true, BytesPerSecond: 200000},
+	}
+	if !slices.Equal(limits, want) {
+		t.Errorf("got %+v, want %+v", limits, want)
+	}
+
+	//no rules without an address or without a rate
+	if limits := deviceBandwidthLimits(config, DeviceEntry{WGPubKey: peer, Groups: []string{"kids"}}); limits != nil {
+		t.Errorf("expected no limits without an ip, got %+v", limits)
+	}
+	if limits := deviceBandwidthLimits(config, DeviceEntry{WGPubKey: peer, RecentIP: "192.168.3.2", Groups: []string{"quota"}}); limits != nil {
+		t.Errorf("expected no limits for a quota only policy, got %+v", limits)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	sprbus "github.com/spr-networks/sprbus-json"
+)
+
+/*
+Auto-apply of plugin-lookup classifications.
+
+classify:result events for newly seen devices are applied to the device
+groups and policies when the classification reaches MinConfidence. Below
+that they are held in a review queue. Suggestions are merged into the
+existing groups and policies, and every change is recorded in the audit
+trail. A user correction from plugin-lookup undoes the earlier automatic
+change and queues the corrected suggestions for review.
+*/
+
+var ClassifyAutoApplyConfigFile = TEST_PREFIX + "/configs/base/classify_autoapply.json"
+var ClassifyAutoApplyStateFile = TEST_PREFIX + "/state/api/classify_autoapply.json"
+
+const classifyMaxAudit = 1000
+const classifyMaxReview = 256
+
+var classifyConfidenceLevels = map[string]int{
+	"Unknown": 0,
+	"Low":     1,
+	"Medium":  2,
+	"High":    3,
+}
+
+// replaces the plugin-lookup suggestions for a category
+type ClassifyCategoryPolicy struct {
+	Groups   []string
+	Policies []string
+	Disabled bool
+}
+
+type ClassifyAutoApplyConfig struct {
+	Enabled        bool
+	MinConfidence  string //Medium or High
+	NewDeviceHours int    //devices first seen within this window are new
+	Categories     map[string]ClassifyCategoryPolicy
+}
+
+// the fields of a plugin-lookup Classification used here
+type ClassifyResult struct {
+	MAC               string
+	Vendor            string
+	Category          string
+	Model             string
+	Confidence        string
+	SuggestedGroups   []string
+	SuggestedPolicies []string
+	UserCorrection    bool
+}
+
+type ClassifyReviewEntry struct {
+	MAC               string
+	Vendor            string
+	Category          string
+	Confidence        string
+	SuggestedGroups   []string
+	SuggestedPolicies []string
+	Time              string
+	UserCorrection    bool `json:",omitempty"`
+}
+
+type ClassifyAuditEntry struct {
+	Time          string
+	MAC           string
+	Category      string
+	Confidence    string
+	Source        string //auto, review or correction
+	AddedGroups   []string
+	AddedPolicies []string
+	Undone        bool
+	UndoneTime    string `json:",omitempty"`
+}
+
+type classifyAutoApplyState struct {
+	Review map[string]ClassifyReviewEntry
+	Audit  []ClassifyAuditEntry
+}
+
+var ClassifyAutoApplymtx sync.Mutex
+var gClassifyConfig = ClassifyAutoApplyConfig{}
+var gClassifyState = classifyAutoApplyState{Review: map[string]ClassifyReviewEntry{}}
+
+func loadClassifyAutoApply() {
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	data, err := os.ReadFile(ClassifyAutoApplyConfigFile)
+	if err == nil {
+		config := ClassifyAutoApplyConfig{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			log.Println("invalid classify auto-apply config", err)
+		} else {
+			gClassifyConfig = config
+		}
+	}
+
+	data, err = os.ReadFile(ClassifyAutoApplyStateFile)
+	if err == nil {
+		state := classifyAutoApplyState{}
+		if err := json.Unmarshal(data, &state); err == nil {
+			if state.Review == nil {
+				state.Review = map[string]ClassifyReviewEntry{}
+			}
+			gClassifyState = state
+		}
+	}
+}
+
+func saveClassifyStateLocked() {
+	if len(gClassifyState.Audit) > classifyMaxAudit {
+		gClassifyState.Audit = gClassifyState.Audit[len(gClassifyState.Audit)-classifyMaxAudit:]
+	}
+	if err := saveFileJSON(ClassifyAutoApplyStateFile, gClassifyState); err != nil {
+		log.Println("failed to save classify auto-apply state", err)
+	}
+}
+
+func validateClassifyAutoApplyConfig(config *ClassifyAutoApplyConfig) error {
+	if config.MinConfidence == "" {
+		config.MinConfidence = "High"
+	}
+	if config.MinConfidence != "High" && config.MinConfidence != "Medium" {
+		return fmt.Errorf("MinConfidence must be High or Medium")
+	}
+	if config.NewDeviceHours == 0 {
+		config.NewDeviceHours = 24
+	}
+	if config.NewDeviceHours < 0 {
+		return fmt.Errorf("invalid NewDeviceHours")
+	}
+
+	for category, policy := range config.Categories {
+		if strings.TrimSpace(category) == "" {
+			return fmt.Errorf("empty category")
+		}
+		for _, group := range policy.Groups {
+			if strings.TrimSpace(group) == "" || slices.Contains(ValidPolicyStrings, group) {
+				return fmt.Errorf("invalid group %q for %s", group, category)
+			}
+		}
+		for _, p := range policy.Policies {
+			if !slices.Contains(BulkSettablePolicyStrings, p) {
+				return fmt.Errorf("policy not settable by classification: %s", p)
+			}
+		}
+	}
+	return nil
+}
+
+// classifySuggestions returns the groups and policies to add,
+// policies is nil when the device policies are left as they are
+func classifySuggestions(config ClassifyAutoApplyConfig, result ClassifyResult) ([]string, []string, bool) {
+	suggestedGroups := result.SuggestedGroups
+	suggestedPolicies := result.SuggestedPolicies
+
+	if override, exists := config.Categories[result.Category]; exists {
+		if override.Disabled {
+			return nil, nil, false
+		}
+		suggestedGroups = override.Groups
+		suggestedPolicies = override.Policies
+	}
+
+	groups := []string{}
+	for _, group := range suggestedGroups {
+		group = strings.TrimSpace(group)
+		if group != "" && !slices.Contains(ValidPolicyStrings, group) && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	var policies []string
+	for _, p := range suggestedPolicies {
+		if slices.Contains(BulkSettablePolicyStrings, p) && !slices.Contains(policies, p) {
+			policies = append(policies, p)
+		}
+	}
+
+	return groups, policies, len(groups) > 0 || len(policies) > 0
+}
+
+func classifyMeetsConfidence(config ClassifyAutoApplyConfig, confidence string) bool {
+	minimum := config.MinConfidence
+	if minimum == "" {
+		minimum = "High"
+	}
+	return classifyConfidenceLevels[confidence] >= classifyConfidenceLevels[minimum]
+}
+
+// DHCPFirstTime is a time.Time String(), which may carry a monotonic clock suffix
+func parseDeviceTime(value string) (time.Time, error) {
+	if idx := strings.Index(value, " m="); idx != -1 {
+		value = value[:idx]
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", value)
+}
+
+func isNewDevice(config ClassifyAutoApplyConfig, dev DeviceEntry, now time.Time) bool {
+	firstTime, err := parseDeviceTime(dev.DHCPFirstTime)
+	if err != nil {
+		return false
+	}
+	hours := config.NewDeviceHours
+	if hours == 0 {
+		hours = 24
+	}
+	return now.Sub(firstTime) <= time.Duration(hours)*time.Hour
+}
+
+// applyClassificationChanges adds the missing groups and policies to dev
+func applyClassificationChanges(dev DeviceEntry, groups []string, policies []string) (DeviceEntry, ClassifyAuditEntry, bool) {
+	entry := ClassifyAuditEntry{
+		MAC:           dev.MAC,
+		AddedGroups:   []string{},
+		AddedPolicies: []string{},
+	}
+
+	changed := false
+	for _, group := range groups {
+		if !slices.Contains(dev.Groups, group) {
+			dev.Groups = append(dev.Groups, group)
+			entry.AddedGroups = append(entry.AddedGroups, group)
+			changed = true
+		}
+	}
+
+	for _, p := range policies {
+		if !slices.Contains(dev.Policies, p) {
+			dev.Policies = append(dev.Policies, p)
+			entry.AddedPolicies = append(entry.AddedPolicies, p)
+			changed = true
+		}
+	}
+
+	return dev, entry, changed
+}
+
+// removeAdded drops the entries of added from values
+func removeAdded(values []string, added []string) ([]string, bool) {
+	kept := []string{}
+	removed := false
+	for _, value := range values {
+		if slices.Contains(added, value) {
+			removed = true
+			continue
+		}
+		kept = append(kept, value)
+	}
+	return kept, removed
+}
+
+// undoClassificationChanges removes the groups and policies an audit entry
+// added, anything else on the device is left alone
+func undoClassificationChanges(dev DeviceEntry, entry ClassifyAuditEntry) (DeviceEntry, bool) {
+	groups, groupsRemoved := removeAdded(dev.Groups, entry.AddedGroups)
+	policies, policiesRemoved := removeAdded(dev.Policies, entry.AddedPolicies)
+	if !groupsRemoved && !policiesRemoved {
+		return dev, false
+	}
+
+	dev.Groups = groups
+	dev.Policies = policies
+	return dev, true
+}
+
+// assumes ClassifyAutoApplymtx is held
+func activeClassifyAuditLocked(mac string) int {
+	for i := len(gClassifyState.Audit) - 1; i >= 0; i-- {
+		entry := gClassifyState.Audit[i]
+		if entry.MAC == mac && !entry.Undone {
+			return i
+		}
+	}
+	return -1
+}
+
+func updateClassifiedDevice(mac string, update func(DeviceEntry) (DeviceEntry, bool)) bool {
+	Groupsmtx.Lock()
+	defer Groupsmtx.Unlock()
+	Devicesmtx.Lock()
+	defer Devicesmtx.Unlock()
+
+	devices := getDevicesJson()
+	groups := getGroupsJson()
+
+	val, exists := devices[mac]
+	if !exists {
+		return false
+	}
+
+	val, changed := update(val)
+	if !changed {
+		return false
+	}
+
+	devices[mac] = val
+	addGroupsIfMissing(groups, val.Groups)
+	saveDevicesJson(devices)
+
+	refreshDeviceGroupsAndPolicy(devices, getGroupsJson(), val)
+	SprbusPublish("device:groups:update", scrubDevice(val))
+	return true
+}
+
+// assumes ClassifyAutoApplymtx is held
+func applyClassificationLocked(result ClassifyResult, source string, groups []string, policies []string) bool {
+	var entry ClassifyAuditEntry
+	applied := updateClassifiedDevice(result.MAC, func(dev DeviceEntry) (DeviceEntry, bool) {
+		var changed bool
+		dev, entry, changed = applyClassificationChanges(dev, groups, policies)
+		return dev, changed
+	})
+	if !applied {
+		return false
+	}
+
+	entry.Time = time.Now().UTC().Format(time.RFC3339)
+	entry.Category = result.Category
+	entry.Confidence = result.Confidence
+	entry.Source = source
+	gClassifyState.Audit = append(gClassifyState.Audit, entry)
+	delete(gClassifyState.Review, result.MAC)
+	saveClassifyStateLocked()
+	return true
+}
+
+// assumes ClassifyAutoApplymtx is held
+func undoClassificationLocked(mac string) {
+	idx := activeClassifyAuditLocked(mac)
+	if idx == -1 {
+		return
+	}
+
+	entry := gClassifyState.Audit[idx]
+	updateClassifiedDevice(mac, func(dev DeviceEntry) (DeviceEntry, bool) {
+		return undoClassificationChanges(dev, entry)
+	})
+
+	gClassifyState.Audit[idx].Undone = true
+	gClassifyState.Audit[idx].UndoneTime = time.Now().UTC().Format(time.RFC3339)
+	saveClassifyStateLocked()
+}
+
+func handleClassifyResult(result ClassifyResult) bool {
+	result.MAC = trimLower(result.MAC)
+	if result.MAC == "" || result.Category == "" || result.Category == "unknown" {
+		return true
+	}
+
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	if !gClassifyConfig.Enabled {
+		return true
+	}
+
+	if result.UserCorrection {
+		//corrections are never applied automatically, the user approves
+		//the corrected suggestions in the review queue
+		undoClassificationLocked(result.MAC)
+		delete(gClassifyState.Review, result.MAC)
+		if groups, policies, ok := classifySuggestions(gClassifyConfig, result); ok {
+			queueClassifyReviewLocked(result, groups, policies)
+		}
+		saveClassifyStateLocked()
+		return true
+	}
+
+	//only the first classification of a device is applied
+	if activeClassifyAuditLocked(result.MAC) != -1 {
+		return true
+	}
+
+	//a pending correction is not replaced by later classifications
+	if queued, exists := gClassifyState.Review[result.MAC]; exists && queued.UserCorrection {
+		return true
+	}
+
+	dev, exists := readDevicesSnapshot()[result.MAC]
+	if !exists {
+		return false
+	}
+	if dev.DeviceDisabled || !isNewDevice(gClassifyConfig, dev, time.Now()) {
+		return true
+	}
+
+	groups, policies, ok := classifySuggestions(gClassifyConfig, result)
+	if !ok {
+		return true
+	}
+
+	if classifyMeetsConfidence(gClassifyConfig, result.Confidence) {
+		applyClassificationLocked(result, "auto", groups, policies)
+		return true
+	}
+
+	if queueClassifyReviewLocked(result, groups, policies) {
+		saveClassifyStateLocked()
+	}
+	return true
+}
+
+// assumes ClassifyAutoApplymtx is held
+func queueClassifyReviewLocked(result ClassifyResult, groups []string, policies []string) bool {
+	if _, queued := gClassifyState.Review[result.MAC]; !queued && len(gClassifyState.Review) >= classifyMaxReview {
+		return false
+	}
+
+	gClassifyState.Review[result.MAC] = ClassifyReviewEntry{
+		MAC:               result.MAC,
+		Vendor:            result.Vendor,
+		Category:          result.Category,
+		Confidence:        result.Confidence,
+		SuggestedGroups:   groups,
+		SuggestedPolicies: policies,
+		Time:              time.Now().UTC().Format(time.RFC3339),
+		UserCorrection:    result.UserCorrection,
+	}
+	return true
+}
+
+func handleClassifyEvent(topic string, value string) {
+	result := ClassifyResult{}
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		log.Println("invalid classify event", err)
+		return
+	}
+
+	if !handleClassifyResult(result) {
+		//the result can arrive before the DHCP request saved the device
+		go func() {
+			time.Sleep(10 * time.Second)
+			handleClassifyResult(result)
+		}()
+	}
+}
+
+func ClassifyEventListener() {
+	loadClassifyAutoApply()
+	for i := 30; i > 0; i-- {
+		err := sprbus.HandleEvent("classify:result", handleClassifyEvent)
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(3 * time.Second)
+	}
+	log.Println("[-] failed to establish connection to sprbus for classify")
+}
+
+func classifyAutoApplyConfigHandler(w http.ResponseWriter, r *http.Request) {
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	if r.Method == http.MethodPut {
+		config := ClassifyAutoApplyConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := validateClassifyAutoApplyConfig(&config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := saveFileJSON(ClassifyAutoApplyConfigFile, config); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		gClassifyConfig = config
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gClassifyConfig)
+}
+
+func classifyReviewHandler(w http.ResponseWriter, r *http.Request) {
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	entries := []ClassifyReviewEntry{}
+	for _, entry := range gClassifyState.Review {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b ClassifyReviewEntry) int {
+		return strings.Compare(a.Time, b.Time)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// PUT approves a queued suggestion, DELETE dismisses it
+func classifyReviewEntryHandler(w http.ResponseWriter, r *http.Request) {
+	mac := trimLower(mux.Vars(r)["mac"])
+
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	entry, exists := gClassifyState.Review[mac]
+	if !exists {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		delete(gClassifyState.Review, mac)
+		saveClassifyStateLocked()
+		return
+	}
+
+	result := ClassifyResult{
+		MAC:        mac,
+		Vendor:     entry.Vendor,
+		Category:   entry.Category,
+		Confidence: entry.Confidence,
+	}
+	source := "review"
+	if entry.UserCorrection {
+		source = "correction"
+	}
+	if !applyClassificationLocked(result, source, entry.SuggestedGroups, entry.SuggestedPolicies) {
+		delete(gClassifyState.Review, mac)
+		saveClassifyStateLocked()
+	}
+}
+
+func classifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	ClassifyAutoApplymtx.Lock()
+	defer ClassifyAutoApplymtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gClassifyState.Audit)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClassifySuggestions(t *testing.T) {
+	config := ClassifyAutoApplyConfig{
+		Categories: map[string]ClassifyCategoryPolicy{
+			"camera":  {Groups: []string{"iot"}, Policies: []string{"dns"}},
+			"console": {Disabled: true},
+		},
+	}
+
+	groups, policies, ok := classifySuggestions(config, ClassifyResult{
+		Category:          "camera",
+		SuggestedGroups:   []string{"IoT"},
+		SuggestedPolicies: []string{"wan", "dns"},
+	})
+	if !ok || !equalStringSlice(groups, []string{"iot"}) || !equalStringSlice(policies, []string{"dns"}) {
+		t.Errorf("override not applied: %v %v %v", groups, policies, ok)
+	}
+
+	_, _, ok = classifySuggestions(config, ClassifyResult{Category: "console", SuggestedGroups: []string{"Game"}})
+	if ok {
+		t.Errorf("disabled category should not be applied")
+	}
+
+	groups, policies, ok = classifySuggestions(config, ClassifyResult{
+		Category:          "printer",
+		SuggestedGroups:   []string{"Printers", "wan", " "},
+		SuggestedPolicies: []string{"api", "lan"},
+	})
+	if !ok || !equalStringSlice(groups, []string{"Printers"}) || !equalStringSlice(policies, []string{"lan"}) {
+		t.Errorf("unexpected suggestions %v %v", groups, policies)
+	}
+
+	_, policies, _ = classifySuggestions(config, ClassifyResult{Category: "tv", SuggestedGroups: []string{"Media"}})
+	if policies != nil {
+		t.Errorf("policies should be left alone without suggestions")
+	}
+}
+
+func TestClassifyMeetsConfidence(t *testing.T) {
+	config := ClassifyAutoApplyConfig{}
+	if classifyMeetsConfidence(config, "Medium") || !classifyMeetsConfidence(config, "High") {
+		t.Errorf("default minimum should be High")
+	}
+
+	config.MinConfidence = "Medium"
+	if !classifyMeetsConfidence(config, "Medium") || classifyMeetsConfidence(config, "Low") {
+		t.Errorf("Medium minimum not honored")
+	}
+}
+
+func TestIsNewDevice(t *testing.T) {
+	now := time.Now()
+	config := ClassifyAutoApplyConfig{NewDeviceHours: 2}
+
+	dev := DeviceEntry{DHCPFirstTime: now.Add(-time.Hour).String()}
+	if !isNewDevice(config, dev, now) {
+		t.Errorf("device seen an hour ago should be new")
+	}
+
+	dev.DHCPFirstTime = now.Add(-3 * time.Hour).String()
+	if isNewDevice(config, dev, now) {
+		t.Errorf("device seen three hours ago should not be new")
+	}
+
+	dev.DHCPFirstTime = ""
+	if isNewDevice(config, dev, now) {
+		t.Errorf("device without DHCP time should not be new")
+	}
+}
+
+func TestClassificationApplyAndUndo(t *testing.T) {
+	dev := DeviceEntry{
+		MAC:      "11:22:33:44:55:66",
+		Groups:   []string{"home"},
+		Policies: []string{"wan", "dns"},
+	}
+
+	updated, entry, changed := applyClassificationChanges(dev, []string{"iot", "home"}, []string{"dns", "lan"})
+	if !changed {
+		t.Fatalf("expected a change")
+	}
+	if !equalStringSlice(updated.Groups, []string{"home", "iot"}) || !equalStringSlice(updated.Policies, []string{"wan", "dns", "lan"}) {
+		t.Errorf("unexpected device %v %v", updated.Groups, updated.Policies)
+	}
+	if !equalStringSlice(entry.AddedGroups, []string{"iot"}) || !equalStringSlice(entry.AddedPolicies, []string{"lan"}) {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	restored, changed := undoClassificationChanges(updated, entry)
+	if !changed || !equalStringSlice(restored.Groups, []string{"home"}) || !equalStringSlice(restored.Policies, []string{"wan", "dns"}) {
+		t.Errorf("undo failed %v %v", restored.Groups, restored.Policies)
+	}
+
+	//only what was added is removed, later user changes are kept
+	updated.Groups = append(updated.Groups, "printers")
+	updated.Policies = []string{"dns", "lan", "api"}
+	restored, _ = undoClassificationChanges(updated, entry)
+	if !equalStringSlice(restored.Groups, []string{"home", "printers"}) || !equalStringSlice(restored.Policies, []string{"dns", "api"}) {
+		t.Errorf("user changes overwritten %v %v", restored.Groups, restored.Policies)
+	}
+
+	_, _, changed = applyClassificationChanges(restored, []string{"home"}, nil)
+	if changed {
+		t.Errorf("no change expected")
+	}
+
+	if _, changed = undoClassificationChanges(restored, ClassifyAuditEntry{AddedGroups: []string{"iot"}}); changed {
+		t.Errorf("nothing to undo")
+	}
+}
+
+func TestClassifyUserCorrection(t *testing.T) {
+	ClassifyAutoApplymtx.Lock()
+	savedConfig, savedState, savedFile := gClassifyConfig, gClassifyState, ClassifyAutoApplyStateFile
+	gClassifyConfig = ClassifyAutoApplyConfig{Enabled: true, MinConfidence: "Medium"}
+	gClassifyState = classifyAutoApplyState{Review: map[string]ClassifyReviewEntry{}}
+	ClassifyAutoApplyStateFile = filepath.Join(t.TempDir(), "classify_autoapply.json")
+	ClassifyAutoApplymtx.Unlock()
+	defer func() {
+		ClassifyAutoApplymtx.Lock()
+		gClassifyConfig, gClassifyState, ClassifyAutoApplyStateFile = savedConfig, savedState, savedFile
+		ClassifyAutoApplymtx.Unlock()
+	}()
+
+	correction := ClassifyResult{
+		MAC:               "11:22:33:44:55:66",
+		Category:          "printer",
+		Confidence:        "High",
+		SuggestedGroups:   []string{"printers"},
+		SuggestedPolicies: []string{"lan"},
+		UserCorrection:    true,
+	}
+	if !handleClassifyResult(correction) {
+		t.Fatal("correction not handled")
+	}
+
+	//a correction is queued for review even at high confidence
+	entry, queued := gClassifyState.Review[correction.MAC]
+	if !queued || !entry.UserCorrection || !equalStringSlice(entry.SuggestedGroups, []string{"printers"}) {
+		t.Errorf("correction not queued %+v", entry)
+	}
+	if len(gClassifyState.Audit) != 0 {
+		t.Errorf("correction applied without review %+v", gClassifyState.Audit)
+	}
+
+	//later classifications do not replace the pending correction
+	handleClassifyResult(ClassifyResult{MAC: correction.MAC, Category: "camera", Confidence: "High", SuggestedGroups: []string{"iot"}})
+	if entry = gClassifyState.Review[correction.MAC]; entry.Category != "printer" || len(gClassifyState.Audit) != 0 {
+		t.Errorf("pending correction replaced %+v", entry)
+	}
+}
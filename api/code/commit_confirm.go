@@ -0,0 +1,367 @@
+package main
+
+/*
+ Commit confirm: changes to uplinks, interfaces, vlan trunks and custom
+ interface rules can cut off the admin that made them. When such a call
+ carries ?confirm=<seconds>, the configuration from before the change is
+ restored automatically unless PUT /confirm arrives in time. The pending
+ commit is kept in state, so a restart before the deadline still reverts.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var PendingCommitPath = TEST_PREFIX + "/state/api/pending_commit.json"
+
+const commitConfirmMinSeconds = 10
+const commitConfirmMaxSeconds = 600
+
+type PendingCommit struct {
+	SnapshotID string
+	Method     string
+	Path       string
+	Started    time.Time
+	Deadline   time.Time
+}
+
+var CommitConfirmmtx sync.Mutex
+var gPendingCommit *PendingCommit
+var gPendingCommitTimer *time.Timer
+
+func parseConfirmTimeout(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("confirm must be a number of seconds")
+	}
+	if seconds < commitConfirmMinSeconds || seconds > commitConfirmMaxSeconds {
+		return 0, fmt.Errorf("confirm must be between %d and %d seconds", commitConfirmMinSeconds, commitConfirmMaxSeconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+type commitStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *commitStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// commitConfirm wraps a handler so that ?confirm=<seconds> arms an
+// automatic rollback of the change it makes
+func commitConfirm(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("confirm")
+		if value == "" {
+			handler(w, r)
+			return
+		}
+
+		timeout, err := parseConfirmTimeout(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		//configSnapshotMiddleware has already saved the configuration,
+		//this returns that same snapshot
+		snapshot, err := takeConfigSnapshot(r.Method, r.URL.Path)
+		if err != nil {
+			log.Println("failed to snapshot configuration", err)
+			http.Error(w, "Failed to save the current configuration", 500)
+			return
+		}
+
+		recorder := &commitStatusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+
+		if recorder.status != http.StatusOK {
+			return
+		}
+
+		armPendingCommit(snapshot.ID, r.Method, r.URL.Path, timeout)
+	}
+}
+
+// armPendingCommit starts the rollback timer. When a commit is already
+// pending, its snapshot is kept so a rollback undoes all unconfirmed changes
+func armPendingCommit(id string, method string, path string, timeout time.Duration) PendingCommit {
+	CommitConfirmmtx.Lock()
+	defer CommitConfirmmtx.Unlock()
+
+	now := time.Now().UTC()
+	if gPendingCommit == nil {
+		gPendingCommit = &PendingCommit{SnapshotID: id, Started: now}
+		//the history keeps the snapshot until the commit is confirmed or reverted
+		pinConfigSnapshot(id, true)
+	}
+	gPendingCommit.Method = method
+	gPendingCommit.Path = path
+	gPendingCommit.Deadline = now.Add(timeout)
+
+	if gPendingCommitTimer != nil {
+		gPendingCommitTimer.Stop()
+	}
+
+	startPendingCommitTimerLocked(timeout)
+	savePendingCommitLocked()
+
+	SprbusPublish("config:commit:pending", *gPendingCommit)
+
+	return *gPendingCommit
+}
+
+func startPendingCommitTimerLocked(timeout time.Duration) {
+	pendingID := gPendingCommit.SnapshotID
+	gPendingCommitTimer = time.AfterFunc(timeout, func() {
+		revertPendingCommit(pendingID, "timeout")
+	})
+}
+
+// savePendingCommitLocked writes the pending commit to state, or removes
+// it once there is none
+func savePendingCommitLocked() {
+	if gPendingCommit == nil {
+		err := os.Remove(PendingCommitPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("failed to remove pending commit", err)
+		}
+		return
+	}
+
+	if err := saveFileJSON(PendingCommitPath, gPendingCommit); err != nil {
+		log.Println("failed to save pending commit", err)
+	}
+}
+
+// initCommitConfirm rearms a commit that was pending before a restart,
+// a deadline that passed while the api was down reverts right away
+func initCommitConfirm() {
+	data, err := os.ReadFile(PendingCommitPath)
+	if err != nil {
+		return
+	}
+
+	pending := PendingCommit{}
+	err = json.Unmarshal(data, &pending)
+	if err != nil || pending.SnapshotID == "" {
+		log.Println("ignoring invalid pending commit", err)
+		os.Remove(PendingCommitPath)
+		return
+	}
+
+	CommitConfirmmtx.Lock()
+	defer CommitConfirmmtx.Unlock()
+
+	if gPendingCommit != nil {
+		return
+	}
+
+	gPendingCommit = &pending
+	pinConfigSnapshot(pending.SnapshotID, true)
+	startPendingCommitTimerLocked(max(time.Until(pending.Deadline), 0))
+}
+
+func takePendingCommit(id string) (PendingCommit, bool) {
+	CommitConfirmmtx.Lock()
+	defer CommitConfirmmtx.Unlock()
+
+	if gPendingCommit == nil || (id != "" && gPendingCommit.SnapshotID != id) {
+		return PendingCommit{}, false
+	}
+
+	if gPendingCommitTimer != nil {
+		gPendingCommitTimer.Stop()
+		gPendingCommitTimer = nil
+	}
+
+	pending := *gPendingCommit
+	gPendingCommit = nil
+	savePendingCommitLocked()
+	return pending, true
+}
+
+// interfacesToRevert returns the interfaces that differ from the previous
+// configuration and the ones that were added since
+func interfacesToRevert(previous []InterfaceConfig, current []InterfaceConfig) ([]InterfaceConfig, []InterfaceConfig) {
+	changed := []InterfaceConfig{}
+	added := []InterfaceConfig{}
+
+	currentByName := map[string]InterfaceConfig{}
+	for _, iface := range current {
+		currentByName[iface.Name] = iface
+	}
+
+	previousByName := map[string]bool{}
+	for _, iface := range previous {
+		previousByName[iface.Name] = true
+		cur, exists := currentByName[iface.Name]
+		if !exists || !reflect.DeepEqual(cur, iface) {
+			changed = append(changed, iface)
+		}
+	}
+
+	for _, iface := range current {
+		if !previousByName[iface.Name] {
+			added = append(added, iface)
+		}
+	}
+
+	return changed, added
+}
+
+// revertInterfaces puts interfaces back the way the handlers would,
+// so uplinks, addresses and trunks are reprogrammed and not only saved
+func revertInterfaces(files map[string][]byte) {
+	data, exists := files["base/interfaces.json"]
+	if !exists {
+		return
+	}
+
+	previous := []InterfaceConfig{}
+	err := json.Unmarshal(data, &previous)
+	if err != nil {
+		log.Println("failed to parse interfaces from snapshot", err)
+		return
+	}
+
+	Interfacesmtx.Lock()
+	current := loadInterfacesConfigLocked()
+	Interfacesmtx.Unlock()
+
+	currentByName := map[string]InterfaceConfig{}
+	for _, iface := range current {
+		currentByName[iface.Name] = iface
+	}
+
+	changed, added := interfacesToRevert(previous, current)
+
+	for _, iface := range added {
+		iface.Enabled = false
+		err = updateInterfaceConfig(iface)
+		if err != nil {
+			log.Println("failed to disable interface", iface.Name, err)
+		}
+		if iface.Subtype == "VLAN-Trunk" {
+			refreshVlanTrunk(iface.Name, false)
+		}
+	}
+
+	for _, iface := range changed {
+		cur := currentByName[iface.Name]
+
+		if cur.Type != iface.Type || cur.Subtype != iface.Subtype {
+			_, err = updateInterfaceType(iface.Name, iface.Type, iface.Subtype, iface.Enabled)
+			if err != nil {
+				log.Println("failed to revert interface type", iface.Name, err)
+			}
+		}
+
+		err = updateInterfaceConfig(iface)
+		if err != nil {
+			log.Println("failed to revert interface", iface.Name, err)
+		}
+
+		err = updateInterfaceIP(iface)
+		if err != nil {
+			log.Println("failed to revert interface ip", iface.Name, err)
+		}
+
+		if (cur.Subtype == "VLAN-Trunk") != (iface.Subtype == "VLAN-Trunk") {
+			refreshVlanTrunk(iface.Name, iface.Subtype == "VLAN-Trunk")
+		}
+	}
+}
+
+func revertPendingCommit(id string, reason string) {
+	pending, exists := takePendingCommit(id)
+	if !exists {
+		return
+	}
+	defer pinConfigSnapshot(pending.SnapshotID, false)
+
+	ConfigHistorymtx.Lock()
+	files, err := readConfigSnapshotFilesLocked(pending.SnapshotID)
+	ConfigHistorymtx.Unlock()
+	if err != nil {
+		log.Println("failed to read snapshot for commit revert", pending.SnapshotID, err)
+		return
+	}
+
+	//keep the unconfirmed configuration in the history
+	_, err = takeConfigSnapshot("REVERT", pending.Path)
+	if err != nil {
+		log.Println("failed to snapshot configuration", err)
+	}
+
+	revertInterfaces(files)
+
+	changes, err := restoreConfigFiles(pending.SnapshotID)
+	if err != nil {
+		log.Println("failed to revert commit", pending.SnapshotID, err)
+		return
+	}
+
+	log.Println("reverted unconfirmed change to", pending.Path, "("+reason+")")
+
+	SprbusPublish("config:commit:reverted", map[string]interface{}{
+		"ID":      pending.SnapshotID,
+		"Path":    pending.Path,
+		"Reason":  reason,
+		"Changes": len(changes),
+	})
+}
+
+func getPendingCommit(w http.ResponseWriter, r *http.Request) {
+	CommitConfirmmtx.Lock()
+	var pending *PendingCommit
+	if gPendingCommit != nil {
+		copied := *gPendingCommit
+		pending = &copied
+	}
+	CommitConfirmmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending)
+}
+
+func confirmPendingCommit(w http.ResponseWriter, r *http.Request) {
+	pending, exists := takePendingCommit("")
+	if !exists {
+		http.Error(w, "No pending commit", 404)
+		return
+	}
+	pinConfigSnapshot(pending.SnapshotID, false)
+
+	SprbusPublish("config:commit:confirmed", pending)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending)
+}
+
+func rollbackPendingCommit(w http.ResponseWriter, r *http.Request) {
+	CommitConfirmmtx.Lock()
+	exists := gPendingCommit != nil
+	id := ""
+	if exists {
+		id = gPendingCommit.SnapshotID
+	}
+	CommitConfirmmtx.Unlock()
+
+	if !exists {
+		http.Error(w, "No pending commit", 404)
+		return
+	}
+
+	revertPendingCommit(id, "rollback")
+}
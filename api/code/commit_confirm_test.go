@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseConfirmTimeout(t *testing.T) {
+	timeout, err := parseConfirmTimeout("60")
+	if err != nil || timeout != time.Minute {
+		t.Fatalf("got %v %v", timeout, err)
+	}
+
+	for _, value := range []string{"", "abc", "5", "601", "-30"} {
+		if _, err := parseConfirmTimeout(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestInterfacesToRevert(t *testing.T) {
+	previous := []InterfaceConfig{
+		{Name: "eth0", Type: "Uplink", Subtype: "ethernet", Enabled: true},
+		{Name: "eth1", Type: "Downlink", Enabled: true},
+		{Name: "wlan0", Type: "AP", Enabled: true},
+	}
+	current := []InterfaceConfig{
+		{Name: "eth0", Type: "Uplink", Subtype: "ethernet", Enabled: true, DisableDHCP: true, IP: "10.0.0.2/24", Router: "10.0.0.1"},
+		{Name: "eth1", Type: "Downlink", Subtype: "VLAN-Trunk", Enabled: true},
+		{Name: "wlan0", Type: "AP", Enabled: true},
+		{Name: "eth2", Type: "Uplink", Subtype: "ethernet", Enabled: true},
+	}
+
+	changed, added := interfacesToRevert(previous, current)
+	if len(changed) != 2 || changed[0].Name != "eth0" || changed[0].IP != "" || changed[1].Name != "eth1" || changed[1].Subtype != "" {
+		t.Errorf("unexpected changed interfaces %+v", changed)
+	}
+	if len(added) != 1 || added[0].Name != "eth2" {
+		t.Errorf("unexpected added interfaces %+v", added)
+	}
+}
+
+func TestPendingCommit(t *testing.T) {
+	oldPath := PendingCommitPath
+	PendingCommitPath = filepath.Join(t.TempDir(), "pending_commit.json")
+	t.Cleanup(func() {
+		takePendingCommit("")
+		PendingCommitPath = oldPath
+	})
+
+	first := armPendingCommit("20261018T120000.000000", "PUT", "/uplink/ip", time.Hour)
+	t.Cleanup(func() { pinConfigSnapshot(first.SnapshotID, false) })
+
+	ConfigHistorymtx.Lock()
+	pinned := gPinnedConfigSnapshots[first.SnapshotID]
+	ConfigHistorymtx.Unlock()
+	if !pinned {
+		t.Error("the snapshot of the pending commit is not pinned")
+	}
+
+	// a second unconfirmed change keeps the original snapshot
+	second := armPendingCommit("20261018T120100.000000", "PUT", "/link/ip", 2*time.Hour)
+	if second.SnapshotID != first.SnapshotID || second.Path != "/link/ip" || !second.Deadline.After(first.Deadline) {
+		t.Errorf("unexpected pending commit %+v", second)
+	}
+
+	if _, exists := takePendingCommit("20261018T120100.000000"); exists {
+		t.Error("took a pending commit with the wrong id")
+	}
+
+	pending, exists := takePendingCommit("")
+	if !exists || pending.SnapshotID != first.SnapshotID {
+		t.Fatalf("expected the pending commit, got %+v", pending)
+	}
+	if gPendingCommit != nil || gPendingCommitTimer != nil {
+		t.Error("pending commit was not cleared")
+	}
+	if _, err := os.Stat(PendingCommitPath); !os.IsNotExist(err) {
+		t.Errorf("pending commit was not removed from state: %v", err)
+	}
+}
+
+func TestInitCommitConfirm(t *testing.T) {
+	oldPath := PendingCommitPath
+	PendingCommitPath = filepath.Join(t.TempDir(), "pending_commit.json")
+	t.Cleanup(func() {
+		takePendingCommit("")
+		PendingCommitPath = oldPath
+	})
+
+	armed := armPendingCommit("20261018T120000.000000", "PUT", "/uplink/ip", time.Hour)
+
+	// forget it, as a restart would
+	CommitConfirmmtx.Lock()
+	gPendingCommitTimer.Stop()
+	gPendingCommit, gPendingCommitTimer = nil, nil
+	CommitConfirmmtx.Unlock()
+
+	initCommitConfirm()
+
+	CommitConfirmmtx.Lock()
+	restored := gPendingCommit
+	timer := gPendingCommitTimer
+	CommitConfirmmtx.Unlock()
+
+	if restored == nil || restored.SnapshotID != armed.SnapshotID || !restored.Deadline.Equal(armed.Deadline) {
+		t.Fatalf("expected %+v to be restored, got %+v", armed, restored)
+	}
+	if timer == nil {
+		t.Error("rollback timer was not rearmed")
+	}
+}
@@ -0,0 +1,504 @@
+/*
+Versioned snapshots of the configuration, taken before every mutating API
+call, with a structured diff between snapshots and a one call restore.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var ConfigHistoryDirectory = TEST_PREFIX + "/state/api/config_history"
+var ConfigHistoryRoot = TEST_PREFIX + "/configs"
+
+// directories under ConfigHistoryRoot that are versioned. auth is left out
+// on purpose, credentials should not travel with a rollback
+var ConfigHistoryDirs = []string{"base", "devices", "dns"}
+
+var configHistoryLimit = 100
+
+const configHistoryMaxFileSize = 4 * 1024 * 1024
+const configSnapshotManifest = "snapshot.json"
+
+var validSnapshotID = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{6}$`).MatchString
+
+type ConfigSnapshot struct {
+	ID     string
+	Time   time.Time
+	Method string
+	Path   string
+	Files  map[string]string //relative path -> sha256
+}
+
+type ConfigChange struct {
+	File string
+	Path string      `json:",omitempty"` //json pointer into the file
+	Op   string      //add, remove or change
+	Old  interface{} `json:",omitempty"`
+	New  interface{} `json:",omitempty"`
+}
+
+var ConfigHistorymtx sync.Mutex
+
+// snapshots kept when pruning the history, like the one a pending
+// commit rolls back to
+var gPinnedConfigSnapshots = map[string]bool{}
+
+func pinConfigSnapshot(id string, pinned bool) {
+	ConfigHistorymtx.Lock()
+	defer ConfigHistorymtx.Unlock()
+	if pinned {
+		gPinnedConfigSnapshots[id] = true
+	} else {
+		delete(gPinnedConfigSnapshots, id)
+	}
+}
+
+// readConfigFiles returns the versioned files by their path relative to root
+func readConfigFiles(root string) map[string][]byte {
+	files := map[string][]byte{}
+	for _, dir := range ConfigHistoryDirs {
+		filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			//skip markers like .setup_done and temporary files
+			if strings.HasPrefix(info.Name(), ".") || info.Size() > configHistoryMaxFileSize {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err == nil {
+				files[filepath.ToSlash(rel)] = data
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+func hashConfigFiles(files map[string][]byte) map[string]string {
+	hashes := map[string]string{}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// listConfigSnapshotsLocked returns the snapshots, newest first
+func listConfigSnapshotsLocked() []ConfigSnapshot {
+	snapshots := []ConfigSnapshot{}
+	entries, err := os.ReadDir(ConfigHistoryDirectory)
+	if err != nil {
+		return snapshots
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validSnapshotID(entry.Name()) {
+			continue
+		}
+		snapshot, err := loadConfigSnapshotLocked(entry.Name())
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID > snapshots[j].ID
+	})
+	return snapshots
+}
+
+func loadConfigSnapshotLocked(id string) (ConfigSnapshot, error) {
+	snapshot := ConfigSnapshot{}
+	data, err := os.ReadFile(filepath.Join(ConfigHistoryDirectory, id, configSnapshotManifest))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func readConfigSnapshotFilesLocked(id string) (map[string][]byte, error) {
+	snapshot, err := loadConfigSnapshotLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	for name := range snapshot.Files {
+		data, err := os.ReadFile(filepath.Join(ConfigHistoryDirectory, id, "files", filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// takeConfigSnapshot saves the current configuration, unless it is
+// unchanged since the last snapshot
+func takeConfigSnapshot(method string, path string) (ConfigSnapshot, error) {
+	ConfigHistorymtx.Lock()
+	defer ConfigHistorymtx.Unlock()
+
+	files := readConfigFiles(ConfigHistoryRoot)
+	hashes := hashConfigFiles(files)
+
+	snapshots := listConfigSnapshotsLocked()
+	if len(snapshots) > 0 && reflect.DeepEqual(snapshots[0].Files, hashes) {
+		return snapshots[0], nil
+	}
+
+	now := time.Now().UTC()
+	id := now.Format("20060102T150405.000000")
+	if len(snapshots) > 0 && id <= snapshots[0].ID {
+		return ConfigSnapshot{}, fmt.Errorf("snapshot %s is not newer than %s", id, snapshots[0].ID)
+	}
+
+	snapshot := ConfigSnapshot{ID: id, Time: now, Method: method, Path: path, Files: hashes}
+	dir := filepath.Join(ConfigHistoryDirectory, id)
+
+	for name, data := range files {
+		target := filepath.Join(dir, "files", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			os.RemoveAll(dir)
+			return ConfigSnapshot{}, err
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			os.RemoveAll(dir)
+			return ConfigSnapshot{}, err
+		}
+	}
+
+	//the manifest goes last, a snapshot without one is ignored
+	if err := saveFileJSON(filepath.Join(dir, configSnapshotManifest), snapshot); err != nil {
+		os.RemoveAll(dir)
+		return ConfigSnapshot{}, err
+	}
+
+	snapshots = append([]ConfigSnapshot{snapshot}, snapshots...)
+	kept := 0
+	for _, old := range snapshots {
+		if gPinnedConfigSnapshots[old.ID] {
+			continue
+		}
+		kept++
+		if kept > configHistoryLimit {
+			os.RemoveAll(filepath.Join(ConfigHistoryDirectory, old.ID))
+		}
+	}
+
+	return snapshot, nil
+}
+
+// configSnapshotMiddleware snapshots the configuration before each mutating call
+func configSnapshotMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			_, err := takeConfigSnapshot(r.Method, r.URL.Path)
+			if err != nil {
+				log.Println("failed to snapshot configuration", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func jsonPointerEscape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// diffJSON appends the changes between two decoded json values
+func diffJSON(file string, path string, from interface{}, to interface{}, changes []ConfigChange) []ConfigChange {
+	switch a := from.(type) {
+	case map[string]interface{}:
+		b, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := []string{}
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, exists := a[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := path + "/" + jsonPointerEscape(key)
+			oldVal, inOld := a[key]
+			newVal, inNew := b[key]
+			if !inOld {
+				changes = append(changes, ConfigChange{File: file, Path: child, Op: "add", New: newVal})
+			} else if !inNew {
+				changes = append(changes, ConfigChange{File: file, Path: child, Op: "remove", Old: oldVal})
+			} else {
+				changes = diffJSON(file, child, oldVal, newVal, changes)
+			}
+		}
+		return changes
+	case []interface{}:
+		b, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(a), len(b)); i++ {
+			child := path + "/" + strconv.Itoa(i)
+			if i >= len(a) {
+				changes = append(changes, ConfigChange{File: file, Path: child, Op: "add", New: b[i]})
+			} else if i >= len(b) {
+				changes = append(changes, ConfigChange{File: file, Path: child, Op: "remove", Old: a[i]})
+			} else {
+				changes = diffJSON(file, child, a[i], b[i], changes)
+			}
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		changes = append(changes, ConfigChange{File: file, Path: path, Op: "change", Old: from, New: to})
+	}
+	return changes
+}
+
+func configFileValue(data []byte) interface{} {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return nil
+}
+
+// diffConfigFiles compares two sets of files, json files member by member
+func diffConfigFiles(from map[string][]byte, to map[string][]byte) []ConfigChange {
+	names := []string{}
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, exists := from[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []ConfigChange{}
+	for _, name := range names {
+		oldData, inOld := from[name]
+		newData, inNew := to[name]
+		if !inOld {
+			changes = append(changes, ConfigChange{File: name, Op: "add", New: configFileValue(newData)})
+			continue
+		} else if !inNew {
+			changes = append(changes, ConfigChange{File: name, Op: "remove", Old: configFileValue(oldData)})
+			continue
+		} else if bytes.Equal(oldData, newData) {
+			continue
+		}
+
+		var oldVal, newVal interface{}
+		if json.Unmarshal(oldData, &oldVal) == nil && json.Unmarshal(newData, &newVal) == nil {
+			changes = diffJSON(name, "", oldVal, newVal, changes)
+		} else {
+			changes = append(changes, ConfigChange{File: name, Op: "change", Old: configFileValue(oldData), New: configFileValue(newData)})
+		}
+	}
+	return changes
+}
+
+// configFilesFor returns the files of a snapshot, or the live configuration for "current"
+func configFilesFor(id string) (map[string][]byte, error) {
+	if id == "current" {
+		return readConfigFiles(ConfigHistoryRoot), nil
+	}
+	if !validSnapshotID(id) {
+		return nil, fmt.Errorf("Invalid snapshot id")
+	}
+	ConfigHistorymtx.Lock()
+	defer ConfigHistorymtx.Unlock()
+	return readConfigSnapshotFilesLocked(id)
+}
+
+// reapplyConfiguration reloads the restored configuration and
+// reprograms the firewall from it
+func reapplyConfiguration(previous map[string]DeviceEntry, changes []ConfigChange) {
+	loadConfig()
+	loadWithLockingDHCPConfig()
+
+	Groupsmtx.Lock()
+	Devicesmtx.Lock()
+	devices := getDevicesJson()
+	groups := getGroupsJson()
+	for identity, device := range previous {
+		if _, exists := devices[identity]; !exists {
+			//flushes the verdict maps of devices the restore removed
+			refreshDeviceGroupsAndPolicy(devices, groups, device)
+		}
+	}
+	for _, device := range devices {
+		refreshDeviceGroupsAndPolicy(devices, groups, device)
+	}
+	doReloadPSKFiles()
+	refreshVLANTrunks(devices)
+	Devicesmtx.Unlock()
+	Groupsmtx.Unlock()
+
+	FWmtx.Lock()
+	gFirewallConfig = FirewallConfig{}
+	FWmtx.Unlock()
+	loadFirewallRules()
+
+	FWmtx.Lock()
+	applyFirewallRulesLocked()
+	FWmtx.Unlock()
+
+	Interfacesmtx.Lock()
+	interfaces := loadInterfacesConfigLocked()
+	rebuildUplink()
+	Interfacesmtx.Unlock()
+
+	applyRadioInterfaces(interfaces)
+	refreshInterfaceOverrides()
+	refreshDownlinks()
+
+	AlertSettingsmtx.Lock()
+	gAlertsConfig = []AlertSetting{}
+	loadAlertsConfig()
+	AlertSettingsmtx.Unlock()
+
+	WanHealthmtx.Lock()
+	gWanHealthConfig = loadWanHealthConfig()
+	WanHealthmtx.Unlock()
+
+	initBandwidth()
+
+	for _, change := range changes {
+		if strings.HasPrefix(change.File, "dns/") {
+			go callSuperdRestart("", "dns")
+			break
+		}
+	}
+}
+
+func getConfigHistory(w http.ResponseWriter, r *http.Request) {
+	ConfigHistorymtx.Lock()
+	snapshots := listConfigSnapshotsLocked()
+	ConfigHistorymtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+func getConfigHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	fromID := r.URL.Query().Get("from")
+	toID := r.URL.Query().Get("to")
+	if toID == "" {
+		toID = "current"
+	}
+
+	from, err := configFilesFor(fromID)
+	if err != nil {
+		http.Error(w, "Invalid from snapshot: "+err.Error(), 400)
+		return
+	}
+	to, err := configFilesFor(toID)
+	if err != nil {
+		http.Error(w, "Invalid to snapshot: "+err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffConfigFiles(from, to))
+}
+
+// writeConfigFiles makes the files under root match a snapshot: changed
+// files are written back and files the snapshot does not have are removed
+func writeConfigFiles(root string, current map[string][]byte, files map[string][]byte) {
+	for name, data := range files {
+		if existing, exists := current[name]; exists && bytes.Equal(existing, data) {
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = saveFileBytes(target, data)
+		}
+		if err != nil {
+			log.Println("failed to restore", name, err)
+		}
+	}
+
+	for name := range current {
+		if _, exists := files[name]; exists {
+			continue
+		}
+		err := os.Remove(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("failed to remove", name, err)
+		}
+	}
+}
+
+// restoreConfigFiles writes back the files of a snapshot and reapplies them
+func restoreConfigFiles(id string) ([]ConfigChange, error) {
+	ConfigHistorymtx.Lock()
+	files, err := readConfigSnapshotFilesLocked(id)
+	ConfigHistorymtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	current := readConfigFiles(ConfigHistoryRoot)
+	changes := diffConfigFiles(current, files)
+
+	Groupsmtx.Lock()
+	Devicesmtx.Lock()
+	previous := readDevicesSnapshot()
+	writeConfigFiles(ConfigHistoryRoot, current, files)
+	Devicesmtx.Unlock()
+	Groupsmtx.Unlock()
+
+	reapplyConfiguration(previous, changes)
+
+	return changes, nil
+}
+
+func restoreConfigSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validSnapshotID(id) {
+		http.Error(w, "Invalid snapshot id", 400)
+		return
+	}
+
+	changes, err := restoreConfigFiles(id)
+	if err != nil {
+		http.Error(w, "Snapshot not found", 404)
+		return
+	}
+
+	SprbusPublish("config:restore", map[string]interface{}{"ID": id, "Changes": len(changes)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupConfigHistoryTest(t *testing.T) string {
+	t.Helper()
+	oldDirectory, oldRoot := ConfigHistoryDirectory, ConfigHistoryRoot
+	ConfigHistoryDirectory = filepath.Join(t.TempDir(), "history")
+	ConfigHistoryRoot = t.TempDir()
+	t.Cleanup(func() {
+		ConfigHistoryDirectory, ConfigHistoryRoot = oldDirectory, oldRoot
+	})
+
+	for _, dir := range []string{"base", "devices", "auth"} {
+		if err := os.MkdirAll(filepath.Join(ConfigHistoryRoot, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ConfigHistoryRoot
+}
+
+func writeConfigTestFile(t *testing.T, root string, name string, data string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTakeConfigSnapshot(t *testing.T) {
+	root := setupConfigHistoryTest(t)
+	writeConfigTestFile(t, root, "base/firewall.json", `{"BlockRules":[]}`)
+	writeConfigTestFile(t, root, "base/.setup_done", "true")
+	writeConfigTestFile(t, root, "auth/auth_users.json", `{"admin":"secret"}`)
+
+	first, err := takeConfigSnapshot("PUT", "/firewall/block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Files) != 1 || first.Files["base/firewall.json"] == "" {
+		t.Fatalf("unexpected files in snapshot: %v", first.Files)
+	}
+
+	// unchanged configuration does not make a new snapshot
+	again, err := takeConfigSnapshot("PUT", "/firewall/block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("expected snapshot %s to be reused, got %s", first.ID, again.ID)
+	}
+
+	time.Sleep(time.Millisecond)
+	writeConfigTestFile(t, root, "devices/devices.json", `{}`)
+	second, err := takeConfigSnapshot("DELETE", "/device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID <= first.ID {
+		t.Fatalf("snapshot ids are not increasing: %s %s", first.ID, second.ID)
+	}
+
+	snapshots := listConfigSnapshotsLocked()
+	if len(snapshots) != 2 || snapshots[0].ID != second.ID || snapshots[1].Path != "/firewall/block" {
+		t.Fatalf("unexpected history %+v", snapshots)
+	}
+
+	files, err := readConfigSnapshotFilesLocked(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["base/firewall.json"]) != `{"BlockRules":[]}` {
+		t.Errorf("unexpected snapshot contents %v", files)
+	}
+}
+
+func TestConfigHistoryKeepsPinnedSnapshot(t *testing.T) {
+	root := setupConfigHistoryTest(t)
+	oldLimit := configHistoryLimit
+	configHistoryLimit = 2
+	t.Cleanup(func() { configHistoryLimit = oldLimit })
+
+	snapshot := func(i int) ConfigSnapshot {
+		t.Helper()
+		time.Sleep(time.Millisecond)
+		writeConfigTestFile(t, root, "base/firewall.json", fmt.Sprintf(`{"Version":%d}`, i))
+		taken, err := takeConfigSnapshot("PUT", "/uplink/ip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return taken
+	}
+
+	pending := snapshot(0)
+	pinConfigSnapshot(pending.ID, true)
+	t.Cleanup(func() { pinConfigSnapshot(pending.ID, false) })
+
+	// a burst of changes while the commit is unconfirmed
+	for i := 1; i <= 5; i++ {
+		snapshot(i)
+	}
+
+	snapshots := listConfigSnapshotsLocked()
+	if len(snapshots) != 3 || snapshots[2].ID != pending.ID {
+		t.Fatalf("expected the pinned snapshot and 2 more, got %+v", snapshots)
+	}
+	if _, err := readConfigSnapshotFilesLocked(pending.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// once released it is pruned like any other
+	pinConfigSnapshot(pending.ID, false)
+	snapshot(6)
+	for _, kept := range listConfigSnapshotsLocked() {
+		if kept.ID == pending.ID {
+			t.Error("released snapshot was kept")
+		}
+	}
+}
+
+func TestWriteConfigFiles(t *testing.T) {
+	root := setupConfigHistoryTest(t)
+	writeConfigTestFile(t, root, "base/firewall.json", `{"BlockRules":[]}`)
+	writeConfigTestFile(t, root, "devices/devices.json", `{}`)
+
+	snapshot, err := takeConfigSnapshot("PUT", "/firewall/block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := readConfigSnapshotFilesLocked(snapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes made after the snapshot
+	writeConfigTestFile(t, root, "base/firewall.json", `{"BlockRules":[{"SrcIP":"1.2.3.4"}]}`)
+	os.Remove(filepath.Join(root, "devices/devices.json"))
+	writeConfigTestFile(t, root, "base/uplinks.json", `{"Policy":"standby"}`)
+	writeConfigTestFile(t, root, "auth/auth_users.json", `{"admin":"secret"}`)
+
+	writeConfigFiles(root, readConfigFiles(root), files)
+
+	restored := readConfigFiles(root)
+	if !reflect.DeepEqual(restored, files) {
+		t.Errorf("got %q, want %q", restored, files)
+	}
+	// files that are not versioned are left alone
+	if _, err := os.Stat(filepath.Join(root, "auth/auth_users.json")); err != nil {
+		t.Errorf("unversioned file was touched: %v", err)
+	}
+}
+
+func TestDiffConfigFiles(t *testing.T) {
+	from := map[string][]byte{
+		"base/firewall.json":   []byte(`{"BlockRules":[{"SrcIP":"1.2.3.4"}],"PingLan":true}`),
+		"devices/devices.json": []byte(`{"aa:bb":{"Name":"tv","Policies":["wan","dns"]}}`),
+		"base/lanip":           []byte("192.168.2.1"),
+		"base/removed.json":    []byte(`{}`),
+	}
+	to := map[string][]byte{
+		"base/firewall.json":   []byte(`{"BlockRules":[],"PingLan":false,"PingWan":true}`),
+		"devices/devices.json": []byte(`{"aa:bb":{"Name":"tv","Policies":["wan"]}}`),
+		"base/lanip":           []byte("192.168.3.1"),
+		"base/added.json":      []byte(`{}`),
+	}
+
+	want := []ConfigChange{
+		{File: "base/added.json", Op: "add", New: "{}"},
+		{File: "base/firewall.json", Path: "/BlockRules/0", Op: "remove", Old: map[string]interface{}{"SrcIP": "1.2.3.4"}},
+		{File: "base/firewall.json", Path: "/PingLan", Op: "change", Old: true, New: false},
+		{File: "base/firewall.json", Path: "/PingWan", Op: "add", New: true},
+		{File: "base/lanip", Op: "change", Old: "192.168.2.1", New: "192.168.3.1"},
+		{File: "base/removed.json", Op: "remove", Old: "{}"},
+		{File: "devices/devices.json", Path: "/aa:bb/Policies/1", Op: "remove", Old: "dns"},
+	}
+
+	changes := diffConfigFiles(from, to)
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v\nwant %+v", changes, want)
+	}
+
+	if changes := diffConfigFiles(from, from); len(changes) != 0 {
+		t.Errorf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestJSONPointerEscape(t *testing.T) {
+	if got := jsonPointerEscape("a/b~c"); got != "a~1b~0c" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -293,6 +293,10 @@ func CreateIPIfaceVerdictMap(family, tableName, mapName string) error {
 	return fmt.Errorf("nftables not supported on macOS")
 }
 
+func CreateIP6IfaceVerdictMap(family, tableName, mapName string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
 func fwdBlockKey(srcIP, dstIP, protocol, dstPort string) (key, keyEnd []byte) {
 	return nil, nil
 }
@@ -318,6 +322,32 @@ func AddOutboundUplinkHashRule(family, tableName, chainName string, saddrOnly bo
 	return fmt.Errorf("nftables not supported on macOS")
 }
 
+func AddOutboundUplinkWeightedRule(family, tableName, chainName string, saddrOnly bool, numSlots int) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func AddOutboundUplinkPinRule(family, tableName, chainName string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func SetUplinkWeights(family, tableName string, marks []uint32) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+type BandwidthLimit struct {
+	Addr           string
+	Ingress        bool
+	BytesPerSecond uint64
+}
+
+func ReplaceBandwidthLimitRules(family, tableName, chainName, owner string, limits []BandwidthLimit) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func ResetBandwidthLimitRules(family, tableName, chainName string, limits map[string][]BandwidthLimit) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
 func InsertWiphyForwardLanRule(family, tableName, chainName, apIface string) error {
 	return fmt.Errorf("nftables not supported on macOS")
 }
@@ -326,6 +356,14 @@ func InsertCustomGroupVmapRule(family, tableName, chainName, zoneName string) er
 	return fmt.Errorf("nftables not supported on macOS")
 }
 
+func InsertWiphyForwardLanRule6(family, tableName, chainName, apIface string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func InsertCustomGroupVmapRule6(family, tableName, chainName, zoneName string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
 func InsertDNSDnatPortRule(family, tableName, chainName, protocol, dnsIP string) error {
 	return fmt.Errorf("nftables not supported on macOS")
 }
@@ -360,6 +398,18 @@ func AddCIDRToSet(family, tableName, setName, cidr string) error {
 	return fmt.Errorf("nftables not supported on macOS")
 }
 
+func AddIP6CIDRToSet(family, tableName, setName, cidr string, verdict ...string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func DeleteIP6CIDRFromSet(family, tableName, setName, cidr string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
+func GetIP6CIDRFromSet(family, tableName, setName, cidr string) error {
+	return fmt.Errorf("nftables not supported on macOS")
+}
+
 // Route operations
 func getRouteInterface(IP string) string {
 	// Stub implementation for macOS
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/publicsuffix"
+)
+
+/*
+Device behavior baselines.
+
+A baseline per device is learned from the traffic insights buckets of the
+last LearningDays: the countries, ASNs and registered domains it talks to,
+its mean hourly volume and the hours of the day it is active in. The
+current hour is compared against it every minute and deviations are
+published on anomaly:<kind>. Baselines are limited to the traffic insights
+retention.
+*/
+
+var DeviceBaselinesConfigPath = TEST_PREFIX + "/configs/base/device_baselines.json"
+
+const gMaxRecentAnomalies = 256
+const gAnomalyRepeat = 24 * time.Hour
+
+var AnomalyKinds = []string{
+	"new_country",
+	"new_asn",
+	"new_domain",
+	"volume_out",
+	"volume_in",
+	"unusual_hour",
+}
+
+type DeviceBaselinesConfig struct {
+	Enabled         bool
+	LearningDays    int
+	MinHistoryHours int     //devices with less history are still learning
+	VolumeFactor    float64 //multiple of the mean hourly volume
+	MinVolumeBytes  uint64  //smaller hourly volumes are never anomalous
+	IgnoreKinds     []string
+}
+
+type DeviceBaseline struct {
+	IP             string
+	Since          time.Time
+	ActiveHours    int
+	HourOfDay      [24]int //active hours per local hour of the day
+	Countries      map[string]uint64
+	ASNs           map[int]uint64
+	Domains        map[string]uint64
+	HourlyBytesIn  uint64
+	HourlyBytesOut uint64
+}
+
+type DeviceAnomaly struct {
+	Time     time.Time
+	Kind     string
+	IP       string
+	MAC      string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	Remote   string `json:",omitempty"`
+	Country  string `json:",omitempty"`
+	ASN      int    `json:",omitempty"`
+	ASNName  string `json:",omitempty"`
+	Domain   string `json:",omitempty"`
+	Bytes    uint64 `json:",omitempty"`
+	Baseline uint64 `json:",omitempty"`
+	Hour     int
+}
+
+var gBaselinesMtx sync.Mutex
+var gBaselinesConfig = DeviceBaselinesConfig{LearningDays: 7, MinHistoryHours: 72, VolumeFactor: 10, MinVolumeBytes: 10 * 1024 * 1024}
+var gBaselines = map[string]*DeviceBaseline{}
+var gBaselinesHour time.Time
+var gAnomaliesSeen = map[string]time.Time{}
+var gAnomalies = []DeviceAnomaly{}
+
+func validateDeviceBaselinesConfig(config *DeviceBaselinesConfig) error {
+	if config.LearningDays == 0 {
+		config.LearningDays = 7
+	}
+	if config.MinHistoryHours == 0 {
+		config.MinHistoryHours = 72
+	}
+	if config.VolumeFactor == 0 {
+		config.VolumeFactor = 10
+	}
+
+	if config.LearningDays < 1 || config.LearningDays > 90 {
+		return fmt.Errorf("LearningDays must be 1-90")
+	}
+	if config.MinHistoryHours < 1 || config.MinHistoryHours > config.LearningDays*24 {
+		return fmt.Errorf("MinHistoryHours must be between 1 and the learning window")
+	}
+	if config.VolumeFactor < 2 {
+		return fmt.Errorf("VolumeFactor must be at least 2")
+	}
+	for _, kind := range config.IgnoreKinds {
+		if !slices.Contains(AnomalyKinds, kind) {
+			return fmt.Errorf("unknown anomaly kind %q", kind)
+		}
+	}
+	return nil
+}
+
+func loadDeviceBaselinesConfig() {
+	data, err := os.ReadFile(DeviceBaselinesConfigPath)
+	if err != nil {
+		return
+	}
+	config := DeviceBaselinesConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		fmt.Println("[device_baselines] invalid config:", err)
+		return
+	}
+	if err := validateDeviceBaselinesConfig(&config); err != nil {
+		fmt.Println("[device_baselines] invalid config:", err)
+		return
+	}
+	gBaselinesMtx.Lock()
+	gBaselinesConfig = config
+	gBaselinesMtx.Unlock()
+}
+
+// registeredDomain reduces a name to the domain below its public suffix
+func registeredDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return ""
+	}
+	registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return registered
+}
+
+// buildDeviceBaselines learns baselines from the buckets starting in [since, before)
+func buildDeviceBaselines(buckets []*insightBucket, since time.Time, before time.Time) map[string]*DeviceBaseline {
+	baselines := map[string]*DeviceBaseline{}
+	totals := map[string][2]uint64{}
+
+	for _, bucket := range buckets {
+		if bucket.Start.Before(since) || !bucket.Start.Before(before) {
+			continue
+		}
+		hour := bucket.Start.Local().Hour()
+
+		for device, devStats := range bucket.Devices {
+			if len(devStats) == 0 {
+				continue
+			}
+			baseline, exists := baselines[device]
+			if !exists {
+				baseline = &DeviceBaseline{
+					IP:        device,
+					Since:     bucket.Start,
+					Countries: map[string]uint64{},
+					ASNs:      map[int]uint64{},
+					Domains:   map[string]uint64{},
+				}
+				baselines[device] = baseline
+			}
+			if bucket.Start.Before(baseline.Since) {
+				baseline.Since = bucket.Start
+			}
+			baseline.ActiveHours++
+			baseline.HourOfDay[hour]++
+
+			total := totals[device]
+			for remote, stat := range devStats {
+				bytes := stat.BytesIn + stat.BytesOut
+				total[0] += stat.BytesIn
+				total[1] += stat.BytesOut
+				if remote == gInsightOtherKey {
+					continue
+				}
+				if stat.Country != "" {
+					baseline.Countries[stat.Country] += bytes
+				}
+				if stat.ASN != 0 {
+					baseline.ASNs[stat.ASN] += bytes
+				}
+				if domain := registeredDomain(stat.Domain); domain != "" {
+					baseline.Domains[domain] += bytes
+				}
+			}
+			totals[device] = total
+		}
+	}
+
+	for device, baseline := range baselines {
+		total := totals[device]
+		baseline.HourlyBytesIn = total[0] / uint64(baseline.ActiveHours)
+		baseline.HourlyBytesOut = total[1] / uint64(baseline.ActiveHours)
+	}
+
+	return baselines
+}
+
+// detectAnomalies compares the traffic of a device in the current hour with its baseline
+func detectAnomalies(config DeviceBaselinesConfig, baseline *DeviceBaseline, current map[string]InsightDstStat, now time.Time) []DeviceAnomaly {
+	if baseline == nil || now.Sub(baseline.Since) < time.Duration(config.MinHistoryHours)*time.Hour {
+		return nil
+	}
+
+	hour := now.Local().Hour()
+	anomalies := []DeviceAnomaly{}
+	newAnomaly := func(kind string) DeviceAnomaly {
+		return DeviceAnomaly{Time: now.UTC(), Kind: kind, IP: baseline.IP, Hour: hour}
+	}
+
+	bytesIn, bytesOut := uint64(0), uint64(0)
+	for remote, stat := range current {
+		bytesIn += stat.BytesIn
+		bytesOut += stat.BytesOut
+		if remote == gInsightOtherKey {
+			continue
+		}
+
+		kind := ""
+		domain := registeredDomain(stat.Domain)
+		if _, exists := baseline.Countries[stat.Country]; stat.Country != "" && !exists {
+			kind = "new_country"
+		} else if _, exists := baseline.ASNs[stat.ASN]; stat.ASN != 0 && !exists {
+			kind = "new_asn"
+		} else if _, exists := baseline.Domains[domain]; domain != "" && !exists {
+			kind = "new_domain"
+		}
+		if kind == "" {
+			continue
+		}
+
+		anomaly := newAnomaly(kind)
+		anomaly.Remote = remote
+		anomaly.Country = stat.Country
+		anomaly.ASN = stat.ASN
+		anomaly.ASNName = stat.ASNName
+		anomaly.Domain = stat.Domain
+		anomaly.Bytes = stat.BytesIn + stat.BytesOut
+		anomalies = append(anomalies, anomaly)
+	}
+
+	volumeAnomaly := func(kind string, bytes uint64, usual uint64) {
+		if bytes < config.MinVolumeBytes || float64(bytes) <= config.VolumeFactor*float64(usual) {
+			return
+		}
+		anomaly := newAnomaly(kind)
+		anomaly.Bytes = bytes
+		anomaly.Baseline = usual
+		anomalies = append(anomalies, anomaly)
+	}
+	volumeAnomaly("volume_out", bytesOut, baseline.HourlyBytesOut)
+	volumeAnomaly("volume_in", bytesIn, baseline.HourlyBytesIn)
+
+	if baseline.HourOfDay[hour] == 0 && bytesIn+bytesOut > 0 {
+		anomaly := newAnomaly("unusual_hour")
+		anomaly.Bytes = bytesIn + bytesOut
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return anomalies
+}
+
+func anomalyKey(anomaly DeviceAnomaly) string {
+	key := anomaly.IP + "|" + anomaly.Kind
+	switch anomaly.Kind {
+	case "new_country":
+		key += "|" + anomaly.Country
+	case "new_asn":
+		key += "|" + strconv.Itoa(anomaly.ASN)
+	case "new_domain":
+		key += "|" + registeredDomain(anomaly.Domain)
+	}
+	return key
+}
+
+// currentInsightStats copies the stats of the current hour bucket
+func currentInsightStats(now time.Time) map[string]map[string]InsightDstStat {
+	start := now.UTC().Truncate(time.Hour)
+	current := map[string]map[string]InsightDstStat{}
+
+	gInsightsMtx.Lock()
+	defer gInsightsMtx.Unlock()
+
+	if len(gInsightBuckets) == 0 || !gInsightBuckets[len(gInsightBuckets)-1].Start.Equal(start) {
+		return current
+	}
+	for device, devStats := range gInsightBuckets[len(gInsightBuckets)-1].Devices {
+		stats := map[string]InsightDstStat{}
+		for remote, stat := range devStats {
+			stats[remote] = *stat
+		}
+		current[device] = stats
+	}
+	return current
+}
+
+func lookupDeviceByIP(devices map[string]DeviceEntry, ip string) (DeviceEntry, bool) {
+	for _, device := range devices {
+		if device.RecentIP == ip {
+			return device, true
+		}
+	}
+	return DeviceEntry{}, false
+}
+
+func checkDeviceBaselines() {
+	gBaselinesMtx.Lock()
+	config := gBaselinesConfig
+	rebuild := !gBaselinesHour.Equal(time.Now().UTC().Truncate(time.Hour))
+	gBaselinesMtx.Unlock()
+	if !config.Enabled {
+		return
+	}
+
+	now := time.Now()
+	hourStart := now.UTC().Truncate(time.Hour)
+
+	if rebuild {
+		since := hourStart.Add(-time.Duration(config.LearningDays) * 24 * time.Hour)
+		gInsightsMtx.Lock()
+		baselines := buildDeviceBaselines(gInsightBuckets, since, hourStart)
+		gInsightsMtx.Unlock()
+
+		gBaselinesMtx.Lock()
+		gBaselines = baselines
+		gBaselinesHour = hourStart
+		gBaselinesMtx.Unlock()
+	}
+
+	current := currentInsightStats(now)
+
+	found := []DeviceAnomaly{}
+	gBaselinesMtx.Lock()
+	if len(gAnomaliesSeen) > 65536 {
+		gAnomaliesSeen = map[string]time.Time{}
+	}
+	for device, stats := range current {
+		for _, anomaly := range detectAnomalies(config, gBaselines[device], stats, now) {
+			if slices.Contains(config.IgnoreKinds, anomaly.Kind) {
+				continue
+			}
+			key := anomalyKey(anomaly)
+			if last, exists := gAnomaliesSeen[key]; exists && now.Sub(last) < gAnomalyRepeat {
+				continue
+			}
+			gAnomaliesSeen[key] = now
+			found = append(found, anomaly)
+		}
+	}
+	gBaselinesMtx.Unlock()
+
+	if len(found) == 0 {
+		return
+	}
+
+	Devicesmtx.Lock()
+	devices := getDevicesJson()
+	Devicesmtx.Unlock()
+
+	for i := range found {
+		if device, exists := lookupDeviceByIP(devices, found[i].IP); exists {
+			found[i].MAC = device.MAC
+			found[i].Name = device.Name
+		}
+		SprbusPublish("anomaly:"+found[i].Kind, found[i])
+	}
+
+	gBaselinesMtx.Lock()
+	gAnomalies = append(gAnomalies, found...)
+	if len(gAnomalies) > gMaxRecentAnomalies {
+		gAnomalies = gAnomalies[len(gAnomalies)-gMaxRecentAnomalies:]
+	}
+	gBaselinesMtx.Unlock()
+}
+
+func initDeviceBaselines() {
+	loadDeviceBaselinesConfig()
+}
+
+func deviceBaselinesConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		config := DeviceBaselinesConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := validateDeviceBaselinesConfig(&config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := saveFileJSON(DeviceBaselinesConfigPath, config); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		gBaselinesMtx.Lock()
+		gBaselinesConfig = config
+		gBaselinesHour = time.Time{}
+		gBaselinesMtx.Unlock()
+	}
+
+	gBaselinesMtx.Lock()
+	config := gBaselinesConfig
+	gBaselinesMtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func deviceBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid ip", 400)
+		return
+	}
+
+	gBaselinesMtx.Lock()
+	baseline, exists := gBaselines[ip]
+	var result DeviceBaseline
+	if exists {
+		result = *baseline
+	}
+	gBaselinesMtx.Unlock()
+
+	if !exists {
+		http.Error(w, "no baseline for device", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func deviceAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	gBaselinesMtx.Lock()
+	anomalies := append([]DeviceAnomaly{}, gAnomalies...)
+	gBaselinesMtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomalies)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testBaselineBuckets(start time.Time, hours int) []*insightBucket {
+	buckets := []*insightBucket{}
+	for i := 0; i < hours; i++ {
+		buckets = append(buckets, &insightBucket{
+			Start: start.Add(time.Duration(i) * time.Hour),
+			Devices: map[string]map[string]*InsightDstStat{
+				"192.168.2.10": {
+					"1.2.3.4": {BytesIn: 2000, BytesOut: 1000, ASN: 100, Country: "US", Domain: "api.thermostat.example.com"},
+				},
+			},
+		})
+	}
+	return buckets
+}
+
+func TestBuildDeviceBaselines(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Hour).Add(-96 * time.Hour)
+	buckets := testBaselineBuckets(start, 96)
+
+	baselines := buildDeviceBaselines(buckets, start.Add(24*time.Hour), start.Add(96*time.Hour))
+	baseline, exists := baselines["192.168.2.10"]
+	if !exists {
+		t.Fatalf("missing baseline")
+	}
+	if baseline.ActiveHours != 72 || !baseline.Since.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("unexpected window %d %v", baseline.ActiveHours, baseline.Since)
+	}
+	if baseline.HourlyBytesIn != 2000 || baseline.HourlyBytesOut != 1000 {
+		t.Errorf("unexpected volume %d %d", baseline.HourlyBytesIn, baseline.HourlyBytesOut)
+	}
+	if _, exists := baseline.Domains["example.com"]; !exists {
+		t.Errorf("domain not reduced to registered domain %v", baseline.Domains)
+	}
+	for hour, count := range baseline.HourOfDay {
+		if count != 3 {
+			t.Errorf("hour %d active %d times", hour, count)
+		}
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	now := time.Now()
+	config := DeviceBaselinesConfig{LearningDays: 7, MinHistoryHours: 72, VolumeFactor: 10, MinVolumeBytes: 10000}
+	start := now.UTC().Truncate(time.Hour).Add(-96 * time.Hour)
+	baseline := buildDeviceBaselines(testBaselineBuckets(start, 96), start, now.UTC().Truncate(time.Hour))["192.168.2.10"]
+
+	usual := map[string]InsightDstStat{
+		"1.2.3.5": {BytesIn: 1000, BytesOut: 500, ASN: 100, Country: "US", Domain: "cdn.example.com"},
+	}
+	if anomalies := detectAnomalies(config, baseline, usual, now); len(anomalies) != 0 {
+		t.Errorf("unexpected anomalies %+v", anomalies)
+	}
+
+	changed := map[string]InsightDstStat{
+		"5.6.7.8":  {BytesOut: 50000, ASN: 200, Country: "RU", Domain: "upload.other.net"},
+		"1.2.3.6":  {BytesIn: 10, ASN: 101, Country: "US"},
+		"1.2.3.7":  {BytesIn: 10, ASN: 100, Country: "US", Domain: "new.example.org"},
+		"other":    {BytesIn: 10, Country: "CN"},
+		"10.0.0.1": {BytesIn: 10},
+	}
+	kinds := map[string]int{}
+	for _, anomaly := range detectAnomalies(config, baseline, changed, now) {
+		kinds[anomaly.Kind]++
+	}
+	for _, kind := range []string{"new_country", "new_asn", "new_domain", "volume_out"} {
+		if kinds[kind] != 1 {
+			t.Errorf("expected one %s anomaly, got %v", kind, kinds)
+		}
+	}
+	if kinds["volume_in"] != 0 || kinds["unusual_hour"] != 0 {
+		t.Errorf("unexpected anomalies %v", kinds)
+	}
+
+	baseline.HourOfDay[now.Local().Hour()] = 0
+	if anomalies := detectAnomalies(config, baseline, usual, now); len(anomalies) != 1 || anomalies[0].Kind != "unusual_hour" {
+		t.Errorf("expected an unusual_hour anomaly, got %+v", anomalies)
+	}
+
+	//still learning
+	baseline.Since = now.Add(-time.Hour)
+	if anomalies := detectAnomalies(config, baseline, changed, now); len(anomalies) != 0 {
+		t.Errorf("no anomalies expected while learning")
+	}
+}
+
+func TestValidateDeviceBaselinesConfig(t *testing.T) {
+	config := DeviceBaselinesConfig{}
+	if err := validateDeviceBaselinesConfig(&config); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if config.LearningDays != 7 || config.MinHistoryHours != 72 || config.VolumeFactor != 10 {
+		t.Errorf("defaults not applied %+v", config)
+	}
+
+	invalid := []DeviceBaselinesConfig{
+		{LearningDays: 120},
+		{LearningDays: 1, MinHistoryHours: 48},
+		{VolumeFactor: 1.5},
+		{IgnoreKinds: []string{"bogus"}},
+	}
+	for _, entry := range invalid {
+		if err := validateDeviceBaselinesConfig(&entry); err == nil {
+			t.Errorf("expected an error for %+v", entry)
+		}
+	}
+}
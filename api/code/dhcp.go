@@ -4,7 +4,8 @@ CoreDHCP runs the low level DHCP protocol
 # The API generates and manages IP address space
 
 CoreDHCP's tiny_subnets plugins makes upcalls via a unix socket
-into these APIs
+into these APIs, and the spr_options plugin fetches the extra options
+of a lease
 
 wireguardUpdate has also been placed into here since it has to do with device
 IP management
@@ -12,6 +13,7 @@ IP management
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -26,21 +28,68 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 var gDHCPConfigPath = TEST_PREFIX + "/configs/base/dhcp.json"
 var gLANIPPath = TEST_PREFIX + "/configs/base/lanip"
+var gDHCPLeasesPath = TEST_PREFIX + "/state/api/dhcp_leases.json"
 var gDhcpConfig = DHCPConfig{}
+var gDHCPLeases = map[string]DHCPLease{}
 
 type DHCPConfig struct {
 	//subnet pool
 	TinyNets  []string
 	LeaseTime string
 
-	//do we want to maintain client mappings here now? -> lookup into devices and back
-	//devices has RecentIP.
+	//dual stack. each tiny net /30 maps to a /64 inside of IPv6Prefix,
+	//a unique local /48 is generated when enabled without a prefix
+	IPv6Enabled bool   `json:",omitempty"`
+	IPv6Prefix  string `json:",omitempty"`
+
+	//pinned device addresses, never handed to another device
+	Reservations []DHCPReservation `json:",omitempty"`
+
+	//extra options, by interface name and by group name.
+	//a device gets the options of its interface, then of its groups
+	InterfaceOptions map[string]DHCPOptions `json:",omitempty"`
+	GroupOptions     map[string]DHCPOptions `json:",omitempty"`
+}
+
+type DHCPReservation struct {
+	MAC string
+	IP  string
+}
+
+type DHCPRoute struct {
+	Destination string
+	Router      string `json:",omitempty"` //defaults to the device router
+}
+
+type DHCPOptions struct {
+	NTPServers   []string    `json:",omitempty"` //option 42
+	DomainSearch []string    `json:",omitempty"` //option 119
+	Routes       []DHCPRoute `json:",omitempty"` //option 121
+	NextServer   string      `json:",omitempty"` //siaddr, for PXE
+	BootFile     string      `json:",omitempty"` //option 67
+}
+
+// DHCPWireOption is an option encoded for the dhcp server to copy
+// into its reply
+type DHCPWireOption struct {
+	Code  uint8
+	Value []byte
+}
 
-	// additional dhcp options?
+type DHCPLease struct {
+	MAC      string
+	IP       string
+	Name     string
+	Iface    string
+	Start    time.Time
+	Expiry   time.Time
+	Reserved bool
 }
 
 type DHCPRequest struct {
@@ -63,6 +112,9 @@ type DHCPResponse struct {
 	RouterIP   string
 	DNSIP      string
 	LeaseTime  string
+
+	NextServer string           `json:",omitempty"`
+	Options    []DHCPWireOption `json:",omitempty"`
 }
 
 type DHCPFail struct {
@@ -138,6 +190,7 @@ func initDHCP() {
 	DHCPmtx.Lock()
 	defer DHCPmtx.Unlock()
 	loadDHCPConfig()
+	loadDHCPLeases()
 }
 
 func migrateDHCP() {
@@ -170,6 +223,7 @@ func loadDHCPConfig() {
 	}
 	updateFirewallSubnets(getLANIP(), gDhcpConfig.TinyNets)
 	updateLanIPs(gDhcpConfig.TinyNets)
+	updateIPv6Plan(gDhcpConfig)
 }
 
 func loadWithLockingDHCPConfig() DHCPConfig {
@@ -194,6 +248,7 @@ func saveDHCPConfig() {
 
 	updateFirewallSubnets(lanIP, gDhcpConfig.TinyNets)
 	updateLanIPs(gDhcpConfig.TinyNets)
+	updateIPv6Plan(gDhcpConfig)
 }
 
 func getSetDhcpConfig(w http.ResponseWriter, r *http.Request) {
@@ -255,12 +310,393 @@ func getSetDhcpConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//keep reservations and options when a client does not send them
+	if conf.Reservations == nil {
+		conf.Reservations = gDhcpConfig.Reservations
+	}
+	if conf.InterfaceOptions == nil {
+		conf.InterfaceOptions = gDhcpConfig.InterfaceOptions
+	}
+	if conf.GroupOptions == nil {
+		conf.GroupOptions = gDhcpConfig.GroupOptions
+	}
+
+	err = validateDHCPReservations(conf.Reservations, conf.TinyNets)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = dhcpReservationConflict(conf.Reservations, gDhcpConfig.Reservations, readDevicesSnapshot(), gDHCPLeases, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+
+	for iface, options := range conf.InterfaceOptions {
+		if !isValidIface(iface) {
+			http.Error(w, "Invalid interface in InterfaceOptions: "+iface, 400)
+			return
+		}
+		err = validateDHCPOptions(options)
+		if err != nil {
+			http.Error(w, "Invalid options for "+iface+": "+err.Error(), 400)
+			return
+		}
+	}
+
+	for group, options := range conf.GroupOptions {
+		if group == "" || strings.TrimSpace(group) != group {
+			http.Error(w, "Invalid group in GroupOptions", 400)
+			return
+		}
+		err = validateDHCPOptions(options)
+		if err != nil {
+			http.Error(w, "Invalid options for "+group+": "+err.Error(), 400)
+			return
+		}
+	}
+
+	if conf.IPv6Prefix != "" {
+		err = validateIPv6Prefix(conf.IPv6Prefix)
+		if err != nil {
+			http.Error(w, "Invalid IPv6Prefix: "+err.Error(), 400)
+			return
+		}
+	} else if conf.IPv6Enabled {
+		//keep the existing prefix, otherwise pick a unique local one
+		if gDhcpConfig.IPv6Prefix != "" {
+			conf.IPv6Prefix = gDhcpConfig.IPv6Prefix
+		} else {
+			conf.IPv6Prefix, err = genULAPrefix()
+			if err != nil {
+				http.Error(w, "Failed to generate IPv6 prefix", 400)
+				return
+			}
+		}
+	}
+
 	gDhcpConfig = conf
 	saveDHCPConfig()
 
 	json.NewEncoder(w).Encode(conf)
 }
 
+var dhcpDomainRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+func isIPv4(IP string) bool {
+	ip := net.ParseIP(IP)
+	return ip != nil && ip.To4() != nil
+}
+
+// validateDHCPReservations normalizes the MACs, and checks that every
+// address is a device address inside of the tiny nets
+func validateDHCPReservations(reservations []DHCPReservation, tinyNets []string) error {
+	macs := map[string]bool{}
+	ips := map[string]bool{}
+	for i, reservation := range reservations {
+		if !isValidMAC(reservation.MAC) {
+			return fmt.Errorf("Invalid reservation MAC %s", reservation.MAC)
+		}
+		mac := trimLower(reservation.MAC)
+		reservations[i].MAC = mac
+
+		if !isTinyNetDeviceIPIn(reservation.IP, tinyNets) {
+			return fmt.Errorf("Reservation %s is not a device address in TinyNets", reservation.IP)
+		}
+		if macs[mac] || ips[reservation.IP] {
+			return fmt.Errorf("Duplicate reservation for %s %s", mac, reservation.IP)
+		}
+		macs[mac] = true
+		ips[reservation.IP] = true
+	}
+	return nil
+}
+
+// dhcpReservationConflict rejects a new or changed reservation for an
+// address that another device still holds, by its device entry or an
+// active lease
+func dhcpReservationConflict(reservations []DHCPReservation, previous []DHCPReservation,
+	devices map[string]DeviceEntry, leases map[string]DHCPLease, now time.Time) error {
+	for _, reservation := range reservations {
+		if slices.Contains(previous, reservation) {
+			continue
+		}
+
+		for _, device := range devices {
+			if device.RecentIP == reservation.IP && !equalMAC(device.MAC, reservation.MAC) {
+				return fmt.Errorf("Reservation %s is in use by %s", reservation.IP, deviceIdentity(device))
+			}
+		}
+
+		for _, lease := range leases {
+			if lease.IP == reservation.IP && !equalMAC(lease.MAC, reservation.MAC) && now.Before(lease.Expiry) {
+				return fmt.Errorf("Reservation %s is leased to %s", reservation.IP, lease.MAC)
+			}
+		}
+	}
+	return nil
+}
+
+func validateDHCPOptions(options DHCPOptions) error {
+	for _, server := range options.NTPServers {
+		if !isIPv4(server) {
+			return fmt.Errorf("invalid NTP server %s", server)
+		}
+	}
+	for _, domain := range options.DomainSearch {
+		if len(domain) > 253 || !dhcpDomainRegex.MatchString(domain) {
+			return fmt.Errorf("invalid search domain %s", domain)
+		}
+	}
+	for _, route := range options.Routes {
+		_, dest, err := net.ParseCIDR(route.Destination)
+		if err != nil || dest.IP.To4() == nil || dest.String() != route.Destination {
+			return fmt.Errorf("invalid route destination %s", route.Destination)
+		}
+		if route.Router != "" && !isIPv4(route.Router) {
+			return fmt.Errorf("invalid route router %s", route.Router)
+		}
+	}
+	if options.NextServer != "" && !isIPv4(options.NextServer) {
+		return fmt.Errorf("invalid NextServer %s", options.NextServer)
+	}
+	//option 67 is a string, the bootp file field holds 128 bytes
+	if len(options.BootFile) > 127 || strings.ContainsAny(options.BootFile, " \t\r\n\x00") {
+		return fmt.Errorf("invalid BootFile")
+	}
+	//every list has to fit into a single option
+	for _, option := range encodeDHCPOptions(options, "0.0.0.0") {
+		if len(option.Value) > 255 {
+			return fmt.Errorf("option %d is too long", option.Code)
+		}
+	}
+	return nil
+}
+
+func mergeDHCPOptions(dst *DHCPOptions, src DHCPOptions) {
+	for _, server := range src.NTPServers {
+		if !slices.Contains(dst.NTPServers, server) {
+			dst.NTPServers = append(dst.NTPServers, server)
+		}
+	}
+	for _, domain := range src.DomainSearch {
+		if !slices.Contains(dst.DomainSearch, domain) {
+			dst.DomainSearch = append(dst.DomainSearch, domain)
+		}
+	}
+	for _, route := range src.Routes {
+		if !slices.Contains(dst.Routes, route) {
+			dst.Routes = append(dst.Routes, route)
+		}
+	}
+	if src.NextServer != "" {
+		dst.NextServer = src.NextServer
+	}
+	if src.BootFile != "" {
+		dst.BootFile = src.BootFile
+	}
+}
+
+// dhcpOptionsFor merges the options of an interface, or its parent for a vlan,
+// with those of the groups, in order. returns nil without options.
+func dhcpOptionsFor(conf DHCPConfig, Iface string, Router string, groups []string) *DHCPOptions {
+	merged := DHCPOptions{}
+	found := false
+
+	ifaces := []string{Iface}
+	if parent, _, isVlan := strings.Cut(Iface, "."); isVlan {
+		ifaces = []string{parent, Iface}
+	}
+	for _, name := range ifaces {
+		if options, exists := conf.InterfaceOptions[name]; exists {
+			mergeDHCPOptions(&merged, options)
+			found = true
+		}
+	}
+
+	for _, group := range groups {
+		if options, exists := conf.GroupOptions[group]; exists {
+			mergeDHCPOptions(&merged, options)
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	for i, route := range merged.Routes {
+		if route.Router == "" {
+			merged.Routes[i].Router = Router
+		}
+	}
+	return &merged
+}
+
+// encodeDHCPOptions packs the options in their wire format. router is the
+// default gateway of the device: a client that gets option 121 ignores
+// option 3, so the default route is added to the classless routes.
+func encodeDHCPOptions(options DHCPOptions, router string) []DHCPWireOption {
+	encoded := []DHCPWireOption{}
+
+	if len(options.NTPServers) > 0 {
+		value := []byte{}
+		for _, server := range options.NTPServers {
+			value = append(value, net.ParseIP(server).To4()...)
+		}
+		encoded = append(encoded, DHCPWireOption{Code: 42, Value: value})
+	}
+
+	if len(options.DomainSearch) > 0 {
+		//rfc 3397, uncompressed dns names
+		value := []byte{}
+		for _, domain := range options.DomainSearch {
+			for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+				value = append(value, byte(len(label)))
+				value = append(value, label...)
+			}
+			value = append(value, 0)
+		}
+		encoded = append(encoded, DHCPWireOption{Code: 119, Value: value})
+	}
+
+	if len(options.Routes) > 0 {
+		//rfc 3442, the prefix length then the significant octets
+		routes := append(slices.Clone(options.Routes), DHCPRoute{Destination: "0.0.0.0/0", Router: router})
+		value := []byte{}
+		for _, route := range routes {
+			_, dest, err := net.ParseCIDR(route.Destination)
+			if err != nil {
+				continue
+			}
+			ones, _ := dest.Mask.Size()
+			value = append(value, byte(ones))
+			value = append(value, dest.IP.To4()[:(ones+7)/8]...)
+			value = append(value, net.ParseIP(route.Router).To4()...)
+		}
+		encoded = append(encoded, DHCPWireOption{Code: 121, Value: value})
+	}
+
+	if options.BootFile != "" {
+		encoded = append(encoded, DHCPWireOption{Code: 67, Value: []byte(options.BootFile)})
+	}
+
+	return encoded
+}
+
+// setDHCPResponseOptions adds the options for a device to a response,
+// assumes DHCPmtx is held
+func setDHCPResponseOptions(response *DHCPResponse, Iface string, groups []string) {
+	options := dhcpOptionsFor(gDhcpConfig, Iface, response.RouterIP, groups)
+	if options == nil {
+		return
+	}
+	response.NextServer = options.NextServer
+	response.Options = encodeDHCPOptions(*options, response.RouterIP)
+}
+
+func dhcpReservationLocked(MAC string) string {
+	for _, reservation := range gDhcpConfig.Reservations {
+		if equalMAC(reservation.MAC, MAC) {
+			return reservation.IP
+		}
+	}
+	return ""
+}
+
+func dhcpReservedForOtherLocked(IP string, MAC string) bool {
+	for _, reservation := range gDhcpConfig.Reservations {
+		if reservation.IP == IP && !equalMAC(reservation.MAC, MAC) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadDHCPLeases() {
+	data, err := ioutil.ReadFile(gDHCPLeasesPath)
+	if err != nil {
+		return
+	}
+	leases := map[string]DHCPLease{}
+	if json.Unmarshal(data, &leases) == nil {
+		gDHCPLeases = leases
+	}
+}
+
+// recordDHCPLease tracks a lease handed out by dhcpRequest,
+// assumes DHCPmtx is held
+func recordDHCPLease(MAC string, IP string, Name string, Iface string, LeaseTime string) {
+	duration, err := time.ParseDuration(LeaseTime)
+	if err != nil {
+		log.Println("invalid lease time", LeaseTime, err)
+		return
+	}
+
+	now := time.Now()
+	for mac, lease := range gDHCPLeases {
+		if now.After(lease.Expiry) || (lease.IP == IP && mac != MAC) {
+			delete(gDHCPLeases, mac)
+		}
+	}
+
+	gDHCPLeases[MAC] = DHCPLease{
+		MAC:      MAC,
+		IP:       IP,
+		Name:     Name,
+		Iface:    Iface,
+		Start:    now,
+		Expiry:   now.Add(duration),
+		Reserved: dhcpReservationLocked(MAC) == IP,
+	}
+
+	if err := saveFileJSON(gDHCPLeasesPath, gDHCPLeases); err != nil {
+		log.Println("failed to save dhcp leases", err)
+	}
+}
+
+func getDHCPLeases(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	now := time.Now()
+	leases := []DHCPLease{}
+	for _, lease := range gDHCPLeases {
+		if now.Before(lease.Expiry) {
+			leases = append(leases, lease)
+		}
+	}
+	DHCPmtx.Unlock()
+
+	slices.SortFunc(leases, func(a, b DHCPLease) int {
+		return bytes.Compare(net.ParseIP(a.IP).To16(), net.ParseIP(b.IP).To16())
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leases)
+}
+
+// dhcpOptions returns the options of the active lease of a MAC. the
+// spr_options plugin of coredhcp adds them to its reply, since the
+// tiny_subnets plugin only applies the address, router and dns
+func dhcpOptions(w http.ResponseWriter, r *http.Request) {
+	MAC := trimLower(mux.Vars(r)["mac"])
+	devices := readDevicesSnapshot()
+
+	DHCPmtx.Lock()
+	lease, exists := gDHCPLeases[MAC]
+	if !exists || time.Now().After(lease.Expiry) {
+		DHCPmtx.Unlock()
+		http.Error(w, "no lease for "+MAC, 404)
+		return
+	}
+	response := DHCPResponse{Identifier: MAC, IP: lease.IP, RouterIP: RouterFromTinyIP(lease.IP), DNSIP: getLANIP(), LeaseTime: gDhcpConfig.LeaseTime}
+	setDHCPResponseOptions(&response, lease.Iface, devices[MAC].Groups)
+	DHCPmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func normalizeName(Name string) string {
 	re := regexp.MustCompile("[^a-zA-Z0-9]")
 	return trimLower(re.ReplaceAllString(Name, "-"))
@@ -430,7 +866,14 @@ func dhcpRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if exists && val.RecentIP != "" && isTinyNetIPLocked(val.RecentIP) {
+	reserved := dhcpReservationLocked(dhcp.MAC)
+
+	if reserved != "" && isTinyNetDeviceIPLocked(reserved) {
+		//conflicting holders are rejected when the reservation is saved
+		IP = reserved
+		Router = RouterFromTinyIP(IP)
+	} else if exists && val.RecentIP != "" && isTinyNetIPLocked(val.RecentIP) &&
+		!dhcpReservedForOtherLocked(val.RecentIP, dhcp.MAC) {
 		IP = val.RecentIP
 		Router = RouterFromTinyIP(IP)
 	} else {
@@ -451,8 +894,10 @@ func dhcpRequest(w http.ResponseWriter, r *http.Request) {
 	LeaseTime := gDhcpConfig.LeaseTime
 
 	handleDHCPResult(dhcp.MAC, IP, Router, dhcp.Name, dhcp.Iface)
+	recordDHCPLease(dhcp.MAC, IP, dhcp.Name, dhcp.Iface, LeaseTime)
 
-	response := DHCPResponse{dhcp.MAC, IP, Router, getLANIP(), LeaseTime}
+	response := DHCPResponse{Identifier: dhcp.MAC, IP: IP, RouterIP: Router, DNSIP: getLANIP(), LeaseTime: LeaseTime}
+	setDHCPResponseOptions(&response, dhcp.Iface, val.Groups)
 
 	SprbusPublish("dhcp:response", response)
 
@@ -513,6 +958,10 @@ func isTinyNetDeviceIP(IP string) bool {
 }
 
 func isTinyNetDeviceIPLocked(IP string) bool {
+	return isTinyNetDeviceIPIn(IP, gDhcpConfig.TinyNets)
+}
+
+func isTinyNetDeviceIPIn(IP string, tinyNets []string) bool {
 	//check if an IP belongs not just to a subnet,
 	//but that it would be a tinynet device IP
 	ip := net.ParseIP(IP)
@@ -520,7 +969,7 @@ func isTinyNetDeviceIPLocked(IP string) bool {
 		return false
 	}
 
-	for _, subnetString := range gDhcpConfig.TinyNets {
+	for _, subnetString := range tinyNets {
 		// check if theres free IPs in the range
 		_, subnet, err := net.ParseCIDR(subnetString)
 		if err != nil {
@@ -569,6 +1018,11 @@ func genNewDeviceIP(devices *map[string]DeviceEntry) (string, string) {
 		}
 	}
 
+	//reserved addresses are only for their device
+	for _, reservation := range gDhcpConfig.Reservations {
+		IPMap[reservation.IP] = reservation.MAC
+	}
+
 	/*
 	   Each tiny subnet is a /30 containing 4 addresses
 
@@ -666,7 +1120,7 @@ func abstractDhcpRequest(w http.ResponseWriter, r *http.Request) {
 		IP, Router = genNewDeviceIP(&devices)
 	}
 
-	response := DHCPResponse{req.Identifier, IP, Router, getLANIP(), gDhcpConfig.LeaseTime}
+	response := DHCPResponse{Identifier: req.Identifier, IP: IP, RouterIP: Router, DNSIP: getLANIP(), LeaseTime: gDhcpConfig.LeaseTime}
 	//return DHCPResponse now
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -679,6 +1133,7 @@ type WireguardUpdate struct {
 	PublicKey string
 	Iface     string
 	Name      string
+	Subnets   []string `json:",omitempty"`
 }
 
 func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
@@ -689,17 +1144,37 @@ func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tinyNets := loadWithLockingDHCPConfig().TinyNets
+	ifaceSubnets := interfaceSubnets()
+
 	Groupsmtx.Lock()
 	defer Groupsmtx.Unlock()
 
 	Devicesmtx.Lock()
 	defer Devicesmtx.Unlock()
 
-	SprbusPublish("wg:update", wg)
-
 	devices := getDevicesJson()
 	val, exists := lookupWGDevice(&devices, wg.PublicKey, wg.IP)
 
+	if r.Method != http.MethodDelete {
+		err = validateSiteSubnets(wg.Subnets, tinyNets, ifaceSubnets, devices, wg.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	SprbusPublish("wg:update", wg)
+
+	//routed subnets that were dropped or belonged to a removed peer
+	oldSubnets := []string{}
+	for _, subnet := range val.WGSubnets {
+		if r.Method == http.MethodDelete || !slices.Contains(wg.Subnets, subnet) {
+			oldSubnets = append(oldSubnets, subnet)
+		}
+	}
+	subnetsChanged := exists && (len(oldSubnets) > 0 || len(wg.Subnets) != len(val.WGSubnets))
+
 	if r.Method == http.MethodDelete {
 		//delete a device's public key
 		if exists {
@@ -709,6 +1184,7 @@ func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
 			} else {
 				//otherwise update the WGPubKey to be empty
 				val.WGPubKey = ""
+				val.WGSubnets = nil
 				devices[val.MAC] = val
 			}
 			//falls through to save
@@ -722,6 +1198,7 @@ func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
 			newDevice := DeviceEntry{}
 			newDevice.RecentIP = wg.IP
 			newDevice.WGPubKey = wg.PublicKey
+			newDevice.WGSubnets = wg.Subnets
 			newDevice.Groups = []string{}
 			newDevice.DeviceTags = []string{}
 			devices[newDevice.WGPubKey] = newDevice
@@ -729,6 +1206,7 @@ func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
 		} else {
 			//update recent IP
 			val.RecentIP = wg.IP
+			val.WGSubnets = wg.Subnets
 			//override WGPubKey
 			if val.WGPubKey != wg.PublicKey {
 				val.WGPubKey = wg.PublicKey
@@ -748,5 +1226,79 @@ func wireguardUpdate(w http.ResponseWriter, r *http.Request) {
 
 	saveDevicesJson(devices)
 
+	flushSiteSubnetVmaps(oldSubnets)
+	if subnetsChanged && r.Method != http.MethodDelete {
+		refreshDeviceGroupsAndPolicy(devices, getGroupsJson(), val)
+	}
+
 	refreshWireguardDevice(val.MAC, wg.IP, wg.PublicKey, wg.Iface, wg.Name, r.Method == http.MethodPut)
 }
+
+// sent by the wireguard plugin when a peer goes up or down
+type WireguardPeerEvent struct {
+	PublicKey       string
+	IP              string
+	Iface           string
+	Endpoint        string
+	Status          string
+	LatestHandshake int64
+}
+
+func wireguardPeerEvent(w http.ResponseWriter, r *http.Request) {
+	event := WireguardPeerEvent{}
+	err := json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if event.Status != "up" && event.Status != "down" {
+		http.Error(w, "invalid peer status", 400)
+		return
+	}
+
+	SprbusPublish("wireguard:peer:"+event.Status, event)
+}
+
+// wireguardExpire expires the device of a stale peer. Depending on its
+// DeleteExpiration setting the device is then disabled or deleted
+func wireguardExpire(w http.ResponseWriter, r *http.Request) {
+	wg := WireguardUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&wg)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	Groupsmtx.Lock()
+	defer Groupsmtx.Unlock()
+
+	Devicesmtx.Lock()
+	defer Devicesmtx.Unlock()
+
+	devices := getDevicesJson()
+	val, exists := lookupWGDevice(&devices, wg.PublicKey, wg.IP)
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	if val.DeviceDisabled {
+		return
+	}
+
+	//keep an earlier expiration
+	expiration := time.Now().Unix() - 1
+	if val.DeviceExpiration == 0 || val.DeviceExpiration > expiration {
+		val.DeviceExpiration = expiration
+	}
+
+	if val.MAC != "" {
+		devices[val.MAC] = val
+	} else {
+		devices[val.WGPubKey] = val
+	}
+
+	saveDevicesJson(devices)
+	checkDeviceExpiries(devices, getGroupsJson())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateDHCPReservations(t *testing.T) {
+	tinyNets := []string{"192.168.2.0/24"}
+
+	reservations := []DHCPReservation{{MAC: "AA:BB:CC:DD:EE:FF", IP: "192.168.2.10"}}
+	if err := validateDHCPReservations(reservations, tinyNets); err != nil {
+		t.Fatal(err)
+	}
+	if reservations[0].MAC != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("MAC was not normalized: %s", reservations[0].MAC)
+	}
+
+	invalid := [][]DHCPReservation{
+		{{MAC: "junk", IP: "192.168.2.10"}},
+		// routers and broadcast addresses are not device addresses
+		{{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.9"}},
+		{{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.0.2"}},
+		{{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.10"}, {MAC: "11:22:33:44:55:66", IP: "192.168.2.10"}},
+		{{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.10"}, {MAC: "AA:BB:CC:DD:EE:FF", IP: "192.168.2.14"}},
+	}
+	for _, r := range invalid {
+		if err := validateDHCPReservations(r, tinyNets); err == nil {
+			t.Errorf("expected an error for %+v", r)
+		}
+	}
+}
+
+func TestValidateDHCPOptions(t *testing.T) {
+	valid := DHCPOptions{
+		NTPServers:   []string{"192.168.2.1"},
+		DomainSearch: []string{"lan", "corp.example.com"},
+		Routes:       []DHCPRoute{{Destination: "10.10.0.0/16"}, {Destination: "172.16.0.0/12", Router: "192.168.2.1"}},
+		NextServer:   "192.168.2.50",
+		BootFile:     "pxelinux.0",
+	}
+	if err := validateDHCPOptions(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	tooMany := []string{}
+	for len(tooMany) < 64 {
+		tooMany = append(tooMany, "192.168.2.1")
+	}
+
+	invalid := []DHCPOptions{
+		{NTPServers: []string{"pool.ntp.org"}},
+		{NTPServers: tooMany},
+		{DomainSearch: []string{"bad domain"}},
+		{Routes: []DHCPRoute{{Destination: "10.10.0.1/16"}}},
+		{Routes: []DHCPRoute{{Destination: "fd00::/64"}}},
+		{NextServer: "fd00::1"},
+		{BootFile: "boot file"},
+	}
+	for _, options := range invalid {
+		if err := validateDHCPOptions(options); err == nil {
+			t.Errorf("expected an error for %+v", options)
+		}
+	}
+}
+
+func TestDHCPOptionsFor(t *testing.T) {
+	conf := DHCPConfig{
+		InterfaceOptions: map[string]DHCPOptions{
+			"wlan1": {NTPServers: []string{"192.168.2.1"}, Routes: []DHCPRoute{{Destination: "10.10.0.0/16"}}},
+		},
+		GroupOptions: map[string]DHCPOptions{
+			"pxe": {NTPServers: []string{"192.168.2.1", "192.168.2.2"}, NextServer: "192.168.2.50", BootFile: "pxelinux.0"},
+		},
+	}
+
+	if options := dhcpOptionsFor(conf, "eth0", "192.168.2.5", nil); options != nil {
+		t.Errorf("expected no options, got %+v", options)
+	}
+
+	// vlan interfaces inherit from their parent
+	options := dhcpOptionsFor(conf, "wlan1.4096", "192.168.2.5", []string{"pxe"})
+	want := &DHCPOptions{
+		NTPServers: []string{"192.168.2.1", "192.168.2.2"},
+		Routes:     []DHCPRoute{{Destination: "10.10.0.0/16", Router: "192.168.2.5"}},
+		NextServer: "192.168.2.50",
+		BootFile:   "pxelinux.0",
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %+v, want %+v", options, want)
+	}
+	// defaulting the router does not touch the config
+	if conf.InterfaceOptions["wlan1"].Routes[0].Router != "" {
+		t.Error("config routes were modified")
+	}
+}
+
+func TestEncodeDHCPOptions(t *testing.T) {
+	options := DHCPOptions{
+		NTPServers:   []string{"192.168.2.1", "10.0.0.1"},
+		DomainSearch: []string{"lan", "corp.example.com."},
+		Routes: []DHCPRoute{
+			{Destination: "10.10.0.0/16", Router: "192.168.2.5"},
+			{Destination: "172.16.0.0/12", Router: "192.168.2.1"},
+			{Destination: "192.168.50.128/25", Router: "192.168.2.5"},
+		},
+		NextServer: "192.168.2.50",
+		BootFile:   "pxelinux.0",
+	}
+
+	want := map[uint8]string{
+		42:  "c0a80201" + "0a000001",
+		119: "036c616e00" + "04636f7270076578616d706c6503636f6d00",
+		//the default route comes last, clients drop option 3 with option 121
+		121: "100a0a" + "c0a80205" + "0cac10" + "c0a80201" + "19c0a83280" + "c0a80205" + "00" + "c0a80205",
+		67:  hex.EncodeToString([]byte("pxelinux.0")),
+	}
+
+	encoded := encodeDHCPOptions(options, "192.168.2.5")
+	codes := []uint8{}
+	for _, option := range encoded {
+		codes = append(codes, option.Code)
+		if got := hex.EncodeToString(option.Value); got != want[option.Code] {
+			t.Errorf("option %d: got %s, want %s", option.Code, got, want[option.Code])
+		}
+	}
+	if !reflect.DeepEqual(codes, []uint8{42, 119, 121, 67}) {
+		t.Errorf("got options %v", codes)
+	}
+
+	if encoded := encodeDHCPOptions(DHCPOptions{NextServer: "192.168.2.50"}, "192.168.2.5"); len(encoded) != 0 {
+		t.Errorf("expected no options, got %+v", encoded)
+	}
+}
+
+func TestSetDHCPResponseOptions(t *testing.T) {
+	oldConfig := gDhcpConfig
+	t.Cleanup(func() { gDhcpConfig = oldConfig })
+
+	gDhcpConfig = DHCPConfig{
+		GroupOptions: map[string]DHCPOptions{
+			"pxe": {Routes: []DHCPRoute{{Destination: "10.10.0.0/16"}}, NextServer: "192.168.2.50"},
+		},
+	}
+
+	response := DHCPResponse{IP: "192.168.2.6", RouterIP: "192.168.2.5"}
+	setDHCPResponseOptions(&response, "eth0", []string{"pxe"})
+	want := []DHCPWireOption{{Code: 121, Value: []byte{16, 10, 10, 192, 168, 2, 5, 0, 192, 168, 2, 5}}}
+	if response.NextServer != "192.168.2.50" || !reflect.DeepEqual(response.Options, want) {
+		t.Errorf("got %+v", response)
+	}
+
+	response = DHCPResponse{IP: "192.168.2.10", RouterIP: "192.168.2.9"}
+	setDHCPResponseOptions(&response, "eth0", []string{"lan"})
+	if response.NextServer != "" || response.Options != nil {
+		t.Errorf("got options without a matching group %+v", response)
+	}
+}
+
+func TestDHCPReservationConflict(t *testing.T) {
+	now := time.Now()
+	devices := map[string]DeviceEntry{
+		"11:22:33:44:55:66": {MAC: "11:22:33:44:55:66", RecentIP: "192.168.2.10"},
+		"aa:bb:cc:dd:ee:ff": {MAC: "aa:bb:cc:dd:ee:ff", RecentIP: "192.168.2.14"},
+	}
+	leases := map[string]DHCPLease{
+		"22:22:22:22:22:22": {MAC: "22:22:22:22:22:22", IP: "192.168.2.18", Expiry: now.Add(time.Hour)},
+		"33:33:33:33:33:33": {MAC: "33:33:33:33:33:33", IP: "192.168.2.22", Expiry: now.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		reservation DHCPReservation
+		conflict    bool
+	}{
+		{DHCPReservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.10"}, true},
+		{DHCPReservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.14"}, false},
+		{DHCPReservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.18"}, true},
+		//expired leases and the holder itself do not conflict
+		{DHCPReservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.22"}, false},
+		{DHCPReservation{MAC: "22:22:22:22:22:22", IP: "192.168.2.18"}, false},
+	}
+	for _, tt := range tests {
+		err := dhcpReservationConflict([]DHCPReservation{tt.reservation}, nil, devices, leases, now)
+		if (err != nil) != tt.conflict {
+			t.Errorf("%+v: got %v, want conflict %v", tt.reservation, err, tt.conflict)
+		}
+	}
+
+	//reservations saved before are not checked again
+	saved := []DHCPReservation{{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.10"}}
+	if err := dhcpReservationConflict(saved, saved, devices, leases, now); err != nil {
+		t.Errorf("unchanged reservation was rejected: %v", err)
+	}
+}
+
+func TestGenNewDeviceIPSkipsReservations(t *testing.T) {
+	oldConfig := gDhcpConfig
+	oldSetupDonePath := SetupDonePath
+	t.Cleanup(func() {
+		gDhcpConfig = oldConfig
+		SetupDonePath = oldSetupDonePath
+	})
+
+	// not in setup mode
+	SetupDonePath = t.TempDir()
+
+	gDhcpConfig = DHCPConfig{
+		TinyNets:     []string{"192.168.2.0/28"},
+		Reservations: []DHCPReservation{{MAC: "aa:bb:cc:dd:ee:ff", IP: "192.168.2.6"}},
+	}
+
+	devices := map[string]DeviceEntry{
+		"11:22:33:44:55:66": {MAC: "11:22:33:44:55:66", RecentIP: "192.168.2.2"},
+	}
+
+	IP, Router := genNewDeviceIP(&devices)
+	if IP != "192.168.2.10" || Router != "192.168.2.9" {
+		t.Errorf("expected the reserved address to be skipped, got %s %s", IP, Router)
+	}
+
+	gDhcpConfig.Reservations = nil
+	if IP, _ = genNewDeviceIP(&devices); IP != "192.168.2.6" {
+		t.Errorf("expected 192.168.2.6 without a reservation, got %s", IP)
+	}
+}
@@ -29,6 +29,7 @@ type BaseRule struct {
 	RuleName    string
 	Description string
 	Disabled    bool
+	Schedules   []TimeWindow `json:",omitempty"` //when set, the rule is only active inside these windows
 }
 
 type ForwardingRule struct {
@@ -520,7 +521,7 @@ func updateOutboundRoutes() {
 		case <-ticker.C:
 			Interfacesmtx.Lock()
 			outbound := collectOutbound()
-			setMainUplinkRoute(outbound)
+			setMainUplinkRoute(balancedOutbound(outbound, loadUplinksConfig()))
 			Interfacesmtx.Unlock()
 
 			FWmtx.Lock()
@@ -581,6 +582,7 @@ func rebuildUplink() {
 	if len(outbound) < 2 {
 		//dont need more, outbound will work as is
 
+		applyUplinkPins([]string{}, UplinksConfig{})
 		setMainUplinkRoute(outbound)
 		return
 	}
@@ -596,7 +598,24 @@ func rebuildUplink() {
 	//saddr-only can be more consistent but has poor balancing
 	saddrOnly := uplinkSettings.LoadBalanceStrategy == "saddr"
 
-	err = AddOutboundUplinkHashRule("inet", "mangle", "OUTBOUND_UPLINK", saddrOnly, len(outbound), firstOutboundRouteTable)
+	//pinned devices skip the balancing below
+	err = AddOutboundUplinkPinRule("inet", "mangle", "OUTBOUND_UPLINK")
+	if err != nil {
+		log.Println("failed to insert outbound uplink pin rule", err)
+		return
+	}
+
+	balanced := balancedOutbound(outbound, uplinkSettings)
+	slots := uplinkWeightSlots(outbound, balanced, uplinkSettings)
+
+	if slots == nil {
+		err = AddOutboundUplinkHashRule("inet", "mangle", "OUTBOUND_UPLINK", saddrOnly, len(outbound), firstOutboundRouteTable)
+	} else {
+		err = SetUplinkWeights("inet", "mangle", slots)
+		if err == nil {
+			err = AddOutboundUplinkWeightedRule("inet", "mangle", "OUTBOUND_UPLINK", saddrOnly, len(slots))
+		}
+	}
 	if err != nil {
 		log.Println("failed to insert outbound uplink rule", err)
 		return
@@ -645,7 +664,9 @@ func rebuildUplink() {
 
 	}
 
-	setMainUplinkRoute(outbound)
+	applyUplinkPins(outbound, uplinkSettings)
+
+	setMainUplinkRoute(balanced)
 
 	// Flush the route cache to ensure the new route is used immediately.
 	err = exec.Command("ip", "route", "flush", "cache").Run()
@@ -829,6 +850,11 @@ func modifyCustomInterfaceRulesImpl(crule CustomInterfaceRule, doDelete bool) er
 		return fmt.Errorf("Invalid Interface")
 	}
 
+	err := normalizeRuleSchedules(&crule.BaseRule)
+	if err != nil {
+		return err
+	}
+
 	crule.Groups = normalizeStringSlice(crule.Groups)
 	crule.Policies = normalizeStringSlice(crule.Policies)
 	//tags not used for anything yet
@@ -849,10 +875,11 @@ func modifyCustomInterfaceRulesImpl(crule CustomInterfaceRule, doDelete bool) er
 	if doDelete {
 		for i := range gFirewallConfig.CustomInterfaceRules {
 			a := gFirewallConfig.CustomInterfaceRules[i]
-			if crule.Equals(&a) {
+			match, other := withoutSchedules(crule), withoutSchedules(a)
+			if match.Equals(&other) {
 				gFirewallConfig.CustomInterfaceRules = append(gFirewallConfig.CustomInterfaceRules[:i], gFirewallConfig.CustomInterfaceRules[i+1:]...)
 				saveFirewallRulesLocked()
-				err := applyCustomInterfaceRule(gFirewallConfig.CustomInterfaceRules, a, "delete", true)
+				err := applyCustomInterfaceRule(activeCustomInterfaceRulesLocked(), a, "delete", true)
 				if err != nil {
 					return err
 				}
@@ -911,6 +938,10 @@ func applyForwarding(forwarding []ForwardingRule) error {
 	//need to flush the fwd rules here ?
 
 	for _, f := range forwarding {
+		if !scheduledRuleActive("ForwardingRules", f, f.BaseRule) {
+			continue
+		}
+
 		err := AddForwardingRule(f.Protocol, f.SrcIP, f.SrcPort, f.DstIP, f.DstPort)
 		if err != nil {
 			log.Println("failed to add forwarding rule", err)
@@ -923,6 +954,10 @@ func applyForwarding(forwarding []ForwardingRule) error {
 
 func applyBlocking(blockRules []BlockRule) error {
 	for _, br := range blockRules {
+		if !scheduledRuleActive("BlockRules", br, br.BaseRule) {
+			continue
+		}
+
 		err := AddBlockRule(br.SrcIP, br.DstIP, br.Protocol)
 		if err != nil {
 			log.Println("failed to add block rule", err)
@@ -934,6 +969,10 @@ func applyBlocking(blockRules []BlockRule) error {
 
 func applyOutputBlocking(blockRules []OutputBlockRule) error {
 	for _, br := range blockRules {
+		if !scheduledRuleActive("OutputBlockRules", br, br.BaseRule) {
+			continue
+		}
+
 		err := AddOutputBlockRule(br.SrcIP, br.DstIP, br.Protocol)
 		if err != nil {
 			log.Println("failed to add output block rule", err)
@@ -946,6 +985,10 @@ func applyOutputBlocking(blockRules []OutputBlockRule) error {
 func applyForwardBlocking(blockRules []ForwardingBlockRule) error {
 
 	for _, br := range blockRules {
+		if !scheduledRuleActive("ForwardingBlockRules", br, br.BaseRule) {
+			continue
+		}
+
 		addForwardBlock(br)
 	}
 
@@ -1248,6 +1291,8 @@ func applyPrivateNetworkUpstreamDevice(device DeviceEntry) {
 		//if in the verdict map but does not have the policy, remove it
 		removePrivateUpstreamAccess(IP)
 	}
+
+	applyPrivateNetworkUpstream6(IP, foundPolicy)
 }
 
 func hasNoAPIAccess(ip string) bool {
@@ -1287,6 +1332,8 @@ func applyNoAPI(device DeviceEntry) {
 		//if in the verdict map but does not have the policy, remove it
 		removeNoAPIAccess(IP)
 	}
+
+	applyNoAPI6(IP, foundPolicy)
 }
 
 func applyBuiltinTagFirewallRules() {
@@ -1351,8 +1398,9 @@ func refreshDeviceGroupsAndPolicy(devices map[string]DeviceEntry, groups []Group
 
 	//remove from existing verdict maps
 	flushVmaps(ipv4, dev.MAC, ifname, getVerdictMapNames(), isAPVlan(ifname), false, nil)
+	flushSiteSubnetVmaps(dev.WGSubnets)
 
-	device_disabled := slices.Contains(dev.Policies, "disabled") || dev.DeviceDisabled == true
+	device_disabled := slices.Contains(activeDevicePolicies(dev, time.Now()), "disabled") || dev.DeviceDisabled == true
 	if dev.MAC != "" {
 		if _, exists := devices[dev.MAC]; !exists {
 			return
@@ -1367,7 +1415,12 @@ func refreshDeviceGroupsAndPolicy(devices map[string]DeviceEntry, groups []Group
 		addVerdictMac(ipv4, dev.MAC, ifname, "ethernet_filter", "return")
 
 		//and re-add
-		populateVmapEntries(devices, groups, ipv4, dev.MAC, ifname, "", dev.DNSCustom)
+		populateVmapEntries(devices, groups, ipv4, dev.MAC, ifname, dev.WGPubKey, dev.DNSCustom)
+
+		//group pins and limits may have changed
+		dev.RecentIP = ipv4
+		refreshUplinkPin(dev)
+		refreshBandwidthLimits(dev)
 	}
 
 }
@@ -1740,8 +1793,12 @@ func applyContainerInterfaces() {
 		}
 	}
 
+	active := activeCustomInterfaceRulesLocked()
 	for _, container_rule := range gFirewallConfig.CustomInterfaceRules {
-		applyCustomInterfaceRule(gFirewallConfig.CustomInterfaceRules, container_rule, "add", false)
+		if !scheduledRuleActive("CustomInterfaceRules", container_rule, container_rule.BaseRule) {
+			continue
+		}
+		applyCustomInterfaceRule(active, container_rule, "add", false)
 	}
 
 	// TBD: clean up stale iface from dns_access (?) here
@@ -1787,6 +1844,11 @@ func applyRadioInterfaces(interfacesConfig []InterfaceConfig) {
 				log.Println("failed to insert WIPHY_FORWARD_LAN rule", err)
 			}
 
+			err = InsertWiphyForwardLanRule6("inet", "filter", "WIPHY_FORWARD_LAN", entry.Name)
+			if err != nil {
+				log.Println("failed to insert WIPHY_FORWARD_LAN ip6 rule", err)
+			}
+
 		}
 	}
 
@@ -1839,8 +1901,13 @@ func listNFTables(w http.ResponseWriter, r *http.Request) {
 func getFirewallConfig(w http.ResponseWriter, r *http.Request) {
 	FWmtx.Lock()
 	defer FWmtx.Unlock()
+	status := FirewallConfigStatus{
+		FirewallConfig:  gFirewallConfig,
+		RuleSchedules:   ruleScheduleStatesLocked(time.Now()),
+		PolicySchedules: policyScheduleStates(readDevicesSnapshot(), time.Now()),
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gFirewallConfig)
+	json.NewEncoder(w).Encode(status)
 }
 
 func CIDRorIP(IP string) error {
@@ -1895,10 +1962,16 @@ func modifyForwardRules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = normalizeRuleSchedules(&fwd.BaseRule)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	if r.Method == http.MethodDelete {
 		for i := range gFirewallConfig.ForwardingRules {
 			a := gFirewallConfig.ForwardingRules[i]
-			if fwd == a {
+			if reflect.DeepEqual(withoutSchedules(fwd), withoutSchedules(a)) {
 				gFirewallConfig.ForwardingRules = append(gFirewallConfig.ForwardingRules[:i], gFirewallConfig.ForwardingRules[i+1:]...)
 				saveFirewallRulesLocked()
 				deleteForwarding(a)
@@ -1940,10 +2013,16 @@ func blockIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = normalizeRuleSchedules(&br.BaseRule)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	if r.Method == http.MethodDelete {
 		for i := range gFirewallConfig.BlockRules {
 			a := gFirewallConfig.BlockRules[i]
-			if br == a {
+			if reflect.DeepEqual(withoutSchedules(br), withoutSchedules(a)) {
 				gFirewallConfig.BlockRules = append(gFirewallConfig.BlockRules[:i], gFirewallConfig.BlockRules[i+1:]...)
 				saveFirewallRulesLocked()
 				deleteBlock(a)
@@ -1985,10 +2064,16 @@ func blockOutputIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = normalizeRuleSchedules(&br.BaseRule)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	if r.Method == http.MethodDelete {
 		for i := range gFirewallConfig.OutputBlockRules {
 			a := gFirewallConfig.OutputBlockRules[i]
-			if br == a {
+			if reflect.DeepEqual(withoutSchedules(br), withoutSchedules(a)) {
 				gFirewallConfig.OutputBlockRules = append(gFirewallConfig.OutputBlockRules[:i], gFirewallConfig.OutputBlockRules[i+1:]...)
 				saveFirewallRulesLocked()
 				deleteOutputBlock(a)
@@ -2030,6 +2115,12 @@ func blockForwardingIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = normalizeRuleSchedules(&br.BaseRule)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	// Validate destination port
 	if valid, err := validatePort(br.DstPort); !valid {
 		http.Error(w, fmt.Sprintf("Invalid DstPort: %v", err), 400)
@@ -2044,7 +2135,7 @@ func blockForwardingIP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodDelete {
 		for i := range gFirewallConfig.ForwardingBlockRules {
 			a := gFirewallConfig.ForwardingBlockRules[i]
-			if br == a {
+			if reflect.DeepEqual(withoutSchedules(br), withoutSchedules(a)) {
 				gFirewallConfig.ForwardingBlockRules = append(gFirewallConfig.ForwardingBlockRules[:i], gFirewallConfig.ForwardingBlockRules[i+1:]...)
 				saveFirewallRulesLocked()
 				deleteForwardBlock(a)
@@ -2329,6 +2420,8 @@ func addVerdict(IP string, Iface string, Table string) {
 		log.Println("addVerdict Failed", Iface, Table, err)
 		return
 	}
+
+	addVerdict6(IP, Iface, Table, "accept")
 }
 
 func hasVerdict(IP string, Iface string, Table string) bool {
@@ -2374,6 +2467,8 @@ func addInternetVerdict(IP string, Iface string) {
 		log.Println("addVerdict Failed", Iface, "internet_access", err)
 		return
 	}
+
+	addVerdict6(IP, Iface, "internet_access", verdict)
 }
 
 func addCustomVerdict(ZoneName string, IP string, Iface string) {
@@ -2412,6 +2507,8 @@ func addCustomVerdict(ZoneName string, IP string, Iface string) {
 		log.Println("addCustomVerdict Failed", err)
 		return
 	}
+
+	addCustomVerdict6(ZoneName, IP, Iface)
 }
 
 func hasCustomVerdict(ZoneName string, IP string, Iface string) bool {
@@ -2477,7 +2574,7 @@ func hasVmapEntries(snap *MapSnapshot, devices map[string]DeviceEntry, entry Dev
 		}
 	}
 
-	return true
+	return hasVmapEntries6(snap, entry, val, groupsDisabled, Iface)
 }
 
 func flushVmaps(IP string, MAC string, Ifname string, vmap_names []string, matchInterface bool, disabled bool, snap *MapSnapshot) {
@@ -2495,6 +2592,8 @@ func flushVmaps(IP string, MAC string, Ifname string, vmap_names []string, match
 		}
 	}
 
+	subnet6 := deviceIPv6Subnet(IP)
+
 	for _, name := range vmap_names {
 		var entries []verdictEntry
 		if snap != nil {
@@ -2525,15 +2624,16 @@ func flushVmaps(IP string, MAC string, Ifname string, vmap_names []string, match
 
 			if Ifname == "" {
 				//no ifname, cant do anything with these
-			} else if (entry.ipv4 == IP) || (matchInterface && (entry.ifname == Ifname)) || ((MAC != "") && equalMAC(entry.mac, MAC)) {
+			} else if (entry.ipv4 != "" && entry.ipv4 == IP) || (subnet6 != "" && entry.ipv6 != "" && entry.keyIP() == subnet6) ||
+				(matchInterface && (entry.ifname == Ifname)) || ((MAC != "") && equalMAC(entry.mac, MAC)) {
 				if entry.mac != "" {
 					err := DeleteElementFromMapComplex("inet", "filter", name,
-						[]string{entry.ipv4, entry.ifname, entry.mac})
+						[]string{entry.keyIP(), entry.ifname, entry.mac})
 					if err != nil {
 						log.Println("nft delete failed", err)
 					}
 				} else {
-					key := []string{entry.ipv4, entry.ifname}
+					key := []string{entry.keyIP(), entry.ifname}
 					if name == "fwd_iface_wan" {
 						key = []string{entry.ifname, entry.ipv4}
 					}
@@ -2578,6 +2678,8 @@ func addVerdictMac(IP string, MAC string, Iface string, Table string, Verdict st
 		log.Println("addVerdictMac Failed", MAC, Iface, Table, err)
 		return
 	}
+
+	addVerdictMac6(IP, MAC, Iface, Table, Verdict)
 }
 
 func hasVerdictMac(IP string, MAC string, Iface string, Table string, Verdict string) bool {
@@ -2683,18 +2785,20 @@ func notifyFirewallDHCP(device DeviceEntry, iface string) {
 	RecentDHCPWG[device.WGPubKey] = cur_time
 }
 
-func getWireguardActivePeers() ([]string, []string) {
+// getWireguardActivePeers returns the addresses and endpoints of recently active
+// peers on all wireguard interfaces, along with the interface of each address
+func getWireguardActivePeers() ([]string, []string, map[string]string) {
 	var data map[string]interface{}
-	var data2 map[string]interface{}
 	var data3 map[string]interface{}
 	var data4 map[string]interface{}
 	var data5 []interface{}
 	handshakes := []string{}
 	remote_endpoints := []string{}
+	peer_ifaces := map[string]string{}
 
 	req, err := http.NewRequest(http.MethodGet, "http://api-wg/status", nil)
 	if err != nil {
-		return handshakes, remote_endpoints
+		return handshakes, remote_endpoints, peer_ifaces
 	}
 
 	c := getWireguardClient()
@@ -2702,7 +2806,7 @@ func getWireguardActivePeers() ([]string, []string) {
 	resp, err := c.Do(req)
 	if err != nil {
 		log.Println("wireguard request failed", err)
-		return handshakes, remote_endpoints
+		return handshakes, remote_endpoints, peer_ifaces
 	}
 
 	defer resp.Body.Close()
@@ -2710,30 +2814,41 @@ func getWireguardActivePeers() ([]string, []string) {
 
 	if resp.StatusCode != http.StatusOK {
 		log.Println("failed to retrieve wireguard information", resp.StatusCode)
-		return handshakes, remote_endpoints
+		return handshakes, remote_endpoints, peer_ifaces
 	}
 
 	err = json.Unmarshal(output, &data)
 	if err != nil {
 		log.Println(err)
-		return handshakes, remote_endpoints
+		return handshakes, remote_endpoints, peer_ifaces
 	}
 
 	cur_time := time.Now().Unix()
 
-	_, exists := data["wg0"]
-	if !exists {
+	if _, exists := data["wg0"]; !exists {
 		log.Println("Failed to retrieve wg0 from wireguard status")
-		return handshakes, remote_endpoints
+		return handshakes, remote_endpoints, peer_ifaces
 	}
 
-	//iterate through peers
-	data2 = data["wg0"].(map[string]interface{})
-	data3 = data2["peers"].(map[string]interface{})
-	for pubkey, entry := range data3 {
-		data4 = entry.(map[string]interface{})
-		ts := data4["latestHandshake"]
-		if ts != nil {
+	//iterate through peers of every wireguard interface
+	for iface, status := range data {
+		if !strings.HasPrefix(iface, "wg") {
+			continue
+		}
+		data2, ok := status.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		data3, ok = data2["peers"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for pubkey, entry := range data3 {
+			data4 = entry.(map[string]interface{})
+			ts := data4["latestHandshake"]
+			if ts == nil {
+				continue
+			}
 			t := int64(ts.(float64))
 			// Clients with a handshake time less than 3 minutes ago are active.
 			if (cur_time - t) > (60 * 3) {
@@ -2750,23 +2865,26 @@ func getWireguardActivePeers() ([]string, []string) {
 				continue
 			}
 
-			data5 = data4["allowedIps"].([]interface{})
-			if data5 != nil && len(data5) > 0 {
-				var s string = data5[0].(string)
-				if s != "" {
-					pieces := strings.Split(s, "/")
-					handshakes = append(handshakes, pieces[0])
-
-					//also grab the endpoint
-					data6 := data4["endpoint"].(string)
-					remote_endpoints = append(remote_endpoints, data6)
+			//site peers also route subnets, the peer address is the /32
+			data5, _ = data4["allowedIps"].([]interface{})
+			for _, allowed := range data5 {
+				s, _ := allowed.(string)
+				if !strings.HasSuffix(s, "/32") {
+					continue
 				}
-			}
+				ip := strings.TrimSuffix(s, "/32")
+				handshakes = append(handshakes, ip)
+				peer_ifaces[ip] = iface
 
+				//also grab the endpoint
+				data6, _ := data4["endpoint"].(string)
+				remote_endpoints = append(remote_endpoints, data6)
+				break
+			}
 		}
 	}
 
-	return handshakes, remote_endpoints
+	return handshakes, remote_endpoints, peer_ifaces
 }
 
 var MESH_ENABLED_LEAF_PATH = TEST_PREFIX + "/state/plugins/mesh/enabled"
@@ -2955,12 +3073,21 @@ func populateVmapEntries(devices map[string]DeviceEntry, groups []GroupEntry, IP
 		}
 	}
 
+	//scheduled policies only apply inside their windows
+	val.Policies = scheduledDevicePolicies(val)
+
 	//first check for the disabled policy. if so, then do not
 	// apply any verdict maps
 	if slices.Contains(val.Policies, "disabled") {
 		return
 	}
 
+	//site peers route subnets which share the verdicts of the peer
+	siteSubnets := []string{}
+	if strings.HasPrefix(Iface, "wg") {
+		siteSubnets = val.WGSubnets
+	}
+
 	for _, group_name := range val.Groups {
 		//skip groups that are disabled
 		if groupsDisabled[group_name] {
@@ -2979,6 +3106,9 @@ func populateVmapEntries(devices map[string]DeviceEntry, groups []GroupEntry, IP
 		}
 
 		addCustomVerdict(group_name, IP, Iface)
+		for _, subnet := range siteSubnets {
+			addCustomVerdict(group_name, subnet, Iface)
+		}
 	}
 
 	//now apply the policies
@@ -2987,10 +3117,19 @@ func populateVmapEntries(devices map[string]DeviceEntry, groups []GroupEntry, IP
 		switch policy_name {
 		case "dns":
 			addDNSVerdict(IP, Iface, DNSCustom)
+			for _, subnet := range siteSubnets {
+				addDNSVerdict(subnet, Iface, "")
+			}
 		case "lan":
 			addLANVerdict(IP, Iface)
+			for _, subnet := range siteSubnets {
+				addLANVerdict(subnet, Iface)
+			}
 		case "wan":
 			addInternetVerdict(IP, Iface)
+			for _, subnet := range siteSubnets {
+				addInternetVerdict(subnet, Iface)
+			}
 		case "api":
 			//tbd -> can constrain API/website access by device later.
 		case "disabled":
@@ -3152,12 +3291,14 @@ func establishDevice(devices map[string]DeviceEntry, groups []GroupEntry,
 
 	//2. delete this ip, mac from any existing verdict maps
 	flushVmaps(entry.RecentIP, entry.MAC, new_iface, getVerdictMapNames(), isAPVlan(new_iface), false, nil)
+	flushSiteSubnetVmaps(entry.WGSubnets)
 
 	//3. delete the old router address
 	exec.Command("ip", "addr", "del", routeIP, "dev", established_route_device).Run()
 
 	//3. Update the route interface
 	exec.Command("ip", "route", "flush", routeIP).Run()
+	flushDeviceRoute6(entry.RecentIP, established_route_device)
 
 	// no interface set. abort now
 	if new_iface == "" {
@@ -3167,6 +3308,7 @@ func establishDevice(devices map[string]DeviceEntry, groups []GroupEntry,
 	if strings.Contains(new_iface, ExtraBSSPrefix) {
 		//this was a guest wifi network, block API access
 		addNoAPIAccess(entry.RecentIP)
+		applyNoAPI6(entry.RecentIP, true)
 	}
 
 	exec.Command("ip", "route", "add", routeIP, "dev", new_iface).Run()
@@ -3176,6 +3318,7 @@ func establishDevice(devices map[string]DeviceEntry, groups []GroupEntry,
 
 	//4. update router IP for the new interface. first delete the old addr
 	updateAddr(router, new_iface)
+	updateAddr6(entry.RecentIP, new_iface)
 
 	//5. Update the ARP entry
 	if new_iface != "wg0" && entry.MAC != "" {
@@ -3201,6 +3344,9 @@ func establishDevice(devices map[string]DeviceEntry, groups []GroupEntry,
 
 	//apply the tags
 	applyEndpointRules(entry)
+
+	refreshUplinkPin(entry)
+	refreshBandwidthLimits(entry)
 }
 
 var gPreviousVpnPeers = []string{}
@@ -3317,8 +3463,13 @@ func dynamicRouteLoop() {
 			// Get all downlink interfaces
 			downlinks := getDownlinkInterfaces()
 
-			//add wg0 as a valid sink
+			//add the wireguard interfaces as valid sinks
 			downlinks = append(downlinks, "wg0")
+			for _, iface := range getWireguardInterfaces() {
+				if !slices.Contains(downlinks, iface) {
+					downlinks = append(downlinks, iface)
+				}
+			}
 
 			lanif := getFirstDownlink()
 			lanif_vlan_trunk := false
@@ -3339,7 +3490,7 @@ func dynamicRouteLoop() {
 					}
 				}
 			}
-			wireguard_peers, remote_endpoints := getWireguardActivePeers()
+			wireguard_peers, remote_endpoints, wireguard_ifaces := getWireguardActivePeers()
 			wifi_peers := getWifiPeers()
 
 			notifyVpnActivity(wireguard_peers, remote_endpoints)
@@ -3384,7 +3535,7 @@ func dynamicRouteLoop() {
 			for _, ip := range wireguard_peers {
 				_, exists := suggested_device[ip]
 				if !exists {
-					suggested_device[ip] = "wg0"
+					suggested_device[ip] = wireguard_ifaces[ip]
 				}
 			}
 
@@ -3631,6 +3782,12 @@ func initFirewallRules() {
 	// dynamic route refresh
 	go dynamicRouteLoop()
 
+	// track the ipv6 addresses devices use
+	go ipv6NeighborLoop()
+
+	// announce device prefixes
+	go routerAdvertLoop()
+
 	// check on outbound interfaces and
 	// update their routes
 	go updateOutboundRoutes()
@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -425,7 +426,7 @@ func TestForwardingRules(t *testing.T) {
 				FWmtx.Lock()
 				found := false
 				for _, r := range gFirewallConfig.ForwardingRules {
-					if r == tt.rule {
+					if reflect.DeepEqual(r, tt.rule) {
 						found = true
 						break
 					}
@@ -0,0 +1,557 @@
+/*
+IPv6 addressing for tiny networks
+
+Every device /30 handed out from the DHCP TinyNets maps onto a /64 inside
+DHCPConfig.IPv6Prefix, counted in TinyNets order. As with IPv4 the router
+holds ::1, the /64 is announced to the device alone with unicast router
+advertisements (ipv6_ra.go) and the device configures its addresses with
+SLAAC, including privacy extensions.
+
+The ip6 verdict maps (ethernet_filter6, internet_access6, dns_access6,
+lan_access6 and <group>_src_access6/_dst_access6) are keyed by the whole
+/64 and populated alongside their IPv4 counterparts, so the same Policies
+and Groups apply to every address a device uses. Sources outside of the
+device /64 fall through ethernet_filter6 and are dropped.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const tinyNet6PrefixLen = 64
+
+// how many observed addresses to keep per device in DeviceEntry.RecentIPv6
+const maxRecentIPv6 = 8
+
+type ipv6Plan struct {
+	prefix   *net.IPNet
+	tinyNets []*net.IPNet
+}
+
+// the plan is kept apart from gDhcpConfig so verdict map updates
+// do not need DHCPmtx, which is held around device updates
+var IPv6mtx sync.Mutex
+var gIPv6Plan = ipv6Plan{}
+
+type IPv6Unassigned struct {
+	MAC    string
+	IP     string
+	Subnet string
+}
+
+func newIPv6Plan(conf DHCPConfig) ipv6Plan {
+	plan := ipv6Plan{}
+	if !conf.IPv6Enabled || conf.IPv6Prefix == "" {
+		return plan
+	}
+
+	_, prefix, err := net.ParseCIDR(conf.IPv6Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		log.Println("invalid IPv6Prefix", conf.IPv6Prefix)
+		return plan
+	}
+	plan.prefix = prefix
+
+	for _, subnetString := range conf.TinyNets {
+		_, subnet, err := net.ParseCIDR(subnetString)
+		if err != nil || subnet.IP.To4() == nil {
+			continue
+		}
+		plan.tinyNets = append(plan.tinyNets, subnet)
+	}
+
+	return plan
+}
+
+func (p ipv6Plan) enabled() bool {
+	return p.prefix != nil
+}
+
+// deviceSubnet returns the /64 for the tiny network holding the IPv4 address
+func (p ipv6Plan) deviceSubnet(IP string) *net.IPNet {
+	if !p.enabled() {
+		return nil
+	}
+
+	ip := net.ParseIP(IP).To4()
+	if ip == nil {
+		return nil
+	}
+
+	index := uint64(0)
+	found := false
+	for _, subnet := range p.tinyNets {
+		ones, bits := subnet.Mask.Size()
+		count := uint64(1) << uint(bits-ones) / 4
+		if subnet.Contains(ip) {
+			start := binary.BigEndian.Uint32(subnet.IP.To4())
+			index += uint64(binary.BigEndian.Uint32(ip)-start) / 4
+			found = true
+			break
+		}
+		index += count
+	}
+
+	if !found {
+		return nil
+	}
+
+	ones, _ := p.prefix.Mask.Size()
+	if ones > 0 && index >= uint64(1)<<uint(64-ones) {
+		//the prefix is too small to give this tiny network a /64
+		return nil
+	}
+
+	network := make(net.IP, 16)
+	copy(network, p.prefix.IP.To16())
+	upper := binary.BigEndian.Uint64(network[:8]) | index
+	binary.BigEndian.PutUint64(network[:8], upper)
+
+	return &net.IPNet{IP: network, Mask: net.CIDRMask(tinyNet6PrefixLen, 128)}
+}
+
+func updateIPv6Plan(conf DHCPConfig) {
+	plan := newIPv6Plan(conf)
+
+	IPv6mtx.Lock()
+	gIPv6Plan = plan
+	IPv6mtx.Unlock()
+
+	updateFirewallSubnets6(plan)
+}
+
+func getIPv6Plan() ipv6Plan {
+	IPv6mtx.Lock()
+	defer IPv6mtx.Unlock()
+	return gIPv6Plan
+}
+
+func isIPv6Enabled() bool {
+	return getIPv6Plan().enabled()
+}
+
+// deviceIPv6Subnet returns the /64 in CIDR notation for a device's IPv4
+// tiny network address, or "" when IPv6 is disabled or IP is not a tiny net IP
+func deviceIPv6Subnet(IP string) string {
+	subnet := getIPv6Plan().deviceSubnet(IP)
+	if subnet == nil {
+		return ""
+	}
+	return subnet.String()
+}
+
+// deviceIPv6Addresses returns the /64 and the router address for a
+// device's IPv4 tiny network address
+func deviceIPv6Addresses(IP string) (string, string) {
+	subnet := getIPv6Plan().deviceSubnet(IP)
+	if subnet == nil {
+		return "", ""
+	}
+
+	router := make(net.IP, 16)
+	copy(router, subnet.IP)
+	router[15] = 1
+
+	return subnet.String(), router.String()
+}
+
+// genULAPrefix returns a random RFC 4193 unique local /48
+func genULAPrefix() (string, error) {
+	globalID := make([]byte, 5)
+	_, err := rand.Read(globalID)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := make(net.IP, 16)
+	prefix[0] = 0xfd
+	copy(prefix[1:6], globalID)
+
+	return (&net.IPNet{IP: prefix, Mask: net.CIDRMask(48, 128)}).String(), nil
+}
+
+func validateIPv6Prefix(prefix string) error {
+	ip, subnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	if ip.To4() != nil {
+		return fmt.Errorf("not an IPv6 prefix")
+	}
+
+	if !ip.Equal(subnet.IP) {
+		return fmt.Errorf("host bits set in IPv6 prefix")
+	}
+
+	ones, _ := subnet.Mask.Size()
+	if ones < 16 || ones > 64 {
+		return fmt.Errorf("invalid prefix length for IPv6Prefix: %d", ones)
+	}
+
+	if !ip.IsGlobalUnicast() && !ip.IsPrivate() {
+		return fmt.Errorf("IPv6Prefix must be a unique local or global unicast prefix")
+	}
+
+	return nil
+}
+
+func updateFirewallSubnets6(plan ipv6Plan) {
+	FlushSetWithTable("inet", "filter", "supernetworks6")
+	FlushSetWithTable("inet", "nat", "routed_networks6")
+
+	if !plan.enabled() {
+		return
+	}
+
+	prefix := plan.prefix.String()
+	err := AddIP6CIDRToSet("inet", "filter", "supernetworks6", prefix)
+	if err != nil {
+		log.Println("failed to add filter supernetworks6 element", err)
+	}
+
+	//delegated (global) prefixes are routed as is, unique local
+	//addresses are masqueraded on the uplinks like IPv4
+	if !plan.prefix.IP.IsPrivate() {
+		err = AddIP6CIDRToSet("inet", "nat", "routed_networks6", prefix)
+		if err != nil {
+			log.Println("failed to add nat routed_networks6 element", err)
+		}
+	}
+}
+
+// isIPv6MapName reports whether a verdict map is one of the ip6 counterparts
+// of the device maps: ethernet_filter6, internet_access6, dns_access6,
+// lan_access6 and the <zone>_src_access6 / <zone>_dst_access6 group maps
+func isIPv6MapName(mapName string) bool {
+	return mapName == "ethernet_filter6" || strings.HasSuffix(mapName, "_access6")
+}
+
+// ipv6MapName returns the ip6 counterpart of a device verdict map
+func ipv6MapName(mapName string) string {
+	if isIPv6MapName(mapName) {
+		return mapName
+	}
+	return mapName + "6"
+}
+
+// verdict map helpers. These mirror the IPv4 entry for a device into the
+// ip6 map for its /64, and are no-ops when IPv6 is off or for wireguard
+
+func deviceIPv6SubnetForIface(IP string, Iface string) string {
+	if strings.HasPrefix(Iface, "wg") {
+		return ""
+	}
+	return deviceIPv6Subnet(IP)
+}
+
+func addVerdict6(IP string, Iface string, Table string, Verdict string) {
+	subnet6 := deviceIPv6SubnetForIface(IP, Iface)
+	if subnet6 == "" {
+		return
+	}
+
+	err := AddElementToMapComplex("inet", "filter", ipv6MapName(Table), []string{subnet6, Iface}, Verdict)
+	if err != nil {
+		log.Println("addVerdict6 Failed", Iface, ipv6MapName(Table), err)
+	}
+}
+
+func deleteVerdict6(IP string, Iface string, Table string) {
+	subnet6 := deviceIPv6SubnetForIface(IP, Iface)
+	if subnet6 == "" {
+		return
+	}
+
+	err := DeleteElementFromMapComplex("inet", "filter", ipv6MapName(Table), []string{subnet6, Iface})
+	if err != nil {
+		log.Println("deleteVerdict6 Failed", Iface, ipv6MapName(Table), err)
+	}
+}
+
+func addVerdictMac6(IP string, MAC string, Iface string, Table string, Verdict string) {
+	subnet6 := deviceIPv6SubnetForIface(IP, Iface)
+	if subnet6 == "" || MAC == "" {
+		return
+	}
+
+	err := AddElementToMapComplex("inet", "filter", ipv6MapName(Table), []string{subnet6, Iface, MAC}, Verdict)
+	if err != nil {
+		log.Println("addVerdictMac6 Failed", MAC, Iface, ipv6MapName(Table), err)
+	}
+}
+
+func addCustomVerdict6(ZoneName string, IP string, Iface string) {
+	subnet6 := deviceIPv6SubnetForIface(IP, Iface)
+	if subnet6 == "" {
+		return
+	}
+
+	err := CheckMapExists("inet", "filter", ZoneName+"_dst_access6")
+	if err != nil {
+		err = CreateIP6IfaceVerdictMap("inet", "filter", ZoneName+"_src_access6")
+		if err != nil {
+			log.Println("addCustomVerdict6 Failed", err)
+			return
+		}
+		err = CreateIP6IfaceVerdictMap("inet", "filter", ZoneName+"_dst_access6")
+		if err != nil {
+			log.Println("addCustomVerdict6 Failed", err)
+			return
+		}
+		err = InsertCustomGroupVmapRule6("inet", "filter", "CUSTOM_GROUPS", ZoneName)
+		if err != nil {
+			log.Println("addCustomVerdict6 Failed", err)
+			return
+		}
+	}
+
+	err = AddElementToMapComplex("inet", "filter", ZoneName+"_dst_access6", []string{subnet6, Iface}, "continue")
+	if err != nil {
+		log.Println("addCustomVerdict6 Failed", err)
+		return
+	}
+
+	err = AddElementToMapComplex("inet", "filter", ZoneName+"_src_access6", []string{subnet6, Iface}, "accept")
+	if err != nil {
+		log.Println("addCustomVerdict6 Failed", err)
+	}
+}
+
+// hasVmapEntries6 is the ip6 part of hasVmapEntries. Unlike the IPv4 check
+// the policy maps are included, the v6 entries are only added alongside
+// the v4 ones and would otherwise never be repaired.
+func hasVmapEntries6(snap *MapSnapshot, entry DeviceEntry, val DeviceEntry, groupsDisabled map[string]bool, Iface string) bool {
+	subnet6 := deviceIPv6SubnetForIface(entry.RecentIP, Iface)
+	if subnet6 == "" {
+		return true
+	}
+
+	if entry.MAC != "" {
+		if !snap.HasElement("ethernet_filter6", []string{subnet6, Iface, entry.MAC}) {
+			return false
+		}
+	}
+
+	for _, group_name := range val.Groups {
+		if groupsDisabled[group_name] || slices.Contains(ignore_groups, group_name) {
+			continue
+		}
+
+		if !snap.HasElement(group_name+"_dst_access6", []string{subnet6, Iface}) ||
+			!snap.HasElement(group_name+"_src_access6", []string{subnet6, Iface}) {
+			return false
+		}
+	}
+
+	policies := scheduledDevicePolicies(val)
+	if slices.Contains(policies, "disabled") {
+		return true
+	}
+
+	for _, policy_name := range policies {
+		table := ""
+		switch policy_name {
+		case "dns":
+			table = "dns_access6"
+		case "lan":
+			table = "lan_access6"
+		case "wan":
+			if personaInternetBlocked(entry.RecentIP) {
+				continue
+			}
+			table = "internet_access6"
+		default:
+			continue
+		}
+
+		if !snap.HasElement(table, []string{subnet6, Iface}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func applyNoAPI6(IP string, noapi bool) {
+	subnet6 := deviceIPv6Subnet(IP)
+	if subnet6 == "" {
+		return
+	}
+
+	present := GetIP6CIDRFromSet("inet", "filter", "api_block6", subnet6) == nil
+	if noapi && !present {
+		err := AddIP6CIDRToSet("inet", "filter", "api_block6", subnet6)
+		if err != nil {
+			log.Println("failed to add element to api_block6", err)
+		}
+	} else if !noapi && present {
+		err := DeleteIP6CIDRFromSet("inet", "filter", "api_block6", subnet6)
+		if err != nil {
+			log.Println("failed to remove element from api_block6", err)
+		}
+	}
+}
+
+func applyPrivateNetworkUpstream6(IP string, allowed bool) {
+	subnet6 := deviceIPv6Subnet(IP)
+	if subnet6 == "" {
+		return
+	}
+
+	present := GetIP6CIDRFromSet("inet", "filter", "upstream_private_ula6_allowed", subnet6) == nil
+	if allowed && !present {
+		err := AddIP6CIDRToSet("inet", "filter", "upstream_private_ula6_allowed", subnet6, "return")
+		if err != nil {
+			log.Println("failed to add element to upstream_private_ula6_allowed", err)
+		}
+	} else if !allowed && present {
+		err := DeleteIP6CIDRFromSet("inet", "filter", "upstream_private_ula6_allowed", subnet6)
+		if err != nil {
+			log.Println("failed to remove element from upstream_private_ula6_allowed", err)
+		}
+	}
+}
+
+// routes and router addresses
+
+func flushDeviceRoute6(IP string, Ifname string) {
+	subnet6, router6 := deviceIPv6Addresses(IP)
+	if subnet6 == "" {
+		return
+	}
+
+	if Ifname != "" {
+		exec.Command("ip", "-6", "addr", "del", router6+"/"+strconv.Itoa(tinyNet6PrefixLen), "dev", Ifname).Run()
+	}
+	exec.Command("ip", "-6", "route", "flush", subnet6).Run()
+}
+
+func updateAddr6(IP string, Ifname string) {
+	if strings.HasPrefix(Ifname, "wg") {
+		return
+	}
+
+	_, router6 := deviceIPv6Addresses(IP)
+	if router6 == "" {
+		return
+	}
+
+	exec.Command("ip", "-6", "addr", "add", router6+"/"+strconv.Itoa(tinyNet6PrefixLen), "dev", Ifname, "nodad").Run()
+}
+
+// neighbor tracking
+
+func mergeRecentIPv6(recent []string, observed []string) []string {
+	merged := []string{}
+	for _, ip := range observed {
+		if !slices.Contains(merged, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	for _, ip := range recent {
+		if !slices.Contains(merged, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	if len(merged) > maxRecentIPv6 {
+		merged = merged[:maxRecentIPv6]
+	}
+	return merged
+}
+
+func getIPv6Neighbors() map[string][]string {
+	neighbors := map[string][]string{}
+
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_V6)
+	if err != nil {
+		log.Println("failed to list ipv6 neighbors", err)
+		return neighbors
+	}
+
+	for _, neigh := range neighs {
+		if neigh.HardwareAddr == nil || neigh.IP == nil {
+			continue
+		}
+		if neigh.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE|netlink.NUD_NOARP) != 0 {
+			continue
+		}
+		if neigh.IP.IsMulticast() || neigh.IP.IsUnspecified() {
+			continue
+		}
+		mac := trimLower(neigh.HardwareAddr.String())
+		neighbors[mac] = append(neighbors[mac], neigh.IP.String())
+	}
+
+	return neighbors
+}
+
+// trackIPv6Neighbors records the IPv6 addresses devices have been seen
+// using. Global addresses outside of the device /64 are reported, their
+// traffic is dropped by ethernet_filter6.
+func trackIPv6Neighbors() {
+	neighbors := getIPv6Neighbors()
+	if len(neighbors) == 0 {
+		return
+	}
+
+	Devicesmtx.Lock()
+	defer Devicesmtx.Unlock()
+
+	devices := getDevicesJson()
+	changed := false
+
+	for ident, device := range devices {
+		if device.MAC == "" {
+			continue
+		}
+
+		observed, exists := neighbors[trimLower(device.MAC)]
+		if !exists {
+			continue
+		}
+
+		_, subnet, _ := net.ParseCIDR(deviceIPv6Subnet(device.RecentIP))
+		for _, address := range observed {
+			ip := net.ParseIP(address)
+			if ip.IsLinkLocalUnicast() || slices.Contains(device.RecentIPv6, address) {
+				continue
+			}
+			if subnet == nil || !subnet.Contains(ip) {
+				SprbusPublish("device:ipv6:unassigned", IPv6Unassigned{device.MAC, address, deviceIPv6Subnet(device.RecentIP)})
+			}
+		}
+
+		merged := mergeRecentIPv6(device.RecentIPv6, observed)
+		if !slices.Equal(merged, device.RecentIPv6) {
+			device.RecentIPv6 = merged
+			devices[ident] = device
+			changed = true
+		}
+	}
+
+	if changed {
+		saveDevicesJson(devices)
+	}
+}
+
+func ipv6NeighborLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	for range ticker.C {
+		if isIPv6Enabled() {
+			trackIPv6Neighbors()
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+/*
+Router advertisements for the device /64s
+
+Every device shares its interface with others, so the prefix of a device is
+never multicast. Router solicitations are answered with a unicast
+advertisement to the soliciting link local address, and the advertisement is
+repeated for devices seen in the neighbor table before the lifetimes run out.
+The /64 is announced with the autonomous flag for SLAAC and the router
+address as the RDNSS server.
+*/
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	raInterval          = 10 * time.Minute
+	raRouterLifetime    = 30 * time.Minute
+	raPreferredLifetime = time.Hour
+	raValidLifetime     = 2 * time.Hour
+)
+
+const (
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptRDNSS          = 25
+)
+
+// buildRouterAdvertisement returns the ICMPv6 router advertisement for one
+// device prefix. The checksum is left to the kernel.
+func buildRouterAdvertisement(routerMAC net.HardwareAddr, prefix *net.IPNet, router net.IP) []byte {
+	msg := make([]byte, 16)
+	msg[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	msg[4] = 64 //cur hop limit
+	binary.BigEndian.PutUint16(msg[6:8], uint16(raRouterLifetime.Seconds()))
+
+	if len(routerMAC) == 6 {
+		option := make([]byte, 8)
+		option[0] = ndOptSourceLinkAddr
+		option[1] = 1
+		copy(option[2:], routerMAC)
+		msg = append(msg, option...)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	option := make([]byte, 32)
+	option[0] = ndOptPrefixInfo
+	option[1] = 4
+	option[2] = byte(ones)
+	option[3] = 0xc0 //on-link, autonomous
+	binary.BigEndian.PutUint32(option[4:8], uint32(raValidLifetime.Seconds()))
+	binary.BigEndian.PutUint32(option[8:12], uint32(raPreferredLifetime.Seconds()))
+	copy(option[16:], prefix.IP.To16())
+	msg = append(msg, option...)
+
+	option = make([]byte, 24)
+	option[0] = ndOptRDNSS
+	option[1] = 3
+	binary.BigEndian.PutUint32(option[4:8], uint32(raRouterLifetime.Seconds()))
+	copy(option[8:], router.To16())
+	msg = append(msg, option...)
+
+	return msg
+}
+
+// solicitationLinkAddr returns the source link layer address option of
+// a router solicitation, or nil when it has none
+func solicitationLinkAddr(msg []byte) net.HardwareAddr {
+	if len(msg) < 8 || msg[0] != byte(ipv6.ICMPTypeRouterSolicitation) || msg[1] != 0 {
+		return nil
+	}
+
+	options := msg[8:]
+	for len(options) >= 8 {
+		length := int(options[1]) * 8
+		if length == 0 || length > len(options) {
+			return nil
+		}
+		if options[0] == ndOptSourceLinkAddr && length == 8 {
+			return net.HardwareAddr(slices.Clone(options[2:8]))
+		}
+		options = options[length:]
+	}
+
+	return nil
+}
+
+// raDeviceSubnet returns the /64 and router address to advertise to a MAC
+func raDeviceSubnet(devices map[string]DeviceEntry, MAC string) (*net.IPNet, net.IP) {
+	device, exists := devices[trimLower(MAC)]
+	if !exists || device.DeviceDisabled || slices.Contains(device.Policies, "disabled") {
+		return nil, nil
+	}
+
+	subnet6, router6 := deviceIPv6Addresses(device.RecentIP)
+	if subnet6 == "" {
+		return nil, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(subnet6)
+	if err != nil {
+		return nil, nil
+	}
+	return subnet, net.ParseIP(router6)
+}
+
+func sendRouterAdvertisement(conn *ipv6.PacketConn, ifIndex int, dst net.IP, subnet *net.IPNet, router net.IP) {
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(iface.Name, "wg") {
+		return
+	}
+
+	msg := buildRouterAdvertisement(iface.HardwareAddr, subnet, router)
+	cm := &ipv6.ControlMessage{HopLimit: 255, IfIndex: ifIndex}
+	_, err = conn.WriteTo(msg, cm, &net.IPAddr{IP: dst, Zone: iface.Name})
+	if err != nil {
+		log.Println("failed to send router advertisement", iface.Name, dst, err)
+	}
+}
+
+// advertiseKnownNeighbors refreshes the prefix of devices in the neighbor table
+func advertiseKnownNeighbors(conn *ipv6.PacketConn) {
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_V6)
+	if err != nil {
+		log.Println("failed to list ipv6 neighbors", err)
+		return
+	}
+
+	devices := readDevicesSnapshot()
+	for _, neigh := range neighs {
+		if neigh.HardwareAddr == nil || !neigh.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if neigh.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE|netlink.NUD_NOARP) != 0 {
+			continue
+		}
+
+		subnet, router := raDeviceSubnet(devices, neigh.HardwareAddr.String())
+		if subnet == nil {
+			continue
+		}
+		sendRouterAdvertisement(conn, neigh.LinkIndex, neigh.IP, subnet, router)
+	}
+}
+
+func serveRouterSolicitations(conn *ipv6.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("router solicitation read failed", err)
+			return
+		}
+
+		if cm == nil || cm.HopLimit != 255 || !isIPv6Enabled() {
+			continue
+		}
+
+		srcAddr, ok := src.(*net.IPAddr)
+		if !ok || !srcAddr.IP.IsLinkLocalUnicast() {
+			//solicitations from the unspecified address would need a
+			//multicast reply, the device asks again once it has a link local
+			continue
+		}
+
+		mac := solicitationLinkAddr(buf[:n])
+		if mac == nil {
+			continue
+		}
+
+		subnet, router := raDeviceSubnet(readDevicesSnapshot(), mac.String())
+		if subnet == nil {
+			continue
+		}
+		sendRouterAdvertisement(conn, cm.IfIndex, srcAddr.IP, subnet, router)
+	}
+}
+
+func routerAdvertLoop() {
+	c, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		log.Println("failed to open icmpv6 socket, router advertisements disabled", err)
+		return
+	}
+	conn := ipv6.NewPacketConn(c)
+
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	err = conn.SetICMPFilter(&filter)
+	if err != nil {
+		log.Println("failed to set icmpv6 filter", err)
+	}
+
+	err = conn.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagInterface, true)
+	if err != nil {
+		log.Println("failed to enable icmpv6 control messages, router advertisements disabled", err)
+		conn.Close()
+		return
+	}
+
+	go serveRouterSolicitations(conn)
+
+	ticker := time.NewTicker(raInterval)
+	for {
+		if isIPv6Enabled() {
+			advertiseKnownNeighbors(conn)
+		}
+		<-ticker.C
+	}
+}
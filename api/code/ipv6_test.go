@@ -0,0 +1,196 @@
+package main
+
+// Address planning for dual stack: tiny network /30s map onto /64s inside
+// the configured IPv6 prefix, and the ip6 verdict map keys round trip.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestIPv6PlanDeviceSubnet(t *testing.T) {
+	plan := newIPv6Plan(DHCPConfig{
+		TinyNets:    []string{"192.168.2.0/24", "10.10.0.0/30"},
+		IPv6Enabled: true,
+		IPv6Prefix:  "fd12:3456:789a::/48",
+	})
+
+	tests := []struct {
+		ip     string
+		subnet string
+	}{
+		{"192.168.2.2", "fd12:3456:789a::/64"},
+		{"192.168.2.6", "fd12:3456:789a:1::/64"},
+		{"192.168.2.254", "fd12:3456:789a:3f::/64"},
+		// the second tiny net continues after the 64 /30s of the first
+		{"10.10.0.2", "fd12:3456:789a:40::/64"},
+	}
+
+	for _, tt := range tests {
+		subnet := plan.deviceSubnet(tt.ip)
+		if subnet == nil {
+			t.Errorf("%s: no subnet", tt.ip)
+			continue
+		}
+		if subnet.String() != tt.subnet {
+			t.Errorf("%s: got %s, want %s", tt.ip, subnet.String(), tt.subnet)
+		}
+	}
+
+	for _, ip := range []string{"172.16.0.2", "not-an-ip", "fd00::2"} {
+		if subnet := plan.deviceSubnet(ip); subnet != nil {
+			t.Errorf("%s: expected no subnet, got %s", ip, subnet)
+		}
+	}
+}
+
+func TestIPv6PlanDisabled(t *testing.T) {
+	plan := newIPv6Plan(DHCPConfig{
+		TinyNets:   []string{"192.168.2.0/24"},
+		IPv6Prefix: "fd12:3456:789a::/48",
+	})
+	if plan.enabled() || plan.deviceSubnet("192.168.2.2") != nil {
+		t.Error("plan should be disabled without IPv6Enabled")
+	}
+}
+
+func TestIPv6PlanPrefixTooSmall(t *testing.T) {
+	// a /63 only holds two /64s
+	plan := newIPv6Plan(DHCPConfig{
+		TinyNets:    []string{"192.168.2.0/24"},
+		IPv6Enabled: true,
+		IPv6Prefix:  "2001:db8:0:10::/63",
+	})
+	if plan.deviceSubnet("192.168.2.6") == nil {
+		t.Error("second /64 should fit in a /63")
+	}
+	if plan.deviceSubnet("192.168.2.10") != nil {
+		t.Error("third /64 should not fit in a /63")
+	}
+}
+
+func TestValidateIPv6Prefix(t *testing.T) {
+	valid := []string{"fd12:3456:789a::/48", "2001:db8::/56", "2001:db8:0:1::/64"}
+	for _, prefix := range valid {
+		if err := validateIPv6Prefix(prefix); err != nil {
+			t.Errorf("%s: unexpected error %v", prefix, err)
+		}
+	}
+
+	invalid := []string{"192.168.2.0/24", "fd00::/80", "fd00::1/48", "fe80::/64", "junk"}
+	for _, prefix := range invalid {
+		if err := validateIPv6Prefix(prefix); err == nil {
+			t.Errorf("%s: expected an error", prefix)
+		}
+	}
+}
+
+func TestGenULAPrefix(t *testing.T) {
+	prefix, err := genULAPrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateIPv6Prefix(prefix); err != nil {
+		t.Errorf("generated prefix %s is invalid: %v", prefix, err)
+	}
+	if prefix[:2] != "fd" {
+		t.Errorf("generated prefix %s is not a unique local address", prefix)
+	}
+}
+
+func TestIPv6MapKeys(t *testing.T) {
+	if IP6ToBytes("192.168.2.2") != nil {
+		t.Error("IP6ToBytes accepted an ipv4 address")
+	}
+
+	key, keyEnd, err := buildConcatenatedKey("internet_access6", []string{"fd12:3456:789a:1::/64", "wlan1.4096"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || len(keyEnd) != 32 {
+		t.Fatalf("unexpected key lengths %d %d", len(key), len(keyEnd))
+	}
+	if !bytes.Equal(key[8:16], make([]byte, 8)) || !bytes.Equal(keyEnd[8:16], bytes.Repeat([]byte{0xff}, 8)) {
+		t.Error("key range does not cover the /64")
+	}
+
+	parts := splitConcatKey("internet_access6", key)
+	if len(parts) != 2 || parts[0] != "fd12:3456:789a:1::" || parts[1] != "wlan1.4096" {
+		t.Errorf("unexpected split %v", parts)
+	}
+
+	entry := verdictEntryFromKey("internet_access6", len(key), parts)
+	if entry.keyIP() != "fd12:3456:789a:1::/64" || entry.ipv4 != "" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	key, _, err = buildConcatenatedKey("ethernet_filter6", []string{"fd12:3456:789a:1::/64", "wlan1", "aa:bb:cc:dd:ee:ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = splitConcatKey("ethernet_filter6", key)
+	if len(parts) != 3 || parts[2] != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected split %v", parts)
+	}
+}
+
+func TestRouterAdvertisement(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fd12:3456:789a:1::/64")
+	router := net.ParseIP("fd12:3456:789a:1::1")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	msg := buildRouterAdvertisement(mac, prefix, router)
+	if len(msg) != 16+8+32+24 {
+		t.Fatalf("unexpected length %d", len(msg))
+	}
+	if msg[0] != 134 || msg[4] != 64 || binary.BigEndian.Uint16(msg[6:8]) != 1800 {
+		t.Errorf("unexpected header % x", msg[:16])
+	}
+	if msg[16] != 1 || !bytes.Equal(msg[18:24], mac) {
+		t.Errorf("unexpected source link address option % x", msg[16:24])
+	}
+
+	pio := msg[24:56]
+	if pio[0] != 3 || pio[1] != 4 || pio[2] != 64 || pio[3] != 0xc0 {
+		t.Errorf("unexpected prefix information option % x", pio[:4])
+	}
+	if binary.BigEndian.Uint32(pio[4:8]) != 7200 || binary.BigEndian.Uint32(pio[8:12]) != 3600 {
+		t.Errorf("unexpected prefix lifetimes % x", pio[4:12])
+	}
+	if !net.IP(pio[16:32]).Equal(prefix.IP) {
+		t.Errorf("unexpected prefix %s", net.IP(pio[16:32]))
+	}
+
+	rdnss := msg[56:]
+	if rdnss[0] != 25 || rdnss[1] != 3 || !net.IP(rdnss[8:24]).Equal(router) {
+		t.Errorf("unexpected rdnss option % x", rdnss)
+	}
+}
+
+func TestSolicitationLinkAddr(t *testing.T) {
+	rs := []byte{133, 0, 0, 0, 0, 0, 0, 0,
+		14, 1, 0, 0, 0, 0, 0, 0, //nonce option
+		1, 1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	if mac := solicitationLinkAddr(rs); mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected link address %v", mac)
+	}
+
+	if mac := solicitationLinkAddr(rs[:16]); mac != nil {
+		t.Errorf("link address without the option %v", mac)
+	}
+
+	//zero length options are invalid
+	bad := append([]byte{}, rs...)
+	bad[9] = 0
+	if mac := solicitationLinkAddr(bad); mac != nil {
+		t.Errorf("link address from a malformed solicitation %v", mac)
+	}
+
+	bad = append([]byte{}, rs...)
+	bad[0] = 134
+	if mac := solicitationLinkAddr(bad); mac != nil {
+		t.Errorf("link address from a router advertisement %v", mac)
+	}
+}
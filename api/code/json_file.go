@@ -13,6 +13,11 @@ func saveFileJSON(path string, value interface{}) error {
 		return fmt.Errorf("marshal %s: %w", path, err)
 	}
 
+	return saveFileBytes(path, data)
+}
+
+// saveFileBytes replaces a file atomically
+func saveFileBytes(path string, data []byte) error {
 	dir := filepath.Dir(path)
 	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
 	if err != nil {
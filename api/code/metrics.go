@@ -0,0 +1,240 @@
+package main
+
+/*
+ OpenMetrics exporter, so prometheus compatible scrapers can collect
+ router health directly: uplink health, device traffic counters,
+ wifi station signal and db statistics.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+type MetricLabel struct {
+	Name  string
+	Value string
+}
+
+type metricsWriter struct {
+	b strings.Builder
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(&m.b, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(&m.b, "# HELP %s %s\n", name, help)
+}
+
+func (m *metricsWriter) sample(name string, labels []MetricLabel, value float64) {
+	m.b.WriteString(name)
+	if len(labels) > 0 {
+		m.b.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				m.b.WriteString(",")
+			}
+			m.b.WriteString(label.Name + `="` + metricsLabelEscaper.Replace(label.Value) + `"`)
+		}
+		m.b.WriteString("}")
+	}
+	m.b.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (m *metricsWriter) String() string {
+	return m.b.String() + "# EOF\n"
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func deviceMetricLabels(dev DeviceEntry) []MetricLabel {
+	return []MetricLabel{{"mac", dev.MAC}, {"name", dev.Name}}
+}
+
+func writeWanMetrics(m *metricsWriter, statuses []WanUplinkStatus) {
+	type gauge struct {
+		name  string
+		help  string
+		value func(WanUplinkStatus) float64
+	}
+
+	gauges := []gauge{
+		{"spr_wan_up", "Uplink passes health probes", func(s WanUplinkStatus) float64 { return boolMetric(s.Up) }},
+		{"spr_wan_active", "Uplink is used for outbound traffic", func(s WanUplinkStatus) float64 { return boolMetric(s.Active) }},
+		{"spr_wan_latency_milliseconds", "Recent probe round trip time", func(s WanUplinkStatus) float64 { return s.LatencyMs }},
+		{"spr_wan_jitter_milliseconds", "Recent probe jitter", func(s WanUplinkStatus) float64 { return s.JitterMs }},
+		{"spr_wan_loss_ratio", "Recent probe loss", func(s WanUplinkStatus) float64 { return s.LossPct / 100 }},
+		{"spr_wan_downtime_24h_seconds", "Downtime within the last day", func(s WanUplinkStatus) float64 { return float64(s.Downtime24h) }},
+	}
+
+	for _, g := range gauges {
+		m.family(g.name, "gauge", g.help)
+		for _, status := range statuses {
+			m.sample(g.name, []MetricLabel{{"uplink", status.Iface}}, g.value(status))
+		}
+	}
+
+	m.family("spr_wan_outages", "counter", "Recorded uplink outages")
+	for _, status := range statuses {
+		m.sample("spr_wan_outages_total", []MetricLabel{{"uplink", status.Iface}}, float64(status.TotalOutages))
+	}
+}
+
+func writeTrafficMetrics(m *metricsWriter, readings map[string]*NetCount, devices map[string]DeviceEntry) {
+	byIP := map[string]DeviceEntry{}
+	for _, dev := range devices {
+		if dev.RecentIP != "" {
+			byIP[dev.RecentIP] = dev
+		}
+	}
+
+	ips := []string{}
+	for ip := range readings {
+		if _, exists := byIP[ip]; exists {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+
+	m.family("spr_device_traffic_bytes", "counter", "Bytes forwarded for a device")
+	for _, ip := range ips {
+		dev := byIP[ip]
+		count := readings[ip]
+		for _, series := range []struct {
+			zone      string
+			direction string
+			bytes     uint64
+		}{
+			{"lan", "in", count.LanIn},
+			{"lan", "out", count.LanOut},
+			{"wan", "in", count.WanIn},
+			{"wan", "out", count.WanOut},
+		} {
+			labels := append(deviceMetricLabels(dev),
+				MetricLabel{"ip", ip},
+				MetricLabel{"interface", dev.DHCPLastInterface},
+				MetricLabel{"zone", series.zone},
+				MetricLabel{"direction", series.direction})
+			m.sample("spr_device_traffic_bytes_total", labels, float64(series.bytes))
+		}
+	}
+}
+
+func writeStationMetrics(m *metricsWriter, stations map[string]wifiStation, devices map[string]DeviceEntry) {
+	macs := []string{}
+	for mac := range stations {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	labelsFor := func(mac string) []MetricLabel {
+		dev, exists := devices[mac]
+		if !exists {
+			dev = DeviceEntry{MAC: mac}
+		}
+		return append(deviceMetricLabels(dev), MetricLabel{"interface", stations[mac].Iface})
+	}
+
+	m.family("spr_station_signal_dbm", "gauge", "Wifi station signal strength")
+	for _, mac := range macs {
+		m.sample("spr_station_signal_dbm", labelsFor(mac), float64(stationInt(stations[mac].Station, "signal")))
+	}
+
+	//hostapd reports rates in units of 100 kbit/s
+	m.family("spr_station_tx_rate_mbps", "gauge", "Wifi station transmit rate")
+	for _, mac := range macs {
+		m.sample("spr_station_tx_rate_mbps", labelsFor(mac), float64(stationInt(stations[mac].Station, "tx_rate_info"))/10)
+	}
+
+	m.family("spr_station_rx_rate_mbps", "gauge", "Wifi station receive rate")
+	for _, mac := range macs {
+		m.sample("spr_station_rx_rate_mbps", labelsFor(mac), float64(stationInt(stations[mac].Station, "rx_rate_info"))/10)
+	}
+}
+
+type dbStats struct {
+	Size   int64
+	Topics []string
+}
+
+func getDbStats() (dbStats, error) {
+	c := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.DialTimeout("unix", DbSocketPath, 2*time.Second)
+			},
+		},
+	}
+	defer c.CloseIdleConnections()
+
+	stats := dbStats{}
+	resp, err := c.Get("http://localhost/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return stats, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("db stats returned %d", resp.StatusCode)
+	}
+
+	err = json.Unmarshal(data, &stats)
+	return stats, err
+}
+
+func writeDbMetrics(m *metricsWriter, stats dbStats, err error) {
+	m.family("spr_db_up", "gauge", "Event database is reachable")
+	m.sample("spr_db_up", nil, boolMetric(err == nil))
+	if err != nil {
+		return
+	}
+
+	m.family("spr_db_size_bytes", "gauge", "Event database size")
+	m.sample("spr_db_size_bytes", nil, float64(stats.Size))
+
+	m.family("spr_db_topics", "gauge", "Event topics seen by the database")
+	m.sample("spr_db_topics", nil, float64(len(stats.Topics)))
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	devices := readDevicesSnapshot()
+
+	Interfacesmtx.Lock()
+	interfaces := loadInterfacesConfigLocked()
+	Interfacesmtx.Unlock()
+
+	readings := map[string]*NetCount{}
+	if history := gTrafficHistory; len(history) > 0 {
+		readings = history[0]
+	}
+
+	m := &metricsWriter{}
+	writeWanMetrics(m, wanUplinkStatuses())
+	writeTrafficMetrics(m, readings, devices)
+	writeStationMetrics(m, getTopologyWifiStations(interfaces), devices)
+	stats, err := getDbStats()
+	writeDbMetrics(m, stats, err)
+
+	w.Header().Set("Content-Type", openMetricsContentType)
+	fmt.Fprint(w, m.String())
+}
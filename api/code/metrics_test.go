@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	m := &metricsWriter{}
+	m.family("spr_test", "gauge", "A test gauge")
+	m.sample("spr_test", []MetricLabel{{"name", "living \"room\" tv\\"}, {"mac", "aa:bb"}}, 1.5)
+	m.sample("spr_test", nil, 0)
+
+	want := "# TYPE spr_test gauge\n" +
+		"# HELP spr_test A test gauge\n" +
+		`spr_test{name="living \"room\" tv\\",mac="aa:bb"} 1.5` + "\n" +
+		"spr_test 0\n" +
+		"# EOF\n"
+	if got := m.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteWanMetrics(t *testing.T) {
+	m := &metricsWriter{}
+	writeWanMetrics(m, []WanUplinkStatus{{Iface: "eth0", Up: true, LossPct: 25, TotalOutages: 3}})
+	out := m.String()
+
+	for _, line := range []string{
+		`spr_wan_up{uplink="eth0"} 1`,
+		`spr_wan_active{uplink="eth0"} 0`,
+		`spr_wan_loss_ratio{uplink="eth0"} 0.25`,
+		`spr_wan_outages_total{uplink="eth0"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, out)
+		}
+	}
+}
+
+func TestWriteTrafficMetrics(t *testing.T) {
+	devices := map[string]DeviceEntry{
+		"aa:bb:cc:dd:ee:ff": {Name: "tv", MAC: "aa:bb:cc:dd:ee:ff", RecentIP: "192.168.2.6", DHCPLastInterface: "wlan1"},
+	}
+	readings := map[string]*NetCount{
+		"192.168.2.6":  {LanIn: 1, LanOut: 2, WanIn: 300, WanOut: 400},
+		"192.168.2.10": {WanIn: 5},
+	}
+
+	m := &metricsWriter{}
+	writeTrafficMetrics(m, readings, devices)
+	out := m.String()
+
+	line := `spr_device_traffic_bytes_total{mac="aa:bb:cc:dd:ee:ff",name="tv",ip="192.168.2.6",interface="wlan1",zone="wan",direction="in"} 300`
+	if !strings.Contains(out, line+"\n") {
+		t.Errorf("missing %s in\n%s", line, out)
+	}
+	if strings.Contains(out, "192.168.2.10") {
+		t.Error("unknown addresses should not be exported")
+	}
+}
+
+func TestWriteStationMetrics(t *testing.T) {
+	stations := map[string]wifiStation{
+		"aa:bb:cc:dd:ee:ff": {Iface: "wlan1", Station: map[string]string{"signal": "-52", "tx_rate_info": "8667 vhtmcs 9", "rx_rate_info": "60"}},
+	}
+
+	m := &metricsWriter{}
+	writeStationMetrics(m, stations, map[string]DeviceEntry{})
+	out := m.String()
+
+	for _, value := range []string{"signal_dbm", "tx_rate_mbps", "rx_rate_mbps"} {
+		if !strings.Contains(out, "spr_station_"+value+`{mac="aa:bb:cc:dd:ee:ff",name="",interface="wlan1"}`) {
+			t.Errorf("missing %s in\n%s", value, out)
+		}
+	}
+	if !strings.Contains(out, "} 866.7\n") || !strings.Contains(out, "} -52\n") {
+		t.Errorf("unexpected values in\n%s", out)
+	}
+}
+
+func TestWriteDbMetrics(t *testing.T) {
+	m := &metricsWriter{}
+	writeDbMetrics(m, dbStats{}, fmt.Errorf("unreachable"))
+	if out := m.String(); !strings.Contains(out, "spr_db_up 0\n") || strings.Contains(out, "spr_db_size_bytes") {
+		t.Errorf("unexpected output\n%s", out)
+	}
+}
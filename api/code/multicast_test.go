@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateMDNSGateway(t *testing.T) {
+	valid := MDNSGatewaySettings{
+		Enabled: true,
+		Policies: []MDNSServicePolicy{
+			{Service: "_airplay._tcp", FromGroups: []string{"media"}, ToGroups: []string{"family"}},
+			{Service: "_ipp._tcp"},
+			{Service: "_googlecast._tcp", ToGroups: []string{"family"}, Disabled: true},
+		},
+	}
+	if err := validateMDNSGateway(valid); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	invalid := []MDNSServicePolicy{
+		{Service: ""},
+		{Service: "airplay._tcp"},
+		{Service: "_airplay._sctp"},
+		{Service: "_airplay._tcp.local"},
+		{Service: "_air play._tcp"},
+		{Service: "_airplay._tcp", FromGroups: []string{""}},
+		{Service: "_airplay._tcp", ToGroups: []string{" "}},
+	}
+	for _, policy := range invalid {
+		settings := MDNSGatewaySettings{Policies: []MDNSServicePolicy{policy}}
+		if err := validateMDNSGateway(settings); err == nil {
+			t.Errorf("expected an error for %+v", policy)
+		}
+	}
+}
+
+func TestAddIPv6MulticastAddresses(t *testing.T) {
+	settings := MulticastSettings{Addresses: []MulticastAddress{
+		{Address: "224.0.0.251:5353", Tags: []string{"lan"}},
+		{Address: "239.255.255.250:1900", Disabled: true},
+		{Address: "224.0.0.1:7000"},
+	}}
+
+	addIPv6MulticastAddresses(&settings)
+
+	want := []MulticastAddress{
+		{Address: "224.0.0.251:5353", Tags: []string{"lan"}},
+		{Address: "[ff02::fb]:5353", Tags: []string{"lan"}},
+		{Address: "239.255.255.250:1900", Disabled: true},
+		{Address: "[ff02::c]:1900", Disabled: true},
+		{Address: "224.0.0.1:7000"},
+	}
+	if !reflect.DeepEqual(settings.Addresses, want) || !settings.IPv6Migrated {
+		t.Errorf("got %+v", settings)
+	}
+
+	//a group that is configured already is not added twice
+	settings = MulticastSettings{Addresses: []MulticastAddress{
+		{Address: "[ff02::fb]:5353", Disabled: true},
+		{Address: "224.0.0.251:5353"},
+	}}
+	addIPv6MulticastAddresses(&settings)
+	if len(settings.Addresses) != 2 {
+		t.Errorf("got %+v", settings.Addresses)
+	}
+
+	//once migrated, a removed group stays removed
+	settings = MulticastSettings{IPv6Migrated: true, Addresses: []MulticastAddress{{Address: "224.0.0.251:5353"}}}
+	addIPv6MulticastAddresses(&settings)
+	if len(settings.Addresses) != 1 {
+		t.Errorf("got %+v", settings.Addresses)
+	}
+}
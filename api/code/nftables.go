@@ -442,6 +442,8 @@ func verdictEntryFromKey(mapName string, keyLen int, parts []string) verdictEntr
 		switch kind {
 		case "ip":
 			e.ipv4 = parts[i]
+		case "ip6":
+			e.ipv6 = parts[i]
 		case "iface":
 			e.ifname = parts[i]
 		case "mac":
@@ -738,6 +740,15 @@ func concatKeySchema(mapName string, keyLen int) []string {
 	case "all_ip":
 		// type ifname . ipv4_addr . ipv4_addr
 		return []string{"iface", "ip", "ip"}
+	case "ethernet_filter6":
+		// type ipv6_addr . ifname . ether_addr
+		return []string{"ip6", "iface", "mac"}
+	}
+
+	// internet_access6, dns_access6, lan_access6 and the per-group
+	// <zone>_src_access6 / <zone>_dst_access6 maps: ipv6_addr . ifname
+	if isIPv6MapName(mapName) && keyLen == 32 {
+		return []string{"ip6", "iface"}
 	}
 
 	// internet_access, dns_access, lan_access and the per-group
@@ -749,7 +760,7 @@ func concatKeySchema(mapName string, keyLen int) []string {
 	return nil
 }
 
-var concatFieldBytes = map[string]int{"ip": 4, "iface": 16, "mac": 8}
+var concatFieldBytes = map[string]int{"ip": 4, "ip6": 16, "iface": 16, "mac": 8}
 
 // splitConcatKey decodes a concatenated key into its string parts,
 // or returns nil when the map/key is not a known concatenation
@@ -773,7 +784,7 @@ func splitConcatKey(mapName string, key []byte) []string {
 		seg := key[off : off+concatFieldBytes[field]]
 		off += concatFieldBytes[field]
 		switch field {
-		case "ip":
+		case "ip", "ip6":
 			parts = append(parts, net.IP(seg).String())
 		case "iface":
 			parts = append(parts, strings.TrimRight(string(seg), "\x00"))
@@ -926,6 +937,24 @@ func IPToBytes(ip string) []byte {
 	return parsed.To4()
 }
 
+// IP6ToBytes converts an IPv6 address or CIDR string to its 16 byte form.
+// IPv4 and IPv4-mapped addresses are rejected.
+func IP6ToBytes(ip string) []byte {
+	if strings.Contains(ip, "/") {
+		ipAddr, _, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil
+		}
+		ip = ipAddr.String()
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return nil
+	}
+	return parsed.To16()
+}
+
 // PortToBytes converts a port string to bytes
 func PortToBytes(port string) []byte {
 	p, err := strconv.Atoi(port)
@@ -1119,6 +1148,24 @@ func ipRangeBytes(ip string) (start, end []byte) {
 	return b, b
 }
 
+// ip6RangeBytes returns the inclusive start/end bytes for an IPv6 address or CIDR
+func ip6RangeBytes(ip string) (start, end []byte) {
+	if strings.Contains(ip, "/") {
+		_, ipnet, err := net.ParseCIDR(ip)
+		if err != nil || ipnet.IP.To4() != nil {
+			return nil, nil
+		}
+		start = ipnet.IP.To16()
+		end = make([]byte, 16)
+		for i := range start {
+			end[i] = start[i] | ^ipnet.Mask[i]
+		}
+		return start, end
+	}
+	b := IP6ToBytes(ip)
+	return b, b
+}
+
 // portRangeBytesConcat returns the inclusive start/end bytes for a port or port range
 func portRangeBytesConcat(port string) (start, end []byte) {
 	conv := func(s string) []byte {
@@ -1158,6 +1205,7 @@ func concatRangeKeys(fields ...[2][]byte) (key, keyEnd []byte) {
 }
 
 func ipField(ip string) [2][]byte   { s, e := ipRangeBytes(ip); return [2][]byte{s, e} }
+func ip6Field(ip string) [2][]byte  { s, e := ip6RangeBytes(ip); return [2][]byte{s, e} }
 func portField(p string) [2][]byte  { s, e := portRangeBytesConcat(p); return [2][]byte{s, e} }
 func exactField(b []byte) [2][]byte { return [2][]byte{b, b} }
 
@@ -1617,7 +1665,21 @@ func GetElementFromMap(family, tableName, mapName, key string) error {
 func buildConcatenatedKey(mapName string, keyParts []string) ([]byte, []byte, error) {
 	var fields [][2][]byte
 
-	if mapName == "ethernet_filter" && len(keyParts) == 3 {
+	if isIPv6MapName(mapName) && (len(keyParts) == 2 || len(keyParts) == 3) {
+		// ipv6_addr . ifname [. ether_addr], the address is usually a device /64
+		if IP6ToBytes(keyParts[0]) == nil {
+			return nil, nil, fmt.Errorf("invalid IPv6 address: %s", keyParts[0])
+		}
+		fields = append(fields, ip6Field(keyParts[0]), ifaceField(keyParts[1]))
+		if len(keyParts) == 3 {
+			macBytes := MACToBytes(keyParts[2])
+			if macBytes == nil {
+				return nil, nil, fmt.Errorf("invalid MAC address: %s", keyParts[2])
+			}
+			fields = append(fields, exactField(macBytes))
+		}
+
+	} else if mapName == "ethernet_filter" && len(keyParts) == 3 {
 		ipBytes := IPToBytes(keyParts[0])
 		if ipBytes == nil {
 			return nil, nil, fmt.Errorf("invalid IP address: %s", keyParts[0])
@@ -1724,6 +1786,11 @@ func DeleteMACVerdictElement(family, tableName, mapName, ip, iface, mac, verdict
 
 // AddIPIfaceVerdictElement adds an element with IP.Interface:Verdict format
 func AddIPIfaceVerdictElement(family, tableName, mapName, ip, iface, verdict string) error {
+	// IPv6 addresses belong in the ip6 counterpart of the map
+	if IP6ToBytes(ip) != nil {
+		return AddElementToMapComplex(family, tableName, ipv6MapName(mapName), []string{ip, iface}, verdict)
+	}
+
 	// Check if this is a CIDR notation and the map supports intervals
 	if strings.Contains(ip, "/") {
 		// fwd_iface_lan/wan are keyed ifname.ipv4_addr, dns_access ipv4_addr.ifname
@@ -1904,8 +1971,19 @@ func CheckMapExists(family, tableName, mapName string) error {
 	return err
 }
 
-// CreateIPIfaceVerdictMap creates a map with type ipv4_addr . ifname : verdict
+// CreateIPIfaceVerdictMap creates a map with type ipv4_addr . ifname : verdict.
+// The map is an interval map so that a routed site subnet is a single element.
 func CreateIPIfaceVerdictMap(family, tableName, mapName string) error {
+	return createAddrIfaceVerdictMap(family, tableName, mapName, nftables.TypeIPAddr, true)
+}
+
+// CreateIP6IfaceVerdictMap creates a map with type ipv6_addr . ifname : verdict.
+// The map is an interval map so that a whole device /64 is a single element.
+func CreateIP6IfaceVerdictMap(family, tableName, mapName string) error {
+	return createAddrIfaceVerdictMap(family, tableName, mapName, nftables.TypeIP6Addr, true)
+}
+
+func createAddrIfaceVerdictMap(family, tableName, mapName string, addrType nftables.SetDatatype, interval bool) error {
 	f, client, err := withFamily(family)
 	if err != nil {
 		return err
@@ -1918,7 +1996,7 @@ func CreateIPIfaceVerdictMap(family, tableName, mapName string) error {
 	}
 	table := client.GetTable(f, tableName)
 
-	keyType, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeIFName)
+	keyType, err := nftables.ConcatSetType(addrType, nftables.TypeIFName)
 	if err != nil {
 		return fmt.Errorf("failed to build concatenated key type for map %s: %v", mapName, err)
 	}
@@ -1928,6 +2006,7 @@ func CreateIPIfaceVerdictMap(family, tableName, mapName string) error {
 		Name:          mapName,
 		IsMap:         true,
 		Concatenation: true,
+		Interval:      interval,
 		KeyType:       keyType,
 		DataType:      nftables.TypeVerdict,
 	}
@@ -1993,6 +2072,15 @@ func ipv4Dependency() []expr.Any {
 	}
 }
 
+// ipv6Dependency matches `meta nfproto ipv6`, the implicit dependency nft
+// generates for `ip6 ...` matches in inet-family tables.
+func ipv6Dependency() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+	}
+}
+
 // AddMarkSetRule appends `meta mark set <mark>` to a chain.
 func AddMarkSetRule(family, tableName, chainName string, mark uint32) error {
 	return addRuleExprs(family, tableName, chainName, []expr.Any{
@@ -2014,9 +2102,87 @@ func AddAcceptRule(family, tableName, chainName string) error {
 //	ip daddr != @supernetworks ip daddr != 224.0.0.0/4
 //	meta mark set jhash ip saddr [. ip daddr] mod <numTables> offset <offset>
 func AddOutboundUplinkHashRule(family, tableName, chainName string, saddrOnly bool, numTables, offset int) error {
+	exprs, err := outboundUplinkMatch()
+	if err != nil {
+		return err
+	}
+
+	exprs = append(exprs, outboundUplinkHash(saddrOnly, numTables, offset)...)
+	exprs = append(exprs,
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+
+	return addRuleExprs(family, tableName, chainName, exprs, false)
+}
+
+// AddOutboundUplinkWeightedRule appends the weighted load-balancing rule,
+// hashing into numSlots slots that map to uplink marks:
+//
+//	<outbound match> meta mark set jhash ip saddr [. ip daddr] mod <numSlots> map @uplink_weights
+func AddOutboundUplinkWeightedRule(family, tableName, chainName string, saddrOnly bool, numSlots int) error {
+	exprs, err := outboundUplinkMatch()
+	if err != nil {
+		return err
+	}
+
+	exprs = append(exprs, outboundUplinkHash(saddrOnly, numSlots, 0)...)
+	exprs = append(exprs,
+		&expr.Lookup{SourceRegister: 1, SetName: "uplink_weights", DestRegister: 1, IsDestRegSet: true},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+
+	return addRuleExprs(family, tableName, chainName, exprs, false)
+}
+
+// AddOutboundUplinkPinRule appends the per device uplink rule:
+//
+//	<outbound match> ip saddr vmap @uplink_pins
+func AddOutboundUplinkPinRule(family, tableName, chainName string) error {
+	exprs, err := outboundUplinkMatch()
+	if err != nil {
+		return err
+	}
+
+	exprs = append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: "uplink_pins", DestRegister: 0, IsDestRegSet: true},
+	)
+
+	return addRuleExprs(family, tableName, chainName, exprs, false)
+}
+
+// SetUplinkWeights replaces the uplink_weights slots, slot i maps to marks[i]
+func SetUplinkWeights(family, tableName string, marks []uint32) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	err = client.FlushMap(f, tableName, "uplink_weights")
+	if err != nil {
+		return err
+	}
+
+	for slot, mark := range marks {
+		err = client.AddMapElement(f, tableName, "uplink_weights",
+			binaryutil.NativeEndian.PutUint32(uint32(slot)),
+			binaryutil.NativeEndian.PutUint32(mark))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// outboundUplinkMatch matches traffic eligible for uplink selection:
+//
+//	iif != lo iifname != "site*" iifname != @uplink_interfaces
+//	ip daddr != @supernetworks ip daddr != 224.0.0.0/4
+func outboundUplinkMatch() ([]expr.Any, error) {
 	lo, err := net.InterfaceByName("lo")
 	if err != nil {
-		return fmt.Errorf("failed to resolve interface lo: %v", err)
+		return nil, fmt.Errorf("failed to resolve interface lo: %v", err)
 	}
 
 	exprs := []expr.Any{
@@ -2039,6 +2205,13 @@ func AddOutboundUplinkHashRule(family, tableName, chainName string, saddrOnly bo
 		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0xe0, 0x00, 0x00, 0x00}},
 	)
 
+	return exprs, nil
+}
+
+// outboundUplinkHash leaves jhash ip saddr [. ip daddr] mod <modulus> offset <offset> in register 1
+func outboundUplinkHash(saddrOnly bool, modulus, offset int) []expr.Any {
+	exprs := []expr.Any{}
+
 	// Hash key loads into 128-bit register 2 (32-bit slots 12+), matching nft's
 	// register allocation: saddr to the first slot, daddr to slot 13 for the
 	// concatenated strategy.
@@ -2050,11 +2223,123 @@ func AddOutboundUplinkHashRule(family, tableName, chainName string, saddrOnly bo
 	}
 	exprs = append(exprs,
 		&expr.Hash{SourceRegister: 2, DestRegister: 1, Length: hashLen,
-			Modulus: uint32(numTables), Offset: uint32(offset), Type: expr.HashTypeJenkins},
-		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			Modulus: uint32(modulus), Offset: uint32(offset), Type: expr.HashTypeJenkins},
 	)
 
-	return addRuleExprs(family, tableName, chainName, exprs, false)
+	return exprs
+}
+
+// BandwidthLimit drops uplink traffic of an address over a byte rate.
+// Addr is an IPv4 address or a device ip6 /64.
+type BandwidthLimit struct {
+	Addr           string
+	Ingress        bool
+	BytesPerSecond uint64
+}
+
+// bandwidthLimitExprs builds:
+//
+//	oifname @uplink_interfaces ip saddr <addr> limit rate over <rate> bytes/second drop
+//
+// with iifname and daddr for ingress, and ip6 saddr/daddr for a /64
+func bandwidthLimitExprs(limit BandwidthLimit) ([]expr.Any, error) {
+	ifKey, offset4, offset6 := expr.MetaKeyOIFNAME, uint32(12), uint32(8)
+	if limit.Ingress {
+		ifKey, offset4, offset6 = expr.MetaKeyIIFNAME, 16, 24
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: ifKey, Register: 1},
+		&expr.Lookup{SourceRegister: 1, SetName: "uplink_interfaces"},
+	}
+
+	if ip := net.ParseIP(limit.Addr); ip != nil && ip.To4() != nil {
+		exprs = append(exprs, ipv4Dependency()...)
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset4, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.To4()},
+		)
+	} else if _, subnet, err := net.ParseCIDR(limit.Addr); err == nil && subnet.IP.To4() == nil {
+		if ones, _ := subnet.Mask.Size(); ones != 64 {
+			return nil, fmt.Errorf("expected an ip6 /64, got %s", limit.Addr)
+		}
+		exprs = append(exprs, ipv6Dependency()...)
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset6, Len: 8},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP[:8]},
+		)
+	} else {
+		return nil, fmt.Errorf("invalid address %s", limit.Addr)
+	}
+
+	exprs = append(exprs,
+		&expr.Limit{Type: expr.LimitTypePktBytes, Rate: limit.BytesPerSecond, Over: true, Unit: expr.LimitTimeSecond},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+
+	return exprs, nil
+}
+
+// queueBandwidthLimits adds the rules for an owner to the pending batch,
+// the owner is kept in the rule userdata
+func queueBandwidthLimits(client *NFTClient, chain *nftables.Chain, owner string, limits []BandwidthLimit) {
+	for _, limit := range limits {
+		exprs, err := bandwidthLimitExprs(limit)
+		if err != nil {
+			log.Println("skipping bandwidth limit", owner, err)
+			continue
+		}
+		client.conn.AddRule(&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: []byte(owner),
+		})
+	}
+}
+
+// ReplaceBandwidthLimitRules swaps the rules of one owner in a single
+// transaction, the rules of other owners are left alone
+func ReplaceBandwidthLimitRules(family, tableName, chainName, owner string, limits []BandwidthLimit) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	table := client.GetTable(f, tableName)
+	chain := &nftables.Chain{Name: chainName, Table: table}
+
+	rules, err := client.conn.GetRules(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if string(rule.UserData) == owner {
+			if err := client.conn.DelRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	queueBandwidthLimits(client, chain, owner, limits)
+	return client.conn.Flush()
+}
+
+// ResetBandwidthLimitRules replaces the whole chain in a single transaction
+func ResetBandwidthLimitRules(family, tableName, chainName string, limits map[string][]BandwidthLimit) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	table := client.GetTable(f, tableName)
+	chain := &nftables.Chain{Name: chainName, Table: table}
+
+	client.conn.FlushChain(chain)
+	for owner, ownerLimits := range limits {
+		queueBandwidthLimits(client, chain, owner, ownerLimits)
+	}
+	return client.conn.Flush()
 }
 
 // InsertWiphyForwardLanRule inserts:
@@ -2077,6 +2362,25 @@ func InsertWiphyForwardLanRule(family, tableName, chainName, apIface string) err
 	return addRuleExprs(family, tableName, chainName, exprs, true)
 }
 
+// InsertWiphyForwardLanRule6 inserts the ip6 counterpart of InsertWiphyForwardLanRule:
+//
+//	counter oifname "<apIface>.*" ip6 saddr . iifname vmap @lan_access6
+func InsertWiphyForwardLanRule6(family, tableName, chainName, apIface string) error {
+	exprs := []expr.Any{
+		&expr.Counter{},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(apIface + ".")},
+	}
+	exprs = append(exprs, ipv6Dependency()...)
+	exprs = append(exprs,
+		// the 16 byte saddr fills 32-bit registers 8-11, iifname follows at 12
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 12},
+		&expr.Lookup{SourceRegister: 1, SetName: "lan_access6", DestRegister: 0, IsDestRegSet: true},
+	)
+	return addRuleExprs(family, tableName, chainName, exprs, true)
+}
+
 // InsertCustomGroupVmapRule inserts the custom-zone vmap rule:
 //
 //	ip daddr . oifname vmap @<zone>_dst_access ip saddr . iifname vmap @<zone>_src_access
@@ -2093,6 +2397,22 @@ func InsertCustomGroupVmapRule(family, tableName, chainName, zoneName string) er
 	return addRuleExprs(family, tableName, chainName, exprs, true)
 }
 
+// InsertCustomGroupVmapRule6 inserts the ip6 custom-zone vmap rule:
+//
+//	ip6 daddr . oifname vmap @<zone>_dst_access6 ip6 saddr . iifname vmap @<zone>_src_access6
+func InsertCustomGroupVmapRule6(family, tableName, chainName, zoneName string) error {
+	exprs := ipv6Dependency()
+	exprs = append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 12},
+		&expr.Lookup{SourceRegister: 1, SetName: zoneName + "_dst_access6", DestRegister: 0, IsDestRegSet: true},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 12},
+		&expr.Lookup{SourceRegister: 1, SetName: zoneName + "_src_access6", DestRegister: 0, IsDestRegSet: true},
+	)
+	return addRuleExprs(family, tableName, chainName, exprs, true)
+}
+
 // InsertDNSDnatPortRule inserts:
 //
 //	<protocol> dport 53 counter dnat ip to <dnsIP>:53
@@ -2261,6 +2581,123 @@ func AddCIDRToSet(family, tableName, setName, cidr string) error {
 	return client.conn.Flush()
 }
 
+// ip6IntervalElements returns the start and IntervalEnd elements covering an
+// IPv6 address or CIDR in a non-concatenated interval set or map
+func ip6IntervalElements(cidr string, verdictData *expr.Verdict) ([]nftables.SetElement, error) {
+	start, end := ip6RangeBytes(cidr)
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("invalid IPv6 address or CIDR: %s", cidr)
+	}
+
+	// IntervalEnd marks the element after the last included address
+	next := make(net.IP, 16)
+	copy(next, end)
+	overflow := true
+	for i := 15; i >= 0; i-- {
+		if next[i] < 255 {
+			next[i]++
+			overflow = false
+			break
+		}
+		next[i] = 0
+	}
+	if overflow {
+		return nil, fmt.Errorf("range %s reaches the end of the address space", cidr)
+	}
+
+	return []nftables.SetElement{
+		{Key: start, VerdictData: verdictData},
+		{Key: next, IntervalEnd: true},
+	}, nil
+}
+
+// AddIP6CIDRToSet adds an IPv6 address or CIDR to an ipv6_addr interval set.
+// With a verdict the target is treated as an ipv6_addr : verdict interval map.
+func AddIP6CIDRToSet(family, tableName, setName, cidr string, verdict ...string) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	var verdictData *expr.Verdict
+	if len(verdict) != 0 {
+		verdictData, err = createVerdictData(verdict[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	elements, err := ip6IntervalElements(cidr, verdictData)
+	if err != nil {
+		return err
+	}
+
+	set, err := client.GetMap(f, tableName, setName)
+	if err != nil {
+		return err
+	}
+
+	if err := client.conn.SetAddElements(set, elements); err != nil {
+		return err
+	}
+	return client.conn.Flush()
+}
+
+// DeleteIP6CIDRFromSet removes an IPv6 address or CIDR added by AddIP6CIDRToSet
+func DeleteIP6CIDRFromSet(family, tableName, setName, cidr string) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	elements, err := ip6IntervalElements(cidr, nil)
+	if err != nil {
+		return err
+	}
+
+	set, err := client.GetMap(f, tableName, setName)
+	if err != nil {
+		return err
+	}
+
+	if err := client.conn.SetDeleteElements(set, elements); err != nil {
+		return err
+	}
+	return client.conn.Flush()
+}
+
+// GetIP6CIDRFromSet checks if the interval starting an IPv6 address or CIDR
+// is present in a set
+func GetIP6CIDRFromSet(family, tableName, setName, cidr string) error {
+	f, client, err := withFamily(family)
+	if err != nil {
+		return err
+	}
+
+	start, _ := ip6RangeBytes(cidr)
+	if start == nil {
+		return fmt.Errorf("invalid IPv6 address or CIDR: %s", cidr)
+	}
+
+	set, err := client.GetMap(f, tableName, setName)
+	if err != nil {
+		return fmt.Errorf("failed to get set %s/%s/%s: %w", familyToString(f), tableName, setName, err)
+	}
+
+	elements, err := client.conn.GetSetElements(set)
+	if err != nil {
+		return fmt.Errorf("failed to get set elements: %w", err)
+	}
+
+	for _, elem := range elements {
+		if !elem.IntervalEnd && bytes.Equal(elem.Key, start) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("element not found in set")
+}
+
 func AddIPRangesToSet(family, tableName, setName string, ranges [][2]net.IP, verdict ...string) error {
 	f, client, err := withFamily(family)
 	if err != nil {
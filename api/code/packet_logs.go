@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var PacketLogsConfigFile = TEST_PREFIX + "/configs/base/packet_logs.json"
+
+// publish one of every Rate packets on topics starting with Topic,
+// 0 publishes none and 1 every packet
+type PacketLogsTopicSampling struct {
+	Topic string
+	Rate  int
+}
+
+type PacketLogsSettings struct {
+	Aggregate      bool
+	WindowSeconds  int
+	PacketSampling []PacketLogsTopicSampling
+}
+
+var PacketLogsmtx sync.Mutex
+
+func validatePacketLogsSettings(settings *PacketLogsSettings) error {
+	if settings.WindowSeconds == 0 {
+		settings.WindowSeconds = 60
+	}
+	if settings.WindowSeconds < 10 || settings.WindowSeconds > 3600 {
+		return fmt.Errorf("window must be between 10 and 3600 seconds")
+	}
+
+	seen := map[string]bool{}
+	for _, rule := range settings.PacketSampling {
+		if !strings.HasPrefix(rule.Topic, "nft:") {
+			return fmt.Errorf("invalid sampling topic %q, expected an nft: prefix", rule.Topic)
+		}
+		if strings.ContainsAny(rule.Topic, " \t\n") {
+			return fmt.Errorf("invalid sampling topic %q", rule.Topic)
+		}
+		if rule.Rate < 0 {
+			return fmt.Errorf("invalid sampling rate %d for %s", rule.Rate, rule.Topic)
+		}
+		if seen[rule.Topic] {
+			return fmt.Errorf("duplicate sampling topic %s", rule.Topic)
+		}
+		seen[rule.Topic] = true
+	}
+	return nil
+}
+
+func loadPacketLogsSettings() PacketLogsSettings {
+	settings := PacketLogsSettings{WindowSeconds: 60}
+	data, err := os.ReadFile(PacketLogsConfigFile)
+	if err != nil {
+		return settings
+	}
+	_ = json.Unmarshal(data, &settings)
+	return settings
+}
+
+func packetLogsSettings(w http.ResponseWriter, r *http.Request) {
+	PacketLogsmtx.Lock()
+	defer PacketLogsmtx.Unlock()
+	settings := PacketLogsSettings{}
+
+	if r.Method == http.MethodPut {
+		err := json.NewDecoder(r.Body).Decode(&settings)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to deserialize settings").Error(), 400)
+			return
+		}
+
+		err = validatePacketLogsSettings(&settings)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = saveFileJSON(PacketLogsConfigFile, settings)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		callSuperdRestart("", "packet_logs")
+	} else {
+		settings = loadPacketLogsSettings()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidatePacketLogsSettings(t *testing.T) {
+	settings := PacketLogsSettings{
+		Aggregate: true,
+		PacketSampling: []PacketLogsTopicSampling{
+			{Topic: "nft:drop:", Rate: 10},
+			{Topic: "nft:drop:mac", Rate: 1},
+			{Topic: "nft:lan:", Rate: 0},
+		},
+	}
+	if err := validatePacketLogsSettings(&settings); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if settings.WindowSeconds != 60 {
+		t.Errorf("expected default window, got %d", settings.WindowSeconds)
+	}
+
+	invalid := []PacketLogsSettings{
+		{WindowSeconds: 5},
+		{WindowSeconds: 7200},
+		{PacketSampling: []PacketLogsTopicSampling{{Topic: "drop:", Rate: 1}}},
+		{PacketSampling: []PacketLogsTopicSampling{{Topic: "nft:drop: ", Rate: 1}}},
+		{PacketSampling: []PacketLogsTopicSampling{{Topic: "nft:drop:", Rate: -1}}},
+		{PacketSampling: []PacketLogsTopicSampling{{Topic: "nft:drop:", Rate: 2}, {Topic: "nft:drop:", Rate: 3}}},
+	}
+	for _, entry := range invalid {
+		if err := validatePacketLogsSettings(&entry); err == nil {
+			t.Errorf("expected an error for %+v", entry)
+		}
+	}
+}
@@ -194,6 +194,7 @@ func enforceDeviceInternet(dev DeviceEntry, blocked bool) {
 	}
 	if blocked {
 		DeleteElementFromMapComplex("inet", "filter", "internet_access", []string{dev.RecentIP, iface})
+		deleteVerdict6(dev.RecentIP, iface, "internet_access")
 		return
 	}
 	if slices.Contains(dev.Policies, "wan") {
@@ -268,6 +268,11 @@ var gPluginTemplates = []PluginConfig{
 		Enabled:         false,
 		ComposeFilePath: "wifi_uplink/docker-compose.yml",
 	},
+	{
+		Name:            "FLOWGATHER",
+		Enabled:         false,
+		ComposeFilePath: "flowgather/docker-compose.yml",
+	},
 }
 
 func updateConfigPluginDefaults(config *APIConfig) bool {
@@ -742,6 +747,35 @@ func handleRestartPlugin(w http.ResponseWriter, r *http.Request) {
 	restartPlugin(name)
 }
 
+// plugin health probes and restart supervision run in superd
+func proxyPluginHealth(w http.ResponseWriter, r *http.Request, pathname string) {
+	var body io.Reader
+	if r.Method == http.MethodPut {
+		body = r.Body
+	}
+
+	data, statusCode, err := superdRequestMethod(r.Method, pathname, nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if statusCode != http.StatusOK {
+		http.Error(w, strings.TrimSpace(string(data)), statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func handlePluginHealth(w http.ResponseWriter, r *http.Request) {
+	proxyPluginHealth(w, r, "plugin_health")
+}
+
+func handlePluginHealthConfig(w http.ResponseWriter, r *http.Request) {
+	proxyPluginHealth(w, r, "plugin_health_config")
+}
+
 func enablePlugin(name string) bool {
 	//returns true if a change was made
 	Configmtx.Lock()
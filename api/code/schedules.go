@@ -0,0 +1,377 @@
+package main
+
+/*
+ Time of day schedules for firewall rules and device policies.
+
+ A rule with Schedules is only installed inside one of its windows, and a
+ device policy listed in PolicySchedules only applies inside its windows.
+ Windows use the same format as parental control personas.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RuleScheduleState struct {
+	Kind     string
+	Index    int
+	RuleName string
+	Active   bool
+}
+
+type PolicyScheduleState struct {
+	Device string
+	Name   string
+	Policy string
+	Active bool
+}
+
+type FirewallConfigStatus struct {
+	FirewallConfig
+	RuleSchedules   []RuleScheduleState
+	PolicySchedules []PolicyScheduleState
+}
+
+// rule key -> installed, guarded by FWmtx
+var gRuleScheduleActive = map[string]bool{}
+
+// device identity -> applied policies
+var gPolicyScheduleActive = map[string][]string{}
+var PolicySchedulemtx sync.Mutex
+
+func validateSchedules(schedules []TimeWindow) error {
+	for _, s := range schedules {
+		start := parseHHMM(s.Start)
+		end := parseHHMM(s.End)
+		if start < 0 || end < 0 {
+			return fmt.Errorf("schedule Start/End must be HH:MM")
+		}
+		if start == end {
+			return fmt.Errorf("schedule Start and End must differ")
+		}
+		for _, day := range s.Days {
+			if day != 0 && day != 1 {
+				return fmt.Errorf("schedule Days must be 0 or 1")
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeRuleSchedules validates schedules, and drops empty ones so
+// rules compare equal to their saved form
+func normalizeRuleSchedules(rule *BaseRule) error {
+	if len(rule.Schedules) == 0 {
+		rule.Schedules = nil
+		return nil
+	}
+	return validateSchedules(rule.Schedules)
+}
+
+func inSchedules(schedules []TimeWindow, now time.Time) bool {
+	if len(schedules) == 0 {
+		return true
+	}
+	for _, w := range schedules {
+		if inScheduleWindow(w, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleActive(rule BaseRule, now time.Time) bool {
+	return inSchedules(rule.Schedules, now)
+}
+
+func (rule *BaseRule) baseRule() *BaseRule {
+	return rule
+}
+
+type scheduledRule[T any] interface {
+	*T
+	baseRule() *BaseRule
+}
+
+// withoutSchedules returns a copy of a rule without its schedules.
+// deletes match on the rule itself, so clients need not send them back
+func withoutSchedules[T any, P scheduledRule[T]](rule T) T {
+	P(&rule).baseRule().Schedules = nil
+	return rule
+}
+
+func ruleScheduleKey(kind string, rule interface{}) string {
+	data, _ := json.Marshal(rule)
+	return kind + ":" + string(data)
+}
+
+// scheduledRuleActive reports if a rule should be installed now,
+// and remembers it for the schedule ticker. Assumes FWmtx is locked
+func scheduledRuleActive(kind string, rule interface{}, base BaseRule) bool {
+	active := ruleActive(base, time.Now())
+	gRuleScheduleActive[ruleScheduleKey(kind, rule)] = active
+	return active
+}
+
+func activeCustomInterfaceRulesLocked() []CustomInterfaceRule {
+	now := time.Now()
+	active := []CustomInterfaceRule{}
+	for _, rule := range gFirewallConfig.CustomInterfaceRules {
+		if ruleActive(rule.BaseRule, now) {
+			active = append(active, rule)
+		}
+	}
+	return active
+}
+
+func activeDevicePolicies(dev DeviceEntry, now time.Time) []string {
+	if len(dev.PolicySchedules) == 0 {
+		return dev.Policies
+	}
+	policies := []string{}
+	for _, policy := range dev.Policies {
+		schedules, exists := dev.PolicySchedules[policy]
+		if !exists || inSchedules(schedules, now) {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// scheduledDevicePolicies returns the policies that apply to a device now,
+// and remembers them for the schedule ticker
+func scheduledDevicePolicies(dev DeviceEntry) []string {
+	policies := activeDevicePolicies(dev, time.Now())
+
+	PolicySchedulemtx.Lock()
+	if len(dev.PolicySchedules) == 0 {
+		delete(gPolicyScheduleActive, deviceIdentity(dev))
+	} else {
+		gPolicyScheduleActive[deviceIdentity(dev)] = policies
+	}
+	PolicySchedulemtx.Unlock()
+
+	return policies
+}
+
+func ruleScheduleStatesLocked(now time.Time) []RuleScheduleState {
+	states := []RuleScheduleState{}
+	add := func(kind string, index int, rule BaseRule) {
+		if len(rule.Schedules) > 0 {
+			states = append(states, RuleScheduleState{kind, index, rule.RuleName, ruleActive(rule, now)})
+		}
+	}
+
+	for i, rule := range gFirewallConfig.ForwardingRules {
+		add("ForwardingRules", i, rule.BaseRule)
+	}
+	for i, rule := range gFirewallConfig.BlockRules {
+		add("BlockRules", i, rule.BaseRule)
+	}
+	for i, rule := range gFirewallConfig.OutputBlockRules {
+		add("OutputBlockRules", i, rule.BaseRule)
+	}
+	for i, rule := range gFirewallConfig.ForwardingBlockRules {
+		add("ForwardingBlockRules", i, rule.BaseRule)
+	}
+	for i, rule := range gFirewallConfig.CustomInterfaceRules {
+		add("CustomInterfaceRules", i, rule.BaseRule)
+	}
+	return states
+}
+
+func policyScheduleStates(devices map[string]DeviceEntry, now time.Time) []PolicyScheduleState {
+	states := []PolicyScheduleState{}
+	for identity, dev := range devices {
+		for _, policy := range dev.Policies {
+			schedules, exists := dev.PolicySchedules[policy]
+			if !exists {
+				continue
+			}
+			states = append(states, PolicyScheduleState{identity, dev.Name, policy, inSchedules(schedules, now)})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Device != states[j].Device {
+			return states[i].Device < states[j].Device
+		}
+		return states[i].Policy < states[j].Policy
+	})
+	return states
+}
+
+// ruleScheduleChange returns +1 when a rule has to be installed, -1 when
+// it has to be removed and 0 otherwise
+func ruleScheduleChange(next map[string]bool, kind string, rule interface{}, base BaseRule, now time.Time) int {
+	key := ruleScheduleKey(kind, rule)
+	active := ruleActive(base, now)
+	next[key] = active
+
+	installed, known := gRuleScheduleActive[key]
+	if !known || installed == active {
+		return 0
+	}
+
+	SprbusPublish("firewall:rule:schedule", map[string]interface{}{
+		"Kind":     kind,
+		"RuleName": base.RuleName,
+		"Active":   active,
+	})
+
+	if active {
+		return 1
+	}
+	return -1
+}
+
+func applyRuleSchedulesLocked(now time.Time) {
+	next := map[string]bool{}
+
+	for _, f := range gFirewallConfig.ForwardingRules {
+		switch ruleScheduleChange(next, "ForwardingRules", f, f.BaseRule, now) {
+		case 1:
+			err := AddForwardingRule(f.Protocol, f.SrcIP, f.SrcPort, f.DstIP, f.DstPort)
+			if err != nil {
+				log.Println("failed to add forwarding rule", err)
+			}
+		case -1:
+			deleteForwarding(f)
+		}
+	}
+
+	for _, br := range gFirewallConfig.BlockRules {
+		switch ruleScheduleChange(next, "BlockRules", br, br.BaseRule, now) {
+		case 1:
+			err := AddBlockRule(br.SrcIP, br.DstIP, br.Protocol)
+			if err != nil {
+				log.Println("failed to add block rule", err)
+			}
+		case -1:
+			deleteBlock(br)
+		}
+	}
+
+	for _, br := range gFirewallConfig.OutputBlockRules {
+		switch ruleScheduleChange(next, "OutputBlockRules", br, br.BaseRule, now) {
+		case 1:
+			err := AddOutputBlockRule(br.SrcIP, br.DstIP, br.Protocol)
+			if err != nil {
+				log.Println("failed to add output block rule", err)
+			}
+		case -1:
+			deleteOutputBlock(br)
+		}
+	}
+
+	for _, br := range gFirewallConfig.ForwardingBlockRules {
+		switch ruleScheduleChange(next, "ForwardingBlockRules", br, br.BaseRule, now) {
+		case 1:
+			addForwardBlock(br)
+		case -1:
+			deleteForwardBlock(br)
+		}
+	}
+
+	active := activeCustomInterfaceRulesLocked()
+	for _, crule := range gFirewallConfig.CustomInterfaceRules {
+		switch ruleScheduleChange(next, "CustomInterfaceRules", crule, crule.BaseRule, now) {
+		case 1:
+			applyCustomInterfaceRule(active, crule, "add", false)
+		case -1:
+			err := applyCustomInterfaceRule(active, crule, "delete", true)
+			if err != nil {
+				log.Println("failed to remove custom interface rule", err)
+			}
+		}
+	}
+
+	gRuleScheduleActive = next
+}
+
+func applyPolicySchedules(now time.Time) {
+	Groupsmtx.Lock()
+	defer Groupsmtx.Unlock()
+	Devicesmtx.Lock()
+	defer Devicesmtx.Unlock()
+
+	devices := getDevicesJson()
+	groups := getGroupsJson()
+
+	for identity, dev := range devices {
+		PolicySchedulemtx.Lock()
+		applied, known := gPolicyScheduleActive[identity]
+		PolicySchedulemtx.Unlock()
+
+		if len(dev.PolicySchedules) == 0 {
+			continue
+		}
+
+		active := activeDevicePolicies(dev, now)
+		if known && equalStringSlice(applied, active) {
+			continue
+		}
+
+		//repopulates the verdict maps, and records the applied policies
+		refreshDeviceGroupsAndPolicy(devices, groups, dev)
+
+		PolicySchedulemtx.Lock()
+		gPolicyScheduleActive[identity] = active
+		PolicySchedulemtx.Unlock()
+
+		removed := false
+		for _, policy := range applied {
+			if !slices.Contains(active, policy) {
+				removed = true
+				break
+			}
+		}
+
+		if removed && dev.RecentIP != "" {
+			//drop established connections that are no longer allowed
+			exec.Command("conntrack", "-D", "-s", dev.RecentIP).Run()
+		}
+
+		if known {
+			SprbusPublish("device:policy:schedule", map[string]interface{}{
+				"Device":   identity,
+				"Name":     dev.Name,
+				"Policies": active,
+			})
+		}
+	}
+
+	//forget devices that were removed
+	PolicySchedulemtx.Lock()
+	for identity := range gPolicyScheduleActive {
+		if _, exists := devices[identity]; !exists {
+			delete(gPolicyScheduleActive, identity)
+		}
+	}
+	PolicySchedulemtx.Unlock()
+}
+
+func scheduleTick() {
+	now := time.Now()
+
+	FWmtx.Lock()
+	applyRuleSchedulesLocked(now)
+	FWmtx.Unlock()
+
+	applyPolicySchedules(now)
+}
+
+func scheduleLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for {
+		select {
+		case <-ticker.C:
+			scheduleTick()
+		}
+	}
+}
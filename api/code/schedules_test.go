@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var weekdays = [7]int{0, 1, 1, 1, 1, 1, 0}
+
+func TestValidateSchedules(t *testing.T) {
+	if err := validateSchedules([]TimeWindow{{Days: weekdays, Start: "22:00", End: "06:00"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []TimeWindow{
+		{Days: weekdays, Start: "9am", End: "17:00"},
+		{Days: weekdays, Start: "09:00", End: "09:00"},
+		{Days: [7]int{2}, Start: "09:00", End: "17:00"},
+	}
+	for _, w := range invalid {
+		if err := validateSchedules([]TimeWindow{w}); err == nil {
+			t.Errorf("expected an error for %+v", w)
+		}
+	}
+}
+
+func TestRuleActive(t *testing.T) {
+	// a wednesday
+	noon := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	night := time.Date(2026, 10, 14, 23, 0, 0, 0, time.Local)
+
+	rule := BaseRule{Schedules: []TimeWindow{{Days: weekdays, Start: "09:00", End: "17:00"}}}
+	if !ruleActive(rule, noon) || ruleActive(rule, night) {
+		t.Error("schedule was not honored")
+	}
+
+	if !ruleActive(BaseRule{}, night) {
+		t.Error("a rule without schedules is always active")
+	}
+
+	// Disabled is informational on rules, as before schedules
+	rule.Disabled = true
+	if !ruleActive(rule, noon) {
+		t.Error("Disabled changed whether a rule is installed")
+	}
+}
+
+func TestWithoutSchedules(t *testing.T) {
+	saved := BlockRule{
+		BaseRule: BaseRule{RuleName: "block", Schedules: []TimeWindow{{Days: [7]int{1, 1, 1, 1, 1, 1, 1}, Start: "22:00", End: "06:00"}}},
+		SrcIP:    "192.168.2.10",
+		DstIP:    "1.2.3.4",
+		Protocol: "tcp",
+	}
+
+	// a delete without the schedules matches the saved rule
+	request := saved
+	request.Schedules = nil
+	if !reflect.DeepEqual(withoutSchedules(request), withoutSchedules(saved)) {
+		t.Error("rule did not match without its schedules")
+	}
+	if saved.Schedules == nil {
+		t.Error("the saved rule was modified")
+	}
+
+	request.DstIP = "1.2.3.5"
+	if reflect.DeepEqual(withoutSchedules(request), withoutSchedules(saved)) {
+		t.Error("a different rule matched")
+	}
+}
+
+func TestActiveDevicePolicies(t *testing.T) {
+	noon := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	night := time.Date(2026, 10, 14, 23, 0, 0, 0, time.Local)
+
+	dev := DeviceEntry{
+		MAC:      "aa:bb:cc:dd:ee:ff",
+		Policies: []string{"dns", "wan", "lan"},
+		PolicySchedules: map[string][]TimeWindow{
+			"wan": {{Days: weekdays, Start: "07:00", End: "21:00"}},
+		},
+	}
+
+	if got := activeDevicePolicies(dev, noon); !reflect.DeepEqual(got, []string{"dns", "wan", "lan"}) {
+		t.Errorf("got %v at noon", got)
+	}
+	if got := activeDevicePolicies(dev, night); !reflect.DeepEqual(got, []string{"dns", "lan"}) {
+		t.Errorf("got %v at night", got)
+	}
+
+	states := policyScheduleStates(map[string]DeviceEntry{dev.MAC: dev}, night)
+	want := []PolicyScheduleState{{Device: dev.MAC, Policy: "wan", Active: false}}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("got %+v, want %+v", states, want)
+	}
+}
+
+func TestRuleScheduleChange(t *testing.T) {
+	oldActive := gRuleScheduleActive
+	t.Cleanup(func() {
+		gRuleScheduleActive = oldActive
+	})
+	gRuleScheduleActive = map[string]bool{}
+
+	noon := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)
+	night := time.Date(2026, 10, 14, 23, 0, 0, 0, time.Local)
+
+	rule := BlockRule{
+		BaseRule: BaseRule{RuleName: "school hours", Schedules: []TimeWindow{{Days: weekdays, Start: "08:00", End: "15:00"}}},
+		Protocol: "tcp",
+		SrcIP:    "192.168.2.10",
+		DstIP:    "1.2.3.4",
+	}
+
+	// rules that were never applied are left alone
+	next := map[string]bool{}
+	if change := ruleScheduleChange(next, "BlockRules", rule, rule.BaseRule, noon); change != 0 {
+		t.Fatalf("unexpected change %d", change)
+	}
+	gRuleScheduleActive = next
+
+	next = map[string]bool{}
+	if change := ruleScheduleChange(next, "BlockRules", rule, rule.BaseRule, noon); change != 0 {
+		t.Fatalf("unexpected change %d", change)
+	}
+	gRuleScheduleActive = next
+
+	next = map[string]bool{}
+	if change := ruleScheduleChange(next, "BlockRules", rule, rule.BaseRule, night); change != -1 {
+		t.Fatalf("expected the rule to be removed, got %d", change)
+	}
+	gRuleScheduleActive = next
+
+	next = map[string]bool{}
+	if change := ruleScheduleChange(next, "BlockRules", rule, rule.BaseRule, noon); change != 1 {
+		t.Fatalf("expected the rule to be installed, got %d", change)
+	}
+}
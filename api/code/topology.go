@@ -958,7 +958,7 @@ func showTopology(w http.ResponseWriter, r *http.Request) {
 	}
 
 	activeWG := map[string]bool{}
-	activeIPs, _ := getWireguardActivePeers()
+	activeIPs, _, _ := getWireguardActivePeers()
 	for _, ip := range activeIPs {
 		activeWG[ip] = true
 	}
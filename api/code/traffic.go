@@ -320,6 +320,8 @@ func collectBandwithStats() {
 	}
 	//prepend readings
 	gTrafficHistory = append([]map[string]*NetCount{readings}, gTrafficHistory[:end]...)
+
+	bandwidthQuotaTick(readings)
 }
 
 func collectIPTrafficStats() {
@@ -355,6 +357,8 @@ func trafficTimer() {
 				collectIPTrafficStats()
 
 				collectTrafficInsights()
+
+				checkDeviceBaselines()
 			}
 		}
 	}
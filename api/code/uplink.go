@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,10 +25,37 @@ import (
 
 var gAPIUplinksConfigPath = TEST_PREFIX + "/configs/base/uplinks.json"
 
+// UplinkPolicy sets the share of new flows an uplink receives. Uplinks
+// are balanced within the lowest Priority that has a live uplink, higher
+// priorities are standby links used only when those fail.
+type UplinkPolicy struct {
+	Interface string
+	Weight    int `json:",omitempty"` //1-100, defaults to 1
+	Priority  int `json:",omitempty"` //0 is the primary tier
+}
+
+// UplinkPin sends the outbound traffic of a device, or all devices in
+// a group, out of one uplink while it is alive.
+type UplinkPin struct {
+	Interface string
+	Device    string `json:",omitempty"` //MAC or wireguard public key
+	Group     string `json:",omitempty"`
+}
+
 type UplinksConfig struct {
 	LoadBalanceStrategy string
+	Uplinks             []UplinkPolicy `json:",omitempty"`
+	Pins                []UplinkPin    `json:",omitempty"`
 }
 
+const maxUplinkWeight = 100
+const maxUplinkPriority = 16
+
+var validLoadBalanceStrategies = []string{"", "saddr", "saddr.daddr"}
+
+// marks of the uplinks from the last rebuildUplink, for pinning devices
+var gUplinkPinMarks = map[string]int{}
+
 var Uplinksmtx sync.Mutex
 
 func loadUplinksConfig() UplinksConfig {
@@ -56,6 +85,218 @@ func saveUplinksConfig(config UplinksConfig) error {
 	return nil
 }
 
+func (config *UplinksConfig) Validate() error {
+	if !slices.Contains(validLoadBalanceStrategies, config.LoadBalanceStrategy) {
+		return fmt.Errorf("invalid LoadBalanceStrategy %s", config.LoadBalanceStrategy)
+	}
+
+	seen := map[string]bool{}
+	for i, uplink := range config.Uplinks {
+		if !isValidIface(uplink.Interface) {
+			return fmt.Errorf("invalid uplink interface %s", uplink.Interface)
+		}
+		if seen[uplink.Interface] {
+			return fmt.Errorf("duplicate uplink interface %s", uplink.Interface)
+		}
+		seen[uplink.Interface] = true
+
+		if uplink.Weight < 0 || uplink.Weight > maxUplinkWeight {
+			return fmt.Errorf("uplink Weight must be between 0 and %d (0 = default)", maxUplinkWeight)
+		}
+		if uplink.Weight == 0 {
+			config.Uplinks[i].Weight = 1
+		}
+		if uplink.Priority < 0 || uplink.Priority > maxUplinkPriority {
+			return fmt.Errorf("uplink Priority must be between 0 and %d", maxUplinkPriority)
+		}
+	}
+
+	for i, pin := range config.Pins {
+		if !isValidIface(pin.Interface) {
+			return fmt.Errorf("invalid pin interface %s", pin.Interface)
+		}
+		if (pin.Device == "") == (pin.Group == "") {
+			return fmt.Errorf("a pin needs either a Device or a Group")
+		}
+		if isValidMAC(pin.Device) {
+			config.Pins[i].Device = trimLower(pin.Device)
+		} else if pin.Device != "" && !isValidWGPubKey(pin.Device) {
+			return fmt.Errorf("invalid pin Device %s", pin.Device)
+		}
+		config.Pins[i].Group = trimLower(pin.Group)
+	}
+
+	return nil
+}
+
+func isValidWGPubKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+func (config UplinksConfig) uplinkPolicy(iface string) UplinkPolicy {
+	for _, uplink := range config.Uplinks {
+		if uplink.Interface == iface {
+			return uplink
+		}
+	}
+	return UplinkPolicy{Interface: iface, Weight: 1}
+}
+
+// balancedOutbound returns the live uplinks of the lowest priority tier
+func balancedOutbound(outbound []string, config UplinksConfig) []string {
+	balanced := []string{}
+	best := maxUplinkPriority + 1
+	for _, iface := range outbound {
+		priority := config.uplinkPolicy(iface).Priority
+		if priority < best {
+			best = priority
+			balanced = []string{}
+		}
+		if priority == best {
+			balanced = append(balanced, iface)
+		}
+	}
+	return balanced
+}
+
+// uplinkWeightSlots spreads the marks of the balanced uplinks over hash slots
+// in proportion to their weights. returns nil when a plain hash suffices
+func uplinkWeightSlots(outbound []string, balanced []string, config UplinksConfig) []uint32 {
+	weighted := false
+	for _, iface := range balanced {
+		if config.uplinkPolicy(iface).Weight > 1 {
+			weighted = true
+		}
+	}
+
+	if !weighted && len(balanced) == len(outbound) {
+		return nil
+	}
+
+	slots := []uint32{}
+	for index, iface := range outbound {
+		if !slices.Contains(balanced, iface) {
+			continue
+		}
+		weight := max(config.uplinkPolicy(iface).Weight, 1)
+		for i := 0; i < weight; i++ {
+			slots = append(slots, uint32(firstOutboundRouteTable+index))
+		}
+	}
+	return slots
+}
+
+func pinnedUplinkForDevice(config UplinksConfig, device DeviceEntry) string {
+	//device pins take precedence over group pins
+	for _, pin := range config.Pins {
+		if pin.Device != "" && (equalMAC(pin.Device, device.MAC) || pin.Device == device.WGPubKey) {
+			return pin.Interface
+		}
+	}
+	for _, pin := range config.Pins {
+		if pin.Group != "" && slices.Contains(device.Groups, pin.Group) {
+			return pin.Interface
+		}
+	}
+	return ""
+}
+
+func addUplinkPin(config UplinksConfig, marks map[string]int, device DeviceEntry) {
+	if device.RecentIP == "" {
+		return
+	}
+
+	iface := pinnedUplinkForDevice(config, device)
+	mark, exists := marks[iface]
+	if iface == "" || !exists {
+		//not pinned, or the uplink is down: fall back to balancing
+		DeleteIPFromMap("inet", "mangle", "uplink_pins", device.RecentIP)
+		return
+	}
+
+	err := AddIPVerdictToMap("inet", "mangle", "uplink_pins", device.RecentIP, "goto mark"+strconv.Itoa(mark))
+	if err != nil {
+		log.Println("failed to pin device to uplink", device.RecentIP, iface, err)
+	}
+}
+
+// applyUplinkPins programs uplink_pins, outbound are the live uplinks
+// in the order of their route tables
+func applyUplinkPins(outbound []string, config UplinksConfig) {
+	marks := map[string]int{}
+	for index, iface := range outbound {
+		marks[iface] = firstOutboundRouteTable + index
+	}
+
+	Uplinksmtx.Lock()
+	gUplinkPinMarks = marks
+	Uplinksmtx.Unlock()
+
+	err := FlushMapByName("inet", "mangle", "uplink_pins")
+	if err != nil {
+		log.Println("failed to flush uplink_pins", err)
+		return
+	}
+
+	if len(config.Pins) == 0 {
+		return
+	}
+
+	for _, device := range readDevicesSnapshot() {
+		addUplinkPin(config, marks, device)
+	}
+}
+
+// refreshUplinkPin updates the pin of a single device, after its address
+// or groups changed
+func refreshUplinkPin(device DeviceEntry) {
+	config := loadUplinksConfig()
+	if len(config.Pins) == 0 {
+		return
+	}
+
+	Uplinksmtx.Lock()
+	marks := gUplinkPinMarks
+	Uplinksmtx.Unlock()
+
+	addUplinkPin(config, marks, device)
+}
+
+func getLoadBalanceConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadUplinksConfig())
+}
+
+func setLoadBalanceConfig(w http.ResponseWriter, r *http.Request) {
+	config := UplinksConfig{}
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = config.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = saveUplinksConfig(config)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to save uplinks configuration", 400)
+		return
+	}
+
+	Interfacesmtx.Lock()
+	rebuildUplink()
+	Interfacesmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
 /* WPA Supplicant Support */
 
 var WpaConfigPath = TEST_PREFIX + "/configs/wifi_uplink/wpa.json"
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+var UplinksPublicPath = TEST_PREFIX + "/state/public/uplinks.json"
+
+// PublicUplinkState is exported to all containers in public/uplinks.json,
+// so that plugins such as dyndns can follow the addresses of each uplink
+// without probing for them.
+type PublicUplinkState struct {
+	Iface  string
+	Up     bool
+	Active bool
+	IPv4   []string
+	IPv6   []string
+}
+
+// uplinkAddresses returns the ipv4 and global ipv6 addresses of an uplink
+func uplinkAddresses(iface string) ([]string, []string) {
+	ipv4 := []string{}
+	ipv6 := []string{}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return ipv4, ipv6
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return ipv4, ipv6
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			ipv4 = append(ipv4, ipnet.IP.String())
+		} else {
+			ipv6 = append(ipv6, ipnet.IP.String())
+		}
+	}
+
+	return ipv4, ipv6
+}
+
+func publicUplinkStates() []PublicUplinkState {
+	states := []PublicUplinkState{}
+	for _, status := range wanUplinkStatuses() {
+		state := PublicUplinkState{Iface: status.Iface, Up: status.Up, Active: status.Active}
+		state.IPv4, state.IPv6 = uplinkAddresses(status.Iface)
+		states = append(states, state)
+	}
+	return states
+}
+
+// publicUplinksLoop rewrites public/uplinks.json when an uplink changes
+// state or address
+func publicUplinksLoop() {
+	previous := []byte{}
+	for {
+		data, err := json.MarshalIndent(publicUplinkStates(), "", " ")
+		if err == nil && !bytes.Equal(data, previous) {
+			err = ioutil.WriteFile(UplinksPublicPath, data, 0600)
+			if err != nil {
+				log.Println("failed to write public uplinks", err)
+			} else {
+				previous = data
+			}
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalancedOutboundStandby(t *testing.T) {
+	outbound := []string{"eth0", "eth1", "wwan0"}
+	config := UplinksConfig{
+		Uplinks: []UplinkPolicy{
+			{Interface: "eth1", Priority: 1},
+			{Interface: "wwan0", Priority: 2},
+		},
+	}
+
+	if got := balancedOutbound(outbound, config); !reflect.DeepEqual(got, []string{"eth0"}) {
+		t.Errorf("expected only the primary uplink, got %v", got)
+	}
+
+	// primary is down, the first standby tier takes over
+	if got := balancedOutbound([]string{"eth1", "wwan0"}, config); !reflect.DeepEqual(got, []string{"eth1"}) {
+		t.Errorf("expected failover to eth1, got %v", got)
+	}
+
+	// without policies every uplink is balanced
+	if got := balancedOutbound(outbound, UplinksConfig{}); !reflect.DeepEqual(got, outbound) {
+		t.Errorf("expected all uplinks, got %v", got)
+	}
+}
+
+func TestUplinkWeightSlots(t *testing.T) {
+	outbound := []string{"eth0", "eth1"}
+
+	if slots := uplinkWeightSlots(outbound, outbound, UplinksConfig{}); slots != nil {
+		t.Errorf("equal weights should use the plain hash, got %v", slots)
+	}
+
+	config := UplinksConfig{
+		Uplinks: []UplinkPolicy{
+			{Interface: "eth0", Weight: 3},
+			{Interface: "eth1", Weight: 1},
+		},
+	}
+	want := []uint32{11, 11, 11, 12}
+	if slots := uplinkWeightSlots(outbound, outbound, config); !reflect.DeepEqual(slots, want) {
+		t.Errorf("got %v, want %v", slots, want)
+	}
+
+	// a standby uplink keeps its mark but gets no slots
+	config.Uplinks[1].Priority = 1
+	balanced := balancedOutbound(outbound, config)
+	want = []uint32{11, 11, 11}
+	if slots := uplinkWeightSlots(outbound, balanced, config); !reflect.DeepEqual(slots, want) {
+		t.Errorf("got %v, want %v", slots, want)
+	}
+}
+
+func TestUplinksConfigValidate(t *testing.T) {
+	config := UplinksConfig{
+		LoadBalanceStrategy: "saddr",
+		Uplinks:             []UplinkPolicy{{Interface: "eth0"}},
+		Pins: []UplinkPin{
+			{Interface: "eth0", Device: "AA:BB:CC:DD:EE:FF"},
+			{Interface: "eth0", Group: "Streaming"},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Uplinks[0].Weight != 1 || config.Pins[0].Device != "aa:bb:cc:dd:ee:ff" || config.Pins[1].Group != "streaming" {
+		t.Errorf("config was not normalized: %+v", config)
+	}
+
+	invalid := []UplinksConfig{
+		{LoadBalanceStrategy: "random"},
+		{Uplinks: []UplinkPolicy{{Interface: "eth0", Weight: 101}}},
+		{Uplinks: []UplinkPolicy{{Interface: "eth0"}, {Interface: "eth0"}}},
+		{Uplinks: []UplinkPolicy{{Interface: "eth0", Priority: -1}}},
+		{Pins: []UplinkPin{{Interface: "eth0"}}},
+		{Pins: []UplinkPin{{Interface: "eth0", Device: "aa:bb:cc:dd:ee:ff", Group: "lan"}}},
+		{Pins: []UplinkPin{{Interface: "eth0", Device: "not-a-device"}}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestPinnedUplinkForDevice(t *testing.T) {
+	config := UplinksConfig{
+		Pins: []UplinkPin{
+			{Interface: "eth1", Group: "streaming"},
+			{Interface: "eth0", Device: "aa:bb:cc:dd:ee:ff"},
+		},
+	}
+
+	device := DeviceEntry{MAC: "AA:BB:CC:DD:EE:FF", Groups: []string{"streaming"}}
+	if got := pinnedUplinkForDevice(config, device); got != "eth0" {
+		t.Errorf("device pin should win over group pin, got %q", got)
+	}
+
+	device = DeviceEntry{MAC: "11:22:33:44:55:66", Groups: []string{"streaming"}}
+	if got := pinnedUplinkForDevice(config, device); got != "eth1" {
+		t.Errorf("expected the group pin, got %q", got)
+	}
+
+	device = DeviceEntry{MAC: "11:22:33:44:55:66"}
+	if got := pinnedUplinkForDevice(config, device); got != "" {
+		t.Errorf("expected no pin, got %q", got)
+	}
+}
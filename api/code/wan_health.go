@@ -800,7 +800,7 @@ func wanRuntimeLive(runtime *wanUplinkRuntime) (float64, float64, float64) {
 	return latency, jitter, loss
 }
 
-func getWanStatus(w http.ResponseWriter, r *http.Request) {
+func wanUplinkStatuses() []WanUplinkStatus {
 	uplinks := wanHealthUplinks()
 
 	Interfacesmtx.Lock()
@@ -832,8 +832,12 @@ func getWanStatus(w http.ResponseWriter, r *http.Request) {
 		statuses = append(statuses, status)
 	}
 
+	return statuses
+}
+
+func getWanStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(statuses)
+	json.NewEncoder(w).Encode(wanUplinkStatuses())
 }
 
 func getWanHistory(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+/*
+Site peers are wireguard peers that route whole subnets, for example a
+remote office network behind another router. The wireguard plugin informs
+the subnets along with the peer address, and the subnets are placed in the
+same verdict maps as the peer itself, on the peer's wireguard interface.
+*/
+
+var siteSubnetMaps = []string{"internet_access", "dns_access", "lan_access"}
+
+// getWireguardInterfaces returns the names of all wireguard links
+func getWireguardInterfaces() []string {
+	ifaces := []string{}
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Println("failed to list links via netlink", err)
+		return ifaces
+	}
+	for _, link := range links {
+		if link.Type() == "wireguard" {
+			ifaces = append(ifaces, link.Attrs().Name)
+		}
+	}
+	return ifaces
+}
+
+// interfaceSubnets returns the IPv4 subnets of configured interfaces and
+// the ones addressed on links right now, such as uplink DHCP leases
+func interfaceSubnets() map[string]string {
+	subnets := map[string]string{}
+
+	Interfacesmtx.Lock()
+	config := loadInterfacesConfigLocked()
+	Interfacesmtx.Unlock()
+
+	for _, iface := range config {
+		addresses := []string{iface.IP}
+		for _, additional := range iface.AdditionalIPs {
+			addresses = append(addresses, additional.IP)
+		}
+		for _, address := range addresses {
+			ip, ipnet, err := net.ParseCIDR(address)
+			if err == nil && ip.To4() != nil {
+				subnets["the interface "+iface.Name+" subnet "+ipnet.String()] = ipnet.String()
+			}
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Println("failed to list interfaces", err)
+		return subnets
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+			subnets["the interface "+iface.Name+" subnet "+subnet.String()] = subnet.String()
+		}
+	}
+
+	return subnets
+}
+
+// validateSiteSubnets checks the routed subnets of the site peer with
+// PublicKey against the SPR networks, the interface and uplink subnets
+// and the subnets of other site peers
+func validateSiteSubnets(subnets []string, tinyNets []string, ifaceSubnets map[string]string, devices map[string]DeviceEntry, PublicKey string) error {
+	taken := map[string]*net.IPNet{}
+	for name, subnet := range ifaceSubnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err == nil {
+			taken[name] = ipnet
+		}
+	}
+
+	for _, tinyNet := range tinyNets {
+		_, ipnet, err := net.ParseCIDR(tinyNet)
+		if err == nil {
+			taken["the network "+tinyNet] = ipnet
+		}
+	}
+
+	for _, device := range devices {
+		if device.WGPubKey == PublicKey {
+			continue
+		}
+		for _, subnet := range device.WGSubnets {
+			_, ipnet, err := net.ParseCIDR(subnet)
+			if err == nil {
+				taken["the site "+device.WGPubKey+" subnet "+subnet] = ipnet
+			}
+		}
+	}
+
+	for _, subnet := range subnets {
+		ip, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 subnet %q", subnet)
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		if ones == 0 {
+			return fmt.Errorf("subnet %s routes everything", subnet)
+		}
+
+		if !ip.Equal(ipnet.IP) || ipnet.String() != subnet {
+			return fmt.Errorf("subnet %s should be written as %s", subnet, ipnet.String())
+		}
+
+		for name, other := range taken {
+			if ipnet.Contains(other.IP) || other.Contains(ipnet.IP) {
+				return fmt.Errorf("subnet %s overlaps with %s", subnet, name)
+			}
+		}
+
+		taken["subnet "+subnet] = ipnet
+	}
+
+	return nil
+}
+
+// flushSiteSubnetVmaps removes the verdicts of site subnets from the
+// IPv4 verdict maps for all wireguard interfaces
+func flushSiteSubnetVmaps(subnets []string) {
+	if len(subnets) == 0 {
+		return
+	}
+
+	//map entries are listed by the first address of their range
+	starts := map[string]string{}
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err == nil {
+			starts[ipnet.IP.String()] = ipnet.String()
+		}
+	}
+
+	vmap_names := append([]string{}, siteSubnetMaps...)
+	for _, name := range getGroupVerdictMapNames() {
+		if !strings.HasSuffix(name, "6") {
+			vmap_names = append(vmap_names, name)
+		}
+	}
+
+	for _, name := range vmap_names {
+		for _, entry := range getNFTVerdictMap(name) {
+			subnet, exists := starts[entry.ipv4]
+			if !exists || !strings.HasPrefix(entry.ifname, "wg") {
+				continue
+			}
+			err := DeleteElementFromMapComplex("inet", "filter", name, []string{subnet, entry.ifname})
+			if err != nil {
+				log.Println("failed to delete site subnet verdict", name, subnet, entry.ifname, err)
+			}
+		}
+	}
+}
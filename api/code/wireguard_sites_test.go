@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateSiteSubnets(t *testing.T) {
+	tinyNets := []string{"192.168.2.0/24"}
+	ifaceSubnets := map[string]string{
+		"the interface eth0 subnet 203.0.113.0/24": "203.0.113.0/24",
+		"the interface eth1 subnet 10.50.0.0/16":   "10.50.0.0/16",
+	}
+	devices := map[string]DeviceEntry{
+		"office": {WGPubKey: "office", WGSubnets: []string{"10.10.0.0/16"}},
+	}
+
+	valid := [][]string{
+		nil,
+		{"10.20.0.0/24", "10.21.0.0/24"},
+		{"172.16.5.0/24"},
+	}
+	for _, subnets := range valid {
+		if err := validateSiteSubnets(subnets, tinyNets, ifaceSubnets, devices, "branch"); err != nil {
+			t.Errorf("%v: %v", subnets, err)
+		}
+	}
+
+	//a site may keep its own subnets when it is updated
+	if err := validateSiteSubnets([]string{"10.10.0.0/16"}, tinyNets, ifaceSubnets, devices, "office"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	invalid := [][]string{
+		{"10.20.0.0"},
+		{"fd00::/64"},
+		{"0.0.0.0/0"},
+		{"10.20.0.1/24"},
+		{"192.168.0.0/16"},
+		{"192.168.2.128/25"},
+		{"10.10.5.0/24"},
+		{"10.20.0.0/24", "10.20.0.0/16"},
+		{"203.0.113.64/26"},
+		{"10.0.0.0/8"},
+	}
+	for _, subnets := range invalid {
+		if err := validateSiteSubnets(subnets, tinyNets, ifaceSubnets, devices, "branch"); err == nil {
+			t.Errorf("expected an error for %v", subnets)
+		}
+	}
+}
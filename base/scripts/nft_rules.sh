@@ -2,6 +2,7 @@
 
 # Disable forwarding
 sysctl net.ipv4.ip_forward=0
+sysctl net.ipv6.conf.all.forwarding=0
 
 # Drop input
 iptables -P INPUT DROP
@@ -59,6 +60,12 @@ table inet filter {
     flags interval;
   }
 
+  # device /64s blocked from the api, see api_block
+  set api_block6 {
+    type ipv6_addr;
+    flags interval;
+  }
+
 
   # this set contains setup interfaces with API access
   set setup_interfaces {
@@ -108,7 +115,7 @@ table inet filter {
   }
 
 
-  # fwd_iface_* maps explicitly allow ranges, whereas @internet_access, @lan_access do not.
+  # fwd_iface_* maps are keyed by interface first, whereas @internet_access, @lan_access are keyed by address.
   # We can consider rolling them in the same place later.
 
   # iface /src range to forward to lan , for ex. for a custom docker network
@@ -133,6 +140,12 @@ table inet filter {
     flags interval;
   }
 
+  # dynamically updated -- the ipv6 prefix device /64s are carved from
+  set supernetworks6 {
+    type ipv6_addr;
+    flags interval;
+  }
+
   # Dynamic maps of clients
   # This is used to whitelist mac addresses to interfaces to block
   # spoofing during DHCP requests
@@ -145,6 +158,27 @@ table inet filter {
     type ipv4_addr . ifname . ether_addr : verdict;
   }
 
+  # ipv6 maps are keyed by the device /64 rather than a single address
+  map ethernet_filter6 {
+    type ipv6_addr . ifname . ether_addr : verdict;
+    flags interval;
+  }
+
+  map dns_access6 {
+    type ipv6_addr . ifname: verdict;
+    flags interval;
+  }
+
+  map internet_access6 {
+    type ipv6_addr . ifname: verdict;
+    flags interval;
+  }
+
+  map lan_access6 {
+    type ipv6_addr . ifname: verdict;
+    flags interval;
+  }
+
   map dns_access {
     type ipv4_addr . ifname: verdict;
     flags interval;
@@ -152,6 +186,7 @@ table inet filter {
 
   map internet_access {
     type ipv4_addr . ifname: verdict;
+    flags interval;
   }
 
   # oifname . ip saddr . iifname
@@ -162,6 +197,7 @@ table inet filter {
 
   map lan_access {
     type ipv4_addr . ifname: verdict;
+    flags interval;
   }
 
   map ping_rules {
@@ -227,6 +263,20 @@ table inet filter {
     }
   }
 
+  # ipv6 counterpart of upstream_private_rfc1918_allowed, by device /64
+  map upstream_private_ula6_allowed {
+    type ipv6_addr : verdict;
+    flags interval;
+  }
+
+  map drop_private_ula6 {
+    type ipv6_addr : verdict;
+    flags interval
+    elements = {
+      fc00::/7 : jump restrict_upstream_private_addresses6
+    }
+  }
+
   # Forwarding to Endpoint Service definitions
   map ept_udpfwd {
     type ipv4_addr . ipv4_addr . inet_service : verdict ;
@@ -277,6 +327,16 @@ table inet filter {
     # block lan ranges from uplink interfaces
     iifname @uplink_interfaces ip saddr @supernetworks goto DROPLOGINP
     iifname @uplink_interfaces ip daddr @supernetworks goto DROPLOGINP
+    iifname @uplink_interfaces ip6 saddr @supernetworks6 goto DROPLOGINP
+
+    # ipv6 neighbor discovery. only accept router advertisements
+    # from uplinks and router solicitations from the lan
+    icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert } ip6 hoplimit 255 counter accept
+    iifname != @uplink_interfaces icmpv6 type nd-router-solicit ip6 hoplimit 255 counter accept
+    iifname @uplink_interfaces icmpv6 type nd-router-advert ip6 hoplimit 255 counter accept
+
+    # dhcpv6 client replies for the uplink prefix
+    iifname @uplink_interfaces ip6 saddr fe80::/10 udp dport 546 counter accept
 
     # Drop input from the site to site output interfaces. They are only a sink,
     # Not a source that can connect into SPR services
@@ -292,10 +352,11 @@ table inet filter {
     # block API access for specified clients,
     # this will be set for any devices with a guest policy
     counter tcp dport {22, 80, 443} ip saddr @api_block goto DROPLOGINP
+    counter tcp dport {22, 80, 443} ip6 saddr @api_block6 goto DROPLOGINP
 
     # Allow wireguard to lan services
-    $(if [ "$WIREGUARD_PORT" ]; then echo "iifname wg0 counter tcp dport vmap @lan_tcp_accept"; fi)
-    $(if [ "$WIREGUARD_PORT" ]; then echo "iifname wg0 counter udp dport vmap @lan_udp_accept"; fi)
+    $(if [ "$WIREGUARD_PORT" ]; then echo "iifname \"wg*\" counter tcp dport vmap @lan_tcp_accept"; fi)
+    $(if [ "$WIREGUARD_PORT" ]; then echo "iifname \"wg*\" counter udp dport vmap @lan_udp_accept"; fi)
 
     # drop dhcp requests from upstream
     iifname @uplink_interfaces udp dport {67} counter goto DROPLOGINP
@@ -316,6 +377,10 @@ table inet filter {
     # Authorized wireless stations & MACs. They do not have an ip address yet
     counter udp dport 67 iifname . ether saddr vmap @dhcp_access
 
+    # DHCPv6 Allow rules, same as above
+    iifname @wired_lan_interfaces udp dport 547 counter accept
+    counter udp dport 547 iifname . ether saddr vmap @dhcp_access
+
     # Prevent MAC Spoofing from LANIF, wired interfaces
     iifname @lan_interfaces jump DROP_MAC_SPOOF
 
@@ -327,6 +392,7 @@ table inet filter {
 
     # Dynamic verdict map for dns access
     counter udp dport 53  ip saddr . iifname vmap @dns_access
+    counter udp dport 53  ip6 saddr . iifname vmap @dns_access6
 
     # TCP services
     iifname @lan_interfaces counter tcp dport vmap @lan_tcp_accept
@@ -348,6 +414,9 @@ table inet filter {
     ip daddr 224.0.0.0/4 iifname @lan_interfaces counter udp dport vmap @multicast_lan_udp_accept
     ip daddr 224.0.0.0/4 iifname @uplink_interfaces counter udp dport vmap @multicast_wan_udp_accept
     ip daddr 224.0.0.0/4 iifname @setup_interfaces counter udp dport vmap @multicast_lan_udp_accept
+    ip6 daddr ff00::/8 iifname @lan_interfaces counter udp dport vmap @multicast_lan_udp_accept
+    ip6 daddr ff00::/8 iifname @uplink_interfaces counter udp dport vmap @multicast_wan_udp_accept
+    ip6 daddr ff00::/8 iifname @setup_interfaces counter udp dport vmap @multicast_lan_udp_accept
 
     icmp type { echo-reply, echo-request } ip saddr . iifname vmap @ping_rules
 
@@ -358,6 +427,10 @@ table inet filter {
   #chain USERDEF_INPUT{
   #}
 
+  # Populated by the API with per device limits
+  chain BANDWIDTH_LIMIT {
+  }
+
   chain FORWARD {
     type filter hook forward priority 0; policy drop;
 
@@ -388,10 +461,14 @@ table inet filter {
     iifname @uplink_interfaces ip saddr @supernetworks goto DROPLOGFWD
     # uplinks can not receive @supernetworks destination addresses
     oifname @uplink_interfaces ip daddr @supernetworks goto DROPLOGFWD
+    iifname @uplink_interfaces ip6 saddr @supernetworks6 goto DROPLOGFWD
 
     # Verify MAC addresses for LANIF/WIPHYs
     iifname @lan_interfaces jump DROP_MAC_SPOOF
 
+    # Per device rate limits, before established traffic is accepted
+    jump BANDWIDTH_LIMIT
+
     counter jump F_EST_RELATED
 
     # Do not forward from uplink interfaces after dnat
@@ -412,12 +489,13 @@ table inet filter {
 
     # Drop private_rfc1918 access on upstream
     counter oifname @uplink_interfaces ip daddr vmap @drop_private_rfc1918
+    counter oifname @uplink_interfaces ip6 daddr vmap @drop_private_ula6
 
     # Allow additional interfaces to communicate upstream
     # This includes docker0, see fwd_iface definitions above
     # Note: if they should have rfc1918 forwarding access they need
     # to be added to @upstream_private_rfc1918_allowed.
-    # These maps explicitly allow ranges, whereas @internet_access, @lan_access do not.
+    # These maps are keyed by interface first, whereas @internet_access, @lan_access are keyed by address.
     # We can consider combining them later.
 
     counter oifname @uplink_interfaces iifname . ip saddr vmap @fwd_iface_wan
@@ -439,6 +517,7 @@ table inet filter {
 
     # Forward to uplink interfaces
     counter oifname @uplink_interfaces ip saddr . iifname vmap @internet_access
+    counter oifname @uplink_interfaces ip6 saddr . iifname vmap @internet_access6
 
     # The @lan_access dynamic verdict map implements the special LAN group in SPR.
     # It allows one-way access to all stations, without an explicit relationship by IP,
@@ -446,9 +525,10 @@ table inet filter {
 
     # 1. Transmit to the LANIF interface
     counter oifname @lan_interfaces ip saddr . iifname vmap @lan_access
+    counter oifname @lan_interfaces ip6 saddr . iifname vmap @lan_access6
 
-    # 2. Transmit to the wireguard interface
-    $(if [ "$WIREGUARD_PORT" ]; then echo "counter oifname wg0 ip saddr . iifname vmap @lan_access"; fi)
+    # 2. Transmit to the wireguard interfaces
+    $(if [ "$WIREGUARD_PORT" ]; then echo "counter oifname \"wg*\" ip saddr . iifname vmap @lan_access"; fi)
 
     # 3. Forward to wireless stations. This verdict map is managed in firewall.go
     jump WIPHY_FORWARD_LAN
@@ -466,6 +546,12 @@ table inet filter {
     counter drop
   }
 
+  chain restrict_upstream_private_addresses6 {
+    counter ip6 saddr vmap @upstream_private_ula6_allowed
+    log prefix "drop:private " group 1
+    counter drop
+  }
+
   chain WIPHY_FORWARD_LAN {
 
   }
@@ -519,10 +605,14 @@ table inet filter {
     ip protocol udp ct state related,established counter accept
     ip protocol tcp ct state related,established counter accept
     ip protocol icmp ct state related,established counter accept
+    meta nfproto ipv6 meta l4proto { tcp, udp, ipv6-icmp } ct state related,established counter accept
   }
 
   chain DROP_MAC_SPOOF {
     counter ip saddr . iifname . ether saddr vmap @ethernet_filter
+    counter ip6 saddr . iifname . ether saddr vmap @ethernet_filter6
+    # link local neighbor discovery and dhcpv6 solicitations
+    ip6 saddr fe80::/10 ip6 daddr ff02::/16 counter return
     log prefix "drop:mac " group 1
     counter drop
   }
@@ -574,6 +664,12 @@ table inet nat {
   }
 
 
+  # delegated ipv6 prefixes are routed without masquerade
+  set routed_networks6 {
+    type ipv6_addr;
+    flags interval;
+  }
+
   map custom_dns_devices {
       type ipv4_addr : ipv4_addr
   }
@@ -653,6 +749,7 @@ table inet nat {
     #jump USERDEF_POSTROUTING
 
     # Masquerade upstream traffic
+    oifname @uplink_interfaces ip6 saddr @routed_networks6 counter accept
     oifname @uplink_interfaces counter masquerade
 
     # Masquerade site-to-site VPN
@@ -696,6 +793,16 @@ table inet mangle {
     flags interval;
   }
 
+  # src ip : goto mark<N>, devices pinned to one uplink
+  map uplink_pins {
+    type ipv4_addr : verdict;
+  }
+
+  # hash slot : mark, for weighted and standby uplinks
+  map uplink_weights {
+    type mark : mark;
+  }
+
   # see description above. duplicated since nftables doesnt have cross-table sets
   set supernetworks {
     type ipv4_addr;
@@ -745,6 +852,12 @@ EOF
 
 # Enable forwarding
 sysctl net.ipv4.ip_forward=1
+sysctl net.ipv6.conf.all.forwarding=1
+
+# keep accepting router advertisements on the uplink with forwarding on
+if [ "$WANIF" ]; then
+  sysctl net.ipv6.conf.$WANIF.accept_ra=2
+fi
 
 # Enable ARP filter
 sysctl net.ipv4.conf.all.arp_filter=1
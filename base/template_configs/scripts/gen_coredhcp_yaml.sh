@@ -7,5 +7,6 @@ server4:
 #  Listens on all interfaces when none are configured. Note that iptables should block dhcp from $WANIF
   plugins:
     - tiny_subnets:
+    - spr_options:
 
 END
@@ -74,7 +74,7 @@ mkdir -p state/dns/
 mkdir -p state/wifi/
 touch state/dns/local_mappings state/dhcp/leases.txt
 
-PLUGINS="${PLUGINS-dyndns ppp wifi_uplink}"
+PLUGINS="${PLUGINS-dyndns ppp wifi_uplink flowgather}"
 if [ -f .github_creds ]; then
   BAKE_SET+=(--set "*.args.GITHUB_CREDS=$(cat .github_creds)")
 fi
@@ -57,15 +57,22 @@ type BucketItem struct {
 	Value interface{} `json:value`
 }
 
+// TopicLimit bounds the buckets whose name starts with Name.
+// Size is the maximum number of items, MaxAge a duration like "720h".
+// A zero Size or empty MaxAge leaves that dimension unbounded,
+// at least one of them has to be set.
+// Buckets with a limit are exempt from the size based sweep.
 type TopicLimit struct {
-	Name string
-	Size int
+	Name   string
+	Size   int
+	MaxAge string `json:",omitempty"`
 }
 
 type LogConfig struct {
 	SaveEvents  []string `json:"SaveEvents"`
 	MaxSize     uint64   `json:"MaxSize"`
 	TopicLimits []TopicLimit
+	IndexFields []IndexField `json:",omitempty"`
 }
 
 func LogEvent(topic string) {
@@ -198,13 +205,27 @@ func GetSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, limit := range newConfig.TopicLimits {
+		if err := validateTopicLimit(limit); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
 	if err := saveConfig(newConfig); err != nil {
 		log.Println("[-] Failed to write config for db")
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
+	Configmtx.Lock()
+	reindex := indexFieldsChanged(gConfigPtr.IndexFields, newConfig.IndexFields)
 	*gConfigPtr = newConfig
+	Configmtx.Unlock()
+
+	if reindex {
+		go BuildIndex(db)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(newConfig)
@@ -247,10 +268,16 @@ func GetStats(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// bolt bucket statistics along with the retention applied to the bucket
+type BucketRetentionStats struct {
+	bolt.BucketStats
+	Retention TopicRetention
+}
+
 func GetBucketStats(w http.ResponseWriter, r *http.Request) {
 	DBPtr.RLock()
 	defer DBPtr.RUnlock()
-	var stats bolt.BucketStats
+	var stats BucketRetentionStats
 
 	bucketName := mux.Vars(r)["name"]
 
@@ -260,7 +287,8 @@ func GetBucketStats(w http.ResponseWriter, r *http.Request) {
 			return ErrBucketMissing
 		}
 
-		stats = bucket.Stats()
+		stats.BucketStats = bucket.Stats()
+		stats.Retention = getTopicRetention(bucketName, bucket)
 
 		return nil
 	}); err != nil {
@@ -302,6 +330,9 @@ func ListBuckets(w http.ResponseWriter, r *http.Request) {
 
 	if err := (*db).View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if isInternalBucket(name) {
+				return nil
+			}
 
 			if full {
 				items := []*BucketItem{}
@@ -352,6 +383,10 @@ func DeleteBucket(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
+
+	if _, err := pruneIndex(*db); err != nil {
+		log.Println("[-] Failed to prune search index", err)
+	}
 }
 
 func AddBucket(w http.ResponseWriter, r *http.Request) {
@@ -701,7 +736,11 @@ func PutItem(bucketName string, jsonData map[string]interface{}) (*BucketItem, e
 
 		bucket.FillPercent = 0.9
 
-		return bucket.Put(payload.EncodeKey(), encodedValue)
+		if err := bucket.Put(payload.EncodeKey(), encodedValue); err != nil {
+			return err
+		}
+
+		return updateIndex(tx, strings.TrimSpace(bucketName), payload.EncodeKey(), payload.Value, false)
 	}); err != nil {
 		return nil, err
 	}
@@ -803,7 +842,17 @@ func UpdateBucketItem(w http.ResponseWriter, r *http.Request) {
 			return ErrBucketMissing
 		}
 		bucket.FillPercent = 0.9
-		return bucket.Put(payload.EncodeKey(), encodedValue)
+
+		//drop the index entries of the previous value
+		if err := updateIndex(tx, strings.TrimSpace(bucketName), payload.EncodeKey(), decodeIndexItem(bucket.Get(payload.EncodeKey())), true); err != nil {
+			return err
+		}
+
+		if err := bucket.Put(payload.EncodeKey(), encodedValue); err != nil {
+			return err
+		}
+
+		return updateIndex(tx, strings.TrimSpace(bucketName), payload.EncodeKey(), payload.Value, false)
 	}); err != nil {
 		fail(ErrBucketItemUpdate, err)
 		return
@@ -826,6 +875,11 @@ func DeleteBucketItem(w http.ResponseWriter, r *http.Request) {
 			return ErrBucketMissing
 		}
 		bucket.FillPercent = 0.9
+
+		if err := updateIndex(tx, strings.TrimSpace(bucketName), []byte(bucketItemKey), decodeIndexItem(bucket.Get([]byte(bucketItemKey))), true); err != nil {
+			return err
+		}
+
 		return bucket.Delete([]byte(bucketItemKey))
 	}); err != nil {
 		log.Println(ApiError{ErrBucketItemDelete, err})
@@ -869,6 +923,8 @@ func Serve(boltdb **bolt.DB, socketpath string) error {
 
 	router.HandleFunc("/topics", GetTopics).Methods("GET")
 
+	router.HandleFunc("/search", SearchItems).Methods("POST")
+
 	os.Remove(socketpath)
 	unixPluginListener, err := net.Listen("unix", socketpath)
 	if err != nil {
@@ -212,6 +212,9 @@ func main() {
 		boltapi.LogEvent(topic)
 	}
 
+	// index events stored before search was available
+	go boltapi.BuildIndex(db)
+
 	// drain stored events off the bus read path
 	go storeWriter()
 
@@ -0,0 +1,1048 @@
+package boltapi
+
+/*
+Secondary indexes over stored events
+
+Indexed values live in the _index bucket, with one nested bucket per field.
+Each entry key is value 0x00 bucket 0x00 item key, so every item for a value
+is one cursor seek away and ordered by topic and then time.
+
+Entries are written together with the item in PutItem. Items removed by the
+sweep or through the api leave stale entries behind, these are skipped when
+searching and pruned by the sweep.
+
+Events without a MAC address, like dns queries, are indexed under the MAC
+holding their IP address in the api DHCP leases at the time they are stored.
+
+The fields the index was built with are kept in the _index bucket, when
+IndexFields change the index is dropped and rebuilt in the background.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+import bolt "go.etcd.io/bbolt"
+
+const indexBucketName = "_index"
+const indexFieldsKey = "fields"
+const maxIndexValueLen = 255
+
+// items indexed per transaction when building the index
+var indexBatchSize = 10000
+
+var DHCPLeasesPath = os.Getenv("TEST_PREFIX") + "/state/api/dhcp_leases.json"
+
+var Indexmtx sync.Mutex
+
+var (
+	ErrSearchDecode   = errors.New("error reading search query")
+	ErrSearchTerm     = errors.New("invalid search term")
+	ErrSearchNegation = errors.New("a negated term needs a positive term in the same And")
+	ErrSearchField    = errors.New("unknown search field")
+	ErrSearchCursor   = errors.New("invalid search cursor")
+)
+
+// IndexField names a searchable field and the event keys it is read from.
+// Keys are dotted paths matched case insensitively, arrays are walked,
+// so Q.Name indexes the name of every question in a dns event.
+type IndexField struct {
+	Name string
+	Keys []string
+}
+
+var defaultIndexFields = []IndexField{
+	{"mac", []string{"MAC", "SrcMAC", "DstMAC"}},
+	{"ip", []string{"IP", "Remote", "SrcIP", "DstIP", "RecentIP"}},
+	{"domain", []string{"FirstName", "Q.Name", "Domain"}},
+}
+
+func isInternalBucket(name []byte) bool {
+	return string(name) == indexBucketName
+}
+
+func getIndexFields() []IndexField {
+	if gConfigPtr == nil {
+		return defaultIndexFields
+	}
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+	if len(gConfigPtr.IndexFields) == 0 {
+		return defaultIndexFields
+	}
+	return gConfigPtr.IndexFields
+}
+
+func normalizeIndexValue(field string, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.ReplaceAll(value, "\x00", "")
+
+	switch field {
+	case "ip":
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			value = host
+		}
+	case "domain":
+		value = strings.TrimSuffix(value, ".")
+	}
+
+	if len(value) > maxIndexValueLen {
+		value = value[:maxIndexValueLen]
+	}
+	return value
+}
+
+func lookupPath(node interface{}, path []string, values *[]string) {
+	switch v := node.(type) {
+	case []interface{}:
+		for _, entry := range v {
+			lookupPath(entry, path, values)
+		}
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return
+		}
+		for key, child := range v {
+			if strings.EqualFold(key, path[0]) {
+				lookupPath(child, path[1:], values)
+			}
+		}
+	case string:
+		if len(path) == 0 && v != "" {
+			*values = append(*values, v)
+		}
+	}
+}
+
+// extractIndexValues returns the normalized, deduplicated values per field
+func extractIndexValues(fields []IndexField, item interface{}) map[string][]string {
+	result := map[string][]string{}
+
+	for _, field := range fields {
+		raw := []string{}
+		for _, key := range field.Keys {
+			lookupPath(item, strings.Split(key, "."), &raw)
+		}
+
+		seen := map[string]bool{}
+		for _, value := range raw {
+			value = normalizeIndexValue(field.Name, value)
+			if value == "" || seen[value] {
+				continue
+			}
+			seen[value] = true
+			result[field.Name] = append(result[field.Name], value)
+		}
+	}
+
+	return result
+}
+
+// dhcpLeaseMACs maps the IP addresses of the api DHCP leases to their MAC,
+// the leases file is read again when it changes
+type dhcpLeaseMACs struct {
+	mtx     sync.Mutex
+	path    string
+	checked time.Time
+	modTime time.Time
+	macs    map[string]string
+}
+
+type dhcpLease struct {
+	MAC    string
+	IP     string
+	Expiry time.Time
+}
+
+var gLeaseMACs = &dhcpLeaseMACs{path: DHCPLeasesPath}
+
+func (l *dhcpLeaseMACs) lookup(ip string) string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.checked) > 10*time.Second {
+		l.checked = now
+		if fi, err := os.Stat(l.path); err == nil && !fi.ModTime().Equal(l.modTime) {
+			l.modTime = fi.ModTime()
+			l.load()
+		}
+	}
+
+	return l.macs[ip]
+}
+
+func (l *dhcpLeaseMACs) load() {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return
+	}
+
+	leases := map[string]dhcpLease{}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		log.Println("[-] failed to read dhcp leases", err)
+		return
+	}
+
+	//an address handed out again belongs to the newest lease
+	newest := map[string]dhcpLease{}
+	for _, lease := range leases {
+		ip := normalizeIndexValue("ip", lease.IP)
+		if ip == "" || lease.MAC == "" {
+			continue
+		}
+		if current, exists := newest[ip]; !exists || lease.Expiry.After(current.Expiry) {
+			newest[ip] = lease
+		}
+	}
+
+	l.macs = map[string]string{}
+	for ip, lease := range newest {
+		l.macs[ip] = normalizeIndexValue("mac", lease.MAC)
+	}
+}
+
+// deriveMACValues fills in the mac of items that only carry an ip
+func deriveMACValues(fields []IndexField, values map[string][]string) {
+	if len(values["mac"]) != 0 || len(values["ip"]) == 0 {
+		return
+	}
+
+	hasMAC := false
+	for _, field := range fields {
+		if field.Name == "mac" {
+			hasMAC = true
+			break
+		}
+	}
+	if !hasMAC {
+		return
+	}
+
+	for _, ip := range values["ip"] {
+		if mac := gLeaseMACs.lookup(ip); mac != "" && !slices.Contains(values["mac"], mac) {
+			values["mac"] = append(values["mac"], mac)
+		}
+	}
+}
+
+func indexEntryKey(value string, bucketName string, itemKey []byte) []byte {
+	key := make([]byte, 0, len(value)+len(bucketName)+len(itemKey)+2)
+	key = append(key, value...)
+	key = append(key, 0)
+	key = append(key, bucketName...)
+	key = append(key, 0)
+	return append(key, itemKey...)
+}
+
+// splitIndexEntryKey returns the bucket name and item key of an entry
+func splitIndexEntryKey(value string, key []byte) (string, []byte, bool) {
+	rest := key[len(value)+1:]
+	sep := bytes.IndexByte(rest, 0)
+	if sep < 0 {
+		return "", nil, false
+	}
+	return string(rest[:sep]), rest[sep+1:], true
+}
+
+// updateIndex adds or removes the entries for an item, inside the caller's transaction
+func updateIndex(tx *bolt.Tx, bucketName string, itemKey []byte, item interface{}, remove bool) error {
+	if item == nil {
+		return nil
+	}
+
+	fields := getIndexFields()
+	values := extractIndexValues(fields, item)
+	deriveMACValues(fields, values)
+	if len(values) == 0 {
+		return nil
+	}
+
+	index, err := tx.CreateBucketIfNotExists([]byte(indexBucketName))
+	if err != nil {
+		return err
+	}
+
+	for field, fieldValues := range values {
+		fieldBucket, err := index.CreateBucketIfNotExists([]byte(field))
+		if err != nil {
+			return err
+		}
+		fieldBucket.FillPercent = 0.9
+
+		for _, value := range fieldValues {
+			entry := indexEntryKey(value, bucketName, itemKey)
+			if remove {
+				err = fieldBucket.Delete(entry)
+			} else {
+				err = fieldBucket.Put(entry, []byte{})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func decodeIndexItem(raw []byte) interface{} {
+	if raw == nil {
+		return nil
+	}
+	bucketItem := &BucketItem{}
+	if bucketItem.DecodeValue(raw) != nil {
+		return nil
+	}
+	return bucketItem.Value
+}
+
+// pruneIndex drops entries whose item no longer exists
+func pruneIndex(db *bolt.DB) (int, error) {
+	pruned := 0
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(indexBucketName))
+		if index == nil {
+			return nil
+		}
+
+		return index.ForEach(func(field, v []byte) error {
+			fieldBucket := index.Bucket(field)
+			if fieldBucket == nil {
+				return nil
+			}
+
+			stale := [][]byte{}
+			c := fieldBucket.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				sep := bytes.IndexByte(k, 0)
+				if sep < 0 {
+					stale = append(stale, append([]byte{}, k...))
+					continue
+				}
+				bucketName, itemKey, ok := splitIndexEntryKey(string(k[:sep]), k)
+				if !ok {
+					stale = append(stale, append([]byte{}, k...))
+					continue
+				}
+				bucket := tx.Bucket([]byte(bucketName))
+				if bucket == nil || bucket.Get(itemKey) == nil {
+					stale = append(stale, append([]byte{}, k...))
+				}
+			}
+
+			pruned += len(stale)
+			return deleteKeys(fieldBucket, stale)
+		})
+	})
+
+	return pruned, err
+}
+
+// indexedFields returns the fields the index was built with, nil if
+// the index was never completed
+func indexedFields(tx *bolt.Tx) []byte {
+	index := tx.Bucket([]byte(indexBucketName))
+	if index == nil {
+		return nil
+	}
+	return index.Get([]byte(indexFieldsKey))
+}
+
+// indexBucketBatch indexes up to indexBatchSize items of a bucket after
+// the resume key, returning the last key indexed or nil when done
+func indexBucketBatch(db **bolt.DB, bucketName string, resume []byte) ([]byte, error) {
+	DBPtr.RLock()
+	defer DBPtr.RUnlock()
+
+	var last []byte
+	err := (*db).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		k, v := c.First()
+		if resume != nil {
+			k, v = c.Seek(resume)
+			if k != nil && bytes.Equal(k, resume) {
+				k, v = c.Next()
+			}
+		}
+
+		count := 0
+		for ; k != nil && count < indexBatchSize; k, v = c.Next() {
+			if err := updateIndex(tx, bucketName, k, decodeIndexItem(v), false); err != nil {
+				return err
+			}
+			count++
+			last = append(last[:0], k...)
+		}
+
+		if k == nil {
+			last = nil
+		}
+		return nil
+	})
+
+	return last, err
+}
+
+// BuildIndex indexes the stored items when the index is missing or was
+// built with other IndexFields. The work is split into batches so the db
+// stays available while it runs.
+func BuildIndex(db **bolt.DB) {
+	Indexmtx.Lock()
+	defer Indexmtx.Unlock()
+
+	fields, err := json.Marshal(getIndexFields())
+	if err != nil {
+		return
+	}
+
+	DBPtr.RLock()
+	built := false
+	buckets := []string{}
+	(*db).View(func(tx *bolt.Tx) error {
+		built = bytes.Equal(indexedFields(tx), fields)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !isInternalBucket(name) {
+				buckets = append(buckets, string(name))
+			}
+			return nil
+		})
+	})
+	DBPtr.RUnlock()
+
+	if built {
+		return
+	}
+
+	log.Println("[+] building db search index")
+
+	//entries written with other fields would never be removed
+	DBPtr.RLock()
+	err = (*db).Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(indexBucketName)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(indexBucketName))
+	})
+	DBPtr.RUnlock()
+	if err != nil {
+		log.Println("[-] failed to drop db search index", err)
+		return
+	}
+
+	for _, bucketName := range buckets {
+		var resume []byte
+		for {
+			resume, err = indexBucketBatch(db, bucketName, resume)
+			if err != nil {
+				log.Println("[-] failed to index bucket", bucketName, err)
+				break
+			}
+			if resume == nil {
+				break
+			}
+		}
+	}
+
+	//mark the index as built even when nothing was indexed
+	DBPtr.RLock()
+	defer DBPtr.RUnlock()
+	err = (*db).Update(func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucketIfNotExists([]byte(indexBucketName))
+		if err != nil {
+			return err
+		}
+		return index.Put([]byte(indexFieldsKey), fields)
+	})
+	if err != nil {
+		log.Println("[-] failed to complete db search index", err)
+	}
+}
+
+// indexFieldsChanged reports whether a new config indexes other fields
+func indexFieldsChanged(previous []IndexField, next []IndexField) bool {
+	if len(previous) == 0 {
+		previous = defaultIndexFields
+	}
+	if len(next) == 0 {
+		next = defaultIndexFields
+	}
+	return !reflect.DeepEqual(previous, next)
+}
+
+// searching
+
+// SearchTerm is a field match or a boolean combination of terms.
+// Not excludes items from the enclosing And.
+type SearchTerm struct {
+	Field string       `json:",omitempty"`
+	Value string       `json:",omitempty"`
+	And   []SearchTerm `json:",omitempty"`
+	Or    []SearchTerm `json:",omitempty"`
+	Not   *SearchTerm  `json:",omitempty"`
+}
+
+type SearchQuery struct {
+	Query     SearchTerm
+	Topics    []string //bucket name prefixes, all buckets when empty
+	Min       string   //RFC3339 time range
+	Max       string
+	Order     string //asc or desc (default)
+	Num       int
+	Cursor    string
+	CountOnly bool
+}
+
+type SearchItem struct {
+	Topic string
+	Value interface{}
+}
+
+// SearchResult.Count is the number of items returned, or the number of
+// matches for a CountOnly query
+type SearchResult struct {
+	Count  int
+	Cursor string `json:",omitempty"`
+	Items  []SearchItem
+}
+
+// result references sort by item key, which is the time for events,
+// and then by bucket. Terms are evaluated as streams of references in
+// result order, so a page only reads the index up to its last item.
+
+func itemRef(bucketName string, itemKey []byte) string {
+	return string(itemKey) + "\x00" + bucketName
+}
+
+func splitItemRef(ref string) (string, []byte) {
+	sep := strings.LastIndexByte(ref, 0)
+	return ref[sep+1:], []byte(ref[:sep])
+}
+
+type searchScope struct {
+	topics     []string
+	minKey     []byte
+	maxKey     []byte
+	descending bool
+	after      string //the last reference of the previous page
+}
+
+func (s *searchScope) containsTopic(bucketName string) bool {
+	if len(s.topics) == 0 {
+		return true
+	}
+	for _, topic := range s.topics {
+		if strings.HasPrefix(bucketName, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *searchScope) containsKey(itemKey []byte) bool {
+	if s.minKey != nil || s.maxKey != nil {
+		if len(itemKey) != 8 {
+			return false
+		}
+		if s.minKey != nil && bytes.Compare(itemKey, s.minKey) < 0 {
+			return false
+		}
+		if s.maxKey != nil && bytes.Compare(itemKey, s.maxKey) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// before reports whether reference a comes before b in the result order
+func (s *searchScope) before(a string, b string) bool {
+	if s.descending {
+		return a > b
+	}
+	return a < b
+}
+
+// refStream yields references in result order without repeats
+type refStream interface {
+	peek() (string, bool)
+	advance()
+}
+
+// bucketStream walks the entries for one value in one bucket
+type bucketStream struct {
+	scope      *searchScope
+	c          *bolt.Cursor
+	prefix     []byte
+	bucketName string
+	ref        string
+	ok         bool
+}
+
+func (b *bucketStream) step() []byte {
+	if b.scope.descending {
+		k, _ := b.c.Prev()
+		return k
+	}
+	k, _ := b.c.Next()
+	return k
+}
+
+func (b *bucketStream) load(k []byte) {
+	b.ok = false
+	for ; k != nil && bytes.HasPrefix(k, b.prefix); k = b.step() {
+		itemKey := k[len(b.prefix):]
+
+		//past the end of the time range, so are the remaining keys
+		if !b.scope.descending && b.scope.maxKey != nil && bytes.Compare(itemKey, b.scope.maxKey) > 0 {
+			return
+		}
+		if b.scope.descending && b.scope.minKey != nil && bytes.Compare(itemKey, b.scope.minKey) < 0 {
+			return
+		}
+
+		if !b.scope.containsKey(itemKey) {
+			continue
+		}
+
+		ref := itemRef(b.bucketName, itemKey)
+		if b.scope.after != "" && !b.scope.before(b.scope.after, ref) {
+			continue
+		}
+
+		b.ref = ref
+		b.ok = true
+		return
+	}
+}
+
+// start seeks to the first entry in the time range and after the cursor
+func (b *bucketStream) start() {
+	bound := b.scope.minKey
+	if b.scope.descending {
+		bound = b.scope.maxKey
+	}
+
+	if b.scope.after != "" {
+		_, afterKey := splitItemRef(b.scope.after)
+		if bound == nil ||
+			(b.scope.descending && bytes.Compare(afterKey, bound) < 0) ||
+			(!b.scope.descending && bytes.Compare(afterKey, bound) > 0) {
+			bound = afterKey
+		}
+	}
+
+	if !b.scope.descending {
+		k, _ := b.c.Seek(append(slices.Clone(b.prefix), bound...))
+		b.load(k)
+		return
+	}
+
+	//the last entry at or below the bound, or the last one in the bucket
+	target := append(slices.Clone(b.prefix), bound...)
+	if bound == nil {
+		target[len(target)-1] = 1
+	}
+
+	k, _ := b.c.Seek(target)
+	if k == nil {
+		k, _ = b.c.Last()
+	} else if bound == nil || !bytes.Equal(k, target) {
+		k, _ = b.c.Prev()
+	}
+	b.load(k)
+}
+
+// leafStream merges the buckets holding a field value
+type leafStream struct {
+	scope   *searchScope
+	buckets []*bucketStream
+}
+
+func (l *leafStream) head() *bucketStream {
+	var best *bucketStream
+	for _, b := range l.buckets {
+		if b.ok && (best == nil || l.scope.before(b.ref, best.ref)) {
+			best = b
+		}
+	}
+	return best
+}
+
+func (l *leafStream) peek() (string, bool) {
+	best := l.head()
+	if best == nil {
+		return "", false
+	}
+	return best.ref, true
+}
+
+func (l *leafStream) advance() {
+	if best := l.head(); best != nil {
+		best.load(best.step())
+	}
+}
+
+func newLeafStream(index *bolt.Bucket, scope *searchScope, field string, value string) (refStream, error) {
+	known := false
+	for _, indexField := range getIndexFields() {
+		if indexField.Name == field {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, ErrSearchField
+	}
+
+	leaf := &leafStream{scope: scope}
+	if index == nil {
+		return leaf, nil
+	}
+	fieldBucket := index.Bucket([]byte(field))
+	if fieldBucket == nil {
+		return leaf, nil
+	}
+
+	value = normalizeIndexValue(field, value)
+	prefix := append([]byte(value), 0)
+
+	//one stream per bucket, skipping over the entries of each
+	c := fieldBucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); {
+		sep := bytes.IndexByte(k[len(prefix):], 0)
+		if sep < 0 {
+			k, _ = c.Next()
+			continue
+		}
+
+		bucketName := string(k[len(prefix) : len(prefix)+sep])
+		bucketPrefix := indexEntryKey(value, bucketName, nil)
+		if scope.containsTopic(bucketName) {
+			stream := &bucketStream{scope: scope, c: fieldBucket.Cursor(), prefix: bucketPrefix, bucketName: bucketName}
+			stream.start()
+			leaf.buckets = append(leaf.buckets, stream)
+		}
+
+		next := slices.Clone(bucketPrefix)
+		next[len(next)-1] = 1
+		k, _ = c.Seek(next)
+	}
+
+	return leaf, nil
+}
+
+type orStream struct {
+	scope    *searchScope
+	children []refStream
+}
+
+func (o *orStream) peek() (string, bool) {
+	best, found := "", false
+	for _, child := range o.children {
+		if ref, ok := child.peek(); ok && (!found || o.scope.before(ref, best)) {
+			best, found = ref, true
+		}
+	}
+	return best, found
+}
+
+func (o *orStream) advance() {
+	current, ok := o.peek()
+	if !ok {
+		return
+	}
+	for _, child := range o.children {
+		if ref, ok := child.peek(); ok && ref == current {
+			child.advance()
+		}
+	}
+}
+
+type andStream struct {
+	scope    *searchScope
+	positive []refStream
+	negative []refStream
+	ref      string
+	ok       bool
+	ready    bool
+}
+
+// find moves every positive term to the next reference they all hold
+// and that none of the negated terms hold
+func (a *andStream) find() {
+	a.ok = false
+	for {
+		candidate := ""
+		for i, child := range a.positive {
+			ref, ok := child.peek()
+			if !ok {
+				return
+			}
+			if i == 0 || a.scope.before(candidate, ref) {
+				candidate = ref
+			}
+		}
+
+		matched := true
+		for _, child := range a.positive {
+			ref, ok := child.peek()
+			for ok && a.scope.before(ref, candidate) {
+				child.advance()
+				ref, ok = child.peek()
+			}
+			if !ok {
+				return
+			}
+			if ref != candidate {
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		excluded := false
+		for _, child := range a.negative {
+			ref, ok := child.peek()
+			for ok && a.scope.before(ref, candidate) {
+				child.advance()
+				ref, ok = child.peek()
+			}
+			if ok && ref == candidate {
+				excluded = true
+			}
+		}
+		if excluded {
+			for _, child := range a.positive {
+				child.advance()
+			}
+			continue
+		}
+
+		a.ref, a.ok = candidate, true
+		return
+	}
+}
+
+func (a *andStream) peek() (string, bool) {
+	if !a.ready {
+		a.find()
+		a.ready = true
+	}
+	return a.ref, a.ok
+}
+
+func (a *andStream) advance() {
+	if _, ok := a.peek(); ok {
+		for _, child := range a.positive {
+			child.advance()
+		}
+	}
+	a.ready = false
+}
+
+func evalTerm(index *bolt.Bucket, scope *searchScope, term SearchTerm) (refStream, error) {
+	if term.Not != nil {
+		return nil, ErrSearchNegation
+	}
+
+	if term.Field != "" {
+		if len(term.And) != 0 || len(term.Or) != 0 {
+			return nil, ErrSearchTerm
+		}
+		return newLeafStream(index, scope, term.Field, term.Value)
+	}
+
+	if len(term.And) != 0 && len(term.Or) != 0 {
+		return nil, ErrSearchTerm
+	}
+
+	if len(term.Or) != 0 {
+		stream := &orStream{scope: scope}
+		for _, child := range term.Or {
+			childStream, err := evalTerm(index, scope, child)
+			if err != nil {
+				return nil, err
+			}
+			stream.children = append(stream.children, childStream)
+		}
+		return stream, nil
+	}
+
+	if len(term.And) != 0 {
+		stream := &andStream{scope: scope}
+		for _, child := range term.And {
+			negated := child.Not != nil
+			if negated {
+				child = *child.Not
+			}
+			childStream, err := evalTerm(index, scope, child)
+			if err != nil {
+				return nil, err
+			}
+			if negated {
+				stream.negative = append(stream.negative, childStream)
+			} else {
+				stream.positive = append(stream.positive, childStream)
+			}
+		}
+
+		if len(stream.positive) == 0 {
+			return nil, ErrSearchNegation
+		}
+		return stream, nil
+	}
+
+	return nil, ErrSearchTerm
+}
+
+func searchTimeKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return TimeKey(s)
+}
+
+func runSearch(tx *bolt.Tx, query SearchQuery) (SearchResult, error) {
+	result := SearchResult{Items: []SearchItem{}}
+
+	minKey, err := searchTimeKey(query.Min)
+	if err != nil {
+		return result, err
+	}
+	maxKey, err := searchTimeKey(query.Max)
+	if err != nil {
+		return result, err
+	}
+
+	scope := &searchScope{
+		topics:     query.Topics,
+		minKey:     minKey,
+		maxKey:     maxKey,
+		descending: query.Order != "asc",
+	}
+
+	if query.Cursor != "" && !query.CountOnly {
+		cursor, err := hex.DecodeString(query.Cursor)
+		if err != nil || bytes.IndexByte(cursor, 0) < 0 {
+			return result, ErrSearchCursor
+		}
+		scope.after = string(cursor)
+	}
+
+	stream, err := evalTerm(tx.Bucket([]byte(indexBucketName)), scope, query.Query)
+	if err != nil {
+		return result, err
+	}
+
+	//skip stale entries for removed items
+	next := func() (string, []byte, bool) {
+		for ref, ok := stream.peek(); ok; ref, ok = stream.peek() {
+			stream.advance()
+			bucketName, itemKey := splitItemRef(ref)
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket == nil {
+				continue
+			}
+			if raw := bucket.Get(itemKey); raw != nil {
+				return ref, raw, true
+			}
+		}
+		return "", nil, false
+	}
+
+	if query.CountOnly {
+		for _, _, ok := next(); ok; _, _, ok = next() {
+			result.Count++
+		}
+		return result, nil
+	}
+
+	// default 100, max 1000 like GetBucketItems
+	num := query.Num
+	if num < 1 {
+		num = 100
+	}
+	if num > 1000 {
+		num = 1000
+	}
+
+	last := ""
+	for len(result.Items) < num {
+		ref, raw, ok := next()
+		if !ok {
+			break
+		}
+
+		bucketName, itemKey := splitItemRef(ref)
+		bucketItem := &BucketItem{Key: string(itemKey)}
+		if bucketItem.DecodeValue(raw) != nil || bucketItem.Value == nil {
+			continue
+		}
+
+		if jsonMap, ok := bucketItem.Value.(map[string]interface{}); ok {
+			if _, exists := jsonMap["time"]; !exists {
+				if timeStr, err := keyToTimeString(itemKey); err == nil {
+					jsonMap["time"] = timeStr
+				}
+			}
+		}
+
+		result.Items = append(result.Items, SearchItem{bucketName, bucketItem.Value})
+		last = ref
+	}
+
+	result.Count = len(result.Items)
+	if result.Count == num {
+		if _, _, more := next(); more {
+			result.Cursor = hex.EncodeToString([]byte(last))
+		}
+	}
+
+	return result, nil
+}
+
+func SearchItems(w http.ResponseWriter, r *http.Request) {
+	DBPtr.RLock()
+	defer DBPtr.RUnlock()
+
+	query := SearchQuery{}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		log.Println(ApiError{ErrSearchDecode, err})
+		http.Error(w, ErrSearchDecode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result SearchResult
+	err := (*db).View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = runSearch(tx, query)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
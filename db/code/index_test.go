@@ -0,0 +1,344 @@
+package boltapi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+import bolt "go.etcd.io/bbolt"
+
+var testSearchStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func setupIndexTest(t *testing.T) (*bolt.DB, string) {
+	t.Helper()
+	testDB, path := openTestDB(t)
+	db = &testDB
+
+	previousConfig := gConfigPtr
+	previousLeases := gLeaseMACs
+	t.Cleanup(func() {
+		gConfigPtr = previousConfig
+		gLeaseMACs = previousLeases
+	})
+	gConfigPtr = nil
+	gLeaseMACs = &dhcpLeaseMACs{path: filepath.Join(t.TempDir(), "dhcp_leases.json")}
+
+	return testDB, path
+}
+
+func putTestEvent(t *testing.T, topic string, minute int, event map[string]interface{}) {
+	t.Helper()
+	event["time"] = testSearchStart.Add(time.Duration(minute) * time.Minute).Format(time.RFC3339Nano)
+	if _, err := PutItem(topic, event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func search(t *testing.T, testDB *bolt.DB, query SearchQuery) SearchResult {
+	t.Helper()
+	var result SearchResult
+	err := testDB.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = runSearch(tx, query)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func resultTimes(result SearchResult) []string {
+	times := []string{}
+	for _, item := range result.Items {
+		times = append(times, item.Value.(map[string]interface{})["time"].(string))
+	}
+	return times
+}
+
+func minuteTime(minute int) string {
+	return testSearchStart.Add(time.Duration(minute) * time.Minute).Format(time.RFC3339Nano)
+}
+
+func TestSearchIndexesOnInsert(t *testing.T) {
+	testDB, _ := setupIndexTest(t)
+
+	putTestEvent(t, "wifi:auth:success", 0, map[string]interface{}{"MAC": "AA:BB:CC:DD:EE:01"})
+	putTestEvent(t, "dns:serve:", 1, map[string]interface{}{
+		"Remote": "192.168.2.6:53000",
+		"Q":      []interface{}{map[string]interface{}{"Name": "Example.com."}},
+	})
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "mac", Value: "aa:bb:cc:dd:ee:01"}})
+	if result.Count != 1 || result.Items[0].Topic != "wifi:auth:success" {
+		t.Errorf("unexpected mac result %+v", result)
+	}
+
+	result = search(t, testDB, SearchQuery{Query: SearchTerm{Field: "domain", Value: "example.com"}})
+	if result.Count != 1 || result.Items[0].Topic != "dns:serve:" {
+		t.Errorf("unexpected domain result %+v", result)
+	}
+
+	result = search(t, testDB, SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}})
+	if result.Count != 1 {
+		t.Errorf("unexpected ip result %+v", result)
+	}
+
+	err := testDB.View(func(tx *bolt.Tx) error {
+		_, err := runSearch(tx, SearchQuery{Query: SearchTerm{Field: "user", Value: "x"}})
+		if err != ErrSearchField {
+			t.Errorf("got %v for an unknown field, want ErrSearchField", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchDerivesMACFromLeases(t *testing.T) {
+	testDB, _ := setupIndexTest(t)
+
+	leases := `{
+		"aa:bb:cc:dd:ee:01": {"MAC": "aa:bb:cc:dd:ee:01", "IP": "192.168.2.6", "Expiry": "2026-01-01T00:00:00Z"},
+		"aa:bb:cc:dd:ee:02": {"MAC": "AA:BB:CC:DD:EE:02", "IP": "192.168.2.6", "Expiry": "2026-02-01T00:00:00Z"}
+	}`
+	if err := os.WriteFile(gLeaseMACs.path, []byte(leases), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	putTestEvent(t, "dns:serve:", 0, map[string]interface{}{"Remote": "192.168.2.6:53000"})
+	//events with their own MAC keep it
+	putTestEvent(t, "wifi:auth:success", 1, map[string]interface{}{"MAC": "aa:bb:cc:dd:ee:03", "IP": "192.168.2.6"})
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "mac", Value: "aa:bb:cc:dd:ee:02"}})
+	if result.Count != 1 || result.Items[0].Topic != "dns:serve:" {
+		t.Errorf("dns event not found by the mac of the newest lease %+v", result)
+	}
+
+	result = search(t, testDB, SearchQuery{Query: SearchTerm{Field: "mac", Value: "aa:bb:cc:dd:ee:01"}})
+	if result.Count != 0 {
+		t.Errorf("matched the mac of an older lease %+v", result)
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	testDB, _ := setupIndexTest(t)
+
+	//interleave two topics so pages merge buckets
+	for minute := 0; minute < 25; minute++ {
+		topic := "dns:serve:"
+		if minute%2 == 1 {
+			topic = "dns:block:event"
+		}
+		event := map[string]interface{}{"IP": "192.168.2.6"}
+		if minute%5 == 0 {
+			event["Domain"] = "ads.example.com"
+		}
+		putTestEvent(t, topic, minute, event)
+	}
+
+	for _, order := range []string{"desc", "asc"} {
+		query := SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}, Order: order, Num: 10}
+		seen := []string{}
+		pages := 0
+		for {
+			result := search(t, testDB, query)
+			seen = append(seen, resultTimes(result)...)
+			pages++
+			if result.Cursor == "" {
+				break
+			}
+			query.Cursor = result.Cursor
+		}
+
+		if pages != 3 || len(seen) != 25 {
+			t.Fatalf("%s: %d items in %d pages, want 25 in 3", order, len(seen), pages)
+		}
+		for i, ts := range seen {
+			minute := i
+			if order == "desc" {
+				minute = 24 - i
+			}
+			if ts != minuteTime(minute) {
+				t.Fatalf("%s: item %d is %s, want %s", order, i, ts, minuteTime(minute))
+			}
+		}
+	}
+
+	query := SearchQuery{
+		Query: SearchTerm{And: []SearchTerm{
+			{Field: "ip", Value: "192.168.2.6"},
+			{Not: &SearchTerm{Field: "domain", Value: "ads.example.com"}},
+		}},
+		Topics: []string{"dns:serve:"},
+		Min:    minuteTime(4),
+		Max:    minuteTime(20),
+		Order:  "asc",
+		Num:    3,
+	}
+	pages := [][]string{}
+	for {
+		result := search(t, testDB, query)
+		pages = append(pages, resultTimes(result))
+		if result.Cursor == "" || len(pages) > 3 {
+			break
+		}
+		query.Cursor = result.Cursor
+	}
+	//even minutes are dns:serve:, every fifth minute has the domain
+	want := [][]string{
+		{minuteTime(4), minuteTime(6), minuteTime(8)},
+		{minuteTime(12), minuteTime(14), minuteTime(16)},
+		{minuteTime(18)},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+
+	query.Order = "desc"
+	query.Num = 100
+	query.Cursor = ""
+	got := resultTimes(search(t, testDB, query))
+	want[0] = []string{minuteTime(18), minuteTime(16), minuteTime(14), minuteTime(12), minuteTime(8), minuteTime(6), minuteTime(4)}
+	if !reflect.DeepEqual(got, want[0]) {
+		t.Errorf("got %v, want %v", got, want[0])
+	}
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Or: []SearchTerm{
+		{Field: "domain", Value: "ads.example.com"},
+		{Field: "ip", Value: "192.168.2.6"},
+	}}, CountOnly: true})
+	if result.Count != 25 || len(result.Items) != 0 {
+		t.Errorf("unexpected count %+v", result)
+	}
+
+	err := testDB.View(func(tx *bolt.Tx) error {
+		_, err := runSearch(tx, SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}, Cursor: "6869"})
+		if err != ErrSearchCursor {
+			t.Errorf("got %v for a cursor without a bucket, want ErrSearchCursor", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepPrunesIndex(t *testing.T) {
+	testDB, path := setupIndexTest(t)
+
+	for minute := 0; minute < 300; minute++ {
+		putTestEvent(t, "dns:serve:", minute, map[string]interface{}{"IP": "192.168.2.6"})
+	}
+
+	indexEntries := func() int {
+		count := 0
+		testDB.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket([]byte(indexBucketName)).Bucket([]byte("ip")).Stats().KeyN
+			return nil
+		})
+		return count
+	}
+
+	if count := indexEntries(); count != 300 {
+		t.Fatalf("%d index entries, want 300", count)
+	}
+
+	err, _ := CheckSizeIteration(path, testDB, LogConfig{MaxSize: 1}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := indexEntries(); count != 225 {
+		t.Errorf("%d index entries after the sweep, want 225", count)
+	}
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}, Order: "asc", Num: 1})
+	if got := resultTimes(result); len(got) != 1 || got[0] != minuteTime(75) {
+		t.Errorf("oldest remaining item %v, want %s", got, minuteTime(75))
+	}
+}
+
+func TestBuildIndexReindexesOnFieldChange(t *testing.T) {
+	testDB, _ := setupIndexTest(t)
+
+	putTestEvent(t, "log:api", 0, map[string]interface{}{"User": "admin", "IP": "192.168.2.6"})
+
+	//nothing to do when the index was built with the same fields
+	BuildIndex(db)
+	if count := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}}).Count; count != 1 {
+		t.Fatalf("ip not indexed, %d results", count)
+	}
+
+	if indexFieldsChanged(nil, defaultIndexFields) {
+		t.Error("the default fields count as a change")
+	}
+
+	fields := []IndexField{{"user", []string{"User"}}}
+	if !indexFieldsChanged(nil, fields) {
+		t.Fatal("field change not detected")
+	}
+	gConfigPtr = &LogConfig{IndexFields: fields}
+	BuildIndex(db)
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "user", Value: "Admin"}})
+	if result.Count != 1 || result.Items[0].Topic != "log:api" {
+		t.Errorf("new field not indexed %+v", result)
+	}
+
+	testDB.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(indexBucketName))
+		if index.Bucket([]byte("ip")) != nil {
+			t.Error("entries of a removed field were kept")
+		}
+		if string(index.Get([]byte(indexFieldsKey))) != `[{"Name":"user","Keys":["User"]}]` {
+			t.Errorf("unexpected indexed fields %s", index.Get([]byte(indexFieldsKey)))
+		}
+		return nil
+	})
+}
+
+func TestBuildIndexBatches(t *testing.T) {
+	testDB, _ := setupIndexTest(t)
+
+	previousBatchSize := indexBatchSize
+	indexBatchSize = 2
+	t.Cleanup(func() { indexBatchSize = previousBatchSize })
+
+	for minute := 0; minute < 5; minute++ {
+		putTestEvent(t, "log:api", minute, map[string]interface{}{"IP": "192.168.2.6"})
+	}
+	testDB.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(indexBucketName))
+	})
+
+	batches := 0
+	var last []byte
+	for {
+		var err error
+		last, err = indexBucketBatch(db, "log:api", last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches++
+		if last == nil || batches > 5 {
+			break
+		}
+	}
+	if batches != 3 {
+		t.Errorf("indexed in %d batches, want 3", batches)
+	}
+
+	result := search(t, testDB, SearchQuery{Query: SearchTerm{Field: "ip", Value: "192.168.2.6"}})
+	if result.Count != 5 {
+		t.Errorf("%d items indexed, want 5", result.Count)
+	}
+
+	if last, err := indexBucketBatch(db, "missing", nil); last != nil || err != nil {
+		t.Errorf("unexpected batch for a missing bucket %v %v", last, err)
+	}
+}
@@ -1,8 +1,13 @@
 package boltapi
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,31 +20,223 @@ func min(a, b int) int {
 	return b
 }
 
-func updateTopicLimit(db *bolt.DB, limit TopicLimit) {
+// TopicRetention tracks how many items were evicted from a bucket
+// since the db plugin started, and why
+type TopicRetention struct {
+	Limit          *TopicLimit `json:",omitempty"`
+	EvictedBySize  uint64
+	EvictedByAge   uint64
+	EvictedBySweep uint64
+	LastEnforced   time.Time `json:",omitempty"`
+	Oldest         string    `json:",omitempty"`
+}
 
-	var stats bolt.BucketStats
-	bucketName := limit.Name
+var (
+	Retentionmtx     sync.Mutex
+	gTopicRetention  = map[string]*TopicRetention{}
+	ErrInvalidLimit  = errors.New("invalid topic limit")
+	ErrInvalidMaxAge = errors.New("invalid topic limit max age")
+	ErrUnboundLimit  = errors.New("a topic limit needs a Size or a MaxAge")
+)
 
-	if err := (*db).View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
-		if bucket == nil {
-			return ErrBucketMissing
+func validateTopicLimit(limit TopicLimit) error {
+	if strings.TrimSpace(limit.Name) == "" || limit.Size < 0 {
+		return ErrInvalidLimit
+	}
+
+	if limit.MaxAge != "" {
+		age, err := time.ParseDuration(limit.MaxAge)
+		if err != nil || age <= 0 {
+			return ErrInvalidMaxAge
 		}
+	}
 
-		stats = bucket.Stats()
+	if !limit.bounded() {
+		return ErrUnboundLimit
+	}
 
-		return nil
-	}); err != nil {
-		return
+	return nil
+}
+
+// bounded reports whether a limit sets a Size or a MaxAge. Limits without
+// either, such as ones saved before they were rejected, do not exempt
+// their buckets from the sweep
+func (limit TopicLimit) bounded() bool {
+	return limit.Size > 0 || limit.MaxAge != ""
+}
+
+// matchTopicLimit returns the most specific limit for a bucket, limit names
+// are prefixes like the SaveEvents topics
+func matchTopicLimit(limits []TopicLimit, bucketName string) (TopicLimit, bool) {
+	best := TopicLimit{}
+	found := false
+	for _, limit := range limits {
+		if limit.Name == "" || !strings.HasPrefix(bucketName, limit.Name) {
+			continue
+		}
+		if !found || len(limit.Name) > len(best.Name) {
+			best = limit
+			found = true
+		}
+	}
+	return best, found
+}
+
+func recordEviction(bucketName string, bySize, byAge, bySweep int) {
+	Retentionmtx.Lock()
+	defer Retentionmtx.Unlock()
+
+	stats, exists := gTopicRetention[bucketName]
+	if !exists {
+		stats = &TopicRetention{}
+		gTopicRetention[bucketName] = stats
+	}
+
+	stats.EvictedBySize += uint64(bySize)
+	stats.EvictedByAge += uint64(byAge)
+	stats.EvictedBySweep += uint64(bySweep)
+	if bySweep == 0 {
+		stats.LastEnforced = time.Now().UTC()
+	}
+}
+
+// getTopicRetention reports the retention for a bucket, the caller holds a transaction
+func getTopicRetention(bucketName string, bucket *bolt.Bucket) TopicRetention {
+	Retentionmtx.Lock()
+	retention := TopicRetention{}
+	if stats, exists := gTopicRetention[bucketName]; exists {
+		retention = *stats
+	}
+	Retentionmtx.Unlock()
+
+	if gConfigPtr != nil {
+		Configmtx.Lock()
+		limit, found := matchTopicLimit(gConfigPtr.TopicLimits, bucketName)
+		Configmtx.Unlock()
+		if found {
+			retention.Limit = &limit
+		}
+	}
+
+	if k, _ := bucket.Cursor().First(); k != nil {
+		if oldest, err := keyToTimeString(k); err == nil {
+			retention.Oldest = oldest
+		}
+	}
+
+	return retention
+}
+
+// deleteKeys removes keys collected from a cursor. deleting while iterating
+// a bolt cursor skips entries, so keys are gathered first
+func deleteKeys(b *bolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			log.Printf("Failed to delete key: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func updateTopicLimit(b *bolt.Bucket, limit TopicLimit, now time.Time) (int, int, error) {
+	byAge := 0
+	bySize := 0
+
+	if limit.MaxAge != "" {
+		age, err := time.ParseDuration(limit.MaxAge)
+		if err != nil {
+			return 0, 0, ErrInvalidMaxAge
+		}
+
+		cutoff := make([]byte, 8)
+		binary.BigEndian.PutUint64(cutoff, uint64(now.Add(-age).UnixNano()))
+
+		//keys are 8 byte timestamps, so expired items are at the start.
+		//other keys were set through the api and are left alone
+		expired := [][]byte{}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+			if len(k) == 8 {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+
+		if err := deleteKeys(b, expired); err != nil {
+			return 0, 0, err
+		}
+		byAge = len(expired)
+	}
+
+	if limit.Size > 0 {
+		count := b.Stats().KeyN
+		if count > limit.Size {
+			toDelete := count - limit.Size
+			oldest := make([][]byte, 0, toDelete)
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && len(oldest) < toDelete; k, _ = c.Next() {
+				oldest = append(oldest, append([]byte{}, k...))
+			}
+
+			if err := deleteKeys(b, oldest); err != nil {
+				return byAge, 0, err
+			}
+			bySize = len(oldest)
+		}
 	}
 
-	if stats.KeyN > limit.Size {
-		//do stuff
+	return bySize, byAge, nil
+}
+
+// enforceTopicLimits applies the per topic limits to every bucket. This runs
+// on each sweep, regardless of the db size. Returns the number of evicted items
+func enforceTopicLimits(db *bolt.DB, limits []TopicLimit, debug bool) (int, error) {
+	if len(limits) == 0 {
+		return 0, nil
 	}
 
+	now := time.Now().UTC()
+	evicted := 0
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if isInternalBucket(name) {
+				return nil
+			}
+
+			limit, found := matchTopicLimit(limits, string(name))
+			if !found {
+				return nil
+			}
+
+			bySize, byAge, err := updateTopicLimit(b, limit, now)
+			if err != nil {
+				return err
+			}
+
+			if debug && bySize+byAge > 0 {
+				log.Printf("retention: %s evicted %d by size, %d by age\n", name, bySize, byAge)
+			}
+
+			recordEviction(string(name), bySize, byAge, 0)
+			evicted += bySize + byAge
+			return nil
+		})
+	})
+
+	return evicted, err
 }
 
 func CheckSizeIteration(dbpath string, db *bolt.DB, config LogConfig, debug bool, force bool) (error, bool) {
+	evicted, err := enforceTopicLimits(db, config.TopicLimits, debug)
+	if err != nil {
+		log.Println("[-] Failed to enforce topic limits", err)
+	} else if evicted > 0 {
+		if _, err := pruneIndex(db); err != nil {
+			log.Println("[-] Failed to prune search index", err)
+		}
+	}
+
 	fstat, err := os.Stat(dbpath)
 
 	if err != nil {
@@ -64,9 +261,19 @@ func CheckSizeIteration(dbpath string, db *bolt.DB, config LogConfig, debug bool
 	//1. get size of db + all buckets and num keys
 	if err := db.Update(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			//the search index is pruned separately
+			if isInternalBucket(name) {
+				return nil
+			}
+
 			//ensure fill percent is migrated to 0.9
 			b.FillPercent = 0.9
 
+			//buckets with a topic limit keep their own retention
+			if limit, limited := matchTopicLimit(config.TopicLimits, string(name)); limited && limit.bounded() {
+				return nil
+			}
+
 			//delete 25% of each bucket with more than X entries
 			c := b.Cursor()
 			count := 0
@@ -90,6 +297,7 @@ func CheckSizeIteration(dbpath string, db *bolt.DB, config LogConfig, debug bool
 					deleted++
 				}
 
+				recordEviction(string(name), 0, 0, deleted)
 			}
 
 			return nil
@@ -99,12 +307,15 @@ func CheckSizeIteration(dbpath string, db *bolt.DB, config LogConfig, debug bool
 		return err, false
 	}
 
+	if pruned, err := pruneIndex(db); err != nil {
+		log.Println("[-] Failed to prune search index", err)
+	} else if debug {
+		log.Printf("cleanup: pruned %d index entries\n", pruned)
+	}
+
 	fstat, err = os.Stat(dbpath)
 
-	for _, limit := range config.TopicLimits {
-		updateTopicLimit(db, limit)
-	}
-	// over 25% of max, observe topic limits, and then run a compact command
+	// over 25% of max, run a compact command
 
 	dst, err := bolt.Open(dbpath+".tmp", fstat.Mode(), nil)
 	defer dst.Close()
@@ -122,6 +333,13 @@ func CheckSizeLoop(dbpath string, db **bolt.DB, config LogConfig, debug bool) {
 	for {
 		//lock db pointer during deletion
 
+		//pick up topic limits changed through the api
+		if gConfigPtr != nil {
+			Configmtx.Lock()
+			config = *gConfigPtr
+			Configmtx.Unlock()
+		}
+
 		DBPtr.Lock()
 		err, compacted := CheckSizeIteration(dbpath, *db, config, debug, forceFirstRun)
 		forceFirstRun = false
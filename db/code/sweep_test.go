@@ -0,0 +1,214 @@
+package boltapi
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import bolt "go.etcd.io/bbolt"
+
+func openTestDB(t *testing.T) (*bolt.DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "logs.db")
+	testDB, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	return testDB, path
+}
+
+func timeKeyAt(ts time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	return key
+}
+
+// fillBucket stores count items, one minute apart and ending at end
+func fillBucket(t *testing.T, testDB *bolt.DB, bucketName string, count int, end time.Time) {
+	t.Helper()
+	err := testDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			ts := end.Add(-time.Duration(count-1-i) * time.Minute)
+			if err := b.Put(timeKeyAt(ts), []byte(`{}`)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bucketCount(t *testing.T, testDB *bolt.DB, bucketName string) int {
+	t.Helper()
+	count := 0
+	testDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b != nil {
+			count = b.Stats().KeyN
+		}
+		return nil
+	})
+	return count
+}
+
+func TestValidateTopicLimit(t *testing.T) {
+	valid := []TopicLimit{
+		{Name: "dns:serve:", Size: 1000},
+		{Name: "dns:serve:", MaxAge: "720h"},
+		{Name: "wifi:auth:", Size: 10, MaxAge: "1h"},
+	}
+	for _, limit := range valid {
+		if err := validateTopicLimit(limit); err != nil {
+			t.Errorf("%+v: unexpected error %v", limit, err)
+		}
+	}
+
+	invalid := []struct {
+		limit TopicLimit
+		err   error
+	}{
+		{TopicLimit{Name: " ", Size: 10}, ErrInvalidLimit},
+		{TopicLimit{Name: "dns:", Size: -1}, ErrInvalidLimit},
+		{TopicLimit{Name: "dns:", MaxAge: "soon"}, ErrInvalidMaxAge},
+		{TopicLimit{Name: "dns:", MaxAge: "-1h"}, ErrInvalidMaxAge},
+		{TopicLimit{Name: "dns:"}, ErrUnboundLimit},
+	}
+	for _, tt := range invalid {
+		if err := validateTopicLimit(tt.limit); err != tt.err {
+			t.Errorf("%+v: got %v, want %v", tt.limit, err, tt.err)
+		}
+	}
+}
+
+func TestMatchTopicLimitPrefix(t *testing.T) {
+	limits := []TopicLimit{
+		{Name: "dns:", Size: 100},
+		{Name: "dns:serve:", Size: 10},
+		{Name: "wifi:", MaxAge: "1h"},
+	}
+
+	tests := []struct {
+		bucket string
+		name   string
+	}{
+		{"dns:serve:192.168.2.2", "dns:serve:"},
+		{"dns:block:event", "dns:"},
+		{"wifi:auth:success", "wifi:"},
+	}
+	for _, tt := range tests {
+		limit, found := matchTopicLimit(limits, tt.bucket)
+		if !found || limit.Name != tt.name {
+			t.Errorf("%s: got %q %v, want %q", tt.bucket, limit.Name, found, tt.name)
+		}
+	}
+
+	//the longest prefix wins regardless of order
+	reversed := []TopicLimit{limits[1], limits[0]}
+	if limit, _ := matchTopicLimit(reversed, "dns:serve:x"); limit.Name != "dns:serve:" {
+		t.Errorf("got %q, want the most specific limit", limit.Name)
+	}
+
+	if _, found := matchTopicLimit(limits, "log:api"); found {
+		t.Error("matched a bucket without a limit")
+	}
+}
+
+func TestUpdateTopicLimitEvictsBySizeAndAge(t *testing.T) {
+	testDB, _ := openTestDB(t)
+	now := time.Now().UTC()
+	fillBucket(t, testDB, "dns:serve:", 120, now)
+
+	//items are a minute apart, an hour keeps the newest 60
+	err := testDB.Update(func(tx *bolt.Tx) error {
+		bySize, byAge, err := updateTopicLimit(tx.Bucket([]byte("dns:serve:")), TopicLimit{Name: "dns:serve:", MaxAge: "59m30s"}, now)
+		if bySize != 0 || byAge != 60 {
+			t.Errorf("evicted %d by size and %d by age, want 0 and 60", bySize, byAge)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dns:serve:"))
+		bySize, byAge, err := updateTopicLimit(b, TopicLimit{Name: "dns:serve:", Size: 25}, now)
+		if bySize != 35 || byAge != 0 {
+			t.Errorf("evicted %d by size and %d by age, want 35 and 0", bySize, byAge)
+		}
+
+		//the oldest items go first
+		if k, _ := b.Cursor().First(); binary.BigEndian.Uint64(k) != uint64(now.Add(-24*time.Minute).UnixNano()) {
+			t.Errorf("unexpected oldest key %v", k)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := bucketCount(t, testDB, "dns:serve:"); count != 25 {
+		t.Errorf("bucket has %d items, want 25", count)
+	}
+}
+
+func TestUpdateTopicLimitKeepsNamedKeys(t *testing.T) {
+	testDB, _ := openTestDB(t)
+	now := time.Now().UTC()
+	fillBucket(t, testDB, "alerts", 5, now.Add(-2*time.Hour))
+	testDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("alerts")).Put([]byte("last-seen-config"), []byte(`{}`))
+	})
+
+	testDB.Update(func(tx *bolt.Tx) error {
+		_, byAge, _ := updateTopicLimit(tx.Bucket([]byte("alerts")), TopicLimit{Name: "alerts", MaxAge: "1h"}, now)
+		if byAge != 5 {
+			t.Errorf("evicted %d by age, want 5", byAge)
+		}
+		return nil
+	})
+
+	if count := bucketCount(t, testDB, "alerts"); count != 1 {
+		t.Errorf("bucket has %d items, want the named key to stay", count)
+	}
+}
+
+func TestSweepSkipsOnlyBoundedLimits(t *testing.T) {
+	testDB, path := openTestDB(t)
+	now := time.Now().UTC()
+	fillBucket(t, testDB, "dns:serve:", 400, now)
+	fillBucket(t, testDB, "wifi:auth:", 400, now)
+	fillBucket(t, testDB, "log:api", 400, now)
+
+	config := LogConfig{
+		MaxSize: 1,
+		TopicLimits: []TopicLimit{
+			{Name: "dns:serve:", Size: 1000},
+			//saved before unbounded limits were rejected
+			{Name: "wifi:auth:"},
+		},
+	}
+
+	err, _ := CheckSizeIteration(path, testDB, config, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := bucketCount(t, testDB, "dns:serve:"); count != 400 {
+		t.Errorf("limited bucket swept to %d items", count)
+	}
+	for _, bucketName := range []string{"wifi:auth:", "log:api"} {
+		if count := bucketCount(t, testDB, bucketName); count != 300 {
+			t.Errorf("%s has %d items after the sweep, want 300", bucketName, count)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package spr_options adds the DHCP options configured in the SPR API
+// (NTP servers, domain search, classless routes and PXE boot settings)
+// to replies. It runs after tiny_subnets, which assigns the address.
+//
+// The API encodes the options, this plugin only copies them.
+package spr_options
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger("plugins/spr_options")
+
+var Plugin = plugins.Plugin{
+	Name:   "spr_options",
+	Setup4: setup4,
+}
+
+var apiSocket = "/state/dhcp/apisock"
+var apiClient *http.Client
+
+type wireOption struct {
+	Code  uint8
+	Value []byte
+}
+
+type optionsResponse struct {
+	IP         string
+	NextServer string
+	Options    []wireOption
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	if len(args) > 0 && args[0] != "" {
+		apiSocket = args[0]
+	}
+
+	apiClient = &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", apiSocket)
+			},
+		},
+	}
+
+	log.Printf("loaded, api socket %s", apiSocket)
+	return handler4, nil
+}
+
+func fetchOptions(mac string) (optionsResponse, error) {
+	options := optionsResponse{}
+	resp, err := apiClient.Get("http://api/dhcpOptions/" + mac)
+	if err != nil {
+		return options, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return options, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&options)
+	return options, err
+}
+
+func handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	messageType := resp.MessageType()
+	if messageType != dhcpv4.MessageTypeOffer && messageType != dhcpv4.MessageTypeAck {
+		return resp, false
+	}
+
+	options, err := fetchOptions(req.ClientHWAddr.String())
+	if err != nil {
+		log.Errorf("failed to fetch options for %s: %v", req.ClientHWAddr, err)
+		return resp, false
+	}
+
+	//the lease has to match the address tiny_subnets handed out
+	if options.IP == "" || options.IP != resp.YourIPAddr.String() {
+		return resp, false
+	}
+
+	if nextServer := net.ParseIP(options.NextServer).To4(); nextServer != nil {
+		resp.ServerIPAddr = nextServer
+	}
+
+	for _, option := range options.Options {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(option.Code), option.Value))
+		if option.Code == dhcpv4.OptionBootfileName.Code() {
+			resp.BootFileName = string(option.Value)
+		}
+	}
+
+	return resp, false
+}
@@ -1,4 +1,9 @@
 #!/bin/bash
+# Configs generated before the spr_options plugin do not add DHCP options
+if ! grep -q "spr_options" /configs/dhcp/coredhcp.yml; then
+  sed -i '/- tiny_subnets:/a\    - spr_options:' /configs/dhcp/coredhcp.yml
+fi
+
 # Do not run DHCPD in mesh mode
 if [ ! -f state/plugins/mesh/enabled ]; then
   /coredhcpd -c /configs/dhcp/coredhcp.yml
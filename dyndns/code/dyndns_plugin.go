@@ -1,15 +1,13 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
@@ -21,178 +19,98 @@ import (
 var Configmtx sync.Mutex
 var TEST_PREFIX = ""
 var UNIX_PLUGIN_LISTENER = TEST_PREFIX + "/state/plugins/dyndns/dyndns_plugin"
-var GoDyndnsConfigFile = TEST_PREFIX + "/configs/dyndns/godyndns.json"
-var godnsProcess *exec.Cmd
-var godnsProxy *httputil.ReverseProxy
 
-type GodyndnsDomain struct {
+// the file keeps its name from the godyndns configuration it replaces
+var DyndnsConfigFile = TEST_PREFIX + "/configs/dyndns/godyndns.json"
+
+type DyndnsDomain struct {
 	DomainName string   `json:"domain_name"`
 	SubDomains []string `json:"sub_domains"`
-}
-type GodyndnsConfig struct {
-	Provider    string           `json:"provider"`
-	Email       string           `json:"email"`
-	Password    string           `json:"password"`
-	LoginToken  string           `json:"login_token"`
-	Domains     []GodyndnsDomain `json:"domains"`
-	IpUrls      []string         `json:"ip_urls"`
-	IpUrl       string           `json:"ip_url"`   //deprecated entry, replaced by ip_urls
-	Ipv6Url     string           `json:"ipv6_url"` //deprecated entry, replaced by ip_urls
-	IpType      string           `json:"ip_type"`
-	Interval    int              `json:"interval"`
-	Socks5Proxy string           `json:"socks5_proxy"`
-	Resolver    string           `json:"resolver"`
-	RunOnce     bool             `json:"run_once"`
-	WebPanel    WebPanelConfig   `json:"web_panel,omitempty"` // Internal use only
+	Uplink     string   `json:"uplink,omitempty"` //by default the first active uplink
 }
 
-type WebPanelConfig struct {
-	Enabled  bool   `json:"enabled"`
-	Addr     string `json:"addr"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+type RFC2136Config struct {
+	Server        string `json:"server"` //primary name server, host:port
+	Zone          string `json:"zone,omitempty"`
+	TSIGName      string `json:"tsig_name,omitempty"`
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty"`
+	TSIGSecret    string `json:"tsig_secret,omitempty"` //base64
+	TTL           int    `json:"ttl,omitempty"`
 }
 
-// GodyndnsConfigAPI is the config exposed to the API (without internal fields)
-type GodyndnsConfigAPI struct {
-	Provider    string           `json:"provider"`
-	Email       string           `json:"email"`
-	Password    string           `json:"password"`
-	LoginToken  string           `json:"login_token"`
-	Domains     []GodyndnsDomain `json:"domains"`
-	IpUrls      []string         `json:"ip_urls"`
-	IpUrl       string           `json:"ip_url"`   //deprecated entry, replaced by ip_urls
-	Ipv6Url     string           `json:"ipv6_url"` //deprecated entry, replaced by ip_urls
-	IpType      string           `json:"ip_type"`
-	Interval    int              `json:"interval"`
-	Socks5Proxy string           `json:"socks5"`
-	Resolver    string           `json:"resolver"`
-	RunOnce     bool             `json:"run_once"`
+type DyndnsConfig struct {
+	Provider    string         `json:"provider"`
+	Email       string         `json:"email"`
+	Password    string         `json:"password"`
+	LoginToken  string         `json:"login_token"`
+	Server      string         `json:"server"` //update url of dyndns2 providers
+	Domains     []DyndnsDomain `json:"domains"`
+	IpUrls      []string       `json:"ip_urls"`      //for uplinks without a public address
+	IpUrl       string         `json:"ip_url"`       //deprecated entry, replaced by ip_urls
+	Ipv6Url     string         `json:"ipv6_url"`     //deprecated entry, replaced by ip_urls
+	IpType      string         `json:"ip_type"`      //IPv4, IPv6 or Both
+	Interval    int            `json:"interval"`     //seconds between retries of failed updates
+	Socks5Proxy string         `json:"socks5_proxy"` //host:port for provider requests
+	Resolver    string         `json:"resolver"`     //dns server for provider names
+	RunOnce     bool           `json:"run_once"`     //update on save and refresh only
+	RFC2136     *RFC2136Config `json:"rfc2136,omitempty"`
 }
 
-func startGoDyndns() {
-	stopGoDyndns()
-
-	config := loadConfig()
-	if config.Provider == "" {
-		// Don't start if no provider is configured
-		fmt.Println("godns not started: no provider configured")
-		return
-	}
-
-	godnsProcess = exec.Command("/godns", "-c", GoDyndnsConfigFile)
-	godnsProcess.Stdout = os.Stdout
-	godnsProcess.Stderr = os.Stderr
-
-	if err := godnsProcess.Start(); err != nil {
-		fmt.Println("godns failed to start", err)
-		return
-	}
-
-	fmt.Println("godns started with PID:", godnsProcess.Process.Pid)
-
-	// Setup proxy with path rewriting
-	if config.WebPanel.Enabled && config.WebPanel.Addr != "" {
-		time.Sleep(2 * time.Second)
-
-		target, err := url.Parse("http://" + config.WebPanel.Addr)
-		if err == nil {
-			godnsProxy = httputil.NewSingleHostReverseProxy(target)
-			godnsProxy.ModifyResponse = func(resp *http.Response) error {
-				// Only rewrite HTML responses
-				contentType := resp.Header.Get("Content-Type")
-				if strings.Contains(contentType, "text/html") {
-					// Read the body
-					bodyBytes, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						return err
-					}
-					resp.Body.Close()
-
-					// Rewrite paths
-					bodyStr := string(bodyBytes)
-					bodyStr = strings.ReplaceAll(bodyStr, `href="/_next/`, `href="/plugins/dyndns/_next/`)
-					bodyStr = strings.ReplaceAll(bodyStr, `src="/_next/`, `src="/plugins/dyndns/_next/`)
-					bodyStr = strings.ReplaceAll(bodyStr, `"/_next/`, `"/plugins/dyndns/_next/`)
-					bodyStr = strings.ReplaceAll(bodyStr, `'/_next/`, `'/plugins/dyndns/_next/`)
-
-					// Update content length
-					bodyBytes = []byte(bodyStr)
-					resp.Body = ioutil.NopCloser(strings.NewReader(bodyStr))
-					resp.ContentLength = int64(len(bodyBytes))
-					resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-				}
-
-				// Rewrite Location headers for redirects
-				if location := resp.Header.Get("Location"); location != "" {
-					if strings.HasPrefix(location, "/") {
-						resp.Header.Set("Location", "/plugins/dyndns"+location)
-					}
-				}
-
-				return nil
-			}
-			fmt.Println("godns web panel proxy configured for", target)
-		}
-	}
+// returned by GET /config
+type DyndnsConfigStatus struct {
+	DyndnsConfig
+	Status []RecordStatus `json:"status"`
 }
 
-func stopGoDyndns() {
-	if godnsProcess != nil && godnsProcess.Process != nil {
-		godnsProcess.Process.Kill()
-		godnsProcess.Wait()
-		godnsProcess = nil
-	}
-	godnsProxy = nil
-}
+var validCommand = regexp.MustCompile(`^[:/\-=@A-Za-z0-9._]+$`).MatchString
+var validIface = regexp.MustCompile(`^[a-zA-Z0-9._\-]{1,15}$`).MatchString
 
-func runGoDyndns() {
-	// For backward compatibility, run once mode
-	config := loadConfig()
-	if config.Provider == "" {
-		// Don't run if no provider is configured
-		return
-	}
-
-	cmd := exec.Command("/godns", "-c", GoDyndnsConfigFile)
-	stdout, err := cmd.Output()
-	if err != nil {
-		fmt.Println("godns failed to run", err)
-	}
-	fmt.Println("out", string(stdout))
-}
-
-func validateConfig(config GodyndnsConfig) error {
-
-	validCommand := regexp.MustCompile(`^[:/\-=@A-Za-z0-9.]+$`).MatchString
-	if !validCommand(config.Provider) {
-		return fmt.Errorf("invalid provider")
+func validateConfig(config DyndnsConfig) error {
+	if config.Provider != "" {
+		if _, exists := dyndnsProviders[strings.ToLower(config.Provider)]; !exists {
+			return fmt.Errorf("unsupported provider %s, choose one of %s", config.Provider, supportedProviders())
+		}
 	}
 
 	if config.Email != "" && !validCommand(config.Email) {
 		return fmt.Errorf("invalid email")
 	}
 
-	if len(config.IpUrls) == 0 {
-		return fmt.Errorf("invalid IpUrls")
+	if config.Server != "" && !strings.HasPrefix(config.Server, "https://") && !strings.HasPrefix(config.Server, "http://") {
+		return fmt.Errorf("invalid server")
 	}
 
 	for _, url := range config.IpUrls {
-		if !validCommand(url) {
+		if !validCommand(url) || !strings.HasPrefix(url, "http") {
 			return fmt.Errorf("invalid IpUrl: " + url)
 		}
 	}
 
-	if config.IpType != "" && !validCommand(config.IpType) {
-		return fmt.Errorf("invalid IpType")
+	if config.Socks5Proxy != "" {
+		host, port, err := net.SplitHostPort(config.Socks5Proxy)
+		if err != nil || host == "" || port == "" || !validCommand(config.Socks5Proxy) {
+			return fmt.Errorf("socks5 proxy should be host:port")
+		}
 	}
 
-	if config.Socks5Proxy != "" {
-		return fmt.Errorf("Socks5Proxy not supported")
+	if config.Resolver != "" {
+		host := config.Resolver
+		if h, _, err := net.SplitHostPort(config.Resolver); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("resolver should be an ip address")
+		}
+	}
+
+	switch strings.ToLower(config.IpType) {
+	case "", "ipv4", "ipv6", "both":
+	default:
+		return fmt.Errorf("invalid IpType")
 	}
 
-	if config.Resolver != "" && !validCommand(config.Resolver) {
-		return fmt.Errorf("invalid resolver")
+	if config.Interval < 0 || (config.Interval > 0 && config.Interval < 30) {
+		return fmt.Errorf("interval should be at least 30 seconds")
 	}
 
 	for _, entry := range config.Domains {
@@ -204,108 +122,133 @@ func validateConfig(config GodyndnsConfig) error {
 				return fmt.Errorf("invalid subdomain: " + subdomain)
 			}
 		}
+		if entry.Uplink != "" && !validIface(entry.Uplink) {
+			return fmt.Errorf("invalid uplink: " + entry.Uplink)
+		}
+	}
+
+	switch strings.ToLower(config.Provider) {
+	case "cloudflare":
+		if config.LoginToken == "" && (config.Email == "" || config.Password == "") {
+			return fmt.Errorf("cloudflare needs an api token, or an email and api key")
+		}
+	case "duckdns", "dynv6", "hetzner", "linode":
+		if config.LoginToken == "" {
+			return fmt.Errorf("missing login token")
+		}
+	case "dnspod":
+		if !strings.Contains(config.LoginToken, ",") {
+			return fmt.Errorf("dnspod login token should be id,token")
+		}
+	case "porkbun":
+		if config.LoginToken == "" || config.Password == "" {
+			return fmt.Errorf("porkbun needs the api key as login token and the secret key as password")
+		}
+	case "alidns":
+		if config.Email == "" || config.Password == "" {
+			return fmt.Errorf("alidns needs the AccessKey ID as email and the AccessKey secret as password")
+		}
+	case "he", "strato":
+		if config.Password == "" {
+			return fmt.Errorf("missing password")
+		}
+	case "google", "noip", "dynu":
+		if config.Email == "" || config.Password == "" {
+			return fmt.Errorf("missing email or password")
+		}
+	case "rfc2136":
+		return validateRFC2136(config.RFC2136)
+	}
+
+	return nil
+}
+
+func validateRFC2136(config *RFC2136Config) error {
+	if config == nil || config.Server == "" {
+		return fmt.Errorf("rfc2136 needs a server")
+	}
+
+	host := config.Server
+	if h, _, err := net.SplitHostPort(config.Server); err == nil {
+		host = h
+	}
+	if !validCommand(host) {
+		return fmt.Errorf("invalid rfc2136 server")
 	}
 
+	if config.Zone != "" && !validCommand(config.Zone) {
+		return fmt.Errorf("invalid rfc2136 zone")
+	}
+
+	if config.TTL < 0 {
+		return fmt.Errorf("invalid rfc2136 ttl")
+	}
+
+	if config.TSIGName == "" {
+		return nil
+	}
+
+	if _, err := packDNSName(config.TSIGName); err != nil || !validCommand(config.TSIGName) {
+		return fmt.Errorf("invalid tsig key name")
+	}
+	if _, exists := tsigAlgorithms[tsigAlgorithmName(config.TSIGAlgorithm)]; !exists {
+		return fmt.Errorf("unsupported tsig algorithm")
+	}
+	if _, err := base64.StdEncoding.DecodeString(config.TSIGSecret); err != nil || config.TSIGSecret == "" {
+		return fmt.Errorf("tsig secret should be base64")
+	}
 	return nil
 }
 
 func setConfiguration(w http.ResponseWriter, r *http.Request) {
-	// Decode API config
-	apiConfig := GodyndnsConfigAPI{}
-	err := json.NewDecoder(r.Body).Decode(&apiConfig)
+	config := DyndnsConfig{}
+	err := json.NewDecoder(r.Body).Decode(&config)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	// Convert to full config
-	config := GodyndnsConfig{
-		Provider:    strings.Title(apiConfig.Provider),
-		Email:       apiConfig.Email,
-		Password:    apiConfig.Password,
-		LoginToken:  apiConfig.LoginToken,
-		Domains:     apiConfig.Domains,
-		IpUrls:      apiConfig.IpUrls,
-		IpUrl:       apiConfig.IpUrl,
-		Ipv6Url:     apiConfig.Ipv6Url,
-		IpType:      apiConfig.IpType,
-		Interval:    apiConfig.Interval,
-		Socks5Proxy: apiConfig.Socks5Proxy,
-		Resolver:    apiConfig.Resolver,
-		RunOnce:     apiConfig.RunOnce,
-	}
-
 	err = validateConfig(config)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	// Always enable web panel internally if provider is configured
-	if config.Provider != "" {
-		config.WebPanel.Enabled = true
-		config.WebPanel.Addr = "127.0.0.1:9876"
-		config.WebPanel.Username = "admin"
-		config.WebPanel.Password = "dyndns"
-		config.RunOnce = false
-	} else {
-		// No provider, disable web panel
-		config.WebPanel.Enabled = false
-		config.RunOnce = true
-	}
-
-	data, _ := json.Marshal(config)
-
-	Configmtx.Lock()
-	err = ioutil.WriteFile(GoDyndnsConfigFile, data, 0600)
-	Configmtx.Unlock()
+	err = saveConfig(config)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	if config.WebPanel.Enabled {
-		startGoDyndns()
-	} else {
-		runGoDyndns()
-	}
+	//records are updated again with the new settings
+	resetRecordStatus()
+	go dyndnsTick(config, time.Now().Unix())
 }
 
 func refreshDyndns(w http.ResponseWriter, r *http.Request) {
-	runGoDyndns()
+	resetRecordStatus()
+
+	config := loadConfig()
+	dyndnsTick(config, time.Now().Unix())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordStatuses(config))
 }
 
 func getConfiguration(w http.ResponseWriter, r *http.Request) {
 	config := loadConfig()
 
-	// Convert to API version (without web panel settings)
-	apiConfig := GodyndnsConfigAPI{
-		Provider:    config.Provider,
-		Email:       config.Email,
-		Password:    config.Password,
-		LoginToken:  config.LoginToken,
-		Domains:     config.Domains,
-		IpUrls:      config.IpUrls,
-		IpUrl:       config.IpUrl,
-		Ipv6Url:     config.Ipv6Url,
-		IpType:      config.IpType,
-		Interval:    config.Interval,
-		Socks5Proxy: config.Socks5Proxy,
-		Resolver:    config.Resolver,
-		RunOnce:     config.RunOnce,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(apiConfig)
+	json.NewEncoder(w).Encode(DyndnsConfigStatus{DyndnsConfig: config, Status: recordStatuses(config)})
 }
 
-func loadConfig() GodyndnsConfig {
+func loadConfig() DyndnsConfig {
 	Configmtx.Lock()
 	defer Configmtx.Unlock()
 
-	config := GodyndnsConfig{}
+	config := DyndnsConfig{}
 
-	data, err := ioutil.ReadFile(GoDyndnsConfigFile)
+	data, err := ioutil.ReadFile(DyndnsConfigFile)
 	if err != nil {
 		return config
 	}
@@ -318,13 +261,12 @@ func loadConfig() GodyndnsConfig {
 	return config
 }
 
-func getInterval() time.Duration {
-	config := loadConfig()
-	if config.Interval == 0 {
-		return 300 * time.Second
-	} else {
-		return time.Duration(config.Interval) * time.Second
-	}
+func saveConfig(config DyndnsConfig) error {
+	data, _ := json.MarshalIndent(config, "", " ")
+
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+	return ioutil.WriteFile(DyndnsConfigFile, data, 0600)
 }
 
 func logRequest(handler http.Handler) http.Handler {
@@ -336,29 +278,11 @@ func logRequest(handler http.Handler) http.Handler {
 	})
 }
 
-func startIntervalTimer() {
-	runTimer := func() {
-		ticker := time.NewTicker(getInterval())
-		for {
-			select {
-			case <-ticker.C:
-				config := loadConfig()
-				if !config.WebPanel.Enabled {
-					// Only run in interval mode if web panel is disabled
-					go runGoDyndns()
-				}
-			}
-		}
-	}
-
-	go runTimer()
-}
-
 func migrate_ip_urls() {
 	//upgrade ip urls from the old format
 	config := loadConfig()
 
-	if len(config.IpUrls) == 0 {
+	if len(config.IpUrls) == 0 && (config.IpUrl != "" || config.Ipv6Url != "") {
 		urls := []string{}
 		if config.IpUrl != "" {
 			urls = append(urls, config.IpUrl)
@@ -367,15 +291,8 @@ func migrate_ip_urls() {
 			urls = append(urls, config.Ipv6Url)
 		}
 		config.IpUrls = urls
-		config.RunOnce = true
-		data, _ := json.Marshal(config)
 
-		// Only lock when writing
-		Configmtx.Lock()
-		err := ioutil.WriteFile(GoDyndnsConfigFile, data, 0600)
-		Configmtx.Unlock()
-
-		if err != nil {
+		if saveConfig(config) != nil {
 			fmt.Println("[-] Failed to save migration")
 		}
 	}
@@ -386,48 +303,6 @@ func dyndns_init() {
 	migrate_ip_urls()
 }
 
-func handleUIProxy(w http.ResponseWriter, r *http.Request) {
-	config := loadConfig()
-
-	// If no provider is configured, return a message
-	if config.Provider == "" {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, `
-			<html>
-			<body>
-				<h1>GoDNS Dynamic DNS Plugin</h1>
-				<p>No DNS provider configured yet.</p>
-				<p>Please configure the plugin using the SPR UI or API first.</p>
-			</body>
-			</html>
-		`)
-		return
-	}
-
-	// If web panel is not enabled, enable it automatically
-	if !config.WebPanel.Enabled || godnsProxy == nil {
-		config.WebPanel.Enabled = true
-		config.WebPanel.Addr = "127.0.0.1:9876"
-		config.WebPanel.Username = "admin"
-		config.WebPanel.Password = "dyndns"
-		config.RunOnce = false
-
-		data, _ := json.Marshal(config)
-		ioutil.WriteFile(GoDyndnsConfigFile, data, 0600)
-
-		go startGoDyndns()
-		time.Sleep(3 * time.Second)
-	}
-
-	if godnsProxy == nil {
-		http.Error(w, "Web panel is starting, please refresh in a few seconds", 503)
-		return
-	}
-
-	// Proxy the request
-	godnsProxy.ServeHTTP(w, r)
-}
-
 func main() {
 
 	dyndns_init()
@@ -438,27 +313,15 @@ func main() {
 	unix_plugin_router.HandleFunc("/config", setConfiguration).Methods("PUT")
 	unix_plugin_router.HandleFunc("/refresh", refreshDyndns).Methods("GET")
 
-	// Handle all other requests as UI proxy
-	unix_plugin_router.PathPrefix("/").HandlerFunc(handleUIProxy)
-
 	os.Remove(UNIX_PLUGIN_LISTENER)
 	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
 	if err != nil {
 		panic(err)
 	}
 
-	startIntervalTimer()
-
-	// Start godns if web panel is enabled
-	config := loadConfig()
-	if config.WebPanel.Enabled {
-		go startGoDyndns()
-	}
+	go dyndnsLoop()
 
 	pluginServer := http.Server{Handler: logRequest(unix_plugin_router)}
 
-	// Cleanup on exit
-	defer stopGoDyndns()
-
 	pluginServer.Serve(unixPluginListener)
 }
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a provider updates one record, and returns "updated" or "unchanged"
+type dyndnsProvider func(config DyndnsConfig, record dyndnsRecord, address string) (string, error)
+
+var dyndnsProviders = map[string]dyndnsProvider{
+	"alidns":     updateAlidns,
+	"cloudflare": updateCloudflare,
+	"dnspod":     updateDnspod,
+	"duckdns":    updateDuckDNS,
+	"dynu":       updateDynu,
+	"dynv6":      updateDynv6,
+	"dyndns2":    updateDyndns2,
+	"google":     updateGoogle,
+	"he":         updateHE,
+	"hetzner":    updateHetzner,
+	"linode":     updateLinode,
+	"noip":       updateNoIP,
+	"porkbun":    updatePorkbun,
+	"rfc2136":    updateRFC2136,
+	"strato":     updateStrato,
+}
+
+var AlidnsAPI = "https://alidns.aliyuncs.com/"
+var CloudflareAPI = "https://api.cloudflare.com/client/v4"
+var DnspodAPI = "https://dnsapi.cn"
+var DuckDNSUpdateURL = "https://www.duckdns.org/update"
+var DynuUpdateURL = "https://api.dynu.com/nic/update"
+var Dynv6UpdateURL = "https://dynv6.com/api/update"
+var DefaultDyndns2Server = "https://members.dyndns.org/nic/update"
+var GoogleUpdateURL = "https://domains.google.com/nic/update"
+var HEUpdateURL = "https://dyn.dns.he.net/nic/update"
+var HetznerAPI = "https://dns.hetzner.com/api/v1"
+var LinodeAPI = "https://api.linode.com/v4"
+var NoIPUpdateURL = "https://dynupdate.no-ip.com/nic/update"
+var PorkbunAPI = "https://api.porkbun.com/api/json/v3"
+var StratoUpdateURL = "https://dyndns.strato.com/nic/update"
+
+// replaced by configureNetwork before each round, guarded by Updatemtx
+var dyndnsClient = &http.Client{Timeout: 20 * time.Second}
+var dyndnsDialer = &net.Dialer{Timeout: 5 * time.Second}
+
+func supportedProviders() string {
+	names := []string{}
+	for name := range dyndnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// resolverAddress adds the dns port to a resolver without one
+func resolverAddress(resolver string) string {
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return net.JoinHostPort(resolver, "53")
+	}
+	return resolver
+}
+
+// configureNetwork resolves provider names with the configured resolver,
+// and sends provider requests through the socks5 proxy
+func configureNetwork(config DyndnsConfig) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if config.Resolver != "" {
+		resolver := resolverAddress(config.Resolver)
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if config.Socks5Proxy != "" {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: config.Socks5Proxy})
+	}
+
+	dyndnsDialer = dialer
+	dyndnsClient = &http.Client{Timeout: 20 * time.Second, Transport: transport}
+}
+
+// subdomain returns the name of the record relative to its domain,
+// or "" for the domain itself
+func (r dyndnsRecord) subdomain() string {
+	if r.Name == r.Domain {
+		return ""
+	}
+	return strings.TrimSuffix(r.Name, "."+r.Domain)
+}
+
+// jsonRequest sends data as json and decodes the response into result
+func jsonRequest(method string, url string, headers map[string]string, data interface{}, result interface{}) error {
+	body := &bytes.Buffer{}
+	if data != nil {
+		payload, _ := json.Marshal(data)
+		body = bytes.NewBuffer(payload)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	raw, err := providerRequest(req)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func providerRequest(req *http.Request) ([]byte, error) {
+	req.Header.Set("User-Agent", "spr-dyndns")
+
+	resp, err := dyndnsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return body, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+type cloudflareResponse struct {
+	Success bool
+	Errors  []struct {
+		Code    int
+		Message string
+	}
+	Result json.RawMessage
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+func cloudflareRequest(config DyndnsConfig, method string, path string, data interface{}, result interface{}) error {
+	body := &bytes.Buffer{}
+	if data != nil {
+		payload, _ := json.Marshal(data)
+		body = bytes.NewBuffer(payload)
+	}
+
+	req, err := http.NewRequest(method, CloudflareAPI+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.LoginToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.LoginToken)
+	} else {
+		//global api key
+		req.Header.Set("X-Auth-Email", config.Email)
+		req.Header.Set("X-Auth-Key", config.Password)
+	}
+
+	raw, err := providerRequest(req)
+	response := cloudflareResponse{}
+	if jsonErr := json.Unmarshal(raw, &response); jsonErr != nil {
+		if err != nil {
+			return err
+		}
+		return jsonErr
+	}
+
+	if !response.Success {
+		if len(response.Errors) > 0 {
+			return fmt.Errorf("cloudflare error %d: %s", response.Errors[0].Code, response.Errors[0].Message)
+		}
+		return errors.New("cloudflare request failed")
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+func updateCloudflare(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	zones := []struct {
+		ID string `json:"id"`
+	}{}
+	err := cloudflareRequest(config, http.MethodGet, "/zones?name="+url.QueryEscape(record.Domain), nil, &zones)
+	if err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("cloudflare zone %s not found", record.Domain)
+	}
+	zonePath := "/zones/" + url.PathEscape(zones[0].ID) + "/dns_records"
+
+	existing := []cloudflareRecord{}
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	err = cloudflareRequest(config, http.MethodGet, zonePath+"?"+query.Encode(), nil, &existing)
+	if err != nil {
+		return "", err
+	}
+
+	//ttl 1 is automatic
+	update := cloudflareRecord{Type: record.Type, Name: record.Name, Content: address, TTL: 1}
+	result := cloudflareRecord{}
+
+	if len(existing) == 0 {
+		return "updated", cloudflareRequest(config, http.MethodPost, zonePath, update, &result)
+	}
+
+	if existing[0].Content == address {
+		return "unchanged", nil
+	}
+
+	update.TTL = existing[0].TTL
+	update.Proxied = existing[0].Proxied
+	return "updated", cloudflareRequest(config, http.MethodPut, zonePath+"/"+url.PathEscape(existing[0].ID), update, &result)
+}
+
+func updateDuckDNS(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	query := url.Values{
+		"domains": {strings.TrimSuffix(record.Name, ".duckdns.org")},
+		"token":   {config.LoginToken},
+		"verbose": {"true"},
+	}
+	if record.Type == "AAAA" {
+		query.Set("ipv6", address)
+	} else {
+		query.Set("ip", address)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, DuckDNSUpdateURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := providerRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Fields(string(body))
+	if len(lines) == 0 || lines[0] != "OK" {
+		return "", errors.New("duckdns rejected the update")
+	}
+	if lines[len(lines)-1] == "NOCHANGE" {
+		return "unchanged", nil
+	}
+	return "updated", nil
+}
+
+func updateDynv6(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	query := url.Values{"hostname": {record.Name}, "token": {config.LoginToken}}
+	if record.Type == "AAAA" {
+		query.Set("ipv6", address)
+	} else {
+		query.Set("ipv4", address)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, Dynv6UpdateURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := providerRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.Contains(string(body), "unchanged") {
+		return "unchanged", nil
+	}
+	return "updated", nil
+}
+
+// updateDyndns2 speaks the dyndns2 protocol, which many providers implement
+func updateDyndns2(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	server := config.Server
+	if server == "" {
+		server = DefaultDyndns2Server
+	}
+	return dyndns2Update(server, config.Email, config.Password, record, address)
+}
+
+func updateGoogle(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	return dyndns2Update(GoogleUpdateURL, config.Email, config.Password, record, address)
+}
+
+func updateNoIP(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	return dyndns2Update(NoIPUpdateURL, config.Email, config.Password, record, address)
+}
+
+func updateDynu(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	return dyndns2Update(DynuUpdateURL, config.Email, config.Password, record, address)
+}
+
+// he.net authenticates with the record name and its dynamic dns key
+func updateHE(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	return dyndns2Update(HEUpdateURL, record.Name, config.Password, record, address)
+}
+
+// strato logs in with the domain unless another user is set
+func updateStrato(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	user := config.Email
+	if user == "" {
+		user = record.Domain
+	}
+	return dyndns2Update(StratoUpdateURL, user, config.Password, record, address)
+}
+
+func dyndns2Update(server string, user string, password string, record dyndnsRecord, address string) (string, error) {
+	query := url.Values{"hostname": {record.Name}, "myip": {address}}
+	req, err := http.NewRequest(http.MethodGet, server+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(user, password)
+
+	body, err := providerRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	result := strings.Fields(string(body))
+	if len(result) == 0 {
+		return "", errors.New("empty dyndns2 response")
+	}
+
+	switch result[0] {
+	case "good":
+		return "updated", nil
+	case "nochg":
+		return "unchanged", nil
+	}
+	return "", errors.New("dyndns2 update failed: " + result[0])
+}
+
+type porkbunRecord struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+type porkbunResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Records []porkbunRecord `json:"records"`
+}
+
+// porkbun takes the api key as login_token and the secret key as password
+func updatePorkbun(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	request := func(path string, data map[string]string) (porkbunResponse, error) {
+		data["apikey"] = config.LoginToken
+		data["secretapikey"] = config.Password
+		response := porkbunResponse{}
+		err := jsonRequest(http.MethodPost, PorkbunAPI+path, nil, data, &response)
+		if err == nil && response.Status != "SUCCESS" {
+			err = fmt.Errorf("porkbun error: %s", response.Message)
+		}
+		return response, err
+	}
+
+	nameType := url.PathEscape(record.Domain) + "/" + record.Type
+	if sub := record.subdomain(); sub != "" {
+		nameType += "/" + url.PathEscape(sub)
+	}
+
+	existing, err := request("/dns/retrieveByNameType/"+nameType, map[string]string{})
+	if err != nil {
+		return "", err
+	}
+
+	if len(existing.Records) == 0 {
+		_, err = request("/dns/create/"+url.PathEscape(record.Domain), map[string]string{
+			"name":    record.subdomain(),
+			"type":    record.Type,
+			"content": address,
+		})
+		return "updated", err
+	}
+
+	if existing.Records[0].Content == address {
+		return "unchanged", nil
+	}
+
+	_, err = request("/dns/editByNameType/"+nameType, map[string]string{"content": address})
+	return "updated", err
+}
+
+type hetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+func updateHetzner(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	headers := map[string]string{"Auth-API-Token": config.LoginToken}
+
+	zones := struct {
+		Zones []struct {
+			ID string `json:"id"`
+		} `json:"zones"`
+	}{}
+	err := jsonRequest(http.MethodGet, HetznerAPI+"/zones?name="+url.QueryEscape(record.Domain), headers, nil, &zones)
+	if err != nil {
+		return "", err
+	}
+	if len(zones.Zones) == 0 {
+		return "", fmt.Errorf("hetzner zone %s not found", record.Domain)
+	}
+	zoneID := zones.Zones[0].ID
+
+	name := record.subdomain()
+	if name == "" {
+		name = "@"
+	}
+
+	records := struct {
+		Records []hetznerRecord `json:"records"`
+	}{}
+	err = jsonRequest(http.MethodGet, HetznerAPI+"/records?zone_id="+url.QueryEscape(zoneID), headers, nil, &records)
+	if err != nil {
+		return "", err
+	}
+
+	update := hetznerRecord{ZoneID: zoneID, Type: record.Type, Name: name, Value: address}
+	for _, existing := range records.Records {
+		if existing.Type != record.Type || existing.Name != name {
+			continue
+		}
+		if existing.Value == address {
+			return "unchanged", nil
+		}
+		update.TTL = existing.TTL
+		return "updated", jsonRequest(http.MethodPut, HetznerAPI+"/records/"+url.PathEscape(existing.ID), headers, update, nil)
+	}
+
+	return "updated", jsonRequest(http.MethodPost, HetznerAPI+"/records", headers, update, nil)
+}
+
+type linodeRecord struct {
+	ID     int    `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+func updateLinode(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	headers := map[string]string{"Authorization": "Bearer " + config.LoginToken}
+
+	domains := struct {
+		Data []struct {
+			ID     int    `json:"id"`
+			Domain string `json:"domain"`
+		} `json:"data"`
+	}{}
+	filter, _ := json.Marshal(map[string]string{"domain": record.Domain})
+	err := jsonRequest(http.MethodGet, LinodeAPI+"/domains", map[string]string{
+		"Authorization": headers["Authorization"],
+		"X-Filter":      string(filter),
+	}, nil, &domains)
+	if err != nil {
+		return "", err
+	}
+	if len(domains.Data) == 0 {
+		return "", fmt.Errorf("linode domain %s not found", record.Domain)
+	}
+	recordsPath := fmt.Sprintf("%s/domains/%d/records", LinodeAPI, domains.Data[0].ID)
+
+	records := struct {
+		Data []linodeRecord `json:"data"`
+	}{}
+	err = jsonRequest(http.MethodGet, recordsPath, headers, nil, &records)
+	if err != nil {
+		return "", err
+	}
+
+	for _, existing := range records.Data {
+		if existing.Type != record.Type || existing.Name != record.subdomain() {
+			continue
+		}
+		if existing.Target == address {
+			return "unchanged", nil
+		}
+		return "updated", jsonRequest(http.MethodPut, fmt.Sprintf("%s/%d", recordsPath, existing.ID), headers, map[string]string{"target": address}, nil)
+	}
+
+	update := linodeRecord{Type: record.Type, Name: record.subdomain(), Target: address}
+	return "updated", jsonRequest(http.MethodPost, recordsPath, headers, update, nil)
+}
+
+type dnspodStatus struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// dnspodRequest posts a form to the dnspod api, login_token is "id,token"
+func dnspodRequest(config DyndnsConfig, action string, form url.Values, result interface{}) error {
+	form.Set("login_token", config.LoginToken)
+	form.Set("format", "json")
+
+	req, err := http.NewRequest(http.MethodPost, DnspodAPI+"/"+action, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	raw, err := providerRequest(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func updateDnspod(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	sub := record.subdomain()
+	if sub == "" {
+		sub = "@"
+	}
+
+	list := struct {
+		Status  dnspodStatus `json:"status"`
+		Records []struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Type   string `json:"type"`
+			Value  string `json:"value"`
+			LineID string `json:"line_id"`
+		} `json:"records"`
+	}{}
+	err := dnspodRequest(config, "Record.List", url.Values{
+		"domain":      {record.Domain},
+		"sub_domain":  {sub},
+		"record_type": {record.Type},
+	}, &list)
+	if err != nil {
+		return "", err
+	}
+
+	//code 10 is returned for a name without records
+	if list.Status.Code != "1" && list.Status.Code != "10" {
+		return "", fmt.Errorf("dnspod error %s: %s", list.Status.Code, list.Status.Message)
+	}
+
+	form := url.Values{
+		"domain":         {record.Domain},
+		"sub_domain":     {sub},
+		"record_type":    {record.Type},
+		"record_line_id": {"0"},
+		"value":          {address},
+	}
+	action := "Record.Create"
+	if len(list.Records) > 0 {
+		if list.Records[0].Value == address {
+			return "unchanged", nil
+		}
+		action = "Record.Modify"
+		form.Set("record_id", list.Records[0].ID)
+		form.Set("record_line_id", list.Records[0].LineID)
+	}
+
+	result := struct {
+		Status dnspodStatus `json:"status"`
+	}{}
+	err = dnspodRequest(config, action, form, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.Status.Code != "1" {
+		return "", fmt.Errorf("dnspod error %s: %s", result.Status.Code, result.Status.Message)
+	}
+	return "updated", nil
+}
+
+// aliyunEscape percent encodes the way aliyun signatures expect
+func aliyunEscape(value string) string {
+	value = url.QueryEscape(value)
+	value = strings.ReplaceAll(value, "+", "%20")
+	value = strings.ReplaceAll(value, "*", "%2A")
+	return strings.ReplaceAll(value, "%7E", "~")
+}
+
+// signAliyun returns the signature of a GET request with the given
+// parameters, with HMAC-SHA1 over the sorted and escaped query
+func signAliyun(params url.Values, secret string) string {
+	keys := []string{}
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, aliyunEscape(key)+"="+aliyunEscape(params.Get(key)))
+	}
+
+	stringToSign := "GET&" + aliyunEscape("/") + "&" + aliyunEscape(strings.Join(pairs, "&"))
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// alidnsRequest calls an alidns action, email holds the AccessKey ID and
+// password the AccessKey secret
+func alidnsRequest(config DyndnsConfig, action string, params url.Values, result interface{}) error {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	params.Set("Action", action)
+	params.Set("Format", "JSON")
+	params.Set("Version", "2015-01-09")
+	params.Set("AccessKeyId", config.Email)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	params.Set("SignatureNonce", hex.EncodeToString(nonce))
+	params.Set("Timestamp", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	params.Set("Signature", signAliyun(params, config.Password))
+
+	req, err := http.NewRequest(http.MethodGet, AlidnsAPI+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	raw, err := providerRequest(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func updateAlidns(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	rr := record.subdomain()
+	if rr == "" {
+		rr = "@"
+	}
+
+	existing := struct {
+		DomainRecords struct {
+			Record []struct {
+				RecordId string
+				RR       string
+				Type     string
+				Value    string
+			}
+		}
+	}{}
+	err := alidnsRequest(config, "DescribeSubDomainRecords", url.Values{
+		"SubDomain": {record.Name},
+		"Type":      {record.Type},
+	}, &existing)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{"RR": {rr}, "Type": {record.Type}, "Value": {address}}
+	action := "AddDomainRecord"
+	if records := existing.DomainRecords.Record; len(records) > 0 {
+		if records[0].Value == address {
+			return "unchanged", nil
+		}
+		action = "UpdateDomainRecord"
+		params.Set("RecordId", records[0].RecordId)
+	} else {
+		params.Set("DomainName", record.Domain)
+	}
+
+	result := struct{ RecordId string }{}
+	return "updated", alidnsRequest(config, action, params, &result)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testRecord = dyndnsRecord{Domain: "example.com", Name: "home.example.com", Type: "A"}
+var testApex = dyndnsRecord{Domain: "example.com", Name: "example.com", Type: "AAAA"}
+
+type providerCall struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// fakeProvider points the provider url at a test server, which answers
+// every request with reply and records it
+func fakeProvider(t *testing.T, target *string, suffix string, reply func(call providerCall) (int, string)) *[]providerCall {
+	t.Helper()
+
+	calls := &[]providerCall{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		call := providerCall{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header, Body: string(body)}
+		*calls = append(*calls, call)
+		status, response := reply(call)
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+
+	old := *target
+	*target = server.URL + suffix
+	t.Cleanup(func() {
+		*target = old
+		server.Close()
+	})
+	return calls
+}
+
+func decodeBody(t *testing.T, call providerCall) map[string]interface{} {
+	t.Helper()
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(call.Body), &body); err != nil {
+		t.Fatalf("%s %s: invalid body %q", call.Method, call.Path, call.Body)
+	}
+	return body
+}
+
+func TestUpdateCloudflare(t *testing.T) {
+	calls := fakeProvider(t, &CloudflareAPI, "", func(call providerCall) (int, string) {
+		switch {
+		case call.Path == "/zones":
+			return 200, `{"success":true,"result":[{"id":"zone1"}]}`
+		case call.Method == http.MethodGet:
+			return 200, `{"success":true,"result":[{"id":"rec1","type":"A","name":"home.example.com","content":"198.51.100.1","ttl":120,"proxied":true}]}`
+		}
+		return 200, `{"success":true,"result":{}}`
+	})
+
+	result, err := updateCloudflare(DyndnsConfig{LoginToken: "token"}, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 3 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	zones, records, put := (*calls)[0], (*calls)[1], (*calls)[2]
+	if zones.Query.Get("name") != "example.com" || zones.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("unexpected zone lookup %+v", zones)
+	}
+	if records.Path != "/zones/zone1/dns_records" || records.Query.Get("name") != "home.example.com" || records.Query.Get("type") != "A" {
+		t.Errorf("unexpected record lookup %+v", records)
+	}
+	want := map[string]interface{}{"type": "A", "name": "home.example.com", "content": "203.0.113.7", "ttl": 120.0, "proxied": true}
+	if put.Method != http.MethodPut || put.Path != "/zones/zone1/dns_records/rec1" || !reflect.DeepEqual(decodeBody(t, put), want) {
+		t.Errorf("unexpected update %+v", put)
+	}
+
+	//the global api key is sent with the account email
+	*calls = nil
+	updateCloudflare(DyndnsConfig{Email: "me@example.com", Password: "key"}, testRecord, "203.0.113.7")
+	if h := (*calls)[0].Header; h.Get("X-Auth-Email") != "me@example.com" || h.Get("X-Auth-Key") != "key" || h.Get("Authorization") != "" {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestUpdateCloudflareErrors(t *testing.T) {
+	fakeProvider(t, &CloudflareAPI, "", func(call providerCall) (int, string) {
+		return 403, `{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`
+	})
+
+	_, err := updateCloudflare(DyndnsConfig{LoginToken: "token"}, testRecord, "203.0.113.7")
+	if err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUpdateDuckDNS(t *testing.T) {
+	response := "OK\n203.0.113.7\n\nUPDATED"
+	calls := fakeProvider(t, &DuckDNSUpdateURL, "/update", func(call providerCall) (int, string) {
+		return 200, response
+	})
+
+	record := dyndnsRecord{Domain: "home.duckdns.org", Name: "home.duckdns.org", Type: "AAAA"}
+	result, err := updateDuckDNS(DyndnsConfig{LoginToken: "token"}, record, "2001:db8::7")
+	if err != nil || result != "updated" {
+		t.Fatalf("got %q %v", result, err)
+	}
+	want := url.Values{"domains": {"home"}, "token": {"token"}, "verbose": {"true"}, "ipv6": {"2001:db8::7"}}
+	if query := (*calls)[0].Query; !reflect.DeepEqual(query, want) {
+		t.Errorf("got query %v, want %v", query, want)
+	}
+
+	response = "OK\n203.0.113.7\n\nNOCHANGE"
+	if result, _ := updateDuckDNS(DyndnsConfig{LoginToken: "token"}, record, "2001:db8::7"); result != "unchanged" {
+		t.Errorf("got %q", result)
+	}
+
+	response = "KO"
+	if _, err := updateDuckDNS(DyndnsConfig{LoginToken: "token"}, record, "2001:db8::7"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestUpdateDynv6(t *testing.T) {
+	calls := fakeProvider(t, &Dynv6UpdateURL, "/api/update", func(call providerCall) (int, string) {
+		return 200, "addresses unchanged"
+	})
+
+	result, err := updateDynv6(DyndnsConfig{LoginToken: "token"}, testRecord, "203.0.113.7")
+	if err != nil || result != "unchanged" {
+		t.Fatalf("got %q %v", result, err)
+	}
+	want := url.Values{"hostname": {"home.example.com"}, "token": {"token"}, "ipv4": {"203.0.113.7"}}
+	if query := (*calls)[0].Query; !reflect.DeepEqual(query, want) {
+		t.Errorf("got query %v, want %v", query, want)
+	}
+}
+
+func TestDyndns2Providers(t *testing.T) {
+	tests := []struct {
+		name   string
+		target *string
+		update dyndnsProvider
+		config DyndnsConfig
+		user   string
+	}{
+		{"dyndns2", &DefaultDyndns2Server, updateDyndns2, DyndnsConfig{Email: "user", Password: "pass"}, "user"},
+		{"google", &GoogleUpdateURL, updateGoogle, DyndnsConfig{Email: "user", Password: "pass"}, "user"},
+		{"noip", &NoIPUpdateURL, updateNoIP, DyndnsConfig{Email: "user", Password: "pass"}, "user"},
+		{"dynu", &DynuUpdateURL, updateDynu, DyndnsConfig{Email: "user", Password: "pass"}, "user"},
+		{"he", &HEUpdateURL, updateHE, DyndnsConfig{Password: "pass"}, "home.example.com"},
+		{"strato", &StratoUpdateURL, updateStrato, DyndnsConfig{Password: "pass"}, "example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := "good 203.0.113.7"
+			calls := fakeProvider(t, tt.target, "/nic/update", func(call providerCall) (int, string) {
+				return 200, response
+			})
+
+			result, err := tt.update(tt.config, testRecord, "203.0.113.7")
+			if err != nil || result != "updated" {
+				t.Fatalf("got %q %v", result, err)
+			}
+
+			call := (*calls)[0]
+			req := http.Request{Header: call.Header}
+			user, password, _ := req.BasicAuth()
+			if call.Path != "/nic/update" || user != tt.user || password != "pass" {
+				t.Errorf("unexpected request %s %s:%s", call.Path, user, password)
+			}
+			want := url.Values{"hostname": {"home.example.com"}, "myip": {"203.0.113.7"}}
+			if !reflect.DeepEqual(call.Query, want) {
+				t.Errorf("got query %v, want %v", call.Query, want)
+			}
+
+			response = "nochg 203.0.113.7"
+			if result, _ := tt.update(tt.config, testRecord, "203.0.113.7"); result != "unchanged" {
+				t.Errorf("got %q", result)
+			}
+
+			response = "badauth"
+			if _, err := tt.update(tt.config, testRecord, "203.0.113.7"); err == nil || !strings.Contains(err.Error(), "badauth") {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestDyndns2Server(t *testing.T) {
+	server := ""
+	calls := fakeProvider(t, &server, "/custom/update", func(call providerCall) (int, string) {
+		return 200, "good"
+	})
+
+	config := DyndnsConfig{Server: server, Email: "user", Password: "pass"}
+	if _, err := updateDyndns2(config, testRecord, "203.0.113.7"); err != nil || (*calls)[0].Path != "/custom/update" {
+		t.Errorf("server was not used: %v %+v", err, *calls)
+	}
+}
+
+func TestUpdatePorkbun(t *testing.T) {
+	existing := `{"status":"SUCCESS","records":[{"id":"1","name":"home.example.com","type":"A","content":"198.51.100.1"}]}`
+	calls := fakeProvider(t, &PorkbunAPI, "/api/json/v3", func(call providerCall) (int, string) {
+		if strings.Contains(call.Path, "/retrieveByNameType/") {
+			return 200, existing
+		}
+		return 200, `{"status":"SUCCESS"}`
+	})
+
+	config := DyndnsConfig{LoginToken: "pk1_key", Password: "sk1_secret"}
+	result, err := updatePorkbun(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 2 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	retrieve, edit := (*calls)[0], (*calls)[1]
+	credentials := map[string]interface{}{"apikey": "pk1_key", "secretapikey": "sk1_secret"}
+	if retrieve.Path != "/api/json/v3/dns/retrieveByNameType/example.com/A/home" || !reflect.DeepEqual(decodeBody(t, retrieve), credentials) {
+		t.Errorf("unexpected lookup %+v", retrieve)
+	}
+	want := map[string]interface{}{"apikey": "pk1_key", "secretapikey": "sk1_secret", "content": "203.0.113.7"}
+	if edit.Path != "/api/json/v3/dns/editByNameType/example.com/A/home" || !reflect.DeepEqual(decodeBody(t, edit), want) {
+		t.Errorf("unexpected edit %+v", edit)
+	}
+
+	//the apex has no subdomain, missing records are created
+	*calls = nil
+	existing = `{"status":"SUCCESS","records":[]}`
+	if _, err = updatePorkbun(config, testApex, "2001:db8::7"); err != nil {
+		t.Fatal(err)
+	}
+	retrieve, create := (*calls)[0], (*calls)[1]
+	want = map[string]interface{}{"apikey": "pk1_key", "secretapikey": "sk1_secret", "name": "", "type": "AAAA", "content": "2001:db8::7"}
+	if retrieve.Path != "/api/json/v3/dns/retrieveByNameType/example.com/AAAA" || create.Path != "/api/json/v3/dns/create/example.com" || !reflect.DeepEqual(decodeBody(t, create), want) {
+		t.Errorf("unexpected requests %+v %+v", retrieve, create)
+	}
+
+	existing = `{"status":"ERROR","message":"Invalid API key."}`
+	if _, err = updatePorkbun(config, testRecord, "203.0.113.7"); err == nil || !strings.Contains(err.Error(), "Invalid API key") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUpdateHetzner(t *testing.T) {
+	calls := fakeProvider(t, &HetznerAPI, "/api/v1", func(call providerCall) (int, string) {
+		switch call.Path {
+		case "/api/v1/zones":
+			return 200, `{"zones":[{"id":"zone1"}]}`
+		case "/api/v1/records":
+			if call.Method == http.MethodGet {
+				return 200, `{"records":[{"id":"rec1","zone_id":"zone1","type":"A","name":"home","value":"198.51.100.1","ttl":600},{"id":"rec2","zone_id":"zone1","type":"A","name":"@","value":"203.0.113.7"}]}`
+			}
+		}
+		return 200, `{"record":{}}`
+	})
+
+	config := DyndnsConfig{LoginToken: "token"}
+	result, err := updateHetzner(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 3 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	zones, records, put := (*calls)[0], (*calls)[1], (*calls)[2]
+	if zones.Query.Get("name") != "example.com" || zones.Header.Get("Auth-API-Token") != "token" || records.Query.Get("zone_id") != "zone1" {
+		t.Errorf("unexpected lookups %+v %+v", zones, records)
+	}
+	want := map[string]interface{}{"zone_id": "zone1", "type": "A", "name": "home", "value": "203.0.113.7", "ttl": 600.0}
+	if put.Method != http.MethodPut || put.Path != "/api/v1/records/rec1" || !reflect.DeepEqual(decodeBody(t, put), want) {
+		t.Errorf("unexpected update %+v", put)
+	}
+
+	//the apex is named @
+	apex := dyndnsRecord{Domain: "example.com", Name: "example.com", Type: "A"}
+	if result, _ := updateHetzner(config, apex, "203.0.113.7"); result != "unchanged" {
+		t.Errorf("got %q", result)
+	}
+
+	*calls = nil
+	if _, err = updateHetzner(config, testApex, "2001:db8::7"); err != nil {
+		t.Fatal(err)
+	}
+	post := (*calls)[2]
+	want = map[string]interface{}{"zone_id": "zone1", "type": "AAAA", "name": "@", "value": "2001:db8::7"}
+	if post.Method != http.MethodPost || post.Path != "/api/v1/records" || !reflect.DeepEqual(decodeBody(t, post), want) {
+		t.Errorf("unexpected create %+v", post)
+	}
+}
+
+func TestUpdateLinode(t *testing.T) {
+	calls := fakeProvider(t, &LinodeAPI, "/v4", func(call providerCall) (int, string) {
+		switch {
+		case call.Path == "/v4/domains":
+			return 200, `{"data":[{"id":42,"domain":"example.com"}]}`
+		case call.Method == http.MethodGet:
+			return 200, `{"data":[{"id":7,"type":"A","name":"home","target":"198.51.100.1"},{"id":8,"type":"A","name":"","target":"203.0.113.7"}]}`
+		}
+		return 200, `{}`
+	})
+
+	config := DyndnsConfig{LoginToken: "token"}
+	result, err := updateLinode(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 3 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	domains, records, put := (*calls)[0], (*calls)[1], (*calls)[2]
+	if domains.Header.Get("X-Filter") != `{"domain":"example.com"}` || domains.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("unexpected domain lookup %+v", domains)
+	}
+	if records.Path != "/v4/domains/42/records" || records.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("unexpected record lookup %+v", records)
+	}
+	if put.Method != http.MethodPut || put.Path != "/v4/domains/42/records/7" || !reflect.DeepEqual(decodeBody(t, put), map[string]interface{}{"target": "203.0.113.7"}) {
+		t.Errorf("unexpected update %+v", put)
+	}
+
+	apex := dyndnsRecord{Domain: "example.com", Name: "example.com", Type: "A"}
+	if result, _ := updateLinode(config, apex, "203.0.113.7"); result != "unchanged" {
+		t.Errorf("got %q", result)
+	}
+
+	*calls = nil
+	if _, err = updateLinode(config, testApex, "2001:db8::7"); err != nil {
+		t.Fatal(err)
+	}
+	post := (*calls)[2]
+	want := map[string]interface{}{"type": "AAAA", "name": "", "target": "2001:db8::7"}
+	if post.Method != http.MethodPost || post.Path != "/v4/domains/42/records" || !reflect.DeepEqual(decodeBody(t, post), want) {
+		t.Errorf("unexpected create %+v", post)
+	}
+}
+
+func TestUpdateDnspod(t *testing.T) {
+	list := `{"status":{"code":"1"},"records":[{"id":"16894439","name":"home","type":"A","value":"198.51.100.1","line_id":"10=1"}]}`
+	calls := fakeProvider(t, &DnspodAPI, "", func(call providerCall) (int, string) {
+		if call.Path == "/Record.List" {
+			return 200, list
+		}
+		return 200, `{"status":{"code":"1"}}`
+	})
+
+	config := DyndnsConfig{LoginToken: "13490,6b5976c68aba5b14a0558b77c17c3932"}
+	result, err := updateDnspod(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 2 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	lookup, modify := (*calls)[0], (*calls)[1]
+	form, _ := url.ParseQuery(lookup.Body)
+	want := url.Values{"login_token": {config.LoginToken}, "format": {"json"}, "domain": {"example.com"}, "sub_domain": {"home"}, "record_type": {"A"}}
+	if lookup.Method != http.MethodPost || !reflect.DeepEqual(form, want) {
+		t.Errorf("unexpected lookup %v", form)
+	}
+
+	form, _ = url.ParseQuery(modify.Body)
+	want = url.Values{"login_token": {config.LoginToken}, "format": {"json"}, "domain": {"example.com"}, "sub_domain": {"home"},
+		"record_type": {"A"}, "record_id": {"16894439"}, "record_line_id": {"10=1"}, "value": {"203.0.113.7"}}
+	if modify.Path != "/Record.Modify" || !reflect.DeepEqual(form, want) {
+		t.Errorf("unexpected modify %s %v", modify.Path, form)
+	}
+
+	//no records yet
+	*calls = nil
+	list = `{"status":{"code":"10","message":"No records"}}`
+	if _, err = updateDnspod(config, testApex, "2001:db8::7"); err != nil {
+		t.Fatal(err)
+	}
+	form, _ = url.ParseQuery((*calls)[1].Body)
+	if (*calls)[1].Path != "/Record.Create" || form.Get("sub_domain") != "@" || form.Get("record_line_id") != "0" || form.Get("record_type") != "AAAA" {
+		t.Errorf("unexpected create %s %v", (*calls)[1].Path, form)
+	}
+
+	list = `{"status":{"code":"-1","message":"Login failed"}}`
+	if _, err = updateDnspod(config, testRecord, "203.0.113.7"); err == nil || !strings.Contains(err.Error(), "Login failed") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSignAliyun(t *testing.T) {
+	//computed independently with python hmac and urllib.parse.quote
+	params := url.Values{
+		"Action":           {"DescribeSubDomainRecords"},
+		"SubDomain":        {"home.example.com"},
+		"Type":             {"A"},
+		"Format":           {"JSON"},
+		"Version":          {"2015-01-09"},
+		"AccessKeyId":      {"testid"},
+		"SignatureMethod":  {"HMAC-SHA1"},
+		"SignatureVersion": {"1.0"},
+		"SignatureNonce":   {"nonce 1~*"},
+		"Timestamp":        {"2026-10-18T12:00:00Z"},
+	}
+	if signature := signAliyun(params, "testsecret"); signature != "0vm4ULg4X4JK2+WFTTlTItlvfcg=" {
+		t.Errorf("got signature %s", signature)
+	}
+}
+
+func TestUpdateAlidns(t *testing.T) {
+	existing := `{"DomainRecords":{"Record":[{"RecordId":"9999985","RR":"home","Type":"A","Value":"198.51.100.1"}]}}`
+	calls := fakeProvider(t, &AlidnsAPI, "/", func(call providerCall) (int, string) {
+		if call.Query.Get("Action") == "DescribeSubDomainRecords" {
+			return 200, existing
+		}
+		return 200, `{"RecordId":"9999985"}`
+	})
+
+	config := DyndnsConfig{Email: "testid", Password: "testsecret"}
+	result, err := updateAlidns(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" || len(*calls) != 2 {
+		t.Fatalf("got %q %v after %d calls", result, err, len(*calls))
+	}
+
+	for _, call := range *calls {
+		params := url.Values{}
+		for key, values := range call.Query {
+			if key != "Signature" {
+				params[key] = values
+			}
+		}
+		if call.Query.Get("Signature") != signAliyun(params, "testsecret") || call.Query.Get("AccessKeyId") != "testid" {
+			t.Errorf("bad signature on %v", call.Query)
+		}
+	}
+
+	describe, update := (*calls)[0].Query, (*calls)[1].Query
+	if describe.Get("SubDomain") != "home.example.com" || describe.Get("Type") != "A" {
+		t.Errorf("unexpected lookup %v", describe)
+	}
+	if update.Get("Action") != "UpdateDomainRecord" || update.Get("RecordId") != "9999985" || update.Get("RR") != "home" || update.Get("Value") != "203.0.113.7" {
+		t.Errorf("unexpected update %v", update)
+	}
+
+	*calls = nil
+	existing = `{"DomainRecords":{"Record":[]}}`
+	if _, err = updateAlidns(config, testApex, "2001:db8::7"); err != nil {
+		t.Fatal(err)
+	}
+	add := (*calls)[1].Query
+	if add.Get("Action") != "AddDomainRecord" || add.Get("DomainName") != "example.com" || add.Get("RR") != "@" || add.Get("Type") != "AAAA" {
+		t.Errorf("unexpected add %v", add)
+	}
+}
+
+func TestUpdateRFC2136(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received <- buf[:n]
+		//echo the header as a successful reply
+		reply := append([]byte{}, buf[:12]...)
+		reply[2] |= 0x80
+		reply[4], reply[5], reply[6], reply[7], reply[8], reply[9], reply[10], reply[11] = 0, 0, 0, 0, 0, 0, 0, 0
+		conn.WriteTo(reply, addr)
+	}()
+
+	config := DyndnsConfig{RFC2136: &RFC2136Config{Server: conn.LocalAddr().String(), TTL: 60}}
+	result, err := updateRFC2136(config, testRecord, "203.0.113.7")
+	if err != nil || result != "updated" {
+		t.Fatalf("got %q %v", result, err)
+	}
+
+	msg := <-received
+	want, _ := buildDNSUpdate(0, "example.com", "home.example.com", net.ParseIP("203.0.113.7"), 60)
+	if len(msg) != len(want) || string(msg[2:]) != string(want[2:]) {
+		t.Errorf("got update %x, want %x", msg, want)
+	}
+}
+
+func TestDyndnsTickUnsupportedProvider(t *testing.T) {
+	resetRecordStatus()
+	t.Cleanup(resetRecordStatus)
+
+	config := DyndnsConfig{Provider: "Dreamhost", Domains: []DyndnsDomain{{DomainName: "example.com", SubDomains: []string{"home"}}}}
+	dyndnsTick(config, 1000)
+
+	statuses := recordStatuses(config)
+	if len(statuses) != 1 || statuses[0].Result != "failed" || !strings.Contains(statuses[0].Error, "Dreamhost is not supported") {
+		t.Errorf("unexpected status %+v", statuses)
+	}
+}
+
+func TestValidateConfigNetwork(t *testing.T) {
+	config := DyndnsConfig{Provider: "duckdns", LoginToken: "token", Socks5Proxy: "127.0.0.1:1080", Resolver: "1.1.1.1"}
+	if err := validateConfig(config); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	config.Resolver = "[2606:4700::1111]:53"
+	if err := validateConfig(config); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	invalid := []DyndnsConfig{
+		{Provider: "duckdns", LoginToken: "token", Socks5Proxy: "127.0.0.1"},
+		{Provider: "duckdns", LoginToken: "token", Socks5Proxy: "proxy:1080;"},
+		{Provider: "duckdns", LoginToken: "token", Resolver: "dns.example.com"},
+		{Provider: "dnspod", LoginToken: "token"},
+		{Provider: "porkbun", LoginToken: "pk1_key"},
+		{Provider: "alidns", Password: "secret"},
+		{Provider: "he"},
+		{Provider: "dreamhost"},
+	}
+	for _, config := range invalid {
+		if err := validateConfig(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+Dynamic updates (RFC 2136) signed with TSIG (RFC 8945).
+
+An update deletes the RRset of the record and adds the new address in a
+single message, so the name always has one address per type.
+
+A signed update requires a successful response to carry a valid TSIG over
+the request MAC. Error responses are reported without checking their
+signature, a server rejecting the key can not sign them.
+*/
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeTSIG = 250
+
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsOpcodeUpdate = 5
+
+	tsigFudge = 300
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int": md5.New,
+	"hmac-sha1":                sha1.New,
+	"hmac-sha256":              sha256.New,
+	"hmac-sha512":              sha512.New,
+}
+
+var dnsRcodes = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+}
+
+func tsigAlgorithmName(algorithm string) string {
+	algorithm = strings.TrimSuffix(strings.ToLower(algorithm), ".")
+	if algorithm == "" {
+		return "hmac-sha256"
+	}
+	if algorithm == "hmac-md5" {
+		return "hmac-md5.sig-alg.reg.int"
+	}
+	return algorithm
+}
+
+// packDNSName encodes a domain name in wire format
+func packDNSName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	buf := []byte{}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %s", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	buf = append(buf, 0)
+	if len(buf) > 255 {
+		return nil, fmt.Errorf("domain name too long %s", name)
+	}
+	return buf, nil
+}
+
+func appendRR(msg []byte, name []byte, rrtype uint16, class uint16, ttl uint32, rdata []byte) []byte {
+	msg = append(msg, name...)
+	msg = appendUint16(msg, rrtype)
+	msg = appendUint16(msg, class)
+	msg = appendUint32(msg, ttl)
+	msg = appendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// buildDNSUpdate returns an update message that replaces the address
+// records of name in zone
+func buildDNSUpdate(id uint16, zone string, name string, address net.IP, ttl uint32) ([]byte, error) {
+	zoneName, err := packDNSName(zone)
+	if err != nil {
+		return nil, err
+	}
+	recordName, err := packDNSName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rrtype := uint16(dnsTypeAAAA)
+	rdata := []byte(address.To16())
+	if ip4 := address.To4(); ip4 != nil {
+		rrtype = dnsTypeA
+		rdata = []byte(ip4)
+	}
+
+	msg := []byte{}
+	msg = appendUint16(msg, id)
+	msg = appendUint16(msg, dnsOpcodeUpdate<<11)
+	msg = appendUint16(msg, 1) //zone
+	msg = appendUint16(msg, 0) //prerequisites
+	msg = appendUint16(msg, 2) //updates
+	msg = appendUint16(msg, 0) //additional
+
+	//zone section
+	msg = append(msg, zoneName...)
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+
+	//delete the RRset, then add the address
+	msg = appendRR(msg, recordName, rrtype, dnsClassANY, 0, nil)
+	msg = appendRR(msg, recordName, rrtype, dnsClassIN, ttl, rdata)
+
+	return msg, nil
+}
+
+type tsigKey struct {
+	name      []byte //wire format, canonical
+	algorithm []byte
+	newHash   func() hash.Hash
+	secret    []byte
+}
+
+func parseTSIGKey(keyName string, algorithm string, secret string) (tsigKey, error) {
+	algorithm = tsigAlgorithmName(algorithm)
+	newHash, exists := tsigAlgorithms[algorithm]
+	if !exists {
+		return tsigKey{}, fmt.Errorf("unsupported TSIG algorithm %s", algorithm)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return tsigKey{}, fmt.Errorf("invalid TSIG secret: %v", err)
+	}
+
+	//names are canonical (lower case) in the signed variables
+	keyWire, err := packDNSName(strings.ToLower(keyName))
+	if err != nil {
+		return tsigKey{}, err
+	}
+	algorithmWire, err := packDNSName(algorithm)
+	if err != nil {
+		return tsigKey{}, err
+	}
+
+	return tsigKey{name: keyWire, algorithm: algorithmWire, newHash: newHash, secret: key}, nil
+}
+
+// mac signs the message with the TSIG variables, prefixed by the request
+// MAC when signing a response
+func (key tsigKey) mac(requestMAC []byte, msg []byte, timeSigned uint64, fudge uint16, tsigError uint16, other []byte) []byte {
+	variables := append([]byte{}, key.name...)
+	variables = appendUint16(variables, dnsClassANY)
+	variables = appendUint32(variables, 0)
+	variables = append(variables, key.algorithm...)
+	variables = appendUint48(variables, timeSigned)
+	variables = appendUint16(variables, fudge)
+	variables = appendUint16(variables, tsigError)
+	variables = appendUint16(variables, uint16(len(other)))
+	variables = append(variables, other...)
+
+	mac := hmac.New(key.newHash, key.secret)
+	if requestMAC != nil {
+		mac.Write(appendUint16([]byte{}, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	mac.Write(variables)
+	return mac.Sum(nil)
+}
+
+// signTSIG appends a TSIG record to msg, and returns the MAC that the
+// response is signed over
+func signTSIG(msg []byte, keyName string, algorithm string, secret string, now time.Time) ([]byte, []byte, error) {
+	key, err := parseTSIGKey(keyName, algorithm, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeSigned := uint64(now.Unix())
+	digest := key.mac(nil, msg, timeSigned, tsigFudge, 0, nil)
+
+	rdata := append([]byte{}, key.algorithm...)
+	rdata = appendUint48(rdata, timeSigned)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(digest)))
+	rdata = append(rdata, digest...)
+	rdata = append(rdata, msg[0], msg[1]) //original id
+	rdata = appendUint16(rdata, 0)        //error
+	rdata = appendUint16(rdata, 0)        //other length
+
+	signed := appendRR(append([]byte{}, msg...), key.name, dnsTypeTSIG, dnsClassANY, 0, rdata)
+	arcount := binary.BigEndian.Uint16(signed[10:12])
+	binary.BigEndian.PutUint16(signed[10:12], arcount+1)
+	return signed, digest, nil
+}
+
+// skipDNSName returns the offset after the name at offset
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			//a compression pointer ends the name
+			if offset+2 > len(msg) {
+				return 0, errors.New("truncated DNS name")
+			}
+			return offset + 2, nil
+		case length&0xc0 != 0:
+			return 0, errors.New("invalid DNS label")
+		}
+		offset += 1 + length
+	}
+	return 0, errors.New("truncated DNS name")
+}
+
+// skipDNSRR returns the offset after the resource record at offset
+func skipDNSRR(msg []byte, offset int) (int, error) {
+	offset, err := skipDNSName(msg, offset)
+	if err != nil {
+		return 0, err
+	}
+	if offset+10 > len(msg) {
+		return 0, errors.New("truncated DNS record")
+	}
+	end := offset + 10 + int(binary.BigEndian.Uint16(msg[offset+8:offset+10]))
+	if end > len(msg) {
+		return 0, errors.New("truncated DNS record")
+	}
+	return end, nil
+}
+
+// verifyTSIG checks the TSIG record that ends a response to a request
+// signed with requestMAC
+func verifyTSIG(response []byte, requestMAC []byte, keyName string, algorithm string, secret string, now time.Time) error {
+	key, err := parseTSIGKey(keyName, algorithm, secret)
+	if err != nil {
+		return err
+	}
+
+	if len(response) < 12 {
+		return errors.New("short DNS response")
+	}
+	arcount := binary.BigEndian.Uint16(response[10:12])
+	if arcount == 0 {
+		return errors.New("DNS response is not signed")
+	}
+
+	offset := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(response[4:6])); i++ {
+		offset, err = skipDNSName(response, offset)
+		if err != nil {
+			return err
+		}
+		offset += 4
+	}
+	records := int(binary.BigEndian.Uint16(response[6:8])) + int(binary.BigEndian.Uint16(response[8:10])) + int(arcount) - 1
+	for i := 0; i < records; i++ {
+		offset, err = skipDNSRR(response, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	//the TSIG record is last, its names are never compressed
+	tsigStart := offset
+	offset, err = skipDNSName(response, offset)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(string(response[tsigStart:offset]), string(key.name)) {
+		return errors.New("DNS response is signed with another key")
+	}
+	if offset+10 > len(response) || binary.BigEndian.Uint16(response[offset:offset+2]) != dnsTypeTSIG {
+		return errors.New("DNS response is not signed")
+	}
+	rdata := response[offset+10:]
+	if int(binary.BigEndian.Uint16(response[offset+8:offset+10])) != len(rdata) {
+		return errors.New("invalid TSIG record")
+	}
+
+	algorithmEnd, err := skipDNSName(rdata, 0)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(string(rdata[:algorithmEnd]), string(key.algorithm)) {
+		return errors.New("DNS response is signed with another algorithm")
+	}
+
+	fields := rdata[algorithmEnd:]
+	if len(fields) < 10 {
+		return errors.New("invalid TSIG record")
+	}
+	timeSigned := uint64(binary.BigEndian.Uint16(fields[0:2]))<<32 | uint64(binary.BigEndian.Uint32(fields[2:6]))
+	fudge := binary.BigEndian.Uint16(fields[6:8])
+	macSize := int(binary.BigEndian.Uint16(fields[8:10]))
+	if len(fields) < 10+macSize+6 {
+		return errors.New("invalid TSIG record")
+	}
+	mac := fields[10 : 10+macSize]
+	fields = fields[10+macSize:]
+	originalID := fields[0:2]
+	tsigError := binary.BigEndian.Uint16(fields[2:4])
+	otherLength := int(binary.BigEndian.Uint16(fields[4:6]))
+	if len(fields) != 6+otherLength {
+		return errors.New("invalid TSIG record")
+	}
+	other := fields[6:]
+
+	if tsigError != 0 {
+		name, exists := dnsRcodes[int(tsigError)]
+		if !exists {
+			name = fmt.Sprintf("error %d", tsigError)
+		}
+		return fmt.Errorf("TSIG failed: %s", name)
+	}
+
+	//the MAC covers the message without its TSIG record
+	unsigned := append([]byte{}, response[:tsigStart]...)
+	copy(unsigned[0:2], originalID)
+	binary.BigEndian.PutUint16(unsigned[10:12], arcount-1)
+
+	if !hmac.Equal(mac, key.mac(requestMAC, unsigned, timeSigned, fudge, tsigError, other)) {
+		return errors.New("DNS response has an invalid TSIG signature")
+	}
+
+	skew := int64(timeSigned) - now.Unix()
+	if skew < -int64(fudge) || skew > int64(fudge) {
+		return errors.New("DNS response TSIG time is outside of the fudge")
+	}
+	return nil
+}
+
+// dnsResponseError checks the header of an update response
+func dnsResponseError(id uint16, response []byte) error {
+	if len(response) < 12 {
+		return errors.New("short DNS response")
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != id {
+		return errors.New("DNS response id mismatch")
+	}
+
+	flags := binary.BigEndian.Uint16(response[2:4])
+	if flags&0x8000 == 0 {
+		return errors.New("DNS response is not a reply")
+	}
+
+	rcode := int(flags & 0xf)
+	if rcode != 0 {
+		name, exists := dnsRcodes[rcode]
+		if !exists {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+		return fmt.Errorf("update failed: %s", name)
+	}
+	return nil
+}
+
+func dnsTruncated(response []byte) bool {
+	return len(response) >= 4 && response[2]&0x02 != 0
+}
+
+func exchangeDNS(server string, msg []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+
+	conn, err := dyndnsDialer.Dial(network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if !tcp {
+		_, err = conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	//tcp messages are prefixed with their length
+	_, err = conn.Write(appendUint16([]byte{}, uint16(len(msg))))
+	if err == nil {
+		_, err = conn.Write(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, response)
+	return response, err
+}
+
+func rfc2136Server(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+func updateRFC2136(config DyndnsConfig, record dyndnsRecord, address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %s", address)
+	}
+
+	zone := config.RFC2136.Zone
+	if zone == "" {
+		zone = record.Domain
+	}
+
+	ttl := uint32(config.RFC2136.TTL)
+	if ttl == 0 {
+		ttl = 300
+	}
+
+	idBytes := make([]byte, 2)
+	rand.Read(idBytes)
+	id := binary.BigEndian.Uint16(idBytes)
+
+	msg, err := buildDNSUpdate(id, zone, record.Name, ip, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	var requestMAC []byte
+	if config.RFC2136.TSIGName != "" {
+		msg, requestMAC, err = signTSIG(msg, config.RFC2136.TSIGName, config.RFC2136.TSIGAlgorithm, config.RFC2136.TSIGSecret, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	server := rfc2136Server(config.RFC2136.Server)
+	response, err := exchangeDNS(server, msg, false)
+	if err == nil && dnsTruncated(response) {
+		response, err = exchangeDNS(server, msg, true)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = dnsResponseError(id, response)
+	if err != nil {
+		return "", err
+	}
+
+	if requestMAC != nil {
+		err = verifyTSIG(response, requestMAC, config.RFC2136.TSIGName, config.RFC2136.TSIGAlgorithm, config.RFC2136.TSIGSecret, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+	return "updated", nil
+}
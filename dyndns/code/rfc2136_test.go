@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generated with github.com/miekg/dns: an update of home.example.com to
+// 203.0.113.7, signed with hmac-sha256 at 1760000000, and its reply
+const (
+	testTSIGName   = "update-key"
+	testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+
+	testUpdateHex = "123428000001000000020000" +
+		"076578616d706c6503636f6d0000060001" +
+		"04686f6d65076578616d706c6503636f6d00000100ff000000000000" +
+		"04686f6d65076578616d706c6503636f6d00000100010000012c0004cb007107"
+	testSignedHex = "123428000001000000020001" +
+		"076578616d706c6503636f6d0000060001" +
+		"04686f6d65076578616d706c6503636f6d00000100ff000000000000" +
+		"04686f6d65076578616d706c6503636f6d00000100010000012c0004cb007107" +
+		"0a7570646174652d6b65790000fa00ff00000000003d0b686d61632d736861323536" +
+		"00000068e77800012c0020" +
+		"9e6443d8bad09a8fcf3d3952c694408034bfdb28a826e1c646af71c791f2fdaf" +
+		"123400000000"
+	testRequestMACHex = "9e6443d8bad09a8fcf3d3952c694408034bfdb28a826e1c646af71c791f2fdaf"
+	testResponseHex   = "1234a8000001000000000001" +
+		"076578616d706c6503636f6d0000060001" +
+		"0a7570646174652d6b65790000fa00ff00000000003d0b686d61632d736861323536" +
+		"00000068e77801012c0020" +
+		"6e1367bc1fce3f86aa6229d582ba038867f268135a11600d2ac69f7b9cf3790d" +
+		"123400000000"
+)
+
+var testSignedAt = time.Unix(1760000000, 0)
+
+func mustHex(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPackDNSName(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+	}{
+		{"example.com", "076578616d706c6503636f6d00"},
+		{"example.com.", "076578616d706c6503636f6d00"},
+		{"", "00"},
+	}
+	for _, tt := range tests {
+		wire, err := packDNSName(tt.name)
+		if err != nil || hex.EncodeToString(wire) != tt.wire {
+			t.Errorf("%q: got %x %v, want %s", tt.name, wire, err, tt.wire)
+		}
+	}
+
+	for _, name := range []string{"a..b", strings.Repeat("a", 64) + ".com", strings.Repeat("abcdefghi.", 26) + "com"} {
+		if _, err := packDNSName(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+}
+
+func TestBuildDNSUpdate(t *testing.T) {
+	msg, err := buildDNSUpdate(0x1234, "example.com", "home.example.com", net.ParseIP("203.0.113.7"), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, testUpdateHex); !bytes.Equal(msg, want) {
+		t.Errorf("got %x\nwant %x", msg, want)
+	}
+
+	//ipv6 replaces the AAAA RRset
+	msg, err = buildDNSUpdate(1, "example.com", "home.example.com", net.ParseIP("2001:db8::7"), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := msg[len(msg)-26:]
+	want := "001c00010000003c0010" + "20010db8000000000000000000000007"
+	if hex.EncodeToString(add) != want {
+		t.Errorf("got AAAA record %x, want %s", add, want)
+	}
+}
+
+func TestSignTSIG(t *testing.T) {
+	msg := mustHex(t, testUpdateHex)
+
+	signed, mac, err := signTSIG(msg, "Update-Key.", "HMAC-SHA256", testTSIGSecret, testSignedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, testSignedHex); !bytes.Equal(signed, want) {
+		t.Errorf("got %x\nwant %x", signed, want)
+	}
+	if hex.EncodeToString(mac) != testRequestMACHex {
+		t.Errorf("got mac %x", mac)
+	}
+
+	//the message itself is left alone
+	if !bytes.Equal(msg, mustHex(t, testUpdateHex)) {
+		t.Error("signing modified the message")
+	}
+
+	if _, _, err = signTSIG(msg, testTSIGName, "hmac-sha3", testTSIGSecret, testSignedAt); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+	if _, _, err = signTSIG(msg, testTSIGName, "", "not base64!", testSignedAt); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestVerifyTSIG(t *testing.T) {
+	requestMAC := mustHex(t, testRequestMACHex)
+	now := testSignedAt.Add(10 * time.Second)
+
+	response := mustHex(t, testResponseHex)
+	if err := verifyTSIG(response, requestMAC, testTSIGName, "hmac-sha256", testTSIGSecret, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(offset int, value byte) []byte {
+		modified := mustHex(t, testResponseHex)
+		modified[offset] = value
+		return modified
+	}
+	errorField := len(response) - 4
+
+	tests := []struct {
+		name       string
+		response   []byte
+		requestMAC []byte
+		secret     string
+		now        time.Time
+		err        string
+	}{
+		{"rcode changed", tamper(3, 0x05), requestMAC, testTSIGSecret, now, "invalid TSIG signature"},
+		{"other request", response, bytes.Repeat([]byte{1}, 32), testTSIGSecret, now, "invalid TSIG signature"},
+		{"other secret", response, requestMAC, "b3RoZXI=", now, "invalid TSIG signature"},
+		{"clock skew", response, requestMAC, testTSIGSecret, testSignedAt.Add(time.Hour), "outside of the fudge"},
+		{"tsig error", tamper(errorField+1, 18), requestMAC, testTSIGSecret, now, "BADTIME"},
+		{"unsigned", mustHex(t, "1234a8000001000000000000076578616d706c6503636f6d0000060001"), requestMAC, testTSIGSecret, now, "not signed"},
+		{"truncated", response[:len(response)-8], requestMAC, testTSIGSecret, now, "invalid TSIG record"},
+	}
+	for _, tt := range tests {
+		err := verifyTSIG(tt.response, tt.requestMAC, testTSIGName, "hmac-sha256", tt.secret, tt.now)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDNSResponseError(t *testing.T) {
+	tests := []struct {
+		response string
+		err      string
+	}{
+		{"1234a800", "short DNS response"},
+		{"4321a8000000000000000000", "id mismatch"},
+		{"123428000000000000000000", "not a reply"},
+		{"1234a8050000000000000000", "REFUSED"},
+		{"1234a80b0000000000000000", "rcode 11"},
+		{"1234a8000000000000000000", ""},
+	}
+	for _, tt := range tests {
+		err := dnsResponseError(0x1234, mustHex(t, tt.response))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.response, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.response, err, tt.err)
+		}
+	}
+
+	if !dnsTruncated(mustHex(t, "1234aa000000000000000000")) || dnsTruncated(mustHex(t, "1234a8000000000000000000")) {
+		t.Error("truncated flag was not detected")
+	}
+}
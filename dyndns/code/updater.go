@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The updater follows the uplink addresses the API publishes in
+public/uplinks.json, and updates records when the address of their uplink
+changes. Uplinks without a public address, for example behind a NAT, fall
+back to the configured ip_urls.
+*/
+
+var UplinksPublicPath = TEST_PREFIX + "/state/public/uplinks.json"
+
+// written by the API
+type PublicUplinkState struct {
+	Iface  string
+	Up     bool
+	Active bool
+	IPv4   []string
+	IPv6   []string
+}
+
+type dyndnsRecord struct {
+	Domain string
+	Name   string
+	Type   string
+	Uplink string
+}
+
+// RecordStatus is the result of the last update of a record
+type RecordStatus struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Uplink      string `json:"uplink"`
+	Address     string `json:"address"`
+	LastAttempt int64  `json:"last_attempt"`
+	LastSuccess int64  `json:"last_success"`
+	Result      string `json:"result"`
+	Error       string `json:"error,omitempty"`
+}
+
+var Updatemtx sync.Mutex
+var Statusmtx sync.Mutex
+var gRecordStatus = map[string]*RecordStatus{}
+
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func (r dyndnsRecord) key() string {
+	return r.Name + "/" + r.Type
+}
+
+func configRecords(config DyndnsConfig) []dyndnsRecord {
+	types := []string{}
+	switch strings.ToLower(config.IpType) {
+	case "ipv6":
+		types = []string{"AAAA"}
+	case "both":
+		types = []string{"A", "AAAA"}
+	default:
+		types = []string{"A"}
+	}
+
+	records := []dyndnsRecord{}
+	for _, domain := range config.Domains {
+		if domain.DomainName == "" {
+			continue
+		}
+		subs := domain.SubDomains
+		if len(subs) == 0 {
+			subs = []string{"@"}
+		}
+		for _, sub := range subs {
+			name := domain.DomainName
+			if sub != "" && sub != "@" {
+				name = sub + "." + domain.DomainName
+			}
+			for _, t := range types {
+				records = append(records, dyndnsRecord{Domain: domain.DomainName, Name: name, Type: t, Uplink: domain.Uplink})
+			}
+		}
+	}
+	return records
+}
+
+func loadUplinks() []PublicUplinkState {
+	uplinks := []PublicUplinkState{}
+	data, err := ioutil.ReadFile(UplinksPublicPath)
+	if err != nil {
+		return uplinks
+	}
+	err = json.Unmarshal(data, &uplinks)
+	if err != nil {
+		fmt.Println("invalid uplinks state", err)
+	}
+	return uplinks
+}
+
+func isPublicAddress(ip net.IP) bool {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return !cgnatNet.Contains(ip4)
+	}
+	return true
+}
+
+// uplinkAddress returns the first public address of the given type,
+// on the pinned uplink or else on the first active uplink
+func uplinkAddress(uplinks []PublicUplinkState, pinned string, recordType string) (string, string) {
+	for _, uplink := range uplinks {
+		if pinned != "" && uplink.Iface != pinned {
+			continue
+		}
+		if pinned == "" && !(uplink.Up && uplink.Active) {
+			continue
+		}
+
+		addresses := uplink.IPv4
+		if recordType == "AAAA" {
+			addresses = uplink.IPv6
+		}
+		for _, address := range addresses {
+			if isPublicAddress(net.ParseIP(address)) {
+				return uplink.Iface, address
+			}
+		}
+	}
+	return "", ""
+}
+
+// lookupIpUrls asks the ip_urls services for the public address
+func lookupIpUrls(urls []string, recordType string) (string, error) {
+	err := errors.New("no ip_urls configured")
+	for _, url := range urls {
+		req, reqErr := http.NewRequest(http.MethodGet, url, nil)
+		if reqErr != nil {
+			err = reqErr
+			continue
+		}
+
+		body, reqErr := providerRequest(req)
+		if reqErr != nil {
+			err = reqErr
+			continue
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil || (ip.To4() != nil) != (recordType == "A") {
+			err = fmt.Errorf("%s did not return an %s address", url, recordType)
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", err
+}
+
+type ipUrlLookup struct {
+	Address string
+	Time    int64
+}
+
+// ip_urls results by record type, guarded by Updatemtx
+var gIpUrlLookups = map[string]ipUrlLookup{}
+
+// recordAddress finds the address a record should point to. ip_urls are
+// asked at most once per interval
+func recordAddress(config DyndnsConfig, uplinks []PublicUplinkState, record dyndnsRecord, now int64) (string, string, error) {
+	iface, address := uplinkAddress(uplinks, record.Uplink, record.Type)
+	if address != "" {
+		return iface, address, nil
+	}
+
+	//lookups leave through the active uplink only
+	if record.Uplink != "" {
+		return "", "", fmt.Errorf("no public %s address on uplink %s", record.Type, record.Uplink)
+	}
+	if len(config.IpUrls) == 0 {
+		return "", "", fmt.Errorf("no public %s address on the active uplinks", record.Type)
+	}
+
+	lookup, cached := gIpUrlLookups[record.Type]
+	if !cached || now-lookup.Time >= config.retryInterval() {
+		address, err := lookupIpUrls(config.IpUrls, record.Type)
+		if err != nil {
+			return "", "", err
+		}
+		lookup = ipUrlLookup{Address: address, Time: now}
+		gIpUrlLookups[record.Type] = lookup
+	}
+	return "ip_urls", lookup.Address, nil
+}
+
+func (config DyndnsConfig) retryInterval() int64 {
+	if config.Interval == 0 {
+		return 300
+	}
+	return int64(config.Interval)
+}
+
+// dyndnsTick updates records whose address changed, and retries failed
+// updates after the configured interval
+func dyndnsTick(config DyndnsConfig, now int64) {
+	Updatemtx.Lock()
+	defer Updatemtx.Unlock()
+
+	if config.Provider == "" {
+		return
+	}
+
+	//providers of the former godns updater that are not supported here
+	//fail every record, so the status tells why nothing is updated
+	var providerErr error
+	update, exists := dyndnsProviders[strings.ToLower(config.Provider)]
+	if !exists {
+		providerErr = fmt.Errorf("provider %s is not supported, choose one of %s", config.Provider, supportedProviders())
+	}
+
+	configureNetwork(config)
+	uplinks := loadUplinks()
+	keep := map[string]bool{}
+
+	for _, record := range configRecords(config) {
+		keep[record.key()] = true
+
+		Statusmtx.Lock()
+		status, exists := gRecordStatus[record.key()]
+		if !exists {
+			status = &RecordStatus{Name: record.Name, Type: record.Type}
+			gRecordStatus[record.key()] = status
+		}
+		previous := *status
+		Statusmtx.Unlock()
+
+		if previous.Error != "" && now-previous.LastAttempt < config.retryInterval() {
+			continue
+		}
+
+		iface, address, err := "", "", providerErr
+		if providerErr == nil {
+			iface, address, err = recordAddress(config, uplinks, record, now)
+		}
+		if err == nil && previous.Error == "" && previous.Address == address {
+			continue
+		}
+
+		result := ""
+		if err == nil {
+			result, err = update(config, record, address)
+		}
+
+		Statusmtx.Lock()
+		status.Uplink = iface
+		status.LastAttempt = now
+		if err != nil {
+			status.Result = "failed"
+			status.Error = err.Error()
+			fmt.Println("dyndns update failed", record.Name, record.Type, err)
+		} else {
+			status.Address = address
+			status.LastSuccess = now
+			status.Result = result
+			status.Error = ""
+			fmt.Println("dyndns", record.Name, record.Type, address, result)
+		}
+		Statusmtx.Unlock()
+	}
+
+	Statusmtx.Lock()
+	for key := range gRecordStatus {
+		if !keep[key] {
+			delete(gRecordStatus, key)
+		}
+	}
+	Statusmtx.Unlock()
+}
+
+// resetRecordStatus makes the next round update every record
+func resetRecordStatus() {
+	Updatemtx.Lock()
+	gIpUrlLookups = map[string]ipUrlLookup{}
+	Updatemtx.Unlock()
+
+	Statusmtx.Lock()
+	gRecordStatus = map[string]*RecordStatus{}
+	Statusmtx.Unlock()
+}
+
+func recordStatuses(config DyndnsConfig) []RecordStatus {
+	Statusmtx.Lock()
+	defer Statusmtx.Unlock()
+
+	statuses := []RecordStatus{}
+	for _, record := range configRecords(config) {
+		status, exists := gRecordStatus[record.key()]
+		if !exists {
+			statuses = append(statuses, RecordStatus{Name: record.Name, Type: record.Type, Result: "pending"})
+			continue
+		}
+		statuses = append(statuses, *status)
+	}
+	return statuses
+}
+
+// dyndnsLoop follows address changes. With run_once, records are only
+// updated at startup, when the configuration is saved and on refresh
+func dyndnsLoop() {
+	dyndnsTick(loadConfig(), time.Now().Unix())
+	for {
+		time.Sleep(15 * time.Second)
+		config := loadConfig()
+		if !config.RunOnce {
+			dyndnsTick(config, time.Now().Unix())
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+/*
+IPFIX (RFC 7011) and NetFlow v9 (RFC 3954) export.
+
+Packets are counted per capture interface and unidirectional 5-tuple.
+A flow is exported when it has been idle, when it reaches the active
+timeout or when TCP FIN/RST is seen. Records carry the byte and packet
+counters, the ingress interface index and the ethernet addresses of the
+device.
+
+Collectors are read from /configs/flowgather/config.json:
+
+	{
+		"Collectors": ["ipfix://192.168.2.10:4739", "netflow9://192.168.2.20:2055"],
+		"ObservationDomain": 1,
+		"ActiveTimeout": 60,
+		"IdleTimeout": 15
+	}
+
+The -collectors, -observationDomain, -activeTimeout and -idleTimeout
+flags override the file.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ipfixVersion    = 10
+	netflow9Version = 9
+
+	ipfixTemplateSetId    = 2
+	netflow9TemplateSetId = 0
+
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	maxExportMessage = 1400
+	maxExportFlows   = 65536
+	templateRefresh  = time.Minute
+)
+
+// information elements, the ids are shared by IPFIX and NetFlow v9
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTcpControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieIngressInterface         = 10
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21
+	ieFirstSwitched            = 22
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieSourceMacAddress         = 56
+	ieDestinationMacAddress    = 80
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// ExportConfig is the flow export section of the config file, the
+// timeouts are in seconds
+type ExportConfig struct {
+	Collectors        []string
+	ObservationDomain uint32
+	ActiveTimeout     int
+	IdleTimeout       int
+}
+
+var ExportConfigFile = "/configs/flowgather/config.json"
+
+// loadExportConfig reads the export config, a missing file exports nothing
+func loadExportConfig(path string) (ExportConfig, error) {
+	config := ExportConfig{ObservationDomain: 1, ActiveTimeout: 60, IdleTimeout: 15}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+
+	if config.ActiveTimeout <= 0 || config.IdleTimeout <= 0 {
+		return config, fmt.Errorf("timeouts must be positive")
+	}
+
+	for _, entry := range config.Collectors {
+		if strings.Contains(entry, ",") {
+			return config, fmt.Errorf("invalid collector %s", entry)
+		}
+	}
+
+	return config, nil
+}
+
+type exportField struct {
+	Id     uint16
+	Length uint16
+}
+
+type exportKey struct {
+	Ifindex  uint32
+	IPv6     bool
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+type exportFlow struct {
+	exportKey
+	SrcMAC   [6]byte
+	DstMAC   [6]byte
+	Start    time.Time
+	End      time.Time
+	Packets  uint64
+	Bytes    uint64
+	TCPFlags uint8
+	Finished bool
+}
+
+type exportCollector struct {
+	Version      int
+	Address      string
+	conn         net.Conn
+	sequence     uint32
+	lastTemplate time.Time
+}
+
+type flowExporter struct {
+	mtx               sync.Mutex
+	sendmtx           sync.Mutex
+	flows             map[exportKey]*exportFlow
+	ifindexes         map[string]uint32
+	collectors        []*exportCollector
+	observationDomain uint32
+	activeTimeout     time.Duration
+	idleTimeout       time.Duration
+	boot              time.Time
+}
+
+var gExporter *flowExporter
+
+func parseCollector(entry string) (*exportCollector, error) {
+	version := ipfixVersion
+	port := "4739"
+	address := entry
+
+	if strings.HasPrefix(entry, "ipfix://") {
+		address = strings.TrimPrefix(entry, "ipfix://")
+	} else if strings.HasPrefix(entry, "netflow9://") {
+		version = netflow9Version
+		port = "2055"
+		address = strings.TrimPrefix(entry, "netflow9://")
+	} else if strings.Contains(entry, "://") {
+		return nil, fmt.Errorf("unsupported collector %s", entry)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, port)
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exportCollector{Version: version, Address: address, conn: conn}, nil
+}
+
+func NewFlowExporter(collectors string, observationDomain uint32, activeTimeout time.Duration, idleTimeout time.Duration) (*flowExporter, error) {
+	e := &flowExporter{
+		flows:             make(map[exportKey]*exportFlow),
+		ifindexes:         make(map[string]uint32),
+		observationDomain: observationDomain,
+		activeTimeout:     activeTimeout,
+		idleTimeout:       idleTimeout,
+		boot:              time.Now(),
+	}
+
+	for _, entry := range strings.Split(collectors, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		collector, err := parseCollector(entry)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("exporting flows to", collector.Address, "version", collector.Version)
+		e.collectors = append(e.collectors, collector)
+	}
+
+	if len(e.collectors) == 0 {
+		return nil, fmt.Errorf("no collectors configured")
+	}
+
+	return e, nil
+}
+
+func (e *flowExporter) ifindex(ifaceName string) uint32 {
+	index, exists := e.ifindexes[ifaceName]
+	if !exists {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err == nil {
+			index = uint32(iface.Index)
+		}
+		e.ifindexes[ifaceName] = index
+	}
+	return index
+}
+
+func (e *flowExporter) accountPacket(ifaceName string, packet gopacket.Packet) {
+	key := exportKey{}
+	length := uint64(0)
+
+	if layer := packet.Layer(layers.LayerTypeIPv4); layer != nil {
+		ip4, _ := layer.(*layers.IPv4)
+		copy(key.SrcIP[:], ip4.SrcIP.To4())
+		copy(key.DstIP[:], ip4.DstIP.To4())
+		key.Protocol = uint8(ip4.Protocol)
+		length = uint64(ip4.Length)
+	} else if layer := packet.Layer(layers.LayerTypeIPv6); layer != nil {
+		ip6, _ := layer.(*layers.IPv6)
+		key.IPv6 = true
+		copy(key.SrcIP[:], ip6.SrcIP.To16())
+		copy(key.DstIP[:], ip6.DstIP.To16())
+		key.Protocol = uint8(ip6.NextHeader)
+		length = uint64(ip6.Length) + 40
+		if packet.Layer(layers.LayerTypeICMPv6) != nil {
+			key.Protocol = uint8(layers.IPProtocolICMPv6)
+		}
+	} else {
+		return
+	}
+
+	flags := uint8(0)
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		key.Protocol = uint8(layers.IPProtocolTCP)
+		key.SrcPort = uint16(transport.SrcPort)
+		key.DstPort = uint16(transport.DstPort)
+		flags = tcpFlags(transport)
+	case *layers.UDP:
+		key.Protocol = uint8(layers.IPProtocolUDP)
+		key.SrcPort = uint16(transport.SrcPort)
+		key.DstPort = uint16(transport.DstPort)
+	}
+
+	t := packet.Metadata().Timestamp
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	key.Ifindex = e.ifindex(ifaceName)
+
+	flow, exists := e.flows[key]
+	if !exists {
+		if len(e.flows) >= maxExportFlows {
+			//the cache is full, export everything
+			go e.export(e.takeFlowsLocked(func(*exportFlow) bool { return true }))
+		}
+
+		flow = &exportFlow{exportKey: key, Start: t}
+		if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok {
+			copy(flow.SrcMAC[:], eth.SrcMAC)
+			copy(flow.DstMAC[:], eth.DstMAC)
+		}
+		e.flows[key] = flow
+	}
+
+	flow.End = t
+	flow.Packets++
+	flow.Bytes += length
+	flow.TCPFlags |= flags
+	if flags&0x05 != 0 {
+		//FIN or RST ends the flow
+		flow.Finished = true
+	}
+}
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	flags := uint8(0)
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+func (e *flowExporter) takeFlowsLocked(expired func(*exportFlow) bool) []*exportFlow {
+	flows := []*exportFlow{}
+	for key, flow := range e.flows {
+		if expired(flow) {
+			flows = append(flows, flow)
+			delete(e.flows, key)
+		}
+	}
+	return flows
+}
+
+func (e *flowExporter) expireLoop() {
+	for {
+		time.Sleep(time.Second)
+
+		now := time.Now()
+		e.mtx.Lock()
+		flows := e.takeFlowsLocked(func(flow *exportFlow) bool {
+			return flow.Finished ||
+				now.Sub(flow.End) >= e.idleTimeout ||
+				now.Sub(flow.Start) >= e.activeTimeout
+		})
+		e.mtx.Unlock()
+
+		e.export(flows)
+	}
+}
+
+func (e *flowExporter) export(flows []*exportFlow) {
+	if len(flows) == 0 {
+		return
+	}
+
+	e.sendmtx.Lock()
+	defer e.sendmtx.Unlock()
+	for _, collector := range e.collectors {
+		err := e.send(collector, flows, time.Now())
+		if err != nil {
+			debugPrint(3, "flow export to", collector.Address, "failed", err)
+		}
+	}
+}
+
+func templateFields(version int, ipv6 bool) []exportField {
+	fields := []exportField{
+		{ieIngressInterface, 4},
+		{ieSourceMacAddress, 6},
+		{ieDestinationMacAddress, 6},
+	}
+
+	if ipv6 {
+		fields = append(fields, exportField{ieSourceIPv6Address, 16}, exportField{ieDestinationIPv6Address, 16})
+	} else {
+		fields = append(fields, exportField{ieSourceIPv4Address, 4}, exportField{ieDestinationIPv4Address, 4})
+	}
+
+	fields = append(fields,
+		exportField{ieProtocolIdentifier, 1},
+		exportField{ieSourceTransportPort, 2},
+		exportField{ieDestinationTransportPort, 2},
+		exportField{ieTcpControlBits, 1},
+		exportField{ieOctetDeltaCount, 8},
+		exportField{iePacketDeltaCount, 8},
+	)
+
+	if version == netflow9Version {
+		return append(fields, exportField{ieFirstSwitched, 4}, exportField{ieLastSwitched, 4})
+	}
+	return append(fields, exportField{ieFlowStartMilliseconds, 8}, exportField{ieFlowEndMilliseconds, 8})
+}
+
+func templateSet(version int) []byte {
+	setId := uint16(ipfixTemplateSetId)
+	if version == netflow9Version {
+		setId = netflow9TemplateSetId
+	}
+
+	set := appendUint16(nil, setId)
+	set = appendUint16(set, 0) //length
+	for _, templateId := range []uint16{templateIPv4, templateIPv6} {
+		fields := templateFields(version, templateId == templateIPv6)
+		set = appendUint16(set, templateId)
+		set = appendUint16(set, uint16(len(fields)))
+		for _, field := range fields {
+			set = appendUint16(set, field.Id)
+			set = appendUint16(set, field.Length)
+		}
+	}
+	binary.BigEndian.PutUint16(set[2:4], uint16(len(set)))
+	return set
+}
+
+// uptime returns the NetFlow v9 timestamp of t, milliseconds since start
+func (e *flowExporter) uptime(t time.Time) uint32 {
+	if t.Before(e.boot) {
+		return 0
+	}
+	return uint32(t.Sub(e.boot).Milliseconds())
+}
+
+func (e *flowExporter) encodeRecord(version int, flow *exportFlow) (uint16, []byte) {
+	templateId := uint16(templateIPv4)
+	if flow.IPv6 {
+		templateId = templateIPv6
+	}
+
+	record := []byte{}
+	for _, field := range templateFields(version, flow.IPv6) {
+		switch field.Id {
+		case ieIngressInterface:
+			record = appendUint32(record, flow.Ifindex)
+		case ieSourceMacAddress:
+			record = append(record, flow.SrcMAC[:]...)
+		case ieDestinationMacAddress:
+			record = append(record, flow.DstMAC[:]...)
+		case ieSourceIPv4Address:
+			record = append(record, flow.SrcIP[:4]...)
+		case ieDestinationIPv4Address:
+			record = append(record, flow.DstIP[:4]...)
+		case ieSourceIPv6Address:
+			record = append(record, flow.SrcIP[:]...)
+		case ieDestinationIPv6Address:
+			record = append(record, flow.DstIP[:]...)
+		case ieProtocolIdentifier:
+			record = append(record, flow.Protocol)
+		case ieSourceTransportPort:
+			record = appendUint16(record, flow.SrcPort)
+		case ieDestinationTransportPort:
+			record = appendUint16(record, flow.DstPort)
+		case ieTcpControlBits:
+			record = append(record, flow.TCPFlags)
+		case ieOctetDeltaCount:
+			record = appendUint64(record, flow.Bytes)
+		case iePacketDeltaCount:
+			record = appendUint64(record, flow.Packets)
+		case ieFirstSwitched:
+			record = appendUint32(record, e.uptime(flow.Start))
+		case ieLastSwitched:
+			record = appendUint32(record, e.uptime(flow.End))
+		case ieFlowStartMilliseconds:
+			record = appendUint64(record, uint64(flow.Start.UnixMilli()))
+		case ieFlowEndMilliseconds:
+			record = appendUint64(record, uint64(flow.End.UnixMilli()))
+		}
+	}
+	return templateId, record
+}
+
+type exportMessage struct {
+	sets        []byte
+	records     int
+	dataRecords int
+	setStart    int
+	setId       uint16
+}
+
+func (m *exportMessage) closeSet() {
+	if m.setId == 0 {
+		return
+	}
+	//sets are padded to 32 bits
+	for len(m.sets)%4 != 0 {
+		m.sets = append(m.sets, 0)
+	}
+	binary.BigEndian.PutUint16(m.sets[m.setStart+2:], uint16(len(m.sets)-m.setStart))
+	m.setId = 0
+}
+
+func (m *exportMessage) addRecord(templateId uint16, record []byte) {
+	if m.setId != templateId {
+		m.closeSet()
+		m.setStart = len(m.sets)
+		m.setId = templateId
+		m.sets = appendUint16(m.sets, templateId)
+		m.sets = appendUint16(m.sets, 0)
+	}
+	m.sets = append(m.sets, record...)
+	m.records++
+	m.dataRecords++
+}
+
+func (e *flowExporter) newMessage(collector *exportCollector, now time.Time) *exportMessage {
+	m := &exportMessage{}
+	if now.Sub(collector.lastTemplate) >= templateRefresh {
+		//collectors learn the templates from the periodic template sets
+		m.sets = templateSet(collector.Version)
+		m.records = 2
+		collector.lastTemplate = now
+	}
+	return m
+}
+
+func (e *flowExporter) sendMessage(collector *exportCollector, m *exportMessage, now time.Time) error {
+	m.closeSet()
+	if len(m.sets) == 0 {
+		return nil
+	}
+
+	header := appendUint16(nil, uint16(collector.Version))
+	if collector.Version == netflow9Version {
+		header = appendUint16(header, uint16(m.records))
+		header = appendUint32(header, e.uptime(now))
+		header = appendUint32(header, uint32(now.Unix()))
+		header = appendUint32(header, collector.sequence)
+		header = appendUint32(header, e.observationDomain)
+		collector.sequence++
+	} else {
+		header = appendUint16(header, uint16(16+len(m.sets)))
+		header = appendUint32(header, uint32(now.Unix()))
+		header = appendUint32(header, collector.sequence)
+		header = appendUint32(header, e.observationDomain)
+		collector.sequence += uint32(m.dataRecords)
+	}
+
+	_, err := collector.conn.Write(append(header, m.sets...))
+	return err
+}
+
+func (e *flowExporter) send(collector *exportCollector, flows []*exportFlow, now time.Time) error {
+	var lastErr error
+
+	m := e.newMessage(collector, now)
+	for _, flow := range flows {
+		templateId, record := e.encodeRecord(collector.Version, flow)
+		//header, a new set header and padding
+		if 20+len(m.sets)+4+len(record)+3 > maxExportMessage {
+			if err := e.sendMessage(collector, m, now); err != nil {
+				lastErr = err
+			}
+			m = e.newMessage(collector, now)
+		}
+		m.addRecord(templateId, record)
+	}
+
+	if err := e.sendMessage(collector, m, now); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// messageConn records the messages written to a collector
+type messageConn struct {
+	net.Conn
+	messages [][]byte
+}
+
+func (c *messageConn) Write(b []byte) (int, error) {
+	c.messages = append(c.messages, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func testCollector(version int) (*exportCollector, *messageConn) {
+	conn := &messageConn{}
+	return &exportCollector{Version: version, Address: "192.168.2.10:4739", conn: conn}, conn
+}
+
+var (
+	testBoot = time.Unix(1759999999, 0)
+	testNow  = time.Unix(1760000010, 0)
+)
+
+func testExporter() *flowExporter {
+	return &flowExporter{observationDomain: 1, boot: testBoot}
+}
+
+func testFlow(ipv6 bool, srcPort uint16) *exportFlow {
+	flow := &exportFlow{
+		exportKey: exportKey{Ifindex: 3, IPv6: ipv6, Protocol: 6, SrcPort: srcPort, DstPort: 443},
+		SrcMAC:    [6]byte{0x02, 0, 0, 0, 0, 0x01},
+		DstMAC:    [6]byte{0x02, 0, 0, 0, 0, 0x02},
+		Start:     time.UnixMilli(1760000000000),
+		End:       time.UnixMilli(1760000002500),
+		Packets:   3,
+		Bytes:     1500,
+		TCPFlags:  0x1b,
+	}
+	if ipv6 {
+		copy(flow.SrcIP[:], net.ParseIP("2001:db8::1"))
+		copy(flow.DstIP[:], net.ParseIP("2001:db8::2"))
+	} else {
+		copy(flow.SrcIP[:], net.IPv4(192, 168, 2, 10).To4())
+		copy(flow.DstIP[:], net.IPv4(1, 1, 1, 1).To4())
+	}
+	return flow
+}
+
+// golden decodes hex with spaces and newlines for readability
+func golden(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const (
+	ipfixTemplates = `
+		0002 0074
+		0100 000d
+		000a 0004 0038 0006 0050 0006 0008 0004 000c 0004 0004 0001 0007 0002
+		000b 0002 0006 0001 0001 0008 0002 0008 0098 0008 0099 0008
+		0101 000d
+		000a 0004 0038 0006 0050 0006 001b 0010 001c 0010 0004 0001 0007 0002
+		000b 0002 0006 0001 0001 0008 0002 0008 0098 0008 0099 0008`
+
+	netflow9Templates = `
+		0000 0074
+		0100 000d
+		000a 0004 0038 0006 0050 0006 0008 0004 000c 0004 0004 0001 0007 0002
+		000b 0002 0006 0001 0001 0008 0002 0008 0016 0004 0015 0004
+		0101 000d
+		000a 0004 0038 0006 0050 0006 001b 0010 001c 0010 0004 0001 0007 0002
+		000b 0002 0006 0001 0001 0008 0002 0008 0016 0004 0015 0004`
+
+	//flowStartMilliseconds, flowEndMilliseconds
+	ipfixTimes = `00000199c82cc000 00000199c82cc9c4`
+
+	//first and last switched, milliseconds since boot
+	netflow9Times = `000003e8 00000dac`
+)
+
+// the ifindex, macs, addresses, protocol, ports, tcp flags, octets and
+// packets of testFlow
+func recordIPv4(srcPort uint16) string {
+	return fmt.Sprintf(`00000003 020000000001 020000000002 c0a8020a 01010101 06 %04x 01bb 1b
+		00000000000005dc 0000000000000003`, srcPort)
+}
+
+func recordIPv6(srcPort uint16) string {
+	return fmt.Sprintf(`00000003 020000000001 020000000002
+		20010db8000000000000000000000001 20010db8000000000000000000000002
+		06 %04x 01bb 1b 00000000000005dc 0000000000000003`, srcPort)
+}
+
+func TestTemplateSet(t *testing.T) {
+	if got, want := templateSet(ipfixVersion), golden(t, ipfixTemplates); !bytes.Equal(got, want) {
+		t.Errorf("ipfix templates\n got %x\nwant %x", got, want)
+	}
+	if got, want := templateSet(netflow9Version), golden(t, netflow9Templates); !bytes.Equal(got, want) {
+		t.Errorf("netflow9 templates\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestEncodeRecord(t *testing.T) {
+	e := testExporter()
+
+	tests := []struct {
+		name     string
+		version  int
+		ipv6     bool
+		template uint16
+		want     string
+	}{
+		{"ipfix ipv4", ipfixVersion, false, templateIPv4, recordIPv4(50000) + ipfixTimes},
+		{"ipfix ipv6", ipfixVersion, true, templateIPv6, recordIPv6(50000) + ipfixTimes},
+		{"netflow9 ipv4", netflow9Version, false, templateIPv4, recordIPv4(50000) + netflow9Times},
+		{"netflow9 ipv6", netflow9Version, true, templateIPv6, recordIPv6(50000) + netflow9Times},
+	}
+
+	for _, tt := range tests {
+		template, record := e.encodeRecord(tt.version, testFlow(tt.ipv6, 50000))
+		if template != tt.template {
+			t.Errorf("%s: got template %d, want %d", tt.name, template, tt.template)
+		}
+		if want := golden(t, tt.want); !bytes.Equal(record, want) {
+			t.Errorf("%s\n got %x\nwant %x", tt.name, record, want)
+		}
+	}
+
+	//flows seen before the exporter started are at uptime 0
+	early := testFlow(false, 50000)
+	early.Start = testBoot.Add(-time.Second)
+	_, record := e.encodeRecord(netflow9Version, early)
+	if first := binary.BigEndian.Uint32(record[len(record)-8:]); first != 0 {
+		t.Errorf("got first switched %d", first)
+	}
+}
+
+func TestSendMessageIPFIX(t *testing.T) {
+	e := testExporter()
+	collector, conn := testCollector(ipfixVersion)
+
+	if err := e.send(collector, []*exportFlow{testFlow(false, 50000)}, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	//version, length, export time, sequence, observation domain
+	want := golden(t, `000a 00c8 68e7780a 00000000 00000001`+ipfixTemplates+
+		`0100 0044`+recordIPv4(50000)+ipfixTimes+`0000`)
+	if len(conn.messages) != 1 || !bytes.Equal(conn.messages[0], want) {
+		t.Fatalf("got %x\nwant %x", conn.messages, want)
+	}
+
+	//templates are only repeated after the refresh, the sequence counts
+	//the data records sent before
+	flows := []*exportFlow{testFlow(false, 50001), testFlow(true, 50002)}
+	if err := e.send(collector, flows, testNow.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	want = golden(t, `000a 00b0 68e7780b 00000001 00000001`+
+		`0100 0044`+recordIPv4(50001)+ipfixTimes+`0000`+
+		`0101 005c`+recordIPv6(50002)+ipfixTimes+`0000`)
+	if len(conn.messages) != 2 || !bytes.Equal(conn.messages[1], want) {
+		t.Fatalf("got %x\nwant %x", conn.messages[1], want)
+	}
+	if collector.sequence != 3 {
+		t.Errorf("got sequence %d", collector.sequence)
+	}
+
+	if err := e.send(collector, []*exportFlow{testFlow(false, 50000)}, testNow.Add(templateRefresh)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := conn.messages[2]; !bytes.Equal(msg[16:16+len(templateSet(ipfixVersion))], templateSet(ipfixVersion)) {
+		t.Error("templates were not refreshed")
+	}
+}
+
+func TestSendMessageNetflow9(t *testing.T) {
+	e := testExporter()
+	collector, conn := testCollector(netflow9Version)
+
+	if err := e.send(collector, []*exportFlow{testFlow(false, 50000)}, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	//version, record count with templates, uptime, unix seconds, sequence, source id
+	want := golden(t, `0009 0003 00002af8 68e7780a 00000000 00000001`+netflow9Templates+
+		`0100 003c`+recordIPv4(50000)+netflow9Times+`0000`)
+	if len(conn.messages) != 1 || !bytes.Equal(conn.messages[0], want) {
+		t.Fatalf("got %x\nwant %x", conn.messages, want)
+	}
+
+	//the netflow v9 sequence counts export packets
+	if err := e.send(collector, []*exportFlow{testFlow(false, 50000)}, testNow); err != nil {
+		t.Fatal(err)
+	}
+	header := conn.messages[1][:20]
+	if count, sequence := binary.BigEndian.Uint16(header[2:]), binary.BigEndian.Uint32(header[12:]); count != 1 || sequence != 1 {
+		t.Errorf("got count %d sequence %d", count, sequence)
+	}
+}
+
+func TestSendMessageEmpty(t *testing.T) {
+	e := testExporter()
+	collector, conn := testCollector(ipfixVersion)
+	collector.lastTemplate = testNow
+
+	if err := e.send(collector, nil, testNow); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.messages) != 0 {
+		t.Errorf("sent %d empty messages", len(conn.messages))
+	}
+}
+
+// dataRecords counts the records of a message from its set lengths
+func dataRecords(t *testing.T, version int, msg []byte) int {
+	t.Helper()
+
+	headerLength := 16
+	if version == netflow9Version {
+		headerLength = 20
+	}
+
+	count := 0
+	for offset := headerLength; offset < len(msg); {
+		setId := binary.BigEndian.Uint16(msg[offset:])
+		setLength := int(binary.BigEndian.Uint16(msg[offset+2:]))
+		if setLength < 4 || offset+setLength > len(msg) || setLength%4 != 0 {
+			t.Fatalf("invalid set length %d at %d", setLength, offset)
+		}
+		if setId == templateIPv4 {
+			_, record := testExporter().encodeRecord(version, testFlow(false, 0))
+			count += (setLength - 4) / len(record)
+		}
+		offset += setLength
+	}
+	return count
+}
+
+func TestSendSplitsMessages(t *testing.T) {
+	flows := []*exportFlow{}
+	for port := 0; port < 100; port++ {
+		flows = append(flows, testFlow(false, uint16(port)))
+	}
+
+	for _, version := range []int{ipfixVersion, netflow9Version} {
+		e := testExporter()
+		collector, conn := testCollector(version)
+		if err := e.send(collector, flows, testNow); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(conn.messages) < 2 {
+			t.Fatalf("version %d: got %d messages", version, len(conn.messages))
+		}
+
+		total := 0
+		for i, msg := range conn.messages {
+			if len(msg) > maxExportMessage {
+				t.Errorf("version %d: message %d is %d bytes", version, i, len(msg))
+			}
+
+			records := dataRecords(t, version, msg)
+			if records == 0 {
+				t.Errorf("version %d: message %d has no records", version, i)
+			}
+
+			if version == ipfixVersion {
+				if length := int(binary.BigEndian.Uint16(msg[2:])); length != len(msg) {
+					t.Errorf("message %d has length %d, sent %d", i, length, len(msg))
+				}
+				if sequence := binary.BigEndian.Uint32(msg[8:]); sequence != uint32(total) {
+					t.Errorf("ipfix message %d has sequence %d, want %d", i, sequence, total)
+				}
+			} else {
+				if sequence := binary.BigEndian.Uint32(msg[12:]); sequence != uint32(i) {
+					t.Errorf("netflow9 message %d has sequence %d", i, sequence)
+				}
+				//only the first message carries the templates
+				want := records
+				if i == 0 {
+					want += 2
+				}
+				if count := int(binary.BigEndian.Uint16(msg[2:])); count != want {
+					t.Errorf("netflow9 message %d has count %d, want %d", i, count, want)
+				}
+			}
+			total += records
+		}
+
+		if total != len(flows) {
+			t.Errorf("version %d: exported %d of %d flows", version, total, len(flows))
+		}
+	}
+}
+
+func TestLoadExportConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	config, err := loadExportConfig(filepath.Join(dir, "missing.json"))
+	if err != nil || len(config.Collectors) != 0 || config.ActiveTimeout != 60 || config.IdleTimeout != 15 {
+		t.Errorf("got %+v %v", config, err)
+	}
+
+	write := func(data string) string {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config, err = loadExportConfig(write(`{"Collectors": ["ipfix://192.168.2.10", "netflow9://192.168.2.20:2055"], "IdleTimeout": 30}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Collectors) != 2 || config.ObservationDomain != 1 || config.ActiveTimeout != 60 || config.IdleTimeout != 30 {
+		t.Errorf("got %+v", config)
+	}
+
+	for _, data := range []string{
+		`{"Collectors": "ipfix://192.168.2.10"}`,
+		`{"ActiveTimeout": 0}`,
+		`{"Collectors": ["ipfix://192.168.2.10,netflow9://192.168.2.20"]}`,
+	} {
+		if _, err := loadExportConfig(write(data)); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
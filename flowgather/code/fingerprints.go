@@ -0,0 +1,301 @@
+package main
+
+/*
+Device fingerprints for the plugin-lookup classifier.
+
+TLS client hellos (JA3 and JA4) and the option order of DHCP requests are
+published on fingerprint:tls and fingerprint:dhcp with the observed ip ttl,
+once per device and fingerprint a day. Packets sent by the router itself
+are skipped.
+*/
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreadl0ck/tlsx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	sprbus "github.com/spr-networks/sprbus-json"
+)
+
+var EVENTBUS_SOCK *string
+
+const fingerprintRepublish = 24 * time.Hour
+const maxFingerprintsSeen = 65536
+
+type TLSFingerprint struct {
+	MAC     string
+	IP      string
+	SNI     string
+	JA3     string
+	JA3Hash string
+	JA4     string
+	TTL     int
+}
+
+type DHCPFingerprint struct {
+	MAC          string
+	OptionOrder  string
+	ParamReqList string
+	VendorClass  string
+	TTL          int
+}
+
+var fingerprintMtx sync.Mutex
+var fingerprintsSeen = map[string]time.Time{}
+var localMACs = map[string]bool{}
+var busClient *sprbus.Client
+
+func loadLocalMACs() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+
+	fingerprintMtx.Lock()
+	defer fingerprintMtx.Unlock()
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) != 0 {
+			localMACs[iface.HardwareAddr.String()] = true
+		}
+	}
+}
+
+// publishFingerprint sends value once per key a day
+func publishFingerprint(topic string, key string, value interface{}) {
+	fingerprintMtx.Lock()
+	defer fingerprintMtx.Unlock()
+
+	if last, exists := fingerprintsSeen[key]; exists && time.Since(last) < fingerprintRepublish {
+		return
+	}
+	if len(fingerprintsSeen) >= maxFingerprintsSeen {
+		fingerprintsSeen = map[string]time.Time{}
+	}
+	fingerprintsSeen[key] = time.Now()
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	if busClient == nil {
+		busClient, err = sprbus.NewClient(*EVENTBUS_SOCK)
+		if err != nil {
+			busClient = nil
+			debugPrint(3, "failed to connect to sprbus", err)
+			return
+		}
+	}
+
+	if _, err = busClient.Publish(topic, string(data)); err != nil {
+		debugPrint(3, "failed to publish fingerprint", err)
+		busClient.Close()
+		busClient = nil
+	}
+}
+
+// packetSource returns the source mac, ip and ttl, mac is empty for
+// packets without an ethernet header or sent by the router
+func packetSource(packet gopacket.Packet) (string, string, int) {
+	mac := ""
+	if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok {
+		mac = eth.SrcMAC.String()
+	}
+
+	ip, ttl := "", 0
+	switch network := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		ip, ttl = network.SrcIP.String(), int(network.TTL)
+	case *layers.IPv6:
+		ip, ttl = network.SrcIP.String(), int(network.HopLimit)
+	}
+
+	fingerprintMtx.Lock()
+	local := localMACs[mac]
+	fingerprintMtx.Unlock()
+	if local {
+		return "", "", 0
+	}
+
+	return mac, ip, ttl
+}
+
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func hex4List(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		parts = append(parts, fmt.Sprintf("%04x", value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// ja4 computes the JA4 fingerprint of a tls client hello over tcp
+func ja4(ch *tlsx.ClientHello) string {
+	version := uint16(ch.HandshakeVersion)
+	for _, supported := range ch.SupportedVersions {
+		if !isGREASE(uint16(supported)) && uint16(supported) > version {
+			version = uint16(supported)
+		}
+	}
+
+	sni := "i"
+	if ch.SNI != "" {
+		sni = "d"
+	}
+
+	ciphers := []uint16{}
+	for _, cipher := range ch.CipherSuites {
+		if !isGREASE(uint16(cipher)) {
+			ciphers = append(ciphers, uint16(cipher))
+		}
+	}
+
+	extensions := []uint16{}
+	extensionCount := 0
+	for _, extension := range ch.AllExtensions {
+		if isGREASE(extension) {
+			continue
+		}
+		extensionCount++
+		//sni and alpn are counted but not hashed
+		if extension != 0x0000 && extension != 0x0010 {
+			extensions = append(extensions, extension)
+		}
+	}
+
+	alpn := "00"
+	if len(ch.ALPNs) > 0 && len(ch.ALPNs[0]) > 0 {
+		first, last := ch.ALPNs[0][0], ch.ALPNs[0][len(ch.ALPNs[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = fmt.Sprintf("%02x", first)[:1] + fmt.Sprintf("%02x", last)[1:]
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min(len(ciphers), 99), min(extensionCount, 99), alpn)
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+
+	signatureAlgs := []uint16{}
+	for _, algorithm := range ch.SignatureAlgs {
+		if !isGREASE(algorithm) {
+			signatureAlgs = append(signatureAlgs, algorithm)
+		}
+	}
+
+	c := hex4List(extensions)
+	if len(signatureAlgs) > 0 && c != "" {
+		c += "_" + hex4List(signatureAlgs)
+	}
+
+	return a + "_" + ja4Hash(hex4List(ciphers)) + "_" + ja4Hash(c)
+}
+
+func publishTLSFingerprint(packet gopacket.Packet, bareJA3 string) {
+	transport := packet.TransportLayer()
+	if transport == nil {
+		return
+	}
+
+	ch := tlsx.ClientHello{}
+	if err := ch.Unmarshal(transport.LayerPayload()); err != nil {
+		return
+	}
+
+	mac, ip, ttl := packetSource(packet)
+	if mac == "" && ip == "" {
+		return
+	}
+
+	sum := md5.Sum([]byte(bareJA3))
+	fingerprint := TLSFingerprint{
+		MAC:     mac,
+		IP:      ip,
+		SNI:     ch.SNI,
+		JA3:     bareJA3,
+		JA3Hash: hex.EncodeToString(sum[:]),
+		JA4:     ja4(&ch),
+		TTL:     ttl,
+	}
+
+	publishFingerprint("fingerprint:tls", "tls "+mac+ip+" "+fingerprint.JA4+" "+fingerprint.JA3Hash, fingerprint)
+}
+
+func handleDHCPFingerprint(dhcp *layers.DHCPv4, packet gopacket.Packet) {
+	if dhcp.Operation != layers.DHCPOpRequest {
+		return
+	}
+
+	mac, _, ttl := packetSource(packet)
+	if mac == "" {
+		return
+	}
+
+	fingerprint := DHCPFingerprint{MAC: dhcp.ClientHWAddr.String(), TTL: ttl}
+	order := []string{}
+	for _, option := range dhcp.Options {
+		if option.Type == layers.DHCPOptPad || option.Type == layers.DHCPOptEnd {
+			continue
+		}
+		order = append(order, strconv.Itoa(int(option.Type)))
+
+		switch option.Type {
+		case layers.DHCPOptParamsRequest:
+			params := []string{}
+			for _, param := range option.Data {
+				params = append(params, strconv.Itoa(int(param)))
+			}
+			fingerprint.ParamReqList = strings.Join(params, ",")
+		case layers.DHCPOptClassID:
+			fingerprint.VendorClass = string(option.Data)
+		}
+	}
+	fingerprint.OptionOrder = strings.Join(order, ",")
+
+	key := "dhcp " + fingerprint.MAC + " " + fingerprint.OptionOrder + " " + fingerprint.ParamReqList
+	publishFingerprint("fingerprint:dhcp", key, fingerprint)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dreadl0ck/tlsx"
+)
+
+// the chrome client hello from the JA4 technical details, with GREASE
+// values added to every list
+func testChromeHello() tlsx.ClientHello {
+	ch := tlsx.ClientHello{
+		ClientHelloBasic: tlsx.ClientHelloBasic{
+			HandshakeVersion: 0x0303,
+			SNI:              "www.example.com",
+			CipherSuites: []tlsx.CipherSuite{
+				0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+				0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+			},
+			AllExtensions: []uint16{
+				0x3a3a, 0x001b, 0x0000, 0x0033, 0x0010, 0x4469, 0x0017, 0x002d, 0x000d,
+				0x0005, 0x0023, 0x0012, 0x002b, 0xff01, 0x000b, 0x000a, 0x0015, 0xfafa,
+			},
+		},
+		SignatureAlgs:     []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		ALPNs:             []string{"h2", "http/1.1"},
+		SupportedVersions: []tlsx.Version{0x8a8a, 0x0304, 0x0303},
+	}
+	return ch
+}
+
+func TestJA4(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(ch *tlsx.ClientHello)
+		want   string
+	}{
+		{
+			name:   "reference chrome hello",
+			modify: func(ch *tlsx.ClientHello) {},
+			want:   "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "GREASE signature algorithms are ignored",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.SignatureAlgs = append([]uint16{0x1a1a}, ch.SignatureAlgs...)
+			},
+			want: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "no signature algorithms",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.SignatureAlgs = nil
+			},
+			want: "t13d1516h2_8daaf6152771_6d807ffa2a79",
+		},
+		{
+			name: "only GREASE signature algorithms",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.SignatureAlgs = []uint16{0x0a0a}
+			},
+			want: "t13d1516h2_8daaf6152771_6d807ffa2a79",
+		},
+		{
+			name: "no sni or alpn",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.SNI = ""
+				ch.ALPNs = nil
+			},
+			want: "t13i151600_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "non alphanumeric alpn",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.ALPNs = []string{"\xab"}
+			},
+			want: "t13d1516ab_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "non alphanumeric alpn end",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.ALPNs = []string{"h2\xcd"}
+			},
+			want: "t13d15166d_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "tls 1.2 without supported versions",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.SupportedVersions = nil
+			},
+			want: "t12d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "no ciphers or extensions",
+			modify: func(ch *tlsx.ClientHello) {
+				ch.CipherSuites = nil
+				ch.AllExtensions = nil
+				ch.SNI = ""
+				ch.ALPNs = nil
+			},
+			want: "t13i000000_000000000000_000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		ch := testChromeHello()
+		tt.modify(&ch)
+		if got := ja4(&ch); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
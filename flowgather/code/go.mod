@@ -4,14 +4,16 @@ go 1.25.0
 
 require (
 	github.com/dreadl0ck/ja3 v1.1.0
+	github.com/dreadl0ck/tlsx v1.2.0
 	github.com/google/gopacket v1.1.19
+	github.com/spr-networks/sprbus-json v0.0.0-20260616150305-efdec19847c8
 	github.com/vishvananda/netlink v1.3.1
 	golang.org/x/sys v0.42.0
 )
 
 require (
-	github.com/dreadl0ck/tlsx v1.2.0 // indirect
 	github.com/gopacket/gopacket v1.5.0 // indirect
+	github.com/sirupsen/logrus v1.9.4 // indirect
 	github.com/vishvananda/netns v0.0.5 // indirect
 	golang.org/x/crypto v0.49.0 // indirect
 	golang.org/x/net v0.52.0 // indirect
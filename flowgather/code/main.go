@@ -306,6 +306,8 @@ func listenInterface(iface string) {
 	}
 
 	fmt.Println("listen", iface)
+	//the router's own addresses are not device fingerprints
+	loadLocalMACs()
 	handler, err := pcap.OpenLive(iface, buffer, false, pcap.BlockForever)
 
 	if err != nil {
@@ -337,6 +339,9 @@ func listenInterface(iface string) {
 func handleData() {
 	for data := range GLC {
 		saveFlows(data.iface, data.iface_id, *data.packet)
+		if gExporter != nil {
+			gExporter.accountPacket(data.iface, *data.packet)
+		}
 	}
 
 }
@@ -361,12 +366,50 @@ func saveJSON(fn string) {
 func main() {
 	var profile = flag.String("profile", "", "run profiler service on :6000")
 	DATA_FILE = flag.String("jsonData", "/data/flowgather.json", "path to save json state")
+	EVENTBUS_SOCK = flag.String("eventbus", "/state/api/eventbus.sock", "sprbus socket for device fingerprints")
+	var exportConfigFile = flag.String("config", ExportConfigFile, "path to the flow export config")
+	var collectors = flag.String("collectors", "", "comma separated flow collectors, ipfix://host:port or netflow9://host:port")
+	var observationDomain = flag.Uint("observationDomain", 1, "IPFIX observation domain / NetFlow v9 source id")
+	var activeTimeout = flag.Duration("activeTimeout", 60*time.Second, "export long running flows after this duration")
+	var idleTimeout = flag.Duration("idleTimeout", 15*time.Second, "export flows idle for this duration")
 	flag.Parse()
 
 	debugPrint(2, "--= Flow capture =--")
 
 	InitDB(*DATA_FILE)
 
+	exportConfig, err := loadExportConfig(*exportConfigFile)
+	if err != nil {
+		log.Fatal("invalid flow export config: ", err)
+	}
+
+	//flags given on the command line override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "collectors":
+			exportConfig.Collectors = nil
+			if *collectors != "" {
+				exportConfig.Collectors = strings.Split(*collectors, ",")
+			}
+		case "observationDomain":
+			exportConfig.ObservationDomain = uint32(*observationDomain)
+		case "activeTimeout":
+			exportConfig.ActiveTimeout = int(activeTimeout.Seconds())
+		case "idleTimeout":
+			exportConfig.IdleTimeout = int(idleTimeout.Seconds())
+		}
+	})
+
+	if len(exportConfig.Collectors) != 0 {
+		exporter, err := NewFlowExporter(strings.Join(exportConfig.Collectors, ","), exportConfig.ObservationDomain,
+			time.Duration(exportConfig.ActiveTimeout)*time.Second, time.Duration(exportConfig.IdleTimeout)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gExporter = exporter
+		go gExporter.expireLoop()
+	}
+
 	establishInterfaces()
 
 	go listenNewInterfaceUp(listenInterface)
@@ -414,6 +457,7 @@ func handleTLSFP(tls *layers.TLS, parentBiflowId int64, packet gopacket.Packet)
 
 			if clientFingerprint != "" {
 				tlsFingerprintOutput("tlsFPClient", parentBiflowId, clientFingerprint)
+				publishTLSFingerprint(packet, clientFingerprint)
 			}
 
 			if serverFingerprint != "" {
@@ -758,6 +802,9 @@ func saveFlows(ifaceName string, ifaceId int64, packet gopacket.Packet) {
 			if shouldSaveTransportFlowUDP(ifaceId, previousFlowId, udp) {
 				previousFlowId = saveTransportFlow(ifaceId, int(layer.LayerType()), previousFlowId, udp.TransportFlow(), t, int(udp.SrcPort), int(udp.DstPort))
 			}
+		case layers.LayerTypeDHCPv4:
+			dhcp, _ := layer.(*layers.DHCPv4)
+			handleDHCPFingerprint(dhcp, packet)
 		case layers.LayerTypeDNS:
 			dns, _ := layer.(*layers.DNS)
 			handleDNS(layer.LayerContents(), packet, dns, previousFlowId)
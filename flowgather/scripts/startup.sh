@@ -1,2 +1,5 @@
 #!/bin/bash
-GOGC=4000 /flowgather
+# flow export is configured in /configs/flowgather/config.json,
+# FLOWGATHER_ARGS can override it, for example
+# -collectors ipfix://192.168.2.10:4739,netflow9://192.168.2.20:2055
+GOGC=4000 /flowgather $FLOWGATHER_ARGS
@@ -2679,7 +2679,39 @@ export default function MockAPI(props = null) {
               Runtime: 'spr-krun',
               Image: 'ghcr.io/spr-networks/spr-atlas:latest-krun',
               CPUs: 1,
-              MemoryMiB: 128
+              MemoryMiB: 128,
+              Usage: {
+                Source: 'docker-stats',
+                CPUPercent: 2.5,
+                MemoryBytes: 73400320,
+                MemoryLimitBytes: 134217728,
+                DiskReadBytes: 10485760,
+                DiskWriteBytes: 2097152,
+                NetRxBytes: 524288,
+                NetTxBytes: 262144
+              }
+            }
+          ],
+          Containers: [
+            {
+              ID: 'fedcba987654',
+              PID: 2345,
+              Name: 'superdyndns',
+              State: 'running',
+              Container: true,
+              ContainerID: 'fedcba987654',
+              Runtime: 'runc',
+              Image: 'ghcr.io/spr-networks/super_dyndns:latest',
+              Usage: {
+                Source: 'docker-stats',
+                CPUPercent: 0.1,
+                MemoryBytes: 8388608,
+                MemoryLimitBytes: 2147483648,
+                DiskReadBytes: 1048576,
+                DiskWriteBytes: 0,
+                NetRxBytes: 65536,
+                NetTxBytes: 32768
+              }
             }
           ]
         }
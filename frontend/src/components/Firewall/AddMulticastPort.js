@@ -29,14 +29,18 @@ class AddMulticastPortImpl extends React.Component {
 
   MulticastPorts = {
     '224.0.0.251': '5353',
+    'ff02::fb': '5353',
     '239.255.255.250': '1900',
+    'ff02::c': '1900',
     '224.0.1.129': '319',
     '224.0.1.129-2': '320'
   }
 
   MulticastServices = [
     { label: 'mDNS', value: '224.0.0.251' },
+    { label: 'mDNS IPv6', value: 'ff02::fb' },
     { label: 'SSDP', value: '239.255.255.250' },
+    { label: 'SSDP IPv6', value: 'ff02::c' },
     { label: 'PTP events', value: '224.0.1.129' },
     { label: 'PTP general', value: '224.0.1.129-2' }
   ]
@@ -47,7 +51,12 @@ class AddMulticastPortImpl extends React.Component {
     this.handleSubmit = this.handleSubmit.bind(this)
 
     if (props.item) {
-      let [addr, port] = String(props.item.Address || '').split(':')
+      //ipv6 addresses are in brackets: [ff02::fb]:5353
+      let address = String(props.item.Address || '')
+      let idx = address.lastIndexOf(':')
+      let addr = idx > -1 ? address.slice(0, idx) : address
+      let port = idx > -1 ? address.slice(idx + 1) : ''
+      addr = addr.replace(/^\[|\]$/g, '')
       this.state = {
         ...this.state,
         Address: addr || '',
@@ -76,7 +85,11 @@ class AddMulticastPortImpl extends React.Component {
   handleSubmit() {
     this.setState({ isLoading: true })
 
-    let newAddress = this.state.Address + ':' + this.state.Port
+    let addr = this.state.Address
+    if (addr.includes(':')) {
+      addr = `[${addr}]`
+    }
+    let newAddress = addr + ':' + this.state.Port
     let description = this.state.Description
     let isEditing = !!this.props.item
     let originalAddress = this.originalAddress
@@ -64,10 +64,10 @@ const MulticastPorts = (props) => {
     setList(newList)
     let inUse = {}
     for (let entry of newList) {
-      let port = entry.Address.split(':')[1]
+      let port = entry.Address.split(':').pop()
       inUse[port] = 1
     }
-    let item_port = item.Address.split(':')[1]
+    let item_port = item.Address.split(':').pop()
 
     Multicast.config()
       .then((mcast) => {
@@ -384,8 +384,16 @@ const PrettyItem = ({ item, selected, showJSON, setIsParsable, ...props }) => {
       proto = 'tcp'
     } else if (item.UDP) {
       proto = 'udp'
+    } else if (item.ICMP || item.ICMPv6) {
+      proto = 'icmp'
+    } else if (item.ARP) {
+      proto = 'arp'
     }
 
+    let ip = item.IP || item.IPv6 || {}
+    let srcIP = ip.SrcIP || item.ARP?.SrcIP
+    let dstIP = ip.DstIP || item.ARP?.DstIP
+
     const desktopOnly = {
       display: 'none',
       sx: {
@@ -414,7 +422,7 @@ const PrettyItem = ({ item, selected, showJSON, setIsParsable, ...props }) => {
             <ProtocolItem name={proto} size="sm" />
             <HStack>
               <Text size="sm" bold>
-                {item.IP?.SrcIP}
+                {srcIP}
               </Text>
               {srcPort ? <Text size="sm">:{srcPort}</Text> : null}
             </HStack>
@@ -435,7 +443,7 @@ const PrettyItem = ({ item, selected, showJSON, setIsParsable, ...props }) => {
             {/*<ProtocolItem name={proto} size="sm" />*/}
             <HStack>
               <Text size="sm" bold>
-                {item.IP?.DstIP}
+                {dstIP}
               </Text>
               {dstPort ? <Text size="sm">:{dstPort}</Text> : null}
             </HStack>
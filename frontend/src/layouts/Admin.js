@@ -480,7 +480,7 @@ const AdminLayout = ({
       //if packet allowed & should deny in future
       //if packet denied & should allow in future
       if (data.Action == 'allowed' && action == 'deny') {
-        if (!data.TCP && !data.UDP) {
+        if ((!data.TCP && !data.UDP) || !data.IP) {
           return
         }
 
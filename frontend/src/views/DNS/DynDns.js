@@ -17,7 +17,6 @@ import {
   Input,
   InputField,
   InputSlot,
-  Link,
   Switch,
   SectionList,
   Text,
@@ -25,8 +24,7 @@ import {
   VStack,
   ButtonIcon,
   CloseIcon,
-  AddIcon,
-  LinkText
+  AddIcon
 } from '@gluestack-ui/themed'
 
 import { ListHeader } from 'components/List'
@@ -67,6 +65,7 @@ export default class DynDns extends Component {
     this.addSubdomain = this.addSubdomain.bind(this)
     this.deleteSubdomain = this.deleteSubdomain.bind(this)
     this.updateSubdomain = this.updateSubdomain.bind(this)
+    this.updateRFC2136 = this.updateRFC2136.bind(this)
   }
 
   handleButtonClick = () => {
@@ -91,13 +90,28 @@ export default class DynDns extends Component {
   handleSubmit() {
     const done = (res) => {
       this.context.success('Set Dyndns Configuration')
+      this.getConfig()
     }
 
     //as an easy workaround,
     //update ip_urls to be an array again
-    let ip_urls = this.state.config['ip_urls']
-    this.state.config['ip_urls'] = ip_urls.split(',').map((e) => e.trim())
-    dyndnsAPI.setConfig(this.state.config).then(done, (e) => {
+    let { status, ...config } = this.state.config
+    if (typeof config.ip_urls == 'string') {
+      config.ip_urls = config.ip_urls
+        .split(',')
+        .map((e) => e.trim())
+        .filter((e) => e.length)
+    }
+    config.interval = parseInt(config.interval) || 0
+
+    if (config.rfc2136) {
+      config.rfc2136 = {
+        ...config.rfc2136,
+        ttl: parseInt(config.rfc2136.ttl) || 0
+      }
+    }
+
+    dyndnsAPI.setConfig(config).then(done, (e) => {
       this.context.error('API Failure: ' + e.message)
     })
   }
@@ -203,6 +217,12 @@ export default class DynDns extends Component {
     this.setState({ config })
   }
 
+  updateRFC2136(name, value) {
+    let config = this.state.config
+    config.rfc2136 = { ...(config.rfc2136 || {}), [name]: value }
+    this.setState({ config })
+  }
+
   render() {
 
     if (this.state.navigate) {
@@ -218,6 +238,15 @@ export default class DynDns extends Component {
 
     const niceLabel = (label) => ucFirst(label.replace(/_/g, ' '))
 
+    const rfc2136Fields = [
+      ['Server', 'server'],
+      ['Zone', 'zone'],
+      ['TSIG key name', 'tsig_name'],
+      ['TSIG algorithm', 'tsig_algorithm'],
+      ['TSIG secret', 'tsig_secret'],
+      ['TTL', 'ttl']
+    ]
+
     const handleChange = (name, value) => {
       let config = this.state.config
       config[name] = value
@@ -226,15 +255,10 @@ export default class DynDns extends Component {
 
     return (
       <View>
-        <ListHeader title="Dynamic DNS" description="Powered by godns">
-          <Link
-            href="https://github.com/TimothyYe/godns#configuration-file-format"
-            isExternal
-          >
-            <LinkText size="sm" color="$muted500">
-              Read the documentation
-            </LinkText>
-          </Link>
+        <ListHeader
+          title="Dynamic DNS"
+          description="Cloudflare, DuckDNS, dynv6, dyndns2, RFC 2136 and other provider updates"
+        >
           {/*<Switch
             marginLeft="auto"
             value={this.state.isUp}
@@ -265,9 +289,10 @@ export default class DynDns extends Component {
                           ![
                             'run_once',
                             'domains',
-                            'socks5',
                             'ip_url',
-                            'ipv6_url'
+                            'ipv6_url',
+                            'rfc2136',
+                            'status'
                           ].includes(label)
                       )
                       .map((label) => (
@@ -293,6 +318,62 @@ export default class DynDns extends Component {
                           </HStack>
                         </FormControl>
                       ))}
+
+                    <FormControl>
+                      <HStack space="md" justifyItems="center">
+                        <FormControlLabel
+                          flex={1}
+                          size="xs"
+                          justifyContent="flex-end"
+                        >
+                          <FormControlLabelText>Run once</FormControlLabelText>
+                        </FormControlLabel>
+                        <HStack flex={2}>
+                          <Switch
+                            value={this.state.config.run_once}
+                            onToggle={() =>
+                              handleChange(
+                                'run_once',
+                                !this.state.config.run_once
+                              )
+                            }
+                          />
+                        </HStack>
+                      </HStack>
+                    </FormControl>
+
+                    {(this.state.config.provider || '').toLowerCase() ==
+                    'rfc2136'
+                      ? rfc2136Fields.map(([label, name]) => (
+                          <FormControl key={name}>
+                            <HStack space="md" justifyItems="center">
+                              <FormControlLabel
+                                flex={1}
+                                size="xs"
+                                justifyContent="flex-end"
+                              >
+                                <FormControlLabelText>
+                                  {label}
+                                </FormControlLabelText>
+                              </FormControlLabel>
+                              <Input flex={2} variant="underlined">
+                                <InputField
+                                  type={
+                                    name == 'tsig_secret' ? 'password' : 'text'
+                                  }
+                                  value={`${
+                                    (this.state.config.rfc2136 || {})[name] ??
+                                    ''
+                                  }`}
+                                  onChangeText={(value) =>
+                                    this.updateRFC2136(name, value)
+                                  }
+                                />
+                              </Input>
+                            </HStack>
+                          </FormControl>
+                        ))
+                      : null}
                   </VStack>
 
                   <VStack space="md" minW="$1/2">
@@ -375,6 +456,31 @@ export default class DynDns extends Component {
                   </VStack>
                 </VStack>
 
+                {(this.state.config.status || []).length ? (
+                  <VStack space="xs">
+                    {this.state.config.status.map((record) => (
+                      <HStack
+                        key={`${record.name}-${record.type}`}
+                        space="md"
+                      >
+                        <Text size="sm" bold>
+                          {record.name} {record.type}
+                        </Text>
+                        <Text size="sm">
+                          {record.result}
+                          {record.address ? ` ${record.address}` : ''}
+                          {record.uplink ? ` via ${record.uplink}` : ''}
+                        </Text>
+                        {record.error ? (
+                          <Text size="sm" color="$red500">
+                            {record.error}
+                          </Text>
+                        ) : null}
+                      </HStack>
+                    ))}
+                  </VStack>
+                ) : null}
+
                 <Button
                   action="primary"
                   size="md"
@@ -24,6 +24,43 @@ import {
 import { api } from 'api'
 import { ListHeader, ListItem } from 'components/List'
 
+const formatBytes = (bytes) => {
+  if (bytes >= 1024 * 1024 * 1024) {
+    return `${(bytes / (1024 * 1024 * 1024)).toFixed(1)} GiB`
+  }
+  return `${Math.round(bytes / (1024 * 1024))} MiB`
+}
+
+const VirtualMachineUsage = ({ usage }) => {
+  if (!usage) {
+    return null
+  }
+
+  return (
+    <HStack space="md" alignItems="center" flexWrap="wrap">
+      <Text size="xs" color="$muted500">
+        CPU {usage.CPUPercent.toFixed(1)}%
+      </Text>
+      <Text size="xs" color="$muted500">
+        Mem {formatBytes(usage.MemoryBytes)}
+        {usage.MemoryLimitBytes
+          ? ` / ${formatBytes(usage.MemoryLimitBytes)}`
+          : ''}
+      </Text>
+      <Text size="xs" color="$muted500">
+        Disk {formatBytes(usage.DiskReadBytes)} read,{' '}
+        {formatBytes(usage.DiskWriteBytes)} written
+      </Text>
+      {usage.NetRxBytes || usage.NetTxBytes ? (
+        <Text size="xs" color="$muted500">
+          Net {formatBytes(usage.NetRxBytes)} in,{' '}
+          {formatBytes(usage.NetTxBytes)} out
+        </Text>
+      ) : null}
+    </HStack>
+  )
+}
+
 const VirtualMachineResources = ({ vm }) => {
   if (!vm.CPUs && !vm.MemoryMiB) {
     return null
@@ -54,7 +91,8 @@ const VirtualMachineResources = ({ vm }) => {
 const VirtualMachines = () => {
   const [inventory, setInventory] = useState({
     KVMAvailable: true,
-    VirtualMachines: []
+    VirtualMachines: [],
+    Containers: []
   })
   const [loadError, setLoadError] = useState('')
   const [loading, setLoading] = useState(false)
@@ -64,7 +102,9 @@ const VirtualMachines = () => {
     api
       .get('/info/vms')
       .then((result) => {
-        setInventory(result || { KVMAvailable: true, VirtualMachines: [] })
+        setInventory(
+          result || { KVMAvailable: true, VirtualMachines: [], Containers: [] }
+        )
         setLoadError('')
       })
       .catch((err) => {
@@ -78,6 +118,7 @@ const VirtualMachines = () => {
   }, [])
 
   const virtualMachines = inventory.VirtualMachines || []
+  const containers = inventory.Containers || []
   const description = `${virtualMachines.length} active`
 
   const renderVirtualMachine = ({ item }) => (
@@ -98,8 +139,18 @@ const VirtualMachines = () => {
               {item.Container ? item.Runtime || 'container' : 'KVM'}
             </BadgeText>
           </Badge>
+          {item.Health ? (
+            <Badge
+              action={item.Health == 'healthy' ? 'success' : 'warning'}
+              variant="outline"
+              size="sm"
+            >
+              <BadgeText>{item.Health}</BadgeText>
+            </Badge>
+          ) : null}
           <VirtualMachineResources vm={item} />
         </HStack>
+        <VirtualMachineUsage usage={item.Usage} />
       </VStack>
       <VStack
         flex={1}
@@ -156,6 +207,24 @@ const VirtualMachines = () => {
             renderItem={renderVirtualMachine}
           />
         )}
+
+        <ListHeader
+          title="Containers"
+          description={`${containers.length} running`}
+          info="Resource usage of the SPR and plugin containers"
+        />
+        {containers.length === 0 ? (
+          <Box p="$4">
+            <Text color="$muted500">No container usage available.</Text>
+          </Box>
+        ) : (
+          <FlatList
+            data={containers}
+            keyExtractor={(item) => item.ID}
+            estimatedItemSize={88}
+            renderItem={renderVirtualMachine}
+          />
+        )}
       </VStack>
     </ScrollView>
   )
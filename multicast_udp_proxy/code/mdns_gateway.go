@@ -0,0 +1,628 @@
+/*
+A DNS-SD aware gateway for mDNS.
+
+When enabled, mDNS is no longer relayed as a whole. Instead:
+  - Responses are cached per advertising device, and forwarded with only the
+    records of the services each interface is allowed to see.
+  - Queries are answered from the cache, on the interface of the querier.
+    When nothing is cached for an allowed service, the gateway asks the
+    interfaces of the advertising groups itself.
+
+Service policies allow a service type (_airplay._tcp) from devices in
+FromGroups to be seen by devices in ToGroups. An empty list matches any device.
+Host records (A, AAAA) are visible when an allowed service points to them.
+
+Limitations
+- The tags of the mdns multicast address do not apply, the policies replace them
+- Wireguard peers are not served by the gateway
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type MDNSServicePolicy struct {
+	Service    string   //service type, _airplay._tcp
+	FromGroups []string //groups of the devices advertising the service
+	ToGroups   []string //groups of the devices that may discover it
+	Disabled   bool
+}
+
+type MDNSGatewaySettings struct {
+	Enabled  bool
+	Policies []MDNSServicePolicy
+}
+
+const mdnsServicesName = "_services._dns-sd._udp.local."
+
+// cached records and queries sent by the gateway are bounded
+const mdnsCacheLimit = 4096
+const mdnsQueryInterval = 10 * time.Second
+
+// RFC 6762 6.7, legacy unicast responses use a short ttl
+const mdnsLegacyTTL = 10
+
+type mdnsCacheEntry struct {
+	resource dnsmessage.Resource
+	service  string //empty for host records
+	owner    string //source address of the advertising device
+	expires  time.Time
+}
+
+type mdnsGateway struct {
+	settings           MDNSGatewaySettings
+	group              *net.UDPAddr
+	relayableInterface func(string) bool
+	cache              map[string]*mdnsCacheEntry
+	queried            map[string]time.Time
+}
+
+// per packet view of the devices, sources are resolved once
+type mdnsDevices struct {
+	devices  map[string]DeviceEntry
+	ifaceMap map[string]string
+	resolved map[string]*DeviceEntry
+}
+
+func newMDNSGateway(settings MDNSGatewaySettings, group *net.UDPAddr, relayableInterface func(string) bool) *mdnsGateway {
+	return &mdnsGateway{
+		settings:           settings,
+		group:              group,
+		relayableInterface: relayableInterface,
+		cache:              map[string]*mdnsCacheEntry{},
+		queried:            map[string]time.Time{},
+	}
+}
+
+func (d *mdnsDevices) lookup(srcIP string) (DeviceEntry, bool) {
+	if device, exists := d.resolved[srcIP]; exists {
+		if device == nil {
+			return DeviceEntry{}, false
+		}
+		return *device, true
+	}
+
+	device, found := lookupDevice(d.devices, srcIP)
+	if found {
+		d.resolved[srcIP] = &device
+	} else {
+		d.resolved[srcIP] = nil
+	}
+	return device, found
+}
+
+// mdnsServiceOf returns the service type of a DNS-SD name,
+// _airplay._tcp for "Living Room._airplay._tcp.local."
+func mdnsServiceOf(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	if len(labels) < 3 || labels[len(labels)-1] != "local" {
+		return ""
+	}
+
+	proto := labels[len(labels)-2]
+	service := labels[len(labels)-3]
+	if (proto != "_tcp" && proto != "_udp") || !strings.HasPrefix(service, "_") {
+		return ""
+	}
+	return service + "." + proto
+}
+
+func mdnsRecordService(resource dnsmessage.Resource) string {
+	name := resource.Header.Name.String()
+	if ptr, ok := resource.Body.(*dnsmessage.PTRResource); ok && strings.EqualFold(name, mdnsServicesName) {
+		//service enumeration carries the type in the record data
+		return mdnsServiceOf(ptr.PTR.String())
+	}
+	return mdnsServiceOf(name)
+}
+
+// only the records needed for discovery are cached and forwarded
+func mdnsSupported(resource dnsmessage.Resource) bool {
+	switch resource.Body.(type) {
+	case *dnsmessage.AResource, *dnsmessage.AAAAResource:
+		return true
+	case *dnsmessage.PTRResource, *dnsmessage.SRVResource, *dnsmessage.TXTResource:
+		return mdnsRecordService(resource) != ""
+	}
+	return false
+}
+
+func mdnsIsHostRecord(resource dnsmessage.Resource) bool {
+	switch resource.Body.(type) {
+	case *dnsmessage.AResource, *dnsmessage.AAAAResource:
+		return true
+	}
+	return false
+}
+
+func mdnsRecordKey(owner string, resource dnsmessage.Resource) string {
+	return owner + "|" + strings.ToLower(resource.Header.Name.String()) + "|" +
+		resource.Header.Type.String() + "|" + resource.Body.GoString()
+}
+
+func groupsAllow(groups []string, device DeviceEntry, known bool) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	if !known {
+		return false
+	}
+	for _, group := range groups {
+		for _, deviceGroup := range device.Groups {
+			if group == deviceGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *mdnsGateway) servicePolicies(service string) []MDNSServicePolicy {
+	policies := []MDNSServicePolicy{}
+	for _, policy := range g.settings.Policies {
+		if !policy.Disabled && strings.EqualFold(policy.Service, service) {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// serviceAllowed checks if a service of owner may be seen by querier
+func (g *mdnsGateway) serviceAllowed(service string, owner DeviceEntry, ownerKnown bool, querier DeviceEntry, querierKnown bool) bool {
+	for _, policy := range g.servicePolicies(service) {
+		if groupsAllow(policy.FromGroups, owner, ownerKnown) && groupsAllow(policy.ToGroups, querier, querierKnown) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *mdnsGateway) relayableInterfaces() []net.Interface {
+	relayable := []net.Interface{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Println("failed net interfaces")
+		return relayable
+	}
+	for _, iface := range ifaces {
+		if iface.Name != WireGuardInterface && g.relayableInterface(iface.Name) {
+			relayable = append(relayable, iface)
+		}
+	}
+	return relayable
+}
+
+// groupInterfaces returns the interfaces with devices in groups,
+// or every relayable interface when groups is empty
+func (g *mdnsGateway) groupInterfaces(groups []string, devices *mdnsDevices, ifaces map[string]bool) {
+	if len(groups) == 0 {
+		for _, iface := range g.relayableInterfaces() {
+			ifaces[iface.Name] = true
+		}
+		return
+	}
+
+	for _, device := range devices.devices {
+		if device.RecentIP == "" || !groupsAllow(groups, device, true) {
+			continue
+		}
+		ifaceName, exists := devices.ifaceMap[device.RecentIP]
+		if exists && ifaceName != WireGuardInterface && g.relayableInterface(ifaceName) {
+			ifaces[ifaceName] = true
+		}
+	}
+}
+
+func (g *mdnsGateway) expire(now time.Time) {
+	for key, entry := range g.cache {
+		if now.After(entry.expires) {
+			delete(g.cache, key)
+		}
+	}
+	for key, queried := range g.queried {
+		if now.Sub(queried) > mdnsQueryInterval {
+			delete(g.queried, key)
+		}
+	}
+}
+
+func (g *mdnsGateway) handlePacket(conn multicastConn, ingress *net.Interface, peer *net.UDPAddr, data []byte) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(data)
+	if err != nil {
+		return
+	}
+
+	devices := &mdnsDevices{resolved: map[string]*DeviceEntry{}}
+	devices.devices, err = APIDevices()
+	if err != nil {
+		devices.devices = map[string]DeviceEntry{}
+	}
+	devices.ifaceMap, err = IPIfaceMap()
+	if err != nil {
+		devices.ifaceMap = map[string]string{}
+	}
+
+	now := time.Now()
+	g.expire(now)
+
+	if header.Response {
+		//responses are sent from the mdns port, RFC 6762 6
+		if peer.Port != g.group.Port {
+			return
+		}
+		g.handleResponse(conn, ingress, peer, &parser, devices, now)
+	} else {
+		g.handleQuery(conn, ingress, peer, header, &parser, devices, now)
+	}
+}
+
+func parseResources(parser *dnsmessage.Parser) []dnsmessage.Resource {
+	resources := []dnsmessage.Resource{}
+	if parser.SkipAllQuestions() != nil {
+		return resources
+	}
+
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return resources
+	}
+	resources = append(resources, answers...)
+
+	if parser.SkipAllAuthorities() != nil {
+		return resources
+	}
+
+	additionals, _ := parser.AllAdditionals()
+	return append(resources, additionals...)
+}
+
+func (g *mdnsGateway) handleResponse(conn multicastConn, ingress *net.Interface, peer *net.UDPAddr, parser *dnsmessage.Parser, devices *mdnsDevices, now time.Time) {
+	owner := peer.IP.String()
+	ownerDevice, ownerKnown := devices.lookup(owner)
+
+	resources := []dnsmessage.Resource{}
+	services := map[string]bool{}
+
+	for _, resource := range parseResources(parser) {
+		if !mdnsSupported(resource) {
+			continue
+		}
+		resources = append(resources, resource)
+
+		service := mdnsRecordService(resource)
+		if service != "" {
+			services[service] = true
+		}
+
+		key := mdnsRecordKey(owner, resource)
+		if resource.Header.TTL == 0 {
+			//goodbye packet
+			delete(g.cache, key)
+			continue
+		}
+
+		if _, exists := g.cache[key]; !exists && len(g.cache) >= mdnsCacheLimit {
+			continue
+		}
+		g.cache[key] = &mdnsCacheEntry{
+			resource: resource,
+			service:  service,
+			owner:    owner,
+			expires:  now.Add(time.Duration(resource.Header.TTL) * time.Second),
+		}
+	}
+
+	//interfaces that may see each service of this device
+	ifaceServices := map[string]map[string]bool{}
+	for service := range services {
+		ifaces := map[string]bool{}
+		for _, policy := range g.servicePolicies(service) {
+			if groupsAllow(policy.FromGroups, ownerDevice, ownerKnown) {
+				g.groupInterfaces(policy.ToGroups, devices, ifaces)
+			}
+		}
+
+		for ifaceName := range ifaces {
+			if ifaceServices[ifaceName] == nil {
+				ifaceServices[ifaceName] = map[string]bool{}
+			}
+			ifaceServices[ifaceName][service] = true
+		}
+	}
+
+	//the ingress interface is included, devices there only hear each
+	//other through the gateway
+	for ifaceName, allowed := range ifaceServices {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			continue
+		}
+
+		packet, err := buildMDNSResponse(0, nil, filterResources(resources, allowed), nil, false)
+		if err != nil {
+			continue
+		}
+
+		if debug {
+			fmt.Println("mdns gateway forwarding", owner, "to", ifaceName)
+		}
+
+		//keep the original source, as the relay does
+		if _, err = conn.WriteTo(packet, iface.Index, peer.IP, g.group); err != nil {
+			fmt.Println("mdns gateway failed to write on", ifaceName, ":", err)
+		}
+	}
+}
+
+// filterResources keeps the records of allowed services, and the host
+// records their SRV records point to
+func filterResources(resources []dnsmessage.Resource, allowed map[string]bool) []dnsmessage.Resource {
+	targets := map[string]bool{}
+	for _, resource := range resources {
+		if srv, ok := resource.Body.(*dnsmessage.SRVResource); ok && allowed[mdnsRecordService(resource)] {
+			targets[strings.ToLower(srv.Target.String())] = true
+		}
+	}
+
+	filtered := []dnsmessage.Resource{}
+	for _, resource := range resources {
+		if mdnsIsHostRecord(resource) {
+			if targets[strings.ToLower(resource.Header.Name.String())] {
+				filtered = append(filtered, resource)
+			}
+		} else if allowed[mdnsRecordService(resource)] {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
+
+// entryAllowed checks a cached record against the policies for querier.
+// Host records need an allowed SRV record of the same device pointing to them.
+func (g *mdnsGateway) entryAllowed(entry *mdnsCacheEntry, devices *mdnsDevices, querier DeviceEntry, querierKnown bool) bool {
+	owner, ownerKnown := devices.lookup(entry.owner)
+
+	if entry.service != "" {
+		return g.serviceAllowed(entry.service, owner, ownerKnown, querier, querierKnown)
+	}
+
+	name := entry.resource.Header.Name.String()
+	for _, other := range g.cache {
+		srv, ok := other.resource.Body.(*dnsmessage.SRVResource)
+		if ok && other.owner == entry.owner && strings.EqualFold(srv.Target.String(), name) &&
+			g.serviceAllowed(other.service, owner, ownerKnown, querier, querierKnown) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedRecords returns the allowed cached records for name and type
+func (g *mdnsGateway) cachedRecords(name string, qtype dnsmessage.Type, querierIP string, devices *mdnsDevices, querier DeviceEntry, querierKnown bool) []*mdnsCacheEntry {
+	entries := []*mdnsCacheEntry{}
+	for _, entry := range g.cache {
+		if entry.owner == querierIP || !strings.EqualFold(entry.resource.Header.Name.String(), name) {
+			continue
+		}
+		if qtype != dnsmessage.TypeALL && entry.resource.Header.Type != qtype {
+			continue
+		}
+		if g.entryAllowed(entry, devices, querier, querierKnown) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (g *mdnsGateway) handleQuery(conn multicastConn, ingress *net.Interface, peer *net.UDPAddr, header dnsmessage.Header, parser *dnsmessage.Parser, devices *mdnsDevices, now time.Time) {
+	questions, err := parser.AllQuestions()
+	if err != nil || len(questions) == 0 {
+		return
+	}
+
+	querierIP := peer.IP.String()
+	querier, querierKnown := devices.lookup(querierIP)
+
+	answers := []dnsmessage.Resource{}
+	additionals := []dnsmessage.Resource{}
+	seen := map[string]bool{}
+	missing := map[string]bool{}
+	unicast := true
+
+	add := func(list *[]dnsmessage.Resource, entry *mdnsCacheEntry) {
+		key := mdnsRecordKey(entry.owner, entry.resource)
+		if !seen[key] {
+			seen[key] = true
+			//answer with the remaining ttl
+			resource := entry.resource
+			resource.Header.TTL = uint32(entry.expires.Sub(now) / time.Second)
+			if resource.Header.TTL == 0 {
+				resource.Header.TTL = 1
+			}
+			*list = append(*list, resource)
+		}
+	}
+
+	for _, question := range questions {
+		//the top bit of the class asks for a unicast response
+		if question.Class&(1<<15) == 0 {
+			unicast = false
+		}
+
+		name := question.Name.String()
+		entries := g.cachedRecords(name, question.Type, querierIP, devices, querier, querierKnown)
+
+		service := mdnsServiceOf(name)
+		if len(entries) == 0 && question.Type == dnsmessage.TypePTR && service != "" && !strings.EqualFold(name, mdnsServicesName) {
+			missing[service] = true
+		}
+
+		for _, entry := range entries {
+			add(&answers, entry)
+
+			//DNS-SD additional records, RFC 6763 12
+			switch body := entry.resource.Body.(type) {
+			case *dnsmessage.PTRResource:
+				for _, extra := range g.cachedRecords(body.PTR.String(), dnsmessage.TypeALL, querierIP, devices, querier, querierKnown) {
+					add(&additionals, extra)
+					if srv, ok := extra.resource.Body.(*dnsmessage.SRVResource); ok {
+						for _, host := range g.cachedRecords(srv.Target.String(), dnsmessage.TypeALL, querierIP, devices, querier, querierKnown) {
+							add(&additionals, host)
+						}
+					}
+				}
+			case *dnsmessage.SRVResource:
+				for _, host := range g.cachedRecords(body.Target.String(), dnsmessage.TypeALL, querierIP, devices, querier, querierKnown) {
+					add(&additionals, host)
+				}
+			}
+		}
+	}
+
+	if len(answers) != 0 {
+		g.answer(conn, ingress, peer, header, questions, answers, additionals, unicast)
+	}
+
+	for service := range missing {
+		g.queryService(conn, service, devices, querier, querierKnown, now)
+	}
+}
+
+func (g *mdnsGateway) answer(conn multicastConn, ingress *net.Interface, peer *net.UDPAddr, header dnsmessage.Header, questions []dnsmessage.Question, answers []dnsmessage.Resource, additionals []dnsmessage.Resource, unicast bool) {
+	var err error
+	var packet []byte
+	destination := g.group
+
+	if peer.Port != g.group.Port {
+		//legacy unicast query, the response echoes the id and the questions
+		packet, err = buildMDNSResponse(header.ID, questions, answers, additionals, true)
+		destination = peer
+	} else {
+		packet, err = buildMDNSResponse(0, nil, answers, additionals, false)
+		if unicast {
+			destination = peer
+		}
+	}
+
+	if err != nil {
+		fmt.Println("mdns gateway failed to build response", err)
+		return
+	}
+
+	if debug {
+		fmt.Println("mdns gateway answering", peer, "with", len(answers), "records")
+	}
+
+	if _, err = conn.WriteTo(packet, ingress.Index, nil, destination); err != nil {
+		fmt.Println("mdns gateway failed to answer on", ingress.Name, ":", err)
+	}
+}
+
+// queryService asks the interfaces of the advertising groups for a service.
+// The responses are cached and forwarded by handleResponse.
+func (g *mdnsGateway) queryService(conn multicastConn, service string, devices *mdnsDevices, querier DeviceEntry, querierKnown bool, now time.Time) {
+	if _, recent := g.queried[service]; recent {
+		return
+	}
+
+	ifaces := map[string]bool{}
+	for _, policy := range g.servicePolicies(service) {
+		if groupsAllow(policy.ToGroups, querier, querierKnown) {
+			g.groupInterfaces(policy.FromGroups, devices, ifaces)
+		}
+	}
+	if len(ifaces) == 0 {
+		return
+	}
+	g.queried[service] = now
+
+	name, err := dnsmessage.NewName(service + ".local.")
+	if err != nil {
+		return
+	}
+	question := dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	builder.EnableCompression()
+	if builder.StartQuestions() != nil || builder.Question(question) != nil {
+		return
+	}
+	packet, err := builder.Finish()
+	if err != nil {
+		return
+	}
+
+	for ifaceName := range ifaces {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			continue
+		}
+		if _, err = conn.WriteTo(packet, iface.Index, nil, g.group); err != nil {
+			fmt.Println("mdns gateway failed to query on", ifaceName, ":", err)
+		}
+	}
+}
+
+func addResource(builder *dnsmessage.Builder, resource dnsmessage.Resource) error {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return builder.AResource(resource.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return builder.AAAAResource(resource.Header, *body)
+	case *dnsmessage.PTRResource:
+		return builder.PTRResource(resource.Header, *body)
+	case *dnsmessage.SRVResource:
+		return builder.SRVResource(resource.Header, *body)
+	case *dnsmessage.TXTResource:
+		return builder.TXTResource(resource.Header, *body)
+	}
+	return errors.New("unsupported record type " + resource.Header.Type.String())
+}
+
+func buildMDNSResponse(id uint16, questions []dnsmessage.Question, answers []dnsmessage.Resource, additionals []dnsmessage.Resource, legacy bool) ([]byte, error) {
+	if len(answers) == 0 {
+		return nil, errors.New("no records")
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	builder.EnableCompression()
+
+	err := builder.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	for _, question := range questions {
+		if err = builder.Question(question); err != nil {
+			return nil, err
+		}
+	}
+
+	sections := []func() error{builder.StartAnswers, builder.StartAdditionals}
+	for i, resources := range [][]dnsmessage.Resource{answers, additionals} {
+		if err = sections[i](); err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			if legacy {
+				//no cache flush bit and a short ttl for legacy resolvers
+				resource.Header.Class &^= 1 << 15
+				if resource.Header.TTL > mdnsLegacyTTL {
+					resource.Header.TTL = mdnsLegacyTTL
+				}
+			}
+			if err = addResource(&builder, resource); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return builder.Finish()
+}
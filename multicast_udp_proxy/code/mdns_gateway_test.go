@@ -0,0 +1,447 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type mdnsWrite struct {
+	packet  []byte
+	ifIndex int
+	src     net.IP
+	dst     net.Addr
+}
+
+// records what the gateway sends
+type fakeMulticastConn struct {
+	writes []mdnsWrite
+}
+
+func (c *fakeMulticastConn) JoinGroup(ifi *net.Interface, group net.Addr) error {
+	return nil
+}
+
+func (c *fakeMulticastConn) ReadFrom(b []byte) (int, int, *net.UDPAddr, error) {
+	return 0, 0, nil, net.ErrClosed
+}
+
+func (c *fakeMulticastConn) WriteTo(b []byte, ifIndex int, src net.IP, dst net.Addr) (int, error) {
+	c.writes = append(c.writes, mdnsWrite{append([]byte{}, b...), ifIndex, src, dst})
+	return len(b), nil
+}
+
+const (
+	testOwnerIP   = "192.168.2.10"
+	testKidIP     = "192.168.2.14"
+	testParentIP  = "192.168.2.18"
+	testUnknownIP = "192.168.2.22"
+)
+
+var testMDNSGroup = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+
+func testName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(name)
+}
+
+func testPTR(name string, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testName(name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 4500},
+		Body:   &dnsmessage.PTRResource{PTR: testName(target)},
+	}
+}
+
+func testSRV(name string, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | 1<<15, TTL: 120},
+		Body:   &dnsmessage.SRVResource{Port: 7000, Target: testName(target)},
+	}
+}
+
+func testTXT(name string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testName(name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | 1<<15, TTL: 4500},
+		Body:   &dnsmessage.TXTResource{TXT: []string{"model=AppleTV"}},
+	}
+}
+
+func testA(name string, ip string) dnsmessage.Resource {
+	a := dnsmessage.AResource{}
+	copy(a.A[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | 1<<15, TTL: 120},
+		Body:   &a,
+	}
+}
+
+// an apple tv advertising airplay, and a printer on the same device
+func testAirplayRecords() []dnsmessage.Resource {
+	return []dnsmessage.Resource{
+		testPTR("_airplay._tcp.local.", "Living Room._airplay._tcp.local."),
+		testSRV("Living Room._airplay._tcp.local.", "appletv.local."),
+		testTXT("Living Room._airplay._tcp.local."),
+		testA("appletv.local.", testOwnerIP),
+		testPTR("_ipp._tcp.local.", "Office._ipp._tcp.local."),
+		testSRV("Office._ipp._tcp.local.", "printer.local."),
+		testA("printer.local.", testOwnerIP),
+	}
+}
+
+func testMDNSDevices() *mdnsDevices {
+	owner := DeviceEntry{Name: "appletv", RecentIP: testOwnerIP, Groups: []string{"media"}}
+	kid := DeviceEntry{Name: "tablet", RecentIP: testKidIP, Groups: []string{"kids"}}
+	parent := DeviceEntry{Name: "phone", RecentIP: testParentIP, Groups: []string{"parents"}}
+	return &mdnsDevices{
+		devices:  map[string]DeviceEntry{"owner": owner, "kid": kid, "parent": parent},
+		ifaceMap: map[string]string{testOwnerIP: "lo", testKidIP: "lo", testParentIP: "lo"},
+		resolved: map[string]*DeviceEntry{testOwnerIP: &owner, testKidIP: &kid, testParentIP: &parent, testUnknownIP: nil},
+	}
+}
+
+func testMDNSGateway(relayable bool) *mdnsGateway {
+	settings := MDNSGatewaySettings{
+		Enabled: true,
+		Policies: []MDNSServicePolicy{
+			{Service: "_airplay._tcp", FromGroups: []string{"media"}, ToGroups: []string{"parents", "kids"}},
+			{Service: "_ipp._tcp", FromGroups: []string{"media"}, ToGroups: []string{"parents"}},
+			{Service: "_ipp._tcp", ToGroups: []string{"kids"}, Disabled: true},
+		},
+	}
+	return newMDNSGateway(settings, testMDNSGroup, func(name string) bool { return relayable })
+}
+
+func cacheRecords(g *mdnsGateway, owner string, resources []dnsmessage.Resource, now time.Time) {
+	for _, resource := range resources {
+		g.cache[mdnsRecordKey(owner, resource)] = &mdnsCacheEntry{
+			resource: resource,
+			service:  mdnsRecordService(resource),
+			owner:    owner,
+			expires:  now.Add(time.Duration(resource.Header.TTL) * time.Second),
+		}
+	}
+}
+
+func resourceNames(resources []dnsmessage.Resource) []string {
+	names := []string{}
+	for _, resource := range resources {
+		names = append(names, resource.Header.Type.String()+" "+resource.Header.Name.String())
+	}
+	return names
+}
+
+func parseMDNSPacket(t *testing.T, packet []byte) (dnsmessage.Header, []dnsmessage.Question, []dnsmessage.Resource, []dnsmessage.Resource) {
+	t.Helper()
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = parser.SkipAllAuthorities(); err != nil {
+		t.Fatal(err)
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, questions, answers, additionals
+}
+
+func TestFilterResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed map[string]bool
+		want    []string
+	}{
+		{
+			name:    "service with its host",
+			allowed: map[string]bool{"_airplay._tcp": true},
+			want: []string{
+				"TypePTR _airplay._tcp.local.",
+				"TypeSRV Living Room._airplay._tcp.local.",
+				"TypeTXT Living Room._airplay._tcp.local.",
+				"TypeA appletv.local.",
+			},
+		},
+		{
+			name:    "every service",
+			allowed: map[string]bool{"_airplay._tcp": true, "_ipp._tcp": true},
+			want: []string{
+				"TypePTR _airplay._tcp.local.",
+				"TypeSRV Living Room._airplay._tcp.local.",
+				"TypeTXT Living Room._airplay._tcp.local.",
+				"TypeA appletv.local.",
+				"TypePTR _ipp._tcp.local.",
+				"TypeSRV Office._ipp._tcp.local.",
+				"TypeA printer.local.",
+			},
+		},
+		{
+			name:    "nothing allowed",
+			allowed: map[string]bool{},
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		got := resourceNames(filterResources(testAirplayRecords(), tt.allowed))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntryAllowed(t *testing.T) {
+	now := time.Now()
+	g := testMDNSGateway(false)
+	cacheRecords(g, testOwnerIP, testAirplayRecords(), now)
+	//another device pointing at the same host name
+	cacheRecords(g, testUnknownIP, []dnsmessage.Resource{testSRV("Other._ipp._tcp.local.", "appletv.local.")}, now)
+	devices := testMDNSDevices()
+
+	entry := func(owner string, resource dnsmessage.Resource) *mdnsCacheEntry {
+		return g.cache[mdnsRecordKey(owner, resource)]
+	}
+	records := testAirplayRecords()
+
+	tests := []struct {
+		name    string
+		entry   *mdnsCacheEntry
+		querier string
+		allowed bool
+	}{
+		{"service to an allowed group", entry(testOwnerIP, records[1]), testKidIP, true},
+		{"service to another allowed group", entry(testOwnerIP, records[5]), testParentIP, true},
+		{"disabled policy does not apply", entry(testOwnerIP, records[5]), testKidIP, false},
+		{"unknown querier", entry(testOwnerIP, records[1]), testUnknownIP, false},
+		{"host of an allowed service", entry(testOwnerIP, records[3]), testKidIP, true},
+		{"host only of a denied service", entry(testOwnerIP, records[6]), testKidIP, false},
+		{"host of an allowed service of the same device only", entry(testOwnerIP, records[6]), testParentIP, true},
+	}
+
+	for _, tt := range tests {
+		if tt.entry == nil {
+			t.Fatalf("%s: record was not cached", tt.name)
+		}
+		querier, known := devices.lookup(tt.querier)
+		if got := g.entryAllowed(tt.entry, devices, querier, known); got != tt.allowed {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+
+	//an unknown owner is not in the media group
+	unknownSRV := entry(testUnknownIP, testSRV("Other._ipp._tcp.local.", "appletv.local."))
+	parent, _ := devices.lookup(testParentIP)
+	if g.entryAllowed(unknownSRV, devices, parent, true) {
+		t.Error("service of an unknown owner was allowed")
+	}
+}
+
+func buildTestQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type, class dnsmessage.Class) ([]byte, dnsmessage.Question) {
+	t.Helper()
+	question := dnsmessage.Question{Name: testName(name), Type: qtype, Class: class}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	if err := builder.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Question(question); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet, question
+}
+
+func TestHandleQueryAdditionals(t *testing.T) {
+	ingress := &net.Interface{Index: 7, Name: "wlan0"}
+
+	tests := []struct {
+		name        string
+		querier     string
+		qname       string
+		qtype       dnsmessage.Type
+		answers     []string
+		additionals []string
+	}{
+		{
+			name:        "browse adds the instance and its host",
+			querier:     testKidIP,
+			qname:       "_airplay._tcp.local.",
+			qtype:       dnsmessage.TypePTR,
+			answers:     []string{"TypePTR _airplay._tcp.local."},
+			additionals: []string{"TypeA appletv.local.", "TypeSRV Living Room._airplay._tcp.local.", "TypeTXT Living Room._airplay._tcp.local."},
+		},
+		{
+			name:        "resolve adds the host",
+			querier:     testKidIP,
+			qname:       "Living Room._airplay._tcp.local.",
+			qtype:       dnsmessage.TypeSRV,
+			answers:     []string{"TypeSRV Living Room._airplay._tcp.local."},
+			additionals: []string{"TypeA appletv.local."},
+		},
+		{
+			name:    "denied service is not answered",
+			querier: testKidIP,
+			qname:   "_ipp._tcp.local.",
+			qtype:   dnsmessage.TypePTR,
+		},
+		{
+			name:    "the owner is not answered with its own records",
+			querier: testOwnerIP,
+			qname:   "_airplay._tcp.local.",
+			qtype:   dnsmessage.TypePTR,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			g := testMDNSGateway(false)
+			cacheRecords(g, testOwnerIP, testAirplayRecords(), now)
+			conn := &fakeMulticastConn{}
+
+			data, _ := buildTestQuery(t, 0, tt.qname, tt.qtype, dnsmessage.ClassINET)
+			var parser dnsmessage.Parser
+			header, err := parser.Start(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer := &net.UDPAddr{IP: net.ParseIP(tt.querier), Port: 5353}
+			g.handleQuery(conn, ingress, peer, header, &parser, testMDNSDevices(), now)
+
+			if len(tt.answers) == 0 {
+				if len(conn.writes) != 0 {
+					t.Fatalf("unexpected answer %+v", conn.writes)
+				}
+				return
+			}
+			if len(conn.writes) != 1 {
+				t.Fatalf("expected one answer, got %d", len(conn.writes))
+			}
+
+			write := conn.writes[0]
+			if write.ifIndex != ingress.Index || write.dst.String() != testMDNSGroup.String() {
+				t.Errorf("answered on %d to %v", write.ifIndex, write.dst)
+			}
+
+			_, _, answers, additionals := parseMDNSPacket(t, write.packet)
+			if got := resourceNames(answers); !reflect.DeepEqual(got, tt.answers) {
+				t.Errorf("got answers %v, want %v", got, tt.answers)
+			}
+			got := resourceNames(additionals)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.additionals) {
+				t.Errorf("got additionals %v, want %v", got, tt.additionals)
+			}
+		})
+	}
+}
+
+func TestBuildMDNSResponseLegacy(t *testing.T) {
+	_, question := buildTestQuery(t, 0x4242, "Living Room._airplay._tcp.local.", dnsmessage.TypeSRV, dnsmessage.ClassINET)
+	answers := []dnsmessage.Resource{testSRV("Living Room._airplay._tcp.local.", "appletv.local.")}
+	additionals := []dnsmessage.Resource{testA("appletv.local.", testOwnerIP)}
+
+	tests := []struct {
+		name      string
+		legacy    bool
+		id        uint16
+		questions int
+		class     dnsmessage.Class
+		ttl       uint32
+	}{
+		{"legacy unicast", true, 0x4242, 1, dnsmessage.ClassINET, mdnsLegacyTTL},
+		{"multicast", false, 0, 0, dnsmessage.ClassINET | 1<<15, 120},
+	}
+
+	for _, tt := range tests {
+		questions := []dnsmessage.Question{}
+		if tt.legacy {
+			questions = append(questions, question)
+		}
+		packet, err := buildMDNSResponse(tt.id, questions, answers, additionals, tt.legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, parsedQuestions, parsedAnswers, parsedAdditionals := parseMDNSPacket(t, packet)
+		if header.ID != tt.id || !header.Response || !header.Authoritative || len(parsedQuestions) != tt.questions {
+			t.Errorf("%s: unexpected header %+v with %d questions", tt.name, header, len(parsedQuestions))
+		}
+		for _, resource := range append(parsedAnswers, parsedAdditionals...) {
+			if resource.Header.Class != tt.class || resource.Header.TTL != tt.ttl {
+				t.Errorf("%s: %s has class %v ttl %d", tt.name, resource.Header.Name, resource.Header.Class, resource.Header.TTL)
+			}
+		}
+	}
+
+	//the records passed in are left alone
+	if answers[0].Header.TTL != 120 || answers[0].Header.Class&(1<<15) == 0 {
+		t.Error("legacy response modified the records")
+	}
+
+	if _, err := buildMDNSResponse(0, nil, nil, nil, false); err == nil {
+		t.Error("expected an error without records")
+	}
+}
+
+func TestHandleResponseForwardsToIngress(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+
+	g := testMDNSGateway(true)
+	conn := &fakeMulticastConn{}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	if err = builder.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range testAirplayRecords() {
+		if err = addResource(&builder, resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parser dnsmessage.Parser
+	if _, err = parser.Start(data); err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.UDPAddr{IP: net.ParseIP(testOwnerIP), Port: 5353}
+	//the kids and parents are on the interface the response arrived on
+	g.handleResponse(conn, loopback, peer, &parser, testMDNSDevices(), time.Now())
+
+	if len(g.cache) != len(testAirplayRecords()) {
+		t.Errorf("cached %d records", len(g.cache))
+	}
+	if len(conn.writes) != 1 {
+		t.Fatalf("expected a forward on the ingress interface, got %d writes", len(conn.writes))
+	}
+
+	write := conn.writes[0]
+	if write.ifIndex != loopback.Index || !write.src.Equal(peer.IP) {
+		t.Errorf("forwarded on %d from %v", write.ifIndex, write.src)
+	}
+	_, _, answers, _ := parseMDNSPacket(t, write.packet)
+	if len(answers) != len(testAirplayRecords()) {
+		t.Errorf("forwarded %v", resourceNames(answers))
+	}
+}
@@ -14,9 +14,11 @@ Design:
 - MULTICAST_LOOP should be disabled to avoid infinite relaying.
 
 - Each service to be relayed currently runs as its own goroutine. The services are currently hardcoded
+- IPv6 groups ([ff02::fb]:5353, [ff02::c]:1900) are relayed the same way. The socket binds the port only,
+link-local groups can't be bound without a scope, so other destinations are dropped.
 
 Limitations
-- No IPv6 support
+- IPv6 is not relayed to wireguard peers, which are addressed by their IPv4 address
 - Currently has no concept of IGMP. This means that the router could be waking up wifi devices
 */
 package main
@@ -33,6 +35,7 @@ import (
 	"github.com/pion/mdns"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -61,6 +64,7 @@ type MulticastSettings struct {
 	Addresses            []MulticastAddress
 	DisableMDNSAdvertise bool
 	MDNSName             string
+	MDNSGateway          MDNSGatewaySettings
 }
 
 type DeviceEntry struct {
@@ -172,6 +176,54 @@ func NewIPv4UDPConn(addr *net.UDPAddr) (*net.UDPConn, error) {
 	return udpconn, nil
 }
 
+func NewIPv6UDPConn(addr *net.UDPAddr) (*net.UDPConn, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get a UDP socket: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "")
+	// net.FilePacketConn dups the FD, so we have to close this in any case.
+	defer f.Close()
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+		return nil, fmt.Errorf("cannot set v6only on socket: %v", err)
+	}
+
+	// Allow reusing the addr, the groups of a port share the bind
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, fmt.Errorf("cannot set reuseaddr on socket: %v", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+		return nil, fmt.Errorf("cannot set transparent on socket: %v", err)
+	}
+
+	// Disable MULTICAST LOOP
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_LOOP, 0); err != nil {
+		return nil, fmt.Errorf("cannot set multicast on socket: %v", err)
+	}
+
+	if addr.IP == nil || addr.IP.To4() != nil {
+		return nil, fmt.Errorf("wrong address family (expected v6) for %s", addr.IP)
+	}
+
+	// Bind to the port only, link-local groups need a scope to be bound
+	saddr := unix.SockaddrInet6{Port: addr.Port}
+	if err := unix.Bind(fd, &saddr); err != nil {
+		return nil, fmt.Errorf("cannot bind to port %d: %v", addr.Port, err)
+	}
+
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udpconn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, errors.New("BUG(??): incorrect socket type, expected UDP")
+	}
+	return udpconn, nil
+}
+
 func listenNewInterfaceUp(callback func(string)) {
 	lnkupdate := make(chan netlink.LinkUpdate)
 	lnkdone := make(chan struct{})
@@ -196,10 +248,86 @@ func listenNewInterfaceUp(callback func(string)) {
 	}
 }
 
+// multicastConn hides the address family of the relay socket
+type multicastConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	ReadFrom(b []byte) (int, int, *net.UDPAddr, error)
+	WriteTo(b []byte, ifIndex int, src net.IP, dst net.Addr) (int, error)
+}
+
 type listener4 struct {
 	*ipv4.PacketConn
 }
 
+func (l listener4) ReadFrom(b []byte) (int, int, *net.UDPAddr, error) {
+	n, cm, peer, err := l.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, 0, nil, err
+	}
+	if cm == nil {
+		return n, 0, nil, errors.New("missing control message")
+	}
+	return n, cm.IfIndex, peer.(*net.UDPAddr), nil
+}
+
+func (l listener4) WriteTo(b []byte, ifIndex int, src net.IP, dst net.Addr) (int, error) {
+	//set src as the original peer address. Note: requires IP_TRANSPARENT set on the socket
+	return l.PacketConn.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex, Src: src}, dst)
+}
+
+type listener6 struct {
+	*ipv6.PacketConn
+	group net.IP
+}
+
+func (l listener6) ReadFrom(b []byte) (int, int, *net.UDPAddr, error) {
+	for {
+		n, cm, peer, err := l.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, 0, nil, err
+		}
+		if cm == nil {
+			return n, 0, nil, errors.New("missing control message")
+		}
+		//the socket is bound to the port, skip other destinations
+		if !cm.Dst.Equal(l.group) {
+			continue
+		}
+		return n, cm.IfIndex, peer.(*net.UDPAddr), nil
+	}
+}
+
+func (l listener6) WriteTo(b []byte, ifIndex int, src net.IP, dst net.Addr) (int, error) {
+	//set src as the original peer address. Note: requires IPV6_TRANSPARENT set on the socket
+	return l.PacketConn.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex, Src: src}, dst)
+}
+
+func newMulticastConn(saddr *net.UDPAddr) (multicastConn, error) {
+	if saddr.IP.To4() == nil {
+		conn, err := NewIPv6UDPConn(saddr)
+		if err != nil {
+			return nil, err
+		}
+		l6 := listener6{PacketConn: ipv6.NewPacketConn(conn), group: saddr.IP}
+		err = l6.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true)
+		if err != nil {
+			return nil, fmt.Errorf("error set control message %v", err)
+		}
+		return l6, nil
+	}
+
+	conn, err := NewIPv4UDPConn(saddr)
+	if err != nil {
+		return nil, err
+	}
+	l4 := listener4{PacketConn: ipv4.NewPacketConn(conn)}
+	err = l4.SetControlMessage(ipv4.FlagInterface, true)
+	if err != nil {
+		return nil, fmt.Errorf("error set control message %v", err)
+	}
+	return l4, nil
+}
+
 func wireGuardDevice(peer wgtypes.Peer, devices map[string]DeviceEntry) (DeviceEntry, bool) {
 	publicKey := peer.PublicKey.String()
 	for _, device := range devices {
@@ -302,27 +430,24 @@ func currentWireGuardPeerDestinations(interfaceName string, devices map[string]D
 	return wireGuardPeerDestinations(device.Peers, devices, excludeSourceIP, tags), nil
 }
 
-func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool, tags []string) {
-	l4 := listener4{}
-
-	saddr, err := net.ResolveUDPAddr("udp4", s_saddr)
-	if err != nil {
-		fmt.Println("error", err)
+func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool, tags []string, gatewaySettings MDNSGatewaySettings) {
+	saddr, err := net.ResolveUDPAddr("udp", s_saddr)
+	if err != nil || saddr.IP == nil || !saddr.IP.IsMulticast() {
+		fmt.Println("error invalid multicast address", s_saddr, err)
 		return
 	}
 
-	conn, err := NewIPv4UDPConn(saddr)
+	isIPv6 := saddr.IP.To4() == nil
+
+	mconn, err := newMulticastConn(saddr)
 	if err != nil {
 		fmt.Println("error", err)
 		return
 	}
 
-	l4.PacketConn = ipv4.NewPacketConn(conn)
-
-	err = l4.SetControlMessage(ipv4.FlagInterface, true)
-	if err != nil {
-		fmt.Println("error set control message", err)
-		return
+	var gateway *mdnsGateway
+	if gatewaySettings.Enabled && saddr.Port == 5353 {
+		gateway = newMDNSGateway(gatewaySettings, saddr, relayableInterface)
 	}
 
 	foo := func(interfaceName string) {
@@ -333,7 +458,7 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 
 		//join multicast group
 		if relayableInterface(interfaceName) {
-			l4.JoinGroup(ief, saddr)
+			mconn.JoinGroup(ief, saddr)
 		} else {
 			if debug {
 				fmt.Println("not joining", interfaceName)
@@ -361,7 +486,7 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 
 	for {
 
-		n, oob, peer, err := l4.ReadFrom(buffer[0:])
+		n, ifIndex, peer, err := mconn.ReadFrom(buffer[0:])
 
 		if err != nil {
 			fmt.Println("error", err)
@@ -369,13 +494,13 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 		}
 
 		if debug {
-			fmt.Println("got conn and data", n, peer.String(), oob.IfIndex)
+			fmt.Println("got conn and data", n, peer.String(), ifIndex)
 		}
 
-		ingressInterface, err := net.InterfaceByIndex(oob.IfIndex)
+		ingressInterface, err := net.InterfaceByIndex(ifIndex)
 		if err != nil || !relayableInterface(ingressInterface.Name) {
 			if err != nil {
-				fmt.Println("got err for interface index", oob.IfIndex, err)
+				fmt.Println("got err for interface index", ifIndex, err)
 			} else {
 				if debug {
 					fmt.Println("dropping from interface not specified for relay", ingressInterface.Name)
@@ -385,14 +510,19 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 		}
 
 		//passive decode for device classification
-		queueZeroconf(peer.(*net.UDPAddr).IP.String(), saddr.Port, buffer[0:n])
+		queueZeroconf(peer.IP.String(), saddr.Port, buffer[0:n])
+
+		//the gateway answers and forwards mdns by service policy
+		if gateway != nil {
+			gateway.handlePacket(mconn, ingressInterface, peer, buffer[0:n])
+			continue
+		}
+
+		peerIP := peer.IP
 
 		//replay message out over idx
 		writeit := func(iface net.Interface, destination *net.UDPAddr) {
-			var woob *ipv4.ControlMessage
-			//set src as the original peer address. Note: requires IP_TRANSPARENT set on the socket
-			woob = &ipv4.ControlMessage{IfIndex: iface.Index, Src: peer.(*net.UDPAddr).IP}
-			if _, err = l4.WriteTo(buffer[0:n], woob, destination); err != nil {
+			if _, err = mconn.WriteTo(buffer[0:n], iface.Index, peerIP, destination); err != nil {
 
 				//NOTE: this will warn often about `required key not available`
 				//when sending to wireguard devices without the key
@@ -431,9 +561,13 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 
 			if relayableInterface(iface.Name) {
 				if iface.Name == WireGuardInterface {
+					//peers are only known by their ipv4 address
+					if isIPv6 {
+						continue
+					}
 					var excludeIP net.IP
 					if ingressInterface.Name == WireGuardInterface {
-						excludeIP = peer.(*net.UDPAddr).IP
+						excludeIP = peerIP
 					}
 					destinations, wgErr := currentWireGuardPeerDestinations(iface.Name, devices, excludeIP, tags)
 					if wgErr != nil {
@@ -443,7 +577,7 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 					for _, destinationIP := range destinations {
 						destination := &net.UDPAddr{IP: destinationIP, Port: saddr.Port}
 						if debug {
-							fmt.Println(n, peer.String(), " being relayed to wireguard peer -> ", destination)
+							fmt.Println(n, peerIP.String(), " being relayed to wireguard peer -> ", destination)
 						}
 						writeit(iface, destination)
 					}
@@ -467,7 +601,7 @@ func handleProxy(s_saddr string, relayableInterface func(ifaceName string) bool,
 				}
 
 				if debug {
-					fmt.Println(n, peer.String(), " being broadcast to -> ", iface.Name, iface.Index, n)
+					fmt.Println(n, peerIP.String(), " being broadcast to -> ", iface.Name, iface.Index, n)
 				}
 				writeit(iface, saddr)
 			}
@@ -614,15 +748,9 @@ func ensureIfaceTagged(ifaceMap map[string]string, devices map[string]DeviceEntr
 	for _, device := range devices {
 		if device.RecentIP != "" {
 			curIface, exists := ifaceMap[device.RecentIP]
-			if exists && curIface == ifaceName {
-				//check if the device tags intersect with the wanted tags
-				for _, wantedTag := range tags {
-					for _, currentTag := range device.DeviceTags {
-						if wantedTag == currentTag {
-							return true
-						}
-					}
-				}
+			//check if the device tags intersect with the wanted tags
+			if exists && curIface == ifaceName && deviceHasAnyTag(device, tags) {
+				return true
 			}
 		}
 	}
@@ -689,15 +817,19 @@ func main() {
 	if len(settings.Addresses) == 0 {
 		//run defaults
 		//mdns
-		go handleProxy("224.0.0.251:5353", relayableInterface, []string{})
+		go handleProxy("224.0.0.251:5353", relayableInterface, []string{}, settings.MDNSGateway)
+		go handleProxy("[ff02::fb]:5353", relayableInterface, []string{}, settings.MDNSGateway)
 
 		//ssdp
-		handleProxy("239.255.255.250:1900", relayableInterface, []string{})
+		go handleProxy("239.255.255.250:1900", relayableInterface, []string{}, settings.MDNSGateway)
+		go handleProxy("[ff02::c]:1900", relayableInterface, []string{}, settings.MDNSGateway)
+
+		select {}
 	} else {
 
 		for _, address := range settings.Addresses {
 			if address.Disabled == false {
-				go handleProxy(address.Address, relayableInterface, address.Tags)
+				go handleProxy(address.Address, relayableInterface, address.Tags, settings.MDNSGateway)
 			}
 		}
 
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+// listenLoopback6 returns a dual stack socket on a free port, wrapped the
+// way newMulticastConn wraps the relay socket of a group
+func listenLoopback6(t *testing.T, group net.IP) (listener6, int) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "[::]:0")
+	if err != nil {
+		t.Skip("no ipv6 socket:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	l6 := listener6{PacketConn: ipv6.NewPacketConn(conn), group: group}
+	if err := l6.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return l6, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func sendUDP(t *testing.T, dst string, payload string) {
+	t.Helper()
+	conn, err := net.Dial("udp", dst)
+	if err != nil {
+		t.Skip("cannot reach", dst, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListener6SkipsOtherDestinations(t *testing.T) {
+	l6, port := listenLoopback6(t, net.ParseIP("::1"))
+
+	//the bind is shared by all groups of a port, so the socket also
+	//receives datagrams for other destinations
+	sendUDP(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "other group")
+	sendUDP(t, net.JoinHostPort("::1", strconv.Itoa(port)), "this group")
+
+	buf := make([]byte, 64)
+	n, ifIndex, peer, err := l6.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "this group" {
+		t.Errorf("got %q, the datagram for another destination was relayed", buf[:n])
+	}
+	if peer == nil || !peer.IP.Equal(net.ParseIP("::1")) || ifIndex == 0 {
+		t.Errorf("unexpected peer %v on interface %d", peer, ifIndex)
+	}
+}
+
+func TestListener6ReadError(t *testing.T) {
+	l6, _ := listenLoopback6(t, net.ParseIP("ff02::fb"))
+	l6.PacketConn.SetReadDeadline(time.Now())
+
+	if _, _, _, err := l6.ReadFrom(make([]byte, 64)); err == nil {
+		t.Error("expected the read deadline to end the read")
+	}
+}
+
+func TestNewIPv6UDPConnSharesPort(t *testing.T) {
+	if _, err := NewIPv6UDPConn(&net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}); err == nil {
+		t.Error("expected an error for an ipv4 group")
+	}
+
+	probe, err := net.ListenPacket("udp6", "[::]:0")
+	if err != nil {
+		t.Skip("no ipv6 socket:", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	//mdns and ssdp groups on one port bind the same wildcard address
+	first, err := NewIPv6UDPConn(&net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: port})
+	if err != nil {
+		t.Skip("transparent sockets need CAP_NET_ADMIN:", err)
+	}
+	defer first.Close()
+
+	second, err := NewIPv6UDPConn(&net.UDPAddr{IP: net.ParseIP("ff02::c"), Port: port})
+	if err != nil {
+		t.Fatalf("second group on port %d: %v", port, err)
+	}
+	defer second.Close()
+
+	if addr := second.LocalAddr().(*net.UDPAddr); !addr.IP.IsUnspecified() || addr.Port != port {
+		t.Errorf("bound to %v", addr)
+	}
+}
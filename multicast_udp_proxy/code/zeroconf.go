@@ -10,10 +10,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"sort"
 	"strings"
 
 	sprbus "github.com/spr-networks/sprbus-json"
+	"github.com/vishvananda/netlink"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -152,20 +154,48 @@ func decodeSSDP(data []byte, zdev *ZeroconfDevice) {
 	}
 }
 
-func lookupDeviceMAC(srcIP string) string {
-	devices, err := APIDevices()
+// neighborMAC resolves an ipv6 source, usually link-local, with the neighbor table
+func neighborMAC(srcIP string) string {
+	ip := net.ParseIP(srcIP)
+	if ip == nil || ip.To4() != nil {
+		return ""
+	}
+
+	neighbors, err := netlink.NeighList(0, netlink.FAMILY_V6)
 	if err != nil {
 		return ""
 	}
 
-	for _, device := range devices {
-		if device.RecentIP == srcIP {
-			return device.MAC
+	for _, neighbor := range neighbors {
+		if neighbor.IP.Equal(ip) && len(neighbor.HardwareAddr) != 0 {
+			return neighbor.HardwareAddr.String()
 		}
 	}
 	return ""
 }
 
+// lookupDevice finds the device of an ipv4 or ipv6 source address
+func lookupDevice(devices map[string]DeviceEntry, srcIP string) (DeviceEntry, bool) {
+	mac := neighborMAC(srcIP)
+
+	for _, device := range devices {
+		if device.RecentIP == srcIP || (mac != "" && strings.EqualFold(device.MAC, mac)) {
+			return device, true
+		}
+	}
+	return DeviceEntry{}, false
+}
+
+func lookupDeviceMAC(srcIP string) string {
+	devices, err := APIDevices()
+	if err != nil {
+		return ""
+	}
+
+	device, _ := lookupDevice(devices, srcIP)
+	return device.MAC
+}
+
 func zeroconfKey(zdev ZeroconfDevice) string {
 	parts := append([]string{zdev.SrcIP}, zdev.Services...)
 	for key, value := range zdev.TXT {
@@ -23,9 +23,11 @@ type DNSRecord struct {
 	Bucket      string
 }
 
+// A and AAAA answers
 type ARecord struct {
-	A   string
-	Hdr Header
+	A    string
+	AAAA string
+	Hdr  Header
 }
 
 type Header struct {
@@ -69,16 +71,23 @@ func handleDnsEvent(topic string, value string) {
 		}
 
 		for _, a := range jsonData.A {
-			if a.Hdr.Class != 1 && a.Hdr.Class != 28 {
+			if a.Hdr.Rrtype != 1 && a.Hdr.Rrtype != 28 {
 				continue
 			}
-			if q.Name != "" && a.A != "" {
-				ip := net.ParseIP(a.A)
+			address := a.A
+			if a.Hdr.Rrtype == 28 {
+				address = a.AAAA
+			}
+			if q.Name != "" && address != "" {
+				ip := net.ParseIP(address)
 				if ip != nil {
+					//the canonical form matches net.IP.String() of packets
 					if ip.To4() != nil {
 						ips = append(ips, ip.To4().String())
-						ttls = append(ttls, a.Hdr.Ttl)
+					} else {
+						ips = append(ips, ip.String())
 					}
+					ttls = append(ttls, a.Hdr.Ttl)
 				}
 			}
 		}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandleDnsEventAAAA(t *testing.T) {
+	DNSCachemtx.Lock()
+	DNSCache = map[string]string{}
+	DNSCacheTime = map[string]time.Time{}
+	DNSCachemtx.Unlock()
+
+	//answers as the dns plugin publishes them
+	event := `{
+		"Q": [{"Name": "example.com.", "Qtype": 28, "Qclass": 1}],
+		"A": [
+			{"Hdr": {"Name": "example.com.", "Rrtype": 5, "Class": 1, "Ttl": 60}},
+			{"Hdr": {"Name": "example.com.", "Rrtype": 28, "Class": 1, "Ttl": 60}, "AAAA": "2001:0db8:0000::0001"},
+			{"Hdr": {"Name": "example.com.", "Rrtype": 1, "Class": 1, "Ttl": 60}, "A": "93.184.216.34"},
+			{"Hdr": {"Name": "example.com.", "Rrtype": 16, "Class": 1, "Ttl": 60}, "A": "10.0.0.1"}
+		]
+	}`
+	handleDnsEvent("dns:serve:", event)
+
+	DNSCachemtx.RLock()
+	defer DNSCachemtx.RUnlock()
+
+	//keys are in the form net.IP.String() gives for packets
+	want := map[string]string{"2001:db8::1": "example.com", "93.184.216.34": "example.com"}
+	if len(DNSCache) != len(want) {
+		t.Errorf("got cache %v, want %v", DNSCache, want)
+	}
+	for ip, domain := range want {
+		if DNSCache[ip] != domain {
+			t.Errorf("%s: got %q, want %q", ip, DNSCache[ip], domain)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+/*
+Flow summaries and per-topic sampling.
+
+With Aggregate set, packets are collapsed into one summary per flow
+(prefix, verdict and 5-tuple) and published on flow:<prefix> at the end of
+every window. Per-packet nft:<prefix> events are then only published for
+topics with a sampling rule, so drop logs can stay on at a reduced rate.
+
+Without a configuration every packet is published, as before.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	sprbus "github.com/spr-networks/sprbus-json"
+)
+
+var PacketLogsConfigFile = "/configs/base/packet_logs.json"
+
+const defaultFlowWindow = 60
+const maxFlowsPerWindow = 20000
+
+// publish one of every Rate packets on topics starting with Topic,
+// 0 publishes none and 1 every packet
+type TopicSampling struct {
+	Topic string
+	Rate  int
+}
+
+type PacketLogsConfig struct {
+	Aggregate      bool
+	WindowSeconds  int
+	PacketSampling []TopicSampling
+}
+
+type FlowKey struct {
+	Prefix   string
+	Action   string
+	Protocol string
+	SrcIP    string
+	DstIP    string
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+type FlowSummary struct {
+	FlowKey
+	InDev           string
+	OutDev          string
+	SrcMAC          string `json:",omitempty"`
+	RecentDomainSrc string `json:",omitempty"`
+	RecentDomainDst string `json:",omitempty"`
+	FirstSeen       time.Time
+	LastSeen        time.Time
+	Packets         uint64
+	Bytes           uint64
+}
+
+type FlowAggregator struct {
+	mtx   sync.Mutex
+	flows map[FlowKey]*FlowSummary
+}
+
+var gConfig = PacketLogsConfig{}
+var gFlows = &FlowAggregator{flows: map[FlowKey]*FlowSummary{}}
+
+var samplingmtx sync.Mutex
+var gSampleCounters = map[string]uint64{}
+
+func loadConfig() {
+	data, err := os.ReadFile(PacketLogsConfigFile)
+	if err != nil {
+		return
+	}
+
+	config := PacketLogsConfig{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid packet logs config:", err)
+		return
+	}
+
+	if config.WindowSeconds <= 0 {
+		config.WindowSeconds = defaultFlowWindow
+	}
+	gConfig = config
+}
+
+// sampleRate returns the rate of the longest matching topic rule
+func (config PacketLogsConfig) sampleRate(topic string) int {
+	rate := 1
+	if config.Aggregate {
+		//summaries replace the packets unless a rule keeps them
+		rate = 0
+	}
+
+	matched := -1
+	for _, rule := range config.PacketSampling {
+		if strings.HasPrefix(topic, rule.Topic) && len(rule.Topic) > matched {
+			matched = len(rule.Topic)
+			rate = rule.Rate
+		}
+	}
+	return rate
+}
+
+// samplePacket decides if a packet on topic is published
+func samplePacket(topic string, rate int) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate == 1 {
+		return true
+	}
+
+	samplingmtx.Lock()
+	defer samplingmtx.Unlock()
+	count := gSampleCounters[topic]
+	gSampleCounters[topic] = count + 1
+	return count%uint64(rate) == 0
+}
+
+func flowKey(result *PacketInfo) (FlowKey, bool) {
+	key := FlowKey{Prefix: strings.TrimSpace(strings.ToLower(result.Prefix)), Action: result.Action}
+
+	switch {
+	case result.IP != nil:
+		key.SrcIP = result.IP.SrcIP.String()
+		key.DstIP = result.IP.DstIP.String()
+		key.Protocol = strings.ToLower(result.IP.Protocol.String())
+	case result.IPv6 != nil:
+		key.SrcIP = result.IPv6.SrcIP.String()
+		key.DstIP = result.IPv6.DstIP.String()
+		key.Protocol = strings.ToLower(result.IPv6.NextHeader.String())
+	case result.ARP != nil:
+		key.SrcIP = result.ARP.SrcIP
+		key.DstIP = result.ARP.DstIP
+		key.Protocol = "arp"
+	default:
+		return key, false
+	}
+
+	if result.TCP != nil {
+		key.Protocol = "tcp"
+		key.SrcPort = uint16(result.TCP.SrcPort)
+		key.DstPort = uint16(result.TCP.DstPort)
+	} else if result.UDP != nil {
+		key.Protocol = "udp"
+		key.SrcPort = uint16(result.UDP.SrcPort)
+		key.DstPort = uint16(result.UDP.DstPort)
+	}
+
+	return key, true
+}
+
+func (a *FlowAggregator) add(result *PacketInfo, length int) {
+	key, ok := flowKey(result)
+	if !ok {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	flow, exists := a.flows[key]
+	if !exists {
+		if len(a.flows) >= maxFlowsPerWindow {
+			//the window is full, later flows are dropped until the flush
+			return
+		}
+		flow = &FlowSummary{
+			FlowKey:   key,
+			InDev:     result.InDev,
+			OutDev:    result.OutDev,
+			FirstSeen: result.Timestamp,
+		}
+		if result.Ethernet != nil {
+			flow.SrcMAC = result.Ethernet.SrcMAC
+		}
+		a.flows[key] = flow
+	}
+
+	flow.LastSeen = result.Timestamp
+	flow.Packets++
+	flow.Bytes += uint64(length)
+	if result.RecentDomainSrc != "" {
+		flow.RecentDomainSrc = result.RecentDomainSrc
+	}
+	if result.RecentDomainDst != "" {
+		flow.RecentDomainDst = result.RecentDomainDst
+	}
+}
+
+func (a *FlowAggregator) flush() []*FlowSummary {
+	a.mtx.Lock()
+	flows := a.flows
+	a.flows = map[FlowKey]*FlowSummary{}
+	a.mtx.Unlock()
+
+	summaries := make([]*FlowSummary, 0, len(flows))
+	for _, flow := range flows {
+		summaries = append(summaries, flow)
+	}
+	return summaries
+}
+
+// publishSummaries sends each summary of a window on flow:<prefix>
+func publishSummaries(flows []*FlowSummary, publish func(topic string, data string)) {
+	for _, flow := range flows {
+		data, err := json.Marshal(flow)
+		if err != nil {
+			continue
+		}
+		publish("flow:"+flow.Prefix, string(data))
+	}
+}
+
+func publishFlows(client *sprbus.Client, window time.Duration) {
+	for {
+		time.Sleep(window)
+
+		publishSummaries(gFlows.flush(), func(topic string, data string) {
+			client.Publish(topic, data)
+		})
+	}
+}
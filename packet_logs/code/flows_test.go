@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var testStart = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func tcpPacket(prefix string, src string, srcPort uint16, dst string, dstPort uint16, at time.Duration) *PacketInfo {
+	return &PacketInfo{
+		Prefix:    prefix,
+		Action:    "allowed",
+		Timestamp: testStart.Add(at),
+		InDev:     "wlan0",
+		OutDev:    "eth0",
+		Ethernet:  &PacketEthernet{SrcMAC: "02:00:00:00:00:01"},
+		IP:        &layers.IPv4{Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)},
+		TCP:       &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort)},
+	}
+}
+
+func TestFlowKey(t *testing.T) {
+	key, ok := flowKey(tcpPacket(" LAN:OUT ", "192.168.2.10", 50000, "1.1.1.1", 443, 0))
+	want := FlowKey{Prefix: "lan:out", Action: "allowed", Protocol: "tcp", SrcIP: "192.168.2.10", DstIP: "1.1.1.1", SrcPort: 50000, DstPort: 443}
+	if !ok || key != want {
+		t.Errorf("got %+v, want %+v", key, want)
+	}
+
+	udp6 := &PacketInfo{
+		Prefix: "wan:in",
+		IPv6:   &layers.IPv6{NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")},
+		UDP:    &layers.UDP{SrcPort: 5353, DstPort: 5353},
+	}
+	key, ok = flowKey(udp6)
+	want = FlowKey{Prefix: "wan:in", Protocol: "udp", SrcIP: "2001:db8::1", DstIP: "2001:db8::2", SrcPort: 5353, DstPort: 5353}
+	if !ok || key != want {
+		t.Errorf("got %+v, want %+v", key, want)
+	}
+
+	icmp6 := &PacketInfo{IPv6: &layers.IPv6{NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("ff02::1")}}
+	if key, ok = flowKey(icmp6); !ok || key.Protocol != "icmpv6" || key.SrcPort != 0 {
+		t.Errorf("unexpected key %+v", key)
+	}
+
+	arp := &PacketInfo{ARP: &PacketARP{SrcIP: "192.168.2.1", DstIP: "192.168.2.10"}}
+	if key, ok = flowKey(arp); !ok || key.Protocol != "arp" || key.SrcIP != "192.168.2.1" {
+		t.Errorf("unexpected key %+v", key)
+	}
+
+	if _, ok = flowKey(&PacketInfo{Prefix: "lan:in"}); ok {
+		t.Error("a packet without a network layer has no flow")
+	}
+}
+
+func TestFlowAggregation(t *testing.T) {
+	a := &FlowAggregator{flows: map[FlowKey]*FlowSummary{}}
+
+	first := tcpPacket("lan:out", "192.168.2.10", 50000, "1.1.1.1", 443, 0)
+	a.add(first, 60)
+	last := tcpPacket("lan:out", "192.168.2.10", 50000, "1.1.1.1", 443, 5*time.Second)
+	last.RecentDomainDst = "one.one.one.one"
+	a.add(last, 1500)
+	a.add(tcpPacket("lan:out", "192.168.2.10", 50000, "1.1.1.1", 443, 10*time.Second), 40)
+
+	//another source port, verdict or prefix is another flow
+	a.add(tcpPacket("lan:out", "192.168.2.10", 50001, "1.1.1.1", 443, 0), 60)
+	blocked := tcpPacket("lan:out", "192.168.2.10", 50000, "1.1.1.1", 443, 0)
+	blocked.Action = "blocked"
+	a.add(blocked, 60)
+	a.add(tcpPacket("wan:in", "192.168.2.10", 50000, "1.1.1.1", 443, 0), 60)
+
+	summaries := a.flush()
+	if len(summaries) != 4 {
+		t.Fatalf("got %d flows, want 4", len(summaries))
+	}
+
+	var flow *FlowSummary
+	for _, summary := range summaries {
+		if summary.Prefix == "lan:out" && summary.Action == "allowed" && summary.SrcPort == 50000 {
+			flow = summary
+		}
+	}
+	if flow == nil {
+		t.Fatal("flow is missing")
+	}
+	if flow.Packets != 3 || flow.Bytes != 1600 {
+		t.Errorf("got %d packets %d bytes", flow.Packets, flow.Bytes)
+	}
+	if !flow.FirstSeen.Equal(testStart) || !flow.LastSeen.Equal(testStart.Add(10*time.Second)) {
+		t.Errorf("got first %v last %v", flow.FirstSeen, flow.LastSeen)
+	}
+	if flow.InDev != "wlan0" || flow.OutDev != "eth0" || flow.SrcMAC != "02:00:00:00:00:01" || flow.RecentDomainDst != "one.one.one.one" {
+		t.Errorf("unexpected flow %+v", flow)
+	}
+
+	//a flush starts a new window
+	if summaries = a.flush(); len(summaries) != 0 {
+		t.Errorf("got %d flows after the flush", len(summaries))
+	}
+}
+
+func TestFlowAggregationLimit(t *testing.T) {
+	a := &FlowAggregator{flows: map[FlowKey]*FlowSummary{}}
+	for port := 0; port < maxFlowsPerWindow+10; port++ {
+		a.add(tcpPacket("lan:out", "192.168.2.10", uint16(port), "1.1.1.1", 443, 0), 60)
+	}
+
+	//known flows are still counted once the window is full
+	a.add(tcpPacket("lan:out", "192.168.2.10", 0, "1.1.1.1", 443, 0), 60)
+
+	summaries := a.flush()
+	if len(summaries) != maxFlowsPerWindow {
+		t.Fatalf("got %d flows, want %d", len(summaries), maxFlowsPerWindow)
+	}
+	for _, flow := range summaries {
+		if flow.SrcPort == 0 && flow.Packets != 2 {
+			t.Errorf("got %d packets for a known flow", flow.Packets)
+		}
+	}
+}
+
+func TestPublishSummaries(t *testing.T) {
+	a := &FlowAggregator{flows: map[FlowKey]*FlowSummary{}}
+	a.add(tcpPacket("lan:out", "192.168.2.10", 50000, "1.1.1.1", 443, 0), 60)
+	a.add(tcpPacket("drop:forward", "192.168.2.11", 50000, "1.1.1.1", 443, 0), 60)
+
+	published := map[string]FlowSummary{}
+	publishSummaries(a.flush(), func(topic string, data string) {
+		flow := FlowSummary{}
+		if err := json.Unmarshal([]byte(data), &flow); err != nil {
+			t.Fatal(err)
+		}
+		published[topic] = flow
+	})
+
+	topics := []string{}
+	for topic := range published {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "flow:drop:forward" || topics[1] != "flow:lan:out" {
+		t.Fatalf("got topics %v", topics)
+	}
+	if flow := published["flow:lan:out"]; flow.SrcIP != "192.168.2.10" || flow.DstPort != 443 || flow.Packets != 1 {
+		t.Errorf("unexpected summary %+v", flow)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	config := PacketLogsConfig{PacketSampling: []TopicSampling{
+		{Topic: "nft:drop", Rate: 10},
+		{Topic: "nft:drop:forward", Rate: 2},
+		{Topic: "nft:lan", Rate: 0},
+	}}
+
+	tests := map[string]int{
+		"nft:drop:input":   10,
+		"nft:drop:forward": 2,
+		"nft:lan:in":       0,
+		"nft:wan:out":      1,
+	}
+	for topic, want := range tests {
+		if rate := config.sampleRate(topic); rate != want {
+			t.Errorf("%s: got %d, want %d", topic, rate, want)
+		}
+	}
+
+	//with summaries, packets are only published for topics with a rule
+	config.Aggregate = true
+	if rate := config.sampleRate("nft:wan:out"); rate != 0 {
+		t.Errorf("got %d", rate)
+	}
+	if rate := config.sampleRate("nft:drop:input"); rate != 10 {
+		t.Errorf("got %d", rate)
+	}
+}
+
+func TestSamplePacket(t *testing.T) {
+	samplingmtx.Lock()
+	gSampleCounters = map[string]uint64{}
+	samplingmtx.Unlock()
+
+	count := func(topic string, rate int, packets int) int {
+		published := 0
+		for i := 0; i < packets; i++ {
+			if samplePacket(topic, rate) {
+				published++
+			}
+		}
+		return published
+	}
+
+	if n := count("nft:drop:input", 10, 100); n != 10 {
+		t.Errorf("rate 10 published %d of 100", n)
+	}
+	if n := count("nft:drop:forward", 3, 10); n != 4 {
+		t.Errorf("rate 3 published %d of 10", n)
+	}
+	if n := count("nft:lan:in", 1, 5); n != 5 {
+		t.Errorf("rate 1 published %d of 5", n)
+	}
+	if n := count("nft:lan:out", 0, 5); n != 0 {
+		t.Errorf("rate 0 published %d of 5", n)
+	}
+
+	//topics are counted apart, the first packet of a topic is published
+	if !samplePacket("nft:wan:in", 100) || samplePacket("nft:wan:in", 100) {
+		t.Error("unexpected sampling of a new topic")
+	}
+}
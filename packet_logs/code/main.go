@@ -12,6 +12,7 @@ import (
 	"github.com/google/gopacket/layers"
 	sprbus "github.com/spr-networks/sprbus-json"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -27,12 +28,35 @@ type PacketEthernet struct {
 	HwType uint16
 }
 
+// icmp and icmpv6 with the type and code spelled out
+type PacketICMP struct {
+	Type     uint8
+	Code     uint8
+	TypeCode string
+	Id       uint16 `json:",omitempty"`
+	Seq      uint16 `json:",omitempty"`
+	Target   string `json:",omitempty"` //neighbor discovery target
+}
+
+// arp with strings for the addresses
+type PacketARP struct {
+	Operation uint16
+	SrcMAC    string
+	SrcIP     string
+	DstMAC    string
+	DstIP     string
+}
+
 // new format
 type PacketInfo struct {
 	Ethernet        *PacketEthernet `json:"Ethernet,omitempty"`
 	TCP             *layers.TCP     `json:"TCP,omitempty"`
 	UDP             *layers.UDP     `json:"UDP,omitempty"`
 	IP              *layers.IPv4    `json:"IP,omitempty"`
+	IPv6            *layers.IPv6    `json:"IPv6,omitempty"`
+	ICMP            *PacketICMP     `json:"ICMP,omitempty"`
+	ICMPv6          *PacketICMP     `json:"ICMPv6,omitempty"`
+	ARP             *PacketARP      `json:"ARP,omitempty"`
 	DNS             *layers.DNS     `json:"DNS,omitempty"`
 	DHCP            *layers.DHCPv4  `json:"DHCP,omitempty"`
 	RecentDomainSrc string          `json:"RecentDomainSrc,omitempty"`
@@ -42,6 +66,7 @@ type PacketInfo struct {
 	Timestamp       time.Time       `json:"Timestamp"`
 	InDev           string          `json:"InDev"`
 	OutDev          string          `json:"OutDev"`
+	SampleRate      int             `json:"SampleRate,omitempty"`
 }
 
 var wg sync.WaitGroup
@@ -62,6 +87,11 @@ func main() {
 
 	fmt.Println("sprbus client connected")
 
+	loadConfig()
+	if gConfig.Aggregate {
+		go publishFlows(client, time.Duration(gConfig.WindowSeconds)*time.Second)
+	}
+
 	wg.Add(2)
 
 	// one thread for each netfilter group
@@ -93,12 +123,6 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 	defer cancel()
 
 	hook := func(attrs nflog.Attribute) int {
-		var ip4 layers.IPv4
-		var tcp layers.TCP
-		var udp layers.UDP
-		var dns layers.DNS
-		var dhcp layers.DHCPv4
-
 		if attrs.Payload == nil {
 			if verboseLog {
 				fmt.Fprintln(os.Stderr, "nflog message has no packet payload")
@@ -106,7 +130,23 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 			return 0
 		}
 
-		result := PacketInfo{}
+		packetData := *attrs.Payload
+		firstLayer := payloadLayerType(attrs, packetData)
+		if firstLayer == gopacket.LayerTypeZero {
+			if verboseLog {
+				fmt.Fprintln(os.Stderr, "nflog message has an unknown protocol")
+			}
+			return 0
+		}
+
+		result, err := decodePacket(firstLayer, packetData)
+		if err != nil {
+			if verboseLog {
+				fmt.Fprintf(os.Stderr, "packet parse error: %v\n", err)
+			}
+			return 0
+		}
+
 		if attrs.Prefix != nil {
 			result.Prefix = *attrs.Prefix
 		}
@@ -138,46 +178,22 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 			result.Action = "blocked"
 		}
 
-		//TBD ipv6
-
-		// DecodingLayerParser takes about 10% of the time as NewPacket to decode packet data, but only for known packet stacks.
-		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &tcp, &udp, &dns, &dhcp)
-		parser.IgnoreUnsupported = true
-		decoded := []gopacket.LayerType{}
-		packetData := *attrs.Payload
-		if err := parser.DecodeLayers(packetData, &decoded); err != nil {
-			if verboseLog {
-				fmt.Fprintf(os.Stderr, "packet parse error: %v\n", err)
-			}
-			return 0
-		}
-
-		// iterate to see what layer we have
-		for _, layerType := range decoded {
-			switch layerType {
-			case layers.LayerTypeIPv4:
-				result.IP = &ip4
-			case layers.LayerTypeTCP:
-				result.TCP = &tcp
-			case layers.LayerTypeUDP:
-				result.UDP = &udp
-			case layers.LayerTypeDNS:
-				result.DNS = &dns
-			case layers.LayerTypeDHCPv4:
-				result.DHCP = &dhcp
-			}
-		}
-
 		result.Ethernet = ethernetFromAttributes(attrs)
 
 		//populate RecentDomain based on IPs
 		DNSCachemtx.RLock()
+		var srcIP, dstIP net.IP
 		if result.IP != nil {
-			src_domain, exists := DNSCache[result.IP.SrcIP.String()]
+			srcIP, dstIP = result.IP.SrcIP, result.IP.DstIP
+		} else if result.IPv6 != nil {
+			srcIP, dstIP = result.IPv6.SrcIP, result.IPv6.DstIP
+		}
+		if srcIP != nil {
+			src_domain, exists := DNSCache[srcIP.String()]
 			if exists {
 				result.RecentDomainSrc = src_domain
 			}
-			dst_domain, exists := DNSCache[result.IP.DstIP.String()]
+			dst_domain, exists := DNSCache[dstIP.String()]
 			if exists {
 				result.RecentDomainDst = dst_domain
 			}
@@ -185,10 +201,8 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 		}
 		DNSCachemtx.RUnlock()
 
-		data, err := json.Marshal(result)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "json error: %v", err)
-			return 0
+		if gConfig.Aggregate {
+			gFlows.add(&result, len(packetData))
 		}
 
 		//send to sprbus
@@ -197,6 +211,20 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 		prefix := strings.TrimSpace(strings.ToLower(result.Prefix))
 		topic := fmt.Sprintf("nft:%s", prefix)
 
+		rate := gConfig.sampleRate(topic)
+		if !samplePacket(topic, rate) {
+			return 0
+		}
+		if rate > 1 {
+			result.SampleRate = rate
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "json error: %v", err)
+			return 0
+		}
+
 		if verboseLog {
 			//fmt.Printf("##pub: %v\n%v\n", topic, string(data))
 			fmt.Printf("##pub: %v\n", topic)
@@ -223,6 +251,116 @@ func logGroup(client *sprbus.Client, NetfilterGroup int) {
 	<-ctx.Done()
 }
 
+// decodePacket decodes the layers that are logged from a payload that
+// starts with firstLayer
+func decodePacket(firstLayer gopacket.LayerType, packetData []byte) (PacketInfo, error) {
+	var ip4 layers.IPv4
+	var ip6 layers.IPv6
+	var icmp4 layers.ICMPv4
+	var icmp6 layers.ICMPv6
+	var icmp6echo layers.ICMPv6Echo
+	var icmp6ns layers.ICMPv6NeighborSolicitation
+	var icmp6na layers.ICMPv6NeighborAdvertisement
+	var arp layers.ARP
+	var tcp layers.TCP
+	var udp layers.UDP
+	var dns layers.DNS
+	var dhcp layers.DHCPv4
+
+	result := PacketInfo{}
+
+	// DecodingLayerParser takes about 10% of the time as NewPacket to decode packet data, but only for known packet stacks.
+	parser := gopacket.NewDecodingLayerParser(firstLayer, &ip4, &ip6, &icmp4, &icmp6, &icmp6echo,
+		&icmp6ns, &icmp6na, &arp, &tcp, &udp, &dns, &dhcp)
+	parser.IgnoreUnsupported = true
+	decoded := []gopacket.LayerType{}
+	if err := parser.DecodeLayers(packetData, &decoded); err != nil {
+		return result, err
+	}
+
+	// iterate to see what layer we have
+	for _, layerType := range decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			result.IP = &ip4
+		case layers.LayerTypeIPv6:
+			result.IPv6 = &ip6
+		case layers.LayerTypeICMPv4:
+			result.ICMP = &PacketICMP{
+				Type:     icmp4.TypeCode.Type(),
+				Code:     icmp4.TypeCode.Code(),
+				TypeCode: icmp4.TypeCode.String(),
+				Id:       icmp4.Id,
+				Seq:      icmp4.Seq,
+			}
+		case layers.LayerTypeICMPv6:
+			result.ICMPv6 = &PacketICMP{
+				Type:     icmp6.TypeCode.Type(),
+				Code:     icmp6.TypeCode.Code(),
+				TypeCode: icmp6.TypeCode.String(),
+			}
+		case layers.LayerTypeICMPv6Echo:
+			if result.ICMPv6 != nil {
+				result.ICMPv6.Id = icmp6echo.Identifier
+				result.ICMPv6.Seq = icmp6echo.SeqNumber
+			}
+		case layers.LayerTypeICMPv6NeighborSolicitation:
+			if result.ICMPv6 != nil {
+				result.ICMPv6.Target = icmp6ns.TargetAddress.String()
+			}
+		case layers.LayerTypeICMPv6NeighborAdvertisement:
+			if result.ICMPv6 != nil {
+				result.ICMPv6.Target = icmp6na.TargetAddress.String()
+			}
+		case layers.LayerTypeARP:
+			result.ARP = &PacketARP{
+				Operation: arp.Operation,
+				SrcMAC:    net.HardwareAddr(arp.SourceHwAddress).String(),
+				SrcIP:     net.IP(arp.SourceProtAddress).String(),
+				DstMAC:    net.HardwareAddr(arp.DstHwAddress).String(),
+				DstIP:     net.IP(arp.DstProtAddress).String(),
+			}
+		case layers.LayerTypeTCP:
+			result.TCP = &tcp
+		case layers.LayerTypeUDP:
+			result.UDP = &udp
+		case layers.LayerTypeDNS:
+			result.DNS = &dns
+		case layers.LayerTypeDHCPv4:
+			result.DHCP = &dhcp
+		}
+	}
+
+	return result, nil
+}
+
+// payloadLayerType picks the first layer of the payload, which starts at
+// the network header. arp is only logged from the bridge and arp families
+func payloadLayerType(attrs nflog.Attribute, payload []byte) gopacket.LayerType {
+	if attrs.HwProtocol != nil {
+		switch layers.EthernetType(*attrs.HwProtocol) {
+		case layers.EthernetTypeIPv4:
+			return layers.LayerTypeIPv4
+		case layers.EthernetTypeIPv6:
+			return layers.LayerTypeIPv6
+		case layers.EthernetTypeARP:
+			return layers.LayerTypeARP
+		}
+	}
+
+	if len(payload) == 0 {
+		return gopacket.LayerTypeZero
+	}
+
+	switch payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypeZero
+}
+
 func ethernetFromAttributes(attrs nflog.Attribute) *PacketEthernet {
 	if attrs.HwType == nil {
 		return nil
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testMAC1 = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testMAC2 = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testIP6a = net.ParseIP("2001:db8::1")
+	testIP6b = net.ParseIP("2001:db8::2")
+)
+
+// serialize builds a frame the way nflog hands it over, starting at the
+// network header, with lengths and checksums filled in
+func serialize(t *testing.T, stack ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func icmp6Layers(t *testing.T, typeCode layers.ICMPv6TypeCode) (*layers.IPv6, *layers.ICMPv6) {
+	t.Helper()
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: testIP6a, DstIP: testIP6b}
+	icmp6 := &layers.ICMPv6{TypeCode: typeCode}
+	if err := icmp6.SetNetworkLayerForChecksum(ip6); err != nil {
+		t.Fatal(err)
+	}
+	return ip6, icmp6
+}
+
+func TestDecodeICMPv6Echo(t *testing.T) {
+	ip6, icmp6 := icmp6Layers(t, layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0))
+	frame := serialize(t, ip6, icmp6, &layers.ICMPv6Echo{Identifier: 0x1234, SeqNumber: 7}, gopacket.Payload("ping"))
+
+	result, err := decodePacket(payloadLayerType(nflog.Attribute{}, frame), frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IPv6 == nil || !result.IPv6.SrcIP.Equal(testIP6a) || !result.IPv6.DstIP.Equal(testIP6b) || result.IP != nil {
+		t.Fatalf("unexpected ip layers %+v %+v", result.IPv6, result.IP)
+	}
+	want := PacketICMP{Type: 128, Code: 0, TypeCode: "EchoRequest", Id: 0x1234, Seq: 7}
+	if result.ICMPv6 == nil || *result.ICMPv6 != want || result.ICMP != nil {
+		t.Errorf("got %+v, want %+v", result.ICMPv6, want)
+	}
+}
+
+func TestDecodeICMPv6NeighborDiscovery(t *testing.T) {
+	target := net.ParseIP("2001:db8::99")
+
+	ip6, icmp6 := icmp6Layers(t, layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0))
+	frame := serialize(t, ip6, icmp6, &layers.ICMPv6NeighborSolicitation{TargetAddress: target})
+	result, err := decodePacket(layers.LayerTypeIPv6, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PacketICMP{Type: 135, TypeCode: "NeighborSolicitation", Target: "2001:db8::99"}
+	if result.ICMPv6 == nil || *result.ICMPv6 != want {
+		t.Errorf("got %+v, want %+v", result.ICMPv6, want)
+	}
+
+	ip6, icmp6 = icmp6Layers(t, layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0))
+	frame = serialize(t, ip6, icmp6, &layers.ICMPv6NeighborAdvertisement{TargetAddress: target, Flags: 0x60})
+	result, err = decodePacket(layers.LayerTypeIPv6, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = PacketICMP{Type: 136, TypeCode: "NeighborAdvertisement", Target: "2001:db8::99"}
+	if result.ICMPv6 == nil || *result.ICMPv6 != want {
+		t.Errorf("got %+v, want %+v", result.ICMPv6, want)
+	}
+}
+
+func TestDecodeIPv6UDP(t *testing.T) {
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: testIP6a, DstIP: testIP6b}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 443}
+	udp.SetNetworkLayerForChecksum(ip6)
+	frame := serialize(t, ip6, udp, gopacket.Payload("quic"))
+
+	result, err := decodePacket(payloadLayerType(nflog.Attribute{}, frame), frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IPv6 == nil || result.UDP == nil || result.UDP.SrcPort != 40000 || result.UDP.DstPort != 443 || result.ICMPv6 != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestDecodeICMPv4(t *testing.T) {
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolICMPv4,
+		SrcIP: net.IPv4(192, 168, 2, 10), DstIP: net.IPv4(1, 1, 1, 1)}
+	icmp4 := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 9, Seq: 3}
+	frame := serialize(t, ip4, icmp4, gopacket.Payload("ping"))
+
+	result, err := decodePacket(payloadLayerType(nflog.Attribute{}, frame), frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PacketICMP{Type: 8, TypeCode: "EchoRequest", Id: 9, Seq: 3}
+	if result.IP == nil || result.ICMP == nil || *result.ICMP != want || result.ICMPv6 != nil {
+		t.Errorf("got %+v, want %+v", result.ICMP, want)
+	}
+}
+
+func TestDecodeARP(t *testing.T) {
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   testMAC1,
+		SourceProtAddress: net.IPv4(192, 168, 2, 1).To4(),
+		DstHwAddress:      testMAC2,
+		DstProtAddress:    net.IPv4(192, 168, 2, 10).To4(),
+	}
+	frame := serialize(t, arp)
+
+	//arp has no version nibble, only the hardware protocol tells it apart
+	if first := payloadLayerType(nflog.Attribute{}, frame); first == layers.LayerTypeARP {
+		t.Errorf("arp detected without a hardware protocol")
+	}
+
+	proto := uint16(layers.EthernetTypeARP)
+	first := payloadLayerType(nflog.Attribute{HwProtocol: &proto}, frame)
+	result, err := decodePacket(first, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PacketARP{Operation: 2, SrcMAC: "02:00:00:00:00:01", SrcIP: "192.168.2.1", DstMAC: "02:00:00:00:00:02", DstIP: "192.168.2.10"}
+	if result.ARP == nil || *result.ARP != want || result.IP != nil {
+		t.Errorf("got %+v, want %+v", result.ARP, want)
+	}
+}
+
+func TestPayloadLayerType(t *testing.T) {
+	ipv4 := uint16(layers.EthernetTypeIPv4)
+	ipv6 := uint16(layers.EthernetTypeIPv6)
+	other := uint16(layers.EthernetTypeLLC)
+
+	tests := []struct {
+		name    string
+		proto   *uint16
+		payload []byte
+		want    gopacket.LayerType
+	}{
+		{"hardware protocol ipv6", &ipv6, []byte{0x45}, layers.LayerTypeIPv6},
+		{"hardware protocol ipv4", &ipv4, []byte{0x60}, layers.LayerTypeIPv4},
+		{"version nibble 4", nil, []byte{0x45, 0x00}, layers.LayerTypeIPv4},
+		{"version nibble 6", nil, []byte{0x60, 0x00}, layers.LayerTypeIPv6},
+		{"unknown hardware protocol falls back", &other, []byte{0x60}, layers.LayerTypeIPv6},
+		{"unknown version", nil, []byte{0x10}, gopacket.LayerTypeZero},
+		{"empty payload", nil, []byte{}, gopacket.LayerTypeZero},
+	}
+
+	for _, tt := range tests {
+		if got := payloadLayerType(nflog.Attribute{HwProtocol: tt.proto}, tt.payload); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEthernetFromAttributes(t *testing.T) {
+	if ethernetFromAttributes(nflog.Attribute{}) != nil {
+		t.Error("expected no ethernet without a hardware type")
+	}
+
+	hwType := uint16(1)
+	header := append(append([]byte{}, testMAC2...), testMAC1...)
+	ethernet := ethernetFromAttributes(nflog.Attribute{HwType: &hwType, HwHeader: &header})
+	want := PacketEthernet{SrcMAC: "02:00:00:00:00:01", DstMAC: "02:00:00:00:00:02", HwType: 1}
+	if ethernet == nil || *ethernet != want {
+		t.Errorf("got %+v, want %+v", ethernet, want)
+	}
+}
@@ -28,6 +28,7 @@ var BuiltinOverridesPath = ConfigDir + "/builtin_fingerprints.json"
 var DevicesPublicPath = "/state/public/devices-public.json"
 
 const maxDomainsPerDevice = 32
+const maxTLSFingerprintsPerDevice = 8
 
 type persistedStore struct {
 	Signals         map[string]DeviceSignals  `json:"signals"`
@@ -60,6 +61,26 @@ type ZeroconfDevice struct {
 	SSDPHeaders map[string]string
 }
 
+// published by flowgather for tls client hellos
+type TLSFingerprint struct {
+	MAC     string
+	IP      string
+	SNI     string
+	JA3     string
+	JA3Hash string
+	JA4     string
+	TTL     int
+}
+
+// published by flowgather for dhcp requests
+type DHCPFingerprint struct {
+	MAC          string
+	OptionOrder  string
+	ParamReqList string
+	VendorClass  string
+	TTL          int
+}
+
 type CorrectionRequest struct {
 	Vendor            string
 	Category          string
@@ -389,6 +410,90 @@ func (c *Classifier) handleDNS(event DNSEvent) {
 	c.addDomain(macFromIP(ip), domain)
 }
 
+// initialTTL rounds an observed ttl up to the usual initial values,
+// 64 for linux, android, macos and ios, 128 for windows, 255 for many embedded stacks
+func initialTTL(ttl int) int {
+	switch {
+	case ttl <= 0:
+		return 0
+	case ttl <= 32:
+		return 32
+	case ttl <= 64:
+		return 64
+	case ttl <= 128:
+		return 128
+	}
+	return 255
+}
+
+func appendCapped(values []string, value string, limit int) []string {
+	if value == "" || len(values) >= limit {
+		return values
+	}
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// client hellos are frequent, only new fingerprints reach updateSignals
+func (c *Classifier) handleTLSFingerprint(event TLSFingerprint) {
+	mac := normalizeMAC(event.MAC)
+	if mac == "" {
+		mac = normalizeMAC(macFromIP(event.IP))
+	}
+	if mac == "" || (event.JA3Hash == "" && event.JA4 == "") {
+		return
+	}
+
+	ja3 := strings.ToLower(strings.TrimSpace(event.JA3Hash))
+	ja4 := strings.TrimSpace(event.JA4)
+	ttl := initialTTL(event.TTL)
+
+	c.mu.Lock()
+	signals := c.signals[mac]
+	known := len(appendCapped(signals.TLSJA3, ja3, maxTLSFingerprintsPerDevice)) == len(signals.TLSJA3) &&
+		len(appendCapped(signals.TLSJA4, ja4, maxTLSFingerprintsPerDevice)) == len(signals.TLSJA4) &&
+		(ttl == 0 || signals.TTL == ttl)
+	c.mu.Unlock()
+
+	if known {
+		return
+	}
+
+	c.updateSignals(mac, func(signals *DeviceSignals) {
+		signals.TLSJA3 = appendCapped(signals.TLSJA3, ja3, maxTLSFingerprintsPerDevice)
+		signals.TLSJA4 = appendCapped(signals.TLSJA4, ja4, maxTLSFingerprintsPerDevice)
+		if ttl != 0 {
+			signals.TTL = ttl
+		}
+	})
+}
+
+func (c *Classifier) handleDHCPFingerprint(event DHCPFingerprint) {
+	mac := normalizeMAC(event.MAC)
+	if mac == "" {
+		return
+	}
+
+	c.updateSignals(mac, func(signals *DeviceSignals) {
+		if event.OptionOrder != "" {
+			signals.DHCPOptions = event.OptionOrder
+		}
+		if event.ParamReqList != "" {
+			signals.ParamReqList = event.ParamReqList
+		}
+		if event.VendorClass != "" {
+			signals.VendorClass = event.VendorClass
+		}
+		if ttl := initialTTL(event.TTL); ttl != 0 {
+			signals.TTL = ttl
+		}
+	})
+}
+
 func (c *Classifier) handleZeroconf(event ZeroconfDevice) {
 	mac := normalizeMAC(event.MAC)
 	if mac == "" {
@@ -422,6 +527,18 @@ func (c *Classifier) classifyNow(w http.ResponseWriter, r *http.Request) {
 		existing.Services = mergeStrings(existing.Services, signals.Services)
 		existing.TXT = mergeMap(existing.TXT, signals.TXT)
 		existing.SSDPHeaders = mergeMap(existing.SSDPHeaders, signals.SSDPHeaders)
+		if signals.DHCPOptions != "" {
+			existing.DHCPOptions = signals.DHCPOptions
+		}
+		if signals.TTL != 0 {
+			existing.TTL = initialTTL(signals.TTL)
+		}
+		for _, ja3 := range signals.TLSJA3 {
+			existing.TLSJA3 = appendCapped(existing.TLSJA3, ja3, maxTLSFingerprintsPerDevice)
+		}
+		for _, ja4 := range signals.TLSJA4 {
+			existing.TLSJA4 = appendCapped(existing.TLSJA4, ja4, maxTLSFingerprintsPerDevice)
+		}
 	})
 	if !ok {
 		http.Error(w, "missing MAC", http.StatusBadRequest)
@@ -629,10 +746,30 @@ func busListener(classifier *Classifier) {
 		classifier.handleDNS(event)
 	}
 
+	handleTLSFingerprint := func(topic string, value string) {
+		event := TLSFingerprint{}
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			fmt.Println("invalid tls fingerprint event:", err)
+			return
+		}
+		classifier.handleTLSFingerprint(event)
+	}
+
+	handleDHCPFingerprint := func(topic string, value string) {
+		event := DHCPFingerprint{}
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			fmt.Println("invalid dhcp fingerprint event:", err)
+			return
+		}
+		classifier.handleDHCPFingerprint(event)
+	}
+
 	go retryEventBus("dhcp:request", handleDHCP)
 	go retryEventBus("zeroconf:device", handleZeroconf)
 	go retryEventBus("wifi:auth:success", handleWifiAuth)
 	go retryEventBus("dns:serve:", handleDNS)
+	go retryEventBus("fingerprint:tls", handleTLSFingerprint)
+	go retryEventBus("fingerprint:dhcp", handleDHCPFingerprint)
 }
 
 func retryEventBus(topic string, handler func(string, string)) {
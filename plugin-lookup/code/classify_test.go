@@ -164,6 +164,76 @@ func TestDHCPFingerprintSignals(t *testing.T) {
 	}
 }
 
+func TestTLSAndDHCPOptionSignals(t *testing.T) {
+	classifier := testClassifier(t)
+	mac := "00:11:22:33:44:55"
+
+	devices := fmt.Sprintf(
+		`{"%s": {"MAC": "%s", "RecentIP": "192.168.2.16"}}`, mac, mac)
+	if err := os.WriteFile(DevicesPublicPath, []byte(devices), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	classifier.handleTLSFingerprint(TLSFingerprint{
+		IP:      "192.168.2.16",
+		JA3Hash: "0123456789ABCDEF0123456789abcdef",
+		JA4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		TTL:     60,
+	})
+	classifier.handleTLSFingerprint(TLSFingerprint{
+		MAC:     mac,
+		JA3Hash: "0123456789abcdef0123456789abcdef",
+		TTL:     61,
+	})
+
+	signals := classifier.signals[mac]
+	if len(signals.TLSJA3) != 1 || signals.TLSJA3[0] != "0123456789abcdef0123456789abcdef" {
+		t.Fatalf("ja3 not stored or deduped: %#v", signals.TLSJA3)
+	}
+	if len(signals.TLSJA4) != 1 || signals.TTL != 64 {
+		t.Fatalf("ja4 or ttl not stored: %#v", signals)
+	}
+
+	for i := 0; i < maxTLSFingerprintsPerDevice+4; i++ {
+		classifier.handleTLSFingerprint(TLSFingerprint{MAC: mac, JA4: fmt.Sprintf("t13d%04d", i)})
+	}
+	if len(classifier.signals[mac].TLSJA4) > maxTLSFingerprintsPerDevice {
+		t.Fatalf("tls fingerprint cap not enforced: %d", len(classifier.signals[mac].TLSJA4))
+	}
+
+	classifier.handleDHCPFingerprint(DHCPFingerprint{
+		MAC:         mac,
+		OptionOrder: "53,61,50,12,81,60,55",
+		VendorClass: "MSFT 5.0",
+		TTL:         128,
+	})
+
+	signals = classifier.signals[mac]
+	if signals.DHCPOptions != "53,61,50,12,81,60,55" || signals.TTL != 128 || signals.VendorClass != "MSFT 5.0" {
+		t.Fatalf("dhcp fingerprint not stored: %#v", signals)
+	}
+
+	rules := []Rule{
+		{SignalType: "tls_ja4", Pattern: "^t13d1516h2_8daaf6152771_", Category: "laptop", Weight: 2},
+		{SignalType: "dhcp_options", Pattern: "^53,61,50,12,81,60,55$", Category: "laptop", Weight: 2},
+		{SignalType: "ttl", Pattern: "^128$", Category: "laptop"},
+	}
+	if err := compileRules(rules); err != nil {
+		t.Fatalf("fingerprint rules rejected: %v", err)
+	}
+
+	classifier.mu.Lock()
+	classifier.custom = rules
+	classifier.rebuildRulesLocked()
+	classifier.rescoreLocked()
+	classifier.mu.Unlock()
+
+	result := classifier.classifications[mac]
+	if result.Category != "laptop" || result.Confidence != "High" {
+		t.Fatalf("fingerprint rules not applied: %#v", result)
+	}
+}
+
 func TestDNSQuerySignals(t *testing.T) {
 	classifier := testClassifier(t)
 	mac := "00:11:22:33:44:55"
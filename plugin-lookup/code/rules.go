@@ -6,11 +6,12 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 type Rule struct {
-	SignalType string //oui (mac prefix), mac_vendor, hostname, mdns_service, mdns_txt, ssdp, dns, vendor_class, dhcp_params
+	SignalType string //oui (mac prefix), mac_vendor, hostname, mdns_service, mdns_txt, ssdp, dns, vendor_class, dhcp_params, dhcp_options, ttl, tls_ja3, tls_ja4
 	Pattern    string
 	Vendor     string
 	Category   string
@@ -43,6 +44,10 @@ type DeviceSignals struct {
 	TXT          map[string]string
 	SSDPHeaders  map[string]string
 	Domains      []string //dns queries, deduped, capped
+	DHCPOptions  string   //order of the options in the dhcp request, comma separated option numbers
+	TTL          int      //initial ip ttl guessed from observed packets, an os hint
+	TLSJA3       []string //ja3 hashes of tls client hellos, deduped, capped
+	TLSJA4       []string //ja4 fingerprints of tls client hellos, deduped, capped
 }
 
 type Classification struct {
@@ -87,7 +92,7 @@ func compileRulePattern(pattern string) (*regexp.Regexp, error) {
 	return regexp.Compile("(?i)" + pattern)
 }
 
-var validSignalTypes = []string{"oui", "mac_vendor", "hostname", "mdns_service", "mdns_txt", "ssdp", "dns", "vendor_class", "dhcp_params"}
+var validSignalTypes = []string{"oui", "mac_vendor", "hostname", "mdns_service", "mdns_txt", "ssdp", "dns", "vendor_class", "dhcp_params", "dhcp_options", "ttl", "tls_ja3", "tls_ja4"}
 
 // validate and compile user-supplied rules in place
 func compileRules(rules []Rule) error {
@@ -150,6 +155,14 @@ func signalValues(signals *DeviceSignals) map[string][]string {
 		values["ssdp"] = append(values["ssdp"], key+": "+value)
 	}
 	values["dns"] = signals.Domains
+	if signals.DHCPOptions != "" {
+		values["dhcp_options"] = []string{signals.DHCPOptions}
+	}
+	if signals.TTL != 0 {
+		values["ttl"] = []string{strconv.Itoa(signals.TTL)}
+	}
+	values["tls_ja3"] = signals.TLSJA3
+	values["tls_ja4"] = signals.TLSJA4
 
 	return values
 }
@@ -272,10 +285,16 @@ func classifyDevice(signals *DeviceSignals, db *FingerprintDB) Classification {
 	result.Category = category
 
 	conflict := runnerUpScore >= categoryHyp.score
-	onlyMAC := len(categoryHyp.signalTypes) == 1 && categoryHyp.signalTypes["mac"]
+	//a randomized mac or the ttl alone are only hints
+	weakOnly := true
+	for signalType := range categoryHyp.signalTypes {
+		if signalType != "mac" && signalType != "ttl" {
+			weakOnly = false
+		}
+	}
 
 	switch {
-	case conflict || onlyMAC:
+	case conflict || weakOnly:
 		result.Confidence = "Low"
 		if conflict {
 			result.Evidence = append(result.Evidence, "conflicting signals, confidence reduced")
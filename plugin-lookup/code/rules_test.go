@@ -100,6 +100,18 @@ func TestClassifyRandomMACIsLowConfidence(t *testing.T) {
 	}
 }
 
+func TestClassifyTTLAloneIsLowConfidence(t *testing.T) {
+	db := testDB(t)
+	rule := Rule{SignalType: "ttl", Pattern: `^128$`, Category: "laptop", Weight: 1}
+	rule.compiled, _ = compileRulePattern(rule.Pattern)
+	db.Rules = append(db.Rules, rule)
+
+	result := classifyDevice(&DeviceSignals{MAC: "00:11:22:33:44:55", TTL: 128}, db)
+	if result.Category != "laptop" || result.Confidence != "Low" {
+		t.Fatalf("ttl hint alone: %#v", result)
+	}
+}
+
 func TestClassifyKeepsOUIVendorWhenCategoryUnknown(t *testing.T) {
 	result := classifyDevice(&DeviceSignals{
 		MAC:       "00:11:22:33:44:55",
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	sprbus "github.com/spr-networks/sprbus-json"
+)
+
+/*
+Health probes and restart supervision for plugins.
+
+Each configured plugin service is probed on its own interval. A probe
+fails when the container is not running, a KVM plugin has lost its VM,
+the plugin is above its resource limits, or the http, tcp or unix socket
+check fails. After FailureThreshold consecutive failures the plugin is
+marked unhealthy and, with AutoRestart, restarted. Restarts back off
+exponentially and the backoff resets once the plugin stays healthy.
+*/
+
+var PLUGIN_HEALTH_PATH = "configs/base/plugin_health.json"
+
+const (
+	pluginHealthInitialBackoff = 30 * time.Second
+	pluginHealthMaxBackoff     = 30 * time.Minute
+	pluginHealthBackoffReset   = 10 * time.Minute
+)
+
+var PluginHealthProbeTypes = []string{"running", "http", "tcp", "unix"}
+
+type PluginHealthProbe struct {
+	ComposeFile      string
+	Service          string
+	Type             string //running, http, tcp or unix
+	Target           string `json:",omitempty"`
+	IntervalSeconds  int
+	TimeoutSeconds   int
+	FailureThreshold int
+	GraceSeconds     int     //probes are skipped this long after a restart
+	MaxCPUPercent    float64 `json:",omitempty"`
+	MaxMemoryMiB     int     `json:",omitempty"`
+	AutoRestart      bool
+}
+
+type PluginHealthStatus struct {
+	ComposeFile         string
+	Service             string
+	ContainerID         string `json:",omitempty"`
+	State               string //unknown, healthy, unhealthy or restarting
+	ConsecutiveFailures int
+	LastCheck           time.Time
+	LastError           string               `json:",omitempty"`
+	Usage               *VirtualMachineUsage `json:",omitempty"`
+	Restarts            int
+	LastRestart         time.Time
+	NextRestart         time.Time
+	BackoffSeconds      int
+}
+
+var pluginHealthMtx sync.Mutex
+var pluginHealthProbes = []PluginHealthProbe{}
+var pluginHealthStatus = map[string]*PluginHealthStatus{}
+
+func pluginHealthKey(composeFile, service string) string {
+	return composeFile + "|" + service
+}
+
+func validatePluginHealthProbe(probe *PluginHealthProbe) error {
+	probe.ComposeFile = filepath.ToSlash(filepath.Clean(probe.ComposeFile))
+	if probe.ComposeFile == "." || filepath.IsAbs(probe.ComposeFile) || strings.HasPrefix(probe.ComposeFile, "..") {
+		return fmt.Errorf("invalid compose file %q", probe.ComposeFile)
+	}
+	if probe.Service == "" || strings.ContainsAny(probe.Service, " \t\"'") {
+		return fmt.Errorf("invalid service %q", probe.Service)
+	}
+
+	if probe.Type == "" {
+		probe.Type = "running"
+	}
+	if probe.IntervalSeconds == 0 {
+		probe.IntervalSeconds = 30
+	}
+	if probe.TimeoutSeconds == 0 {
+		probe.TimeoutSeconds = 5
+	}
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = 3
+	}
+	if probe.GraceSeconds == 0 {
+		probe.GraceSeconds = 60
+	}
+
+	if probe.IntervalSeconds < 5 || probe.IntervalSeconds > 3600 {
+		return fmt.Errorf("IntervalSeconds must be 5-3600")
+	}
+	if probe.TimeoutSeconds < 1 || probe.TimeoutSeconds >= probe.IntervalSeconds {
+		return fmt.Errorf("TimeoutSeconds must be at least 1 and below IntervalSeconds")
+	}
+	if probe.FailureThreshold < 1 || probe.FailureThreshold > 100 {
+		return fmt.Errorf("FailureThreshold must be 1-100")
+	}
+	if probe.GraceSeconds < 0 || probe.GraceSeconds > 3600 {
+		return fmt.Errorf("GraceSeconds must be 0-3600")
+	}
+	if probe.MaxCPUPercent < 0 || probe.MaxMemoryMiB < 0 {
+		return fmt.Errorf("resource limits must not be negative")
+	}
+
+	switch probe.Type {
+	case "running":
+		if probe.Target != "" {
+			return fmt.Errorf("running probes take no target")
+		}
+	case "http":
+		target, err := url.Parse(probe.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("http probe target must be an http or https url")
+		}
+	case "tcp":
+		if _, _, err := net.SplitHostPort(probe.Target); err != nil {
+			return fmt.Errorf("tcp probe target must be host:port")
+		}
+	case "unix":
+		//sockets are resolved below the super directory
+		cleanPath := filepath.Clean(probe.Target)
+		if probe.Target == "" || cleanPath != probe.Target || filepath.IsAbs(cleanPath) ||
+			cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("unix probe target must be a clean path relative to the super directory")
+		}
+	default:
+		return fmt.Errorf("unsupported probe type %q", probe.Type)
+	}
+	return nil
+}
+
+func validatePluginHealthProbes(probes []PluginHealthProbe) error {
+	seen := map[string]bool{}
+	for i := range probes {
+		if err := validatePluginHealthProbe(&probes[i]); err != nil {
+			return err
+		}
+		key := pluginHealthKey(probes[i].ComposeFile, probes[i].Service)
+		if seen[key] {
+			return fmt.Errorf("duplicate probe for %s %s", probes[i].ComposeFile, probes[i].Service)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func loadPluginHealthConfig() {
+	data, err := os.ReadFile(PLUGIN_HEALTH_PATH)
+	if err != nil {
+		return
+	}
+	probes := []PluginHealthProbe{}
+	if err := json.Unmarshal(data, &probes); err != nil {
+		fmt.Println("failed to load plugin health config", err)
+		return
+	}
+	if err := validatePluginHealthProbes(probes); err != nil {
+		fmt.Println("invalid plugin health config", err)
+		return
+	}
+	setPluginHealthProbes(probes)
+}
+
+func setPluginHealthProbes(probes []PluginHealthProbe) {
+	pluginHealthMtx.Lock()
+	defer pluginHealthMtx.Unlock()
+
+	statuses := map[string]*PluginHealthStatus{}
+	for _, probe := range probes {
+		key := pluginHealthKey(probe.ComposeFile, probe.Service)
+		status, exists := pluginHealthStatus[key]
+		if !exists {
+			status = &PluginHealthStatus{ComposeFile: probe.ComposeFile, Service: probe.Service, State: "unknown"}
+		}
+		statuses[key] = status
+	}
+	pluginHealthProbes = probes
+	pluginHealthStatus = statuses
+}
+
+func pluginHealthForContainer(containerID string) string {
+	pluginHealthMtx.Lock()
+	defer pluginHealthMtx.Unlock()
+	for _, status := range pluginHealthStatus {
+		if status.ContainerID == containerID {
+			return status.State
+		}
+	}
+	return ""
+}
+
+func kvmDebugfsHasPID(pid int) (bool, bool) {
+	entries, err := os.ReadDir(KVM_DEBUGFS_PATH)
+	if err != nil {
+		return false, false
+	}
+	prefix := strconv.Itoa(pid) + "-"
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// findComposeServiceContainer returns the container of service started
+// from composeFile, services of other compose projects may share the name
+func findComposeServiceContainer(composeFile string, service string) (string, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {"com.docker.compose.service=" + service}})
+	if err != nil {
+		return "", err
+	}
+	containers := []dockerContainerSummary{}
+	if err := dockerAPIGetJSON("/containers/json?all=1&filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return "", err
+	}
+
+	configFile := filepath.Join(getHostSuperDir(), composeFile)
+	for _, container := range containers {
+		configFiles := strings.Split(container.Labels["com.docker.compose.project.config_files"], ",")
+		if slices.Contains(configFiles, configFile) {
+			return container.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no container for service %s of %s", service, composeFile)
+}
+
+func checkPluginResourceLimits(probe PluginHealthProbe, usage VirtualMachineUsage) error {
+	if probe.MaxCPUPercent > 0 && usage.CPUPercent > probe.MaxCPUPercent {
+		return fmt.Errorf("cpu %.1f%% above limit %.1f%%", usage.CPUPercent, probe.MaxCPUPercent)
+	}
+	if probe.MaxMemoryMiB > 0 && usage.MemoryBytes > uint64(probe.MaxMemoryMiB)*1024*1024 {
+		return fmt.Errorf("memory %d MiB above limit %d MiB", usage.MemoryBytes/(1024*1024), probe.MaxMemoryMiB)
+	}
+	return nil
+}
+
+func probePluginTarget(probe PluginHealthProbe) error {
+	timeout := time.Duration(probe.TimeoutSeconds) * time.Second
+
+	switch probe.Type {
+	case "http":
+		c := http.Client{Timeout: timeout}
+		resp, err := c.Get(probe.Target)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http probe status %d", resp.StatusCode)
+		}
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", probe.Target, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case "unix":
+		conn, err := net.DialTimeout("unix", filepath.Join(SuperRootPath, probe.Target), timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// runPluginHealthProbe returns the container and its usage with the probe result
+func runPluginHealthProbe(probe PluginHealthProbe) (string, *VirtualMachineUsage, error) {
+	containerID, err := findComposeServiceContainer(probe.ComposeFile, probe.Service)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info := dockerContainerVMInfo{}
+	if err := dockerAPIGetJSON("/containers/"+url.PathEscape(containerID)+"/json", &info); err != nil {
+		return containerID, nil, err
+	}
+	if info.State.Status != "running" {
+		return containerID, nil, fmt.Errorf("container is %s", info.State.Status)
+	}
+	if info.HostConfig.Runtime == "spr-krun" {
+		if found, available := kvmDebugfsHasPID(info.State.PID); available && !found {
+			return containerID, nil, fmt.Errorf("KVM plugin container is running without a VM")
+		}
+	}
+
+	var usage *VirtualMachineUsage
+	if current, err := containerUsage(containerID); err == nil {
+		usage = &current
+		if err := checkPluginResourceLimits(probe, current); err != nil {
+			return containerID, usage, err
+		}
+	}
+
+	return containerID, usage, probePluginTarget(probe)
+}
+
+// pluginHealthDue reports whether a probe should run, probes are held
+// back while a restart is in its grace period
+func pluginHealthDue(probe PluginHealthProbe, status *PluginHealthStatus, now time.Time) bool {
+	if now.Sub(status.LastRestart) < time.Duration(probe.GraceSeconds)*time.Second {
+		return false
+	}
+	return now.Sub(status.LastCheck) >= time.Duration(probe.IntervalSeconds)*time.Second
+}
+
+// recordPluginHealth updates status with a probe result and returns the
+// event to publish: recovered, unhealthy, restart or empty
+func recordPluginHealth(status *PluginHealthStatus, probe PluginHealthProbe, probeErr error, now time.Time) string {
+	status.LastCheck = now
+
+	if probeErr == nil {
+		event := ""
+		if status.State == "unhealthy" || status.State == "restarting" {
+			event = "recovered"
+		}
+		status.State = "healthy"
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+		if status.BackoffSeconds != 0 && now.Sub(status.LastRestart) > pluginHealthBackoffReset {
+			status.BackoffSeconds = 0
+		}
+		return event
+	}
+
+	status.ConsecutiveFailures++
+	status.LastError = probeErr.Error()
+	if status.ConsecutiveFailures < probe.FailureThreshold {
+		return ""
+	}
+
+	event := ""
+	if status.State != "unhealthy" {
+		event = "unhealthy"
+	}
+	status.State = "unhealthy"
+
+	if !probe.AutoRestart || now.Before(status.NextRestart) {
+		return event
+	}
+
+	backoff := time.Duration(status.BackoffSeconds) * time.Second * 2
+	if backoff == 0 {
+		backoff = pluginHealthInitialBackoff
+	}
+	if backoff > pluginHealthMaxBackoff {
+		backoff = pluginHealthMaxBackoff
+	}
+	status.BackoffSeconds = int(backoff / time.Second)
+	status.Restarts++
+	status.LastRestart = now
+	status.NextRestart = now.Add(backoff)
+	status.ConsecutiveFailures = 0
+	status.State = "restarting"
+	return "restart"
+}
+
+func restartUnhealthyPlugin(probe PluginHealthProbe) {
+	fmt.Println("restarting unhealthy plugin " + probe.Service + " from " + probe.ComposeFile)
+	err := composeCommand(probe.ComposeFile, probe.Service, "restart", "", false)
+	if err != nil {
+		fmt.Println("restart failed, falling back to up -d for " + probe.ComposeFile)
+		composeCommand(probe.ComposeFile, probe.Service, "up", "-d", true)
+	}
+}
+
+func checkPluginHealth(now time.Time) {
+	pluginHealthMtx.Lock()
+	due := []PluginHealthProbe{}
+	for _, probe := range pluginHealthProbes {
+		status := pluginHealthStatus[pluginHealthKey(probe.ComposeFile, probe.Service)]
+		if status != nil && pluginHealthDue(probe, status, now) {
+			due = append(due, probe)
+		}
+	}
+	pluginHealthMtx.Unlock()
+
+	for _, probe := range due {
+		containerID, usage, probeErr := runPluginHealthProbe(probe)
+
+		pluginHealthMtx.Lock()
+		status, exists := pluginHealthStatus[pluginHealthKey(probe.ComposeFile, probe.Service)]
+		if !exists {
+			//removed from the config meanwhile
+			pluginHealthMtx.Unlock()
+			continue
+		}
+		if containerID != "" {
+			status.ContainerID = containerID
+		}
+		status.Usage = usage
+		event := recordPluginHealth(status, probe, probeErr, now)
+		snapshot := *status
+		pluginHealthMtx.Unlock()
+
+		if event != "" {
+			sprbus.Publish("plugin:health:"+event, snapshot)
+		}
+		if event == "restart" {
+			go restartUnhealthyPlugin(probe)
+		}
+	}
+}
+
+func pluginHealthSupervisor() {
+	loadPluginHealthConfig()
+
+	ticker := time.NewTicker(5 * time.Second)
+	for range ticker.C {
+		checkPluginHealth(time.Now())
+	}
+}
+
+func pluginHealth(w http.ResponseWriter, r *http.Request) {
+	pluginHealthMtx.Lock()
+	statuses := []PluginHealthStatus{}
+	for _, probe := range pluginHealthProbes {
+		if status, exists := pluginHealthStatus[pluginHealthKey(probe.ComposeFile, probe.Service)]; exists {
+			statuses = append(statuses, *status)
+		}
+	}
+	pluginHealthMtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func pluginHealthConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		probes := []PluginHealthProbe{}
+		if err := json.NewDecoder(r.Body).Decode(&probes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validatePluginHealthProbes(probes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, probe := range probes {
+			if !composePathAllowed(probe.ComposeFile) {
+				http.Error(w, "compose file is not authorized: "+probe.ComposeFile, http.StatusForbidden)
+				return
+			}
+			if !slices.Contains(pluginComposeServices(probe.ComposeFile), probe.Service) {
+				http.Error(w, "service "+probe.Service+" is not defined in "+probe.ComposeFile, http.StatusBadRequest)
+				return
+			}
+		}
+
+		data, err := json.MarshalIndent(probes, "", " ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpPath := PLUGIN_HEALTH_PATH + ".tmp"
+		if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := os.Rename(tmpPath, PLUGIN_HEALTH_PATH); err != nil {
+			os.Remove(tmpPath)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setPluginHealthProbes(probes)
+	}
+
+	pluginHealthMtx.Lock()
+	probes := append([]PluginHealthProbe{}, pluginHealthProbes...)
+	pluginHealthMtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(probes)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidatePluginHealthProbeDefaults(t *testing.T) {
+	probe := PluginHealthProbe{ComposeFile: "plugins/user/atlas/./docker-compose-kvm.yml", Service: "atlas"}
+	if err := validatePluginHealthProbe(&probe); err != nil {
+		t.Fatal(err)
+	}
+	if probe.ComposeFile != "plugins/user/atlas/docker-compose-kvm.yml" {
+		t.Fatalf("ComposeFile = %q", probe.ComposeFile)
+	}
+	if probe.Type != "running" || probe.IntervalSeconds != 30 || probe.TimeoutSeconds != 5 ||
+		probe.FailureThreshold != 3 || probe.GraceSeconds != 60 {
+		t.Fatalf("defaults not applied: %#v", probe)
+	}
+}
+
+func TestValidatePluginHealthProbeRejectsInvalid(t *testing.T) {
+	invalid := []PluginHealthProbe{
+		{ComposeFile: "../docker-compose.yml", Service: "atlas"},
+		{ComposeFile: "/super/docker-compose.yml", Service: "atlas"},
+		{ComposeFile: "docker-compose.yml", Service: ""},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Type: "ping"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Target: "127.0.0.1:80"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Type: "http", Target: "ftp://127.0.0.1/"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Type: "tcp", Target: "127.0.0.1"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Type: "unix", Target: "../run/docker.sock"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", Type: "unix", Target: "/var/run/docker.sock"},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", IntervalSeconds: 1},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", IntervalSeconds: 10, TimeoutSeconds: 10},
+		{ComposeFile: "docker-compose.yml", Service: "atlas", MaxMemoryMiB: -1},
+	}
+	for _, probe := range invalid {
+		entry := probe
+		if err := validatePluginHealthProbe(&entry); err == nil {
+			t.Errorf("validatePluginHealthProbe(%#v) succeeded, want error", probe)
+		}
+	}
+
+	duplicates := []PluginHealthProbe{
+		{ComposeFile: "plugins/user/atlas/docker-compose-kvm.yml", Service: "atlas"},
+		{ComposeFile: "plugins/user/atlas/docker-compose-kvm.yml", Service: "atlas", Type: "tcp", Target: "127.0.0.1:80"},
+	}
+	if err := validatePluginHealthProbes(duplicates); err == nil {
+		t.Fatal("duplicate probes accepted")
+	}
+}
+
+func TestRecordPluginHealthRestartsWithBackoff(t *testing.T) {
+	probe := PluginHealthProbe{FailureThreshold: 2, AutoRestart: true}
+	status := &PluginHealthStatus{State: "unknown"}
+	now := time.Now()
+	failure := errors.New("probe failed")
+
+	if event := recordPluginHealth(status, probe, failure, now); event != "" {
+		t.Fatalf("event after first failure = %q", event)
+	}
+	if event := recordPluginHealth(status, probe, failure, now); event != "restart" {
+		t.Fatalf("event at threshold = %q, want restart", event)
+	}
+	if status.State != "restarting" || status.Restarts != 1 || status.BackoffSeconds != 30 {
+		t.Fatalf("status after restart = %#v", status)
+	}
+
+	//still failing within the backoff: unhealthy, no restart
+	now = now.Add(10 * time.Second)
+	recordPluginHealth(status, probe, failure, now)
+	if event := recordPluginHealth(status, probe, failure, now); event != "unhealthy" {
+		t.Fatalf("event within backoff = %q, want unhealthy", event)
+	}
+
+	//the failures are still counted, the next one after the backoff restarts
+	now = now.Add(time.Minute)
+	if event := recordPluginHealth(status, probe, failure, now); event != "restart" || status.BackoffSeconds != 60 {
+		t.Fatalf("second restart event = %q backoff %d", event, status.BackoffSeconds)
+	}
+
+	now = now.Add(time.Minute)
+	if event := recordPluginHealth(status, probe, nil, now); event != "recovered" || status.State != "healthy" {
+		t.Fatalf("recovery event = %q state %q", event, status.State)
+	}
+	if status.BackoffSeconds != 60 {
+		t.Fatal("backoff reset too early")
+	}
+	now = now.Add(pluginHealthBackoffReset)
+	recordPluginHealth(status, probe, nil, now)
+	if status.BackoffSeconds != 0 {
+		t.Fatalf("BackoffSeconds = %d after staying healthy, want 0", status.BackoffSeconds)
+	}
+}
+
+func TestRecordPluginHealthWithoutAutoRestart(t *testing.T) {
+	probe := PluginHealthProbe{FailureThreshold: 1}
+	status := &PluginHealthStatus{State: "healthy"}
+	now := time.Now()
+
+	if event := recordPluginHealth(status, probe, errors.New("down"), now); event != "unhealthy" {
+		t.Fatalf("event = %q, want unhealthy", event)
+	}
+	if event := recordPluginHealth(status, probe, errors.New("down"), now); event != "" {
+		t.Fatalf("repeated event = %q, want none", event)
+	}
+	if status.Restarts != 0 {
+		t.Fatal("restarted without AutoRestart")
+	}
+}
+
+func TestPluginHealthDueHonorsGrace(t *testing.T) {
+	probe := PluginHealthProbe{IntervalSeconds: 30, GraceSeconds: 60}
+	now := time.Now()
+	status := &PluginHealthStatus{LastCheck: now.Add(-time.Minute), LastRestart: now.Add(-30 * time.Second)}
+	if pluginHealthDue(probe, status, now) {
+		t.Fatal("probe due within restart grace period")
+	}
+	status.LastRestart = now.Add(-2 * time.Minute)
+	if !pluginHealthDue(probe, status, now) {
+		t.Fatal("probe not due after grace period")
+	}
+	status.LastCheck = now.Add(-10 * time.Second)
+	if pluginHealthDue(probe, status, now) {
+		t.Fatal("probe due before its interval")
+	}
+}
+
+func TestProbePluginTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthy" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	if err := probePluginTarget(PluginHealthProbe{Type: "http", Target: server.URL + "/healthy", TimeoutSeconds: 2}); err != nil {
+		t.Fatalf("healthy http probe: %v", err)
+	}
+	if err := probePluginTarget(PluginHealthProbe{Type: "http", Target: server.URL + "/hung", TimeoutSeconds: 2}); err == nil {
+		t.Fatal("http probe accepted a 503")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if err := probePluginTarget(PluginHealthProbe{Type: "tcp", Target: address, TimeoutSeconds: 2}); err != nil {
+		t.Fatalf("tcp probe: %v", err)
+	}
+	listener.Close()
+	if err := probePluginTarget(PluginHealthProbe{Type: "tcp", Target: address, TimeoutSeconds: 2}); err == nil {
+		t.Fatal("tcp probe succeeded against a closed port")
+	}
+}
+
+func TestCheckPluginResourceLimits(t *testing.T) {
+	probe := PluginHealthProbe{MaxCPUPercent: 90, MaxMemoryMiB: 128}
+	if err := checkPluginResourceLimits(probe, VirtualMachineUsage{CPUPercent: 50, MemoryBytes: 64 << 20}); err != nil {
+		t.Fatalf("usage within limits: %v", err)
+	}
+	if err := checkPluginResourceLimits(probe, VirtualMachineUsage{CPUPercent: 180}); err == nil {
+		t.Fatal("cpu limit not enforced")
+	}
+	if err := checkPluginResourceLimits(probe, VirtualMachineUsage{MemoryBytes: 256 << 20}); err == nil {
+		t.Fatal("memory limit not enforced")
+	}
+	if err := checkPluginResourceLimits(PluginHealthProbe{}, VirtualMachineUsage{CPUPercent: 400, MemoryBytes: 1 << 40}); err != nil {
+		t.Fatalf("limits applied without configuration: %v", err)
+	}
+}
+
+func TestFindComposeServiceContainer(t *testing.T) {
+	serveDockerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/superd/json":
+			w.Write([]byte(`{"Config":{"Labels":{"com.docker.compose.project.working_dir":"/home/spr/super"}}}`))
+		case "/containers/json":
+			//a user plugin with its own "api" service shares the service label
+			w.Write([]byte(`[
+				{"Id":"user-api","Labels":{"com.docker.compose.service":"api",
+					"com.docker.compose.project.config_files":"/home/spr/super/plugins/user/spr-test/docker-compose.yml"}},
+				{"Id":"super-api","Labels":{"com.docker.compose.service":"api",
+					"com.docker.compose.project.config_files":"/home/spr/super/docker-compose.yml,/home/spr/super/state/krun/override.yml"}}
+			]`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	id, err := findComposeServiceContainer("docker-compose.yml", "api")
+	if err != nil || id != "super-api" {
+		t.Fatalf("findComposeServiceContainer = %q, %v, want super-api", id, err)
+	}
+
+	id, err = findComposeServiceContainer("plugins/user/spr-test/docker-compose.yml", "api")
+	if err != nil || id != "user-api" {
+		t.Fatalf("findComposeServiceContainer = %q, %v, want user-api", id, err)
+	}
+
+	if _, err = findComposeServiceContainer("dyndns/docker-compose.yml", "api"); err == nil {
+		t.Fatal("found a container of another compose file")
+	}
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+import (
+	sprbus "github.com/spr-networks/sprbus-json"
+)
+
+/*
+Staged updates of the default compose project.
+
+The UI sets the release with PUT /release and pulls /super with
+/update_git before it calls /update, so the running release info and git
+revision are recorded by the first of these calls. Before an update pulls
+new images the image ids of the running containers are recorded and
+tagged with rollbackImageTag so they are kept. Once the update is
+started, health checks run until they pass stagedUpdatePassesNeeded times
+in a row. If they do not pass within the grace window the previous
+release info, git revision and images are restored and the project is
+started again. The outcome is reported through /release.
+*/
+
+var StagedUpdatePath = TEST_PREFIX + "/state/superd/staged_update.json"
+var RunningReleasePath = TEST_PREFIX + "/state/superd/running_release.json"
+
+const (
+	stagedUpdateGrace         = 5 * time.Minute
+	stagedUpdateCheckInterval = 15 * time.Second
+	stagedUpdatePassesNeeded  = 3
+	rollbackTagName           = "spr-rollback"
+)
+
+type UpdateCheck struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+type StagedUpdate struct {
+	State          string //staged, verifying, succeeded, aborted, rolling_back, rolled_back or rollback_failed
+	StagedAt       time.Time
+	StartedAt      time.Time
+	Deadline       time.Time
+	FinishedAt     time.Time
+	Previous       ReleaseInfo
+	PreviousImages map[string]string //image tag to the image id before the update
+	PreviousGit    string            `json:",omitempty"` //revision of /super before the update
+	Passes         int
+	Checks         []UpdateCheck
+	Error          string `json:",omitempty"`
+}
+
+// the release the running containers were started with, recorded before
+// the release or /super are changed for an update
+type RunningRelease struct {
+	Release     ReleaseInfo
+	GitRevision string
+	RecordedAt  time.Time
+}
+
+var stagedUpdateMtx sync.Mutex
+
+// swapped out by tests
+var stagedUpdateCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+var stagedUpdateChecks = runUpdateChecks
+var stagedUpdateComposeUp = func() error {
+	return composeCommand("", "", "up", "-d", true)
+}
+
+func loadStagedUpdateLocked() *StagedUpdate {
+	data, err := os.ReadFile(StagedUpdatePath)
+	if err != nil {
+		return nil
+	}
+	update := StagedUpdate{}
+	if err := json.Unmarshal(data, &update); err != nil {
+		fmt.Println("[-] failed to load staged update", err)
+		return nil
+	}
+	return &update
+}
+
+func saveStagedUpdateLocked(update *StagedUpdate) error {
+	if err := os.MkdirAll(filepath.Dir(StagedUpdatePath), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(update, "", " ")
+	if err != nil {
+		return err
+	}
+	tmpPath := StagedUpdatePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, StagedUpdatePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func loadRunningReleaseLocked() *RunningRelease {
+	data, err := os.ReadFile(RunningReleasePath)
+	if err != nil {
+		return nil
+	}
+	running := RunningRelease{}
+	if err := json.Unmarshal(data, &running); err != nil {
+		fmt.Println("[-] failed to load running release", err)
+		return nil
+	}
+	return &running
+}
+
+func gitRevision() (string, error) {
+	out, err := stagedUpdateCommand("git", "-C", SuperRootPath, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func restoreGitRevision(revision string) error {
+	if revision == "" {
+		return nil
+	}
+	if current, err := gitRevision(); err == nil && current == revision {
+		return nil
+	}
+	//--keep moves the branch back without discarding local changes
+	out, err := stagedUpdateCommand("git", "-C", SuperRootPath, "reset", "--keep", revision)
+	if err != nil {
+		return fmt.Errorf("git reset %s: %v: %s", revision, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// recordRunningRelease keeps the release and git revision in use before
+// the first change, later changes until the update starts keep the record
+func recordRunningRelease() error {
+	stagedUpdateMtx.Lock()
+	defer stagedUpdateMtx.Unlock()
+
+	if stagedUpdateActive(loadStagedUpdateLocked()) {
+		return fmt.Errorf("the previous update is still being verified")
+	}
+	if loadRunningReleaseLocked() != nil {
+		return nil
+	}
+
+	running := RunningRelease{Release: currentReleaseInfo(), RecordedAt: time.Now().UTC()}
+	revision, err := gitRevision()
+	if err != nil {
+		fmt.Println("[-] failed to record the git revision", err)
+	}
+	running.GitRevision = revision
+
+	data, err := json.MarshalIndent(running, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(RunningReleasePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(RunningReleasePath, data, 0600)
+}
+
+func currentStagedUpdate() *StagedUpdate {
+	stagedUpdateMtx.Lock()
+	defer stagedUpdateMtx.Unlock()
+	return loadStagedUpdateLocked()
+}
+
+func stagedUpdateActive(update *StagedUpdate) bool {
+	return update != nil && (update.State == "verifying" || update.State == "rolling_back")
+}
+
+func currentReleaseInfo() ReleaseInfo {
+	info := ReleaseInfo{
+		CustomChannel: getReleaseChannel(),
+		CustomVersion: getReleaseVersion(),
+	}
+	v, err := dockerImageLabel("superd", "org.supernetworks.version")
+	if err != nil {
+		fmt.Println("[i] Failed to retrieve version for superd")
+	} else {
+		info.Current = v
+	}
+	return info
+}
+
+// rollbackImageTag keeps an image of the previous release under the same
+// repository, ghcr.io/spr-networks/super_api:latest becomes
+// ghcr.io/spr-networks/super_api:spr-rollback
+func rollbackImageTag(image string) string {
+	repository := image
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository = repository[:at]
+	}
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+	return repository + ":" + rollbackTagName
+}
+
+func dockerTag(imageID string, tag string) error {
+	out, err := stagedUpdateCommand("docker", "tag", imageID, tag)
+	if err != nil {
+		return fmt.Errorf("docker tag %s %s: %v: %s", imageID, tag, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func restorePreviousImages(images map[string]string) error {
+	failures := []string{}
+	for tag, id := range images {
+		if id == "" {
+			continue
+		}
+		if err := dockerTag(id, tag); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to restore images: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func restoreReleaseInfo(info ReleaseInfo) error {
+	if info.CustomChannel == "" && info.CustomVersion == "" {
+		resetCustomVersion()
+		return nil
+	}
+	if err := setReleaseChannel(info.CustomChannel); err != nil {
+		return err
+	}
+	if info.CustomVersion == "" {
+		os.Remove(ReleaseVersionFile)
+		return nil
+	}
+	return setReleaseVersion(info.CustomVersion)
+}
+
+// runningProjectImages maps the image tags of the running project
+// containers to their image ids
+func runningProjectImages() (map[string]string, error) {
+	containers := []struct {
+		Image   string
+		ImageID string
+	}{}
+	if err := listProjectContainers(false, &containers); err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{}
+	for _, container := range containers {
+		//a container of a retagged image only knows the image id
+		if container.ImageID == "" || strings.HasPrefix(container.Image, "sha256:") {
+			continue
+		}
+		images[container.Image] = container.ImageID
+	}
+	return images, nil
+}
+
+// stageUpdate records the running release before an update of the default compose
+func stageUpdate() error {
+	stagedUpdateMtx.Lock()
+	defer stagedUpdateMtx.Unlock()
+
+	existing := loadStagedUpdateLocked()
+	if stagedUpdateActive(existing) {
+		return fmt.Errorf("the previous update is still being verified")
+	}
+	if existing != nil && existing.State == "staged" {
+		//an earlier pull was never started, the running release is unchanged
+		existing.StagedAt = time.Now().UTC()
+		return saveStagedUpdateLocked(existing)
+	}
+
+	update := &StagedUpdate{State: "staged", StagedAt: time.Now().UTC()}
+	if running := loadRunningReleaseLocked(); running != nil {
+		update.Previous = running.Release
+		update.PreviousGit = running.GitRevision
+	} else {
+		update.Previous = currentReleaseInfo()
+		update.PreviousGit, _ = gitRevision()
+	}
+
+	previous, err := runningProjectImages()
+	if err != nil {
+		return err
+	}
+	for tag, id := range previous {
+		if err := dockerTag(id, rollbackImageTag(tag)); err != nil {
+			return err
+		}
+	}
+	update.PreviousImages = previous
+
+	return saveStagedUpdateLocked(update)
+}
+
+// abortStagedUpdate restores the image tags after a failed pull
+func abortStagedUpdate(reason error) {
+	stagedUpdateMtx.Lock()
+	defer stagedUpdateMtx.Unlock()
+
+	update := loadStagedUpdateLocked()
+	if update == nil || update.State != "staged" {
+		return
+	}
+	update.State = "aborted"
+	update.FinishedAt = time.Now().UTC()
+	update.Error = reason.Error()
+	if err := restorePreviousImages(update.PreviousImages); err != nil {
+		update.Error += "; " + err.Error()
+	}
+	saveStagedUpdateLocked(update)
+}
+
+// startStagedUpdate opens the grace window, it is called before the
+// default compose is brought up since superd may be replaced by it
+func startStagedUpdate() {
+	stagedUpdateMtx.Lock()
+	defer stagedUpdateMtx.Unlock()
+
+	update := loadStagedUpdateLocked()
+	if update == nil || update.State != "staged" {
+		return
+	}
+	now := time.Now().UTC()
+	update.State = "verifying"
+	update.StartedAt = now
+	update.Deadline = now.Add(stagedUpdateGrace)
+	update.Passes = 0
+	if err := saveStagedUpdateLocked(update); err != nil {
+		fmt.Println("[-] failed to save staged update", err)
+	}
+	//the update now owns the previous release
+	os.Remove(RunningReleasePath)
+}
+
+func checkAPIReachable() error {
+	c := http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Get("http://127.0.0.1:80/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("api status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkDNSAnswering sends a query to address, any well formed response
+// counts since upstream resolvers may be unreachable after an update
+func checkDNSAnswering(address string) error {
+	name, err := dnsmessage.NewName("localhost.")
+	if err != nil {
+		return err
+	}
+	id := uint16(time.Now().UnixNano())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("udp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(buf[:n])
+	if err != nil {
+		return err
+	}
+	if header.ID != id || !header.Response {
+		return fmt.Errorf("unexpected dns response")
+	}
+	return nil
+}
+
+// udpPortListening reads /proc/net/udp for a bound local port
+func udpPortListening(port int) (bool, error) {
+	f, err := os.Open(filepath.Join(PROC_PATH, "net", "udp"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		_, portHex, found := strings.Cut(fields[1], ":")
+		if !found {
+			continue
+		}
+		local, err := strconv.ParseUint(portHex, 16, 16)
+		if err == nil && int(local) == port {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+func checkDHCPListening() error {
+	listening, err := udpPortListening(67)
+	if err != nil {
+		return err
+	}
+	if !listening {
+		return fmt.Errorf("no dhcp server on udp port 67")
+	}
+	return nil
+}
+
+// listProjectContainers decodes the containers of the compose project of superd
+func listProjectContainers(all bool, containers interface{}) error {
+	project, err := dockerObjectLabel("superd", "com.docker.compose.project")
+	if err != nil {
+		return err
+	}
+	if project == "" {
+		return fmt.Errorf("compose project of superd not found")
+	}
+
+	filters, err := json.Marshal(map[string][]string{"label": {"com.docker.compose.project=" + project}})
+	if err != nil {
+		return err
+	}
+	path := "/containers/json?all=0&filters="
+	if all {
+		path = "/containers/json?all=1&filters="
+	}
+	return dockerAPIGetJSON(path+url.QueryEscape(string(filters)), containers)
+}
+
+// checkContainersRunning fails for containers of the project that are
+// not running, except for one shot containers that exited cleanly
+func checkContainersRunning() error {
+	containers := []struct {
+		ID    string
+		Names []string
+		State string
+	}{}
+	if err := listProjectContainers(true, &containers); err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for _, container := range containers {
+		if container.State == "running" {
+			continue
+		}
+		name := container.ID
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		if container.State == "exited" {
+			info := struct {
+				State struct {
+					ExitCode int
+				}
+			}{}
+			err := dockerAPIGetJSON("/containers/"+url.PathEscape(container.ID)+"/json", &info)
+			if err == nil && info.State.ExitCode == 0 {
+				continue
+			}
+		}
+		failures = append(failures, name+" is "+container.State)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+func runUpdateChecks() []UpdateCheck {
+	checks := []struct {
+		name    string
+		service string
+		check   func() error
+	}{
+		{"containers", "", checkContainersRunning},
+		{"api", "api", checkAPIReachable},
+		{"dns", "dns", func() error { return checkDNSAnswering("127.0.0.1:53") }},
+		{"dhcp", "dhcp", checkDHCPListening},
+	}
+
+	services := pluginComposeServices(getDefaultCompose())
+	results := []UpdateCheck{}
+	for _, entry := range checks {
+		if entry.service != "" {
+			//the network checks need the host network namespace
+			if isVirtual() || !slices.Contains(services, entry.service) {
+				continue
+			}
+		}
+		result := UpdateCheck{Name: entry.name, OK: true}
+		if err := entry.check(); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// evaluateStagedUpdate records check results and returns the next state,
+// or an empty string while the update is still being verified
+func evaluateStagedUpdate(update *StagedUpdate, checks []UpdateCheck, now time.Time) string {
+	update.Checks = checks
+
+	passed := true
+	for _, check := range checks {
+		if !check.OK {
+			passed = false
+			break
+		}
+	}
+	if passed {
+		update.Passes++
+	} else {
+		update.Passes = 0
+	}
+
+	if update.Passes >= stagedUpdatePassesNeeded {
+		if update.State == "rolling_back" {
+			return "rolled_back"
+		}
+		return "succeeded"
+	}
+	if now.After(update.Deadline) {
+		if update.State == "rolling_back" {
+			return "rollback_failed"
+		}
+		return "rolling_back"
+	}
+	return ""
+}
+
+func rollbackStagedUpdate(update StagedUpdate) {
+	fmt.Println("[-] update failed its health checks, rolling back to " + update.Previous.Current)
+
+	errs := []string{}
+	if err := restoreReleaseInfo(update.Previous); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := restoreGitRevision(update.PreviousGit); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := restorePreviousImages(update.PreviousImages); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := stagedUpdateComposeUp(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		stagedUpdateMtx.Lock()
+		defer stagedUpdateMtx.Unlock()
+		current := loadStagedUpdateLocked()
+		if current != nil && current.State == "rolling_back" {
+			current.Error = strings.Join(errs, "; ")
+			saveStagedUpdateLocked(current)
+		}
+	}
+}
+
+func superviseStagedUpdate(now time.Time) {
+	update := currentStagedUpdate()
+	if !stagedUpdateActive(update) {
+		return
+	}
+
+	checks := stagedUpdateChecks()
+
+	stagedUpdateMtx.Lock()
+	update = loadStagedUpdateLocked()
+	if !stagedUpdateActive(update) {
+		stagedUpdateMtx.Unlock()
+		return
+	}
+	next := evaluateStagedUpdate(update, checks, now)
+	switch next {
+	case "rolling_back":
+		update.State = next
+		update.Passes = 0
+		update.Deadline = now.UTC().Add(stagedUpdateGrace)
+	case "succeeded", "rolled_back", "rollback_failed":
+		update.State = next
+		update.FinishedAt = now.UTC()
+	}
+	if err := saveStagedUpdateLocked(update); err != nil {
+		fmt.Println("[-] failed to save staged update", err)
+	}
+	snapshot := *update
+	stagedUpdateMtx.Unlock()
+
+	if next != "" {
+		sprbus.Publish("update:"+next, snapshot)
+	}
+	if next == "rolling_back" {
+		go rollbackStagedUpdate(snapshot)
+	}
+}
+
+func stagedUpdateSupervisor() {
+	ticker := time.NewTicker(stagedUpdateCheckInterval)
+	for range ticker.C {
+		superviseStagedUpdate(time.Now())
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRollbackImageTag(t *testing.T) {
+	tests := map[string]string{
+		"ghcr.io/spr-networks/super_api:latest":       "ghcr.io/spr-networks/super_api:spr-rollback",
+		"ghcr.io/spr-networks/super_api:1.0.2-dev":    "ghcr.io/spr-networks/super_api:spr-rollback",
+		"localhost:5000/super_api":                    "localhost:5000/super_api:spr-rollback",
+		"localhost:5000/super_api:latest":             "localhost:5000/super_api:spr-rollback",
+		"ghcr.io/spr-networks/super_api@sha256:abcd0": "ghcr.io/spr-networks/super_api:spr-rollback",
+	}
+	for image, want := range tests {
+		if got := rollbackImageTag(image); got != want {
+			t.Errorf("rollbackImageTag(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestEvaluateStagedUpdateSucceeds(t *testing.T) {
+	now := time.Now()
+	update := &StagedUpdate{State: "verifying", Deadline: now.Add(time.Minute)}
+	passing := []UpdateCheck{{Name: "api", OK: true}, {Name: "dns", OK: true}}
+	failing := []UpdateCheck{{Name: "api", OK: true}, {Name: "dns", Error: "timeout"}}
+
+	for i := 0; i < stagedUpdatePassesNeeded-1; i++ {
+		if next := evaluateStagedUpdate(update, passing, now); next != "" {
+			t.Fatalf("next = %q after %d passes", next, i+1)
+		}
+	}
+	//a failure starts the count over
+	if next := evaluateStagedUpdate(update, failing, now); next != "" || update.Passes != 0 {
+		t.Fatalf("next = %q passes %d after a failure", next, update.Passes)
+	}
+	for i := 0; i < stagedUpdatePassesNeeded-1; i++ {
+		evaluateStagedUpdate(update, passing, now)
+	}
+	if next := evaluateStagedUpdate(update, passing, now); next != "succeeded" {
+		t.Fatalf("next = %q, want succeeded", next)
+	}
+}
+
+func TestEvaluateStagedUpdateRollsBackAfterGrace(t *testing.T) {
+	now := time.Now()
+	failing := []UpdateCheck{{Name: "containers", Error: "superapi is restarting"}}
+
+	update := &StagedUpdate{State: "verifying", Deadline: now.Add(time.Minute)}
+	if next := evaluateStagedUpdate(update, failing, now); next != "" {
+		t.Fatalf("next = %q within the grace window", next)
+	}
+	if next := evaluateStagedUpdate(update, failing, now.Add(2*time.Minute)); next != "rolling_back" {
+		t.Fatalf("next = %q, want rolling_back", next)
+	}
+	if len(update.Checks) != 1 || update.Checks[0].OK {
+		t.Fatalf("checks not recorded: %#v", update.Checks)
+	}
+
+	update = &StagedUpdate{State: "rolling_back", Deadline: now.Add(time.Minute)}
+	if next := evaluateStagedUpdate(update, failing, now.Add(2*time.Minute)); next != "rollback_failed" {
+		t.Fatalf("next = %q, want rollback_failed", next)
+	}
+
+	update = &StagedUpdate{State: "rolling_back", Deadline: now.Add(time.Minute), Passes: stagedUpdatePassesNeeded - 1}
+	if next := evaluateStagedUpdate(update, []UpdateCheck{{Name: "api", OK: true}}, now); next != "rolled_back" {
+		t.Fatalf("next = %q, want rolled_back", next)
+	}
+}
+
+func TestStagedUpdateStateTransitions(t *testing.T) {
+	originalPath := StagedUpdatePath
+	StagedUpdatePath = filepath.Join(t.TempDir(), "state", "staged_update.json")
+	t.Cleanup(func() { StagedUpdatePath = originalPath })
+
+	stagedUpdateMtx.Lock()
+	err := saveStagedUpdateLocked(&StagedUpdate{State: "staged", Previous: ReleaseInfo{CustomVersion: "1.0.1"}})
+	stagedUpdateMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startStagedUpdate()
+	update := currentStagedUpdate()
+	if update == nil || update.State != "verifying" || update.Deadline.IsZero() {
+		t.Fatalf("update after start = %#v", update)
+	}
+	if !stagedUpdateActive(update) {
+		t.Fatal("verifying update is not active")
+	}
+	if update.Previous.CustomVersion != "1.0.1" {
+		t.Fatalf("previous release lost: %#v", update.Previous)
+	}
+
+	//a pull failure after the start is not an abort
+	abortStagedUpdate(os.ErrDeadlineExceeded)
+	if update := currentStagedUpdate(); update.State != "verifying" {
+		t.Fatalf("State = %q, want verifying", update.State)
+	}
+}
+
+func TestStagedUpdateRollsBackToRunningRelease(t *testing.T) {
+	dir := t.TempDir()
+	originals := []*string{&StagedUpdatePath, &RunningReleasePath, &ReleaseChannelFile, &ReleaseVersionFile}
+	saved := []string{}
+	for _, path := range originals {
+		saved = append(saved, *path)
+	}
+	StagedUpdatePath = filepath.Join(dir, "staged_update.json")
+	RunningReleasePath = filepath.Join(dir, "running_release.json")
+	ReleaseChannelFile = filepath.Join(dir, "release_channel")
+	ReleaseVersionFile = filepath.Join(dir, "release_version")
+
+	originalCommand, originalChecks, originalComposeUp := stagedUpdateCommand, stagedUpdateChecks, stagedUpdateComposeUp
+	t.Cleanup(func() {
+		for i, path := range originals {
+			*path = saved[i]
+		}
+		stagedUpdateCommand, stagedUpdateChecks, stagedUpdateComposeUp = originalCommand, originalChecks, originalComposeUp
+	})
+
+	if err := os.WriteFile(ReleaseVersionFile, []byte("1.0.1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mtx sync.Mutex
+	revision := "1111111"
+	runningImage := "sha256:old-api"
+	commands := []string{}
+	stagedUpdateCommand = func(name string, args ...string) ([]byte, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		command := name + " " + strings.Join(args, " ")
+		commands = append(commands, command)
+		if strings.HasSuffix(command, "rev-parse HEAD") {
+			return []byte(revision + "\n"), nil
+		}
+		return nil, nil
+	}
+
+	serveDockerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/superd/json":
+			w.Write([]byte(`{"Config":{"Labels":{"com.docker.compose.project":"super","org.supernetworks.version":"1.0.1"}}}`))
+		case "/containers/json":
+			mtx.Lock()
+			defer mtx.Unlock()
+			w.Write([]byte(`[
+				{"Image":"ghcr.io/spr-networks/super_api:1.0.1","ImageID":"` + runningImage + `"},
+				{"Image":"sha256:retagged","ImageID":"sha256:retagged"}
+			]`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	//the UI sets the release first, then pulls /super and updates
+	rec := httptest.NewRecorder()
+	release_info(rec, httptest.NewRequest(http.MethodPut, "/release", strings.NewReader(`{"CustomVersion":"1.0.2"}`)))
+	if rec.Code != http.StatusOK || getReleaseVersion() != "1.0.2" {
+		t.Fatalf("PUT /release = %d, version %q", rec.Code, getReleaseVersion())
+	}
+	mtx.Lock()
+	revision = "2222222"
+	mtx.Unlock()
+
+	if err := stageUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	update := currentStagedUpdate()
+	if update.State != "staged" || update.Previous.CustomVersion != "1.0.1" || update.Previous.Current != "1.0.1" {
+		t.Fatalf("previous release = %#v, want the running 1.0.1", update.Previous)
+	}
+	if update.PreviousGit != "1111111" {
+		t.Fatalf("PreviousGit = %q, want the revision before the pull", update.PreviousGit)
+	}
+	want := map[string]string{"ghcr.io/spr-networks/super_api:1.0.1": "sha256:old-api"}
+	if len(update.PreviousImages) != 1 || update.PreviousImages["ghcr.io/spr-networks/super_api:1.0.1"] != "sha256:old-api" {
+		t.Fatalf("PreviousImages = %#v, want %#v", update.PreviousImages, want)
+	}
+
+	//staging again before the start keeps the recorded release
+	mtx.Lock()
+	runningImage = "sha256:other"
+	mtx.Unlock()
+	if err := stageUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if update = currentStagedUpdate(); update.PreviousImages["ghcr.io/spr-networks/super_api:1.0.1"] != "sha256:old-api" {
+		t.Fatalf("PreviousImages replaced: %#v", update.PreviousImages)
+	}
+
+	startStagedUpdate()
+	if _, err := os.Stat(RunningReleasePath); !os.IsNotExist(err) {
+		t.Fatalf("running release kept after the start: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	release_info(rec, httptest.NewRequest(http.MethodPut, "/release", strings.NewReader(`{"CustomVersion":"1.0.3"}`)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("PUT /release during verification = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	composedUp := make(chan struct{}, 1)
+	stagedUpdateComposeUp = func() error {
+		composedUp <- struct{}{}
+		return nil
+	}
+	stagedUpdateChecks = func() []UpdateCheck {
+		return []UpdateCheck{{Name: "api", Error: "connection refused"}}
+	}
+
+	superviseStagedUpdate(time.Now().Add(stagedUpdateGrace + time.Minute))
+	if update = currentStagedUpdate(); update.State != "rolling_back" {
+		t.Fatalf("State = %q, want rolling_back", update.State)
+	}
+	select {
+	case <-composedUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the previous release was not started")
+	}
+
+	if got := getReleaseVersion(); got != "1.0.1" {
+		t.Fatalf("release version = %q after the rollback, want 1.0.1", got)
+	}
+	mtx.Lock()
+	for _, command := range []string{
+		"docker tag sha256:old-api ghcr.io/spr-networks/super_api:spr-rollback",
+		"git -C " + SuperRootPath + " reset --keep 1111111",
+		"docker tag sha256:old-api ghcr.io/spr-networks/super_api:1.0.1",
+	} {
+		if !slices.Contains(commands, command) {
+			t.Errorf("%q not run, commands %q", command, commands)
+		}
+	}
+	mtx.Unlock()
+
+	stagedUpdateChecks = func() []UpdateCheck {
+		return []UpdateCheck{{Name: "api", OK: true}}
+	}
+	for i := 0; i < stagedUpdatePassesNeeded; i++ {
+		superviseStagedUpdate(time.Now())
+	}
+	if update = currentStagedUpdate(); update.State != "rolled_back" || update.Error != "" {
+		t.Fatalf("update after the rollback = %#v", update)
+	}
+}
+
+func TestUDPPortListening(t *testing.T) {
+	procPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(procPath, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	udp := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+		"  12: 00000000:0043 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1234 2 0000000000000000 0\n" +
+		"  13: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1235 2 0000000000000000 0\n"
+	if err := os.WriteFile(filepath.Join(procPath, "net", "udp"), []byte(udp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalProcPath := PROC_PATH
+	PROC_PATH = procPath
+	t.Cleanup(func() { PROC_PATH = originalProcPath })
+
+	for port, want := range map[int]bool{67: true, 53: true, 68: false} {
+		got, err := udpPortListening(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("udpPortListening(%d) = %v, want %v", port, got, want)
+		}
+	}
+}
+
+func TestCheckDNSAnswering(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			//upstream failures still count as an answer
+			reply := dnsmessage.Message{Header: dnsmessage.Header{ID: header.ID, Response: true, RCode: dnsmessage.RCodeServerFailure}}
+			packet, err := reply.Pack()
+			if err == nil {
+				conn.WriteTo(packet, addr)
+			}
+		}
+	}()
+
+	if err := checkDNSAnswering(conn.LocalAddr().String()); err != nil {
+		t.Fatalf("checkDNSAnswering: %v", err)
+	}
+}
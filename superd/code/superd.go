@@ -51,7 +51,8 @@ var ComposeAllowListDefaults = []string{"docker-compose.yml", "docker-compose-te
 	"ppp/docker-compose.yml",
 	"wifid-setup/docker-compose.yml",
 	"wifid-setup/docker-compose-test.yml",
-	"wifi_uplink/docker-compose.yml"}
+	"wifi_uplink/docker-compose.yml",
+	"flowgather/docker-compose.yml"}
 
 var ComposeAllowList = ComposeAllowListDefaults
 
@@ -422,7 +423,19 @@ func update(w http.ResponseWriter, r *http.Request) {
 	target := r.URL.Query().Get("service")
 	compose := r.URL.Query().Get("compose_file")
 
+	//updates of the whole default compose can be rolled back
+	staged := compose == "" && target == ""
+	if staged {
+		if err := stageUpdate(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
 	if status, err := pullVerifiedUpdate(compose, target); err != nil {
+		if staged {
+			abortStagedUpdate(err)
+		}
 		http.Error(w, err.Error(), status)
 		return
 	}
@@ -431,6 +444,9 @@ func update(w http.ResponseWriter, r *http.Request) {
 func start(w http.ResponseWriter, r *http.Request) {
 	target := r.URL.Query().Get("service")
 	compose := r.URL.Query().Get("compose_file")
+	if compose == "" && target == "" {
+		startStagedUpdate()
+	}
 	if err := composeCommand(compose, target, "up", "-d", true); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -782,7 +798,11 @@ func update_git(w http.ResponseWriter, r *http.Request) {
 
 	if git_url == "" {
 		os.Chdir("/super")
-		//update SPR itself
+		//update SPR itself, a failed update rolls back to this revision
+		if err := recordRunningRelease(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		os.Setenv("GIT_TERMINAL_PROMPT", "0")
 		out, _ := exec.Command("git", "pull").CombinedOutput()
 		fmt.Println(string(out))
@@ -1252,26 +1272,25 @@ type ReleaseInfo struct {
 	CustomChannel string
 	CustomVersion string
 	Current       string
+	Update        *StagedUpdate `json:",omitempty"`
 }
 
 func release_info(w http.ResponseWriter, r *http.Request) {
 	info := ReleaseInfo{}
 	if r.Method == http.MethodGet {
-		//load t
-		v, err := dockerImageLabel("superd", "org.supernetworks.version")
-		if err != nil {
-			fmt.Println("[i] Failed to retrieve version for superd")
-		} else {
-			info.Current = v
-		}
-
-		info.CustomChannel = getReleaseChannel()
-		info.CustomVersion = getReleaseVersion()
+		info = currentReleaseInfo()
+		info.Update = currentStagedUpdate()
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(info)
 		return
 	}
 
+	//the running release is what an update rolls back to
+	if err := recordRunningRelease(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
 	if r.Method == http.MethodDelete {
 		resetCustomVersion()
 		w.Header().Set("Content-Type", "application/json")
@@ -1285,6 +1304,7 @@ func release_info(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 400)
 		return
 	}
+	info.Update = nil
 
 	if info.CustomChannel != "" {
 		//right now we only allow "-dev" and "main"
@@ -1738,6 +1758,8 @@ func main() {
 	unix_plugin_router.HandleFunc("/docker_ps", docker_ps).Methods("GET")
 	unix_plugin_router.HandleFunc("/docker_info", docker_info).Methods("GET")
 	unix_plugin_router.HandleFunc("/virtual_machines", virtual_machines).Methods("GET")
+	unix_plugin_router.HandleFunc("/plugin_health", pluginHealth).Methods("GET")
+	unix_plugin_router.HandleFunc("/plugin_health_config", pluginHealthConfig).Methods("GET", "PUT")
 
 	// get/set release channel
 	unix_plugin_router.HandleFunc("/release", release_info).Methods("GET", "PUT", "DELETE")
@@ -1748,6 +1770,12 @@ func main() {
 	unix_plugin_router.HandleFunc("/authorizedKeys", deployAuthorizedKeys).Methods("PUT")
 	unix_plugin_router.HandleFunc("/time/sync", syncTime).Methods("PUT")
 
+	// probe plugins, restart hung ones with backoff
+	go pluginHealthSupervisor()
+
+	// verify staged updates, roll back failed ones
+	go stagedUpdateSupervisor()
+
 	os.Remove(UNIX_PLUGIN_LISTENER)
 	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
 	if err != nil {
@@ -5,12 +5,19 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var KVM_DEBUGFS_PATH = "/sys/kernel/debug/kvm"
+var PROC_PATH = "/proc"
+
+// clock ticks per second for /proc/<pid>/stat, USER_HZ is 100 on linux
+const procClockTicks = 100
 
 type VirtualMachineInfo struct {
 	ID          string
@@ -18,12 +25,26 @@ type VirtualMachineInfo struct {
 	Name        string
 	State       string
 	Container   bool
-	ContainerID string `json:",omitempty"`
-	Runtime     string `json:",omitempty"`
-	Image       string `json:",omitempty"`
-	StartedAt   string `json:",omitempty"`
-	CPUs        int    `json:",omitempty"`
-	MemoryMiB   int    `json:",omitempty"`
+	ContainerID string               `json:",omitempty"`
+	Runtime     string               `json:",omitempty"`
+	Image       string               `json:",omitempty"`
+	StartedAt   string               `json:",omitempty"`
+	CPUs        int                  `json:",omitempty"`
+	MemoryMiB   int                  `json:",omitempty"`
+	Usage       *VirtualMachineUsage `json:",omitempty"`
+	Health      string               `json:",omitempty"`
+}
+
+// live resource usage, counters are totals since the VM or container started
+type VirtualMachineUsage struct {
+	Source           string  //docker-stats or procfs
+	CPUPercent       float64 //of one cpu since the previous sample
+	MemoryBytes      uint64
+	MemoryLimitBytes uint64 `json:",omitempty"`
+	DiskReadBytes    uint64
+	DiskWriteBytes   uint64
+	NetRxBytes       uint64 `json:",omitempty"`
+	NetTxBytes       uint64 `json:",omitempty"`
 }
 
 type VirtualMachineInventory struct {
@@ -31,13 +52,47 @@ type VirtualMachineInventory struct {
 	KVMAvailable               bool
 	ContainerMetadataAvailable bool
 	VirtualMachines            []VirtualMachineInfo
-	Error                      string `json:",omitempty"`
+	Containers                 []VirtualMachineInfo //project containers that are not VMs
+	Error                      string               `json:",omitempty"`
 }
 
 type dockerContainerSummary struct {
-	ID string
+	ID     string
+	Labels map[string]string
+}
+
+type dockerContainerStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	BlkioStats struct {
+		IOServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+}
+
+type cpuSample struct {
+	nanos   uint64
+	at      time.Time
+	percent float64
 }
 
+var cpuSamplesMtx sync.Mutex
+var cpuSamples = map[string]cpuSample{}
+
 type dockerContainerVMInfo struct {
 	ID     string
 	Name   string
@@ -63,18 +118,175 @@ func annotationInt(annotations map[string]string, key string) int {
 	return value
 }
 
+// cpuPercent returns the cpu use of key since its previous sample
+func cpuPercent(key string, nanos uint64, now time.Time) float64 {
+	cpuSamplesMtx.Lock()
+	defer cpuSamplesMtx.Unlock()
+
+	sample := cpuSample{nanos: nanos, at: now}
+	if last, exists := cpuSamples[key]; exists {
+		elapsed := now.Sub(last.at)
+		if elapsed < time.Second && nanos >= last.nanos {
+			//too close to the previous sample to be meaningful
+			return last.percent
+		}
+		if elapsed > 0 && nanos >= last.nanos {
+			sample.percent = float64(nanos-last.nanos) / float64(elapsed.Nanoseconds()) * 100
+		}
+	}
+
+	if len(cpuSamples) > 256 {
+		for k, entry := range cpuSamples {
+			if now.Sub(entry.at) > 10*time.Minute {
+				delete(cpuSamples, k)
+			}
+		}
+	}
+	cpuSamples[key] = sample
+	return sample.percent
+}
+
+func usageFromDockerStats(stats dockerContainerStats) VirtualMachineUsage {
+	usage := VirtualMachineUsage{
+		Source:           "docker-stats",
+		MemoryBytes:      stats.MemoryStats.Usage,
+		MemoryLimitBytes: stats.MemoryStats.Limit,
+	}
+	//match docker stats, page cache is not counted
+	inactive, exists := stats.MemoryStats.Stats["inactive_file"]
+	if !exists {
+		inactive = stats.MemoryStats.Stats["total_inactive_file"]
+	}
+	if inactive < usage.MemoryBytes {
+		usage.MemoryBytes -= inactive
+	}
+
+	for _, entry := range stats.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			usage.DiskReadBytes += entry.Value
+		case "write":
+			usage.DiskWriteBytes += entry.Value
+		}
+	}
+	for _, network := range stats.Networks {
+		usage.NetRxBytes += network.RxBytes
+		usage.NetTxBytes += network.TxBytes
+	}
+	return usage
+}
+
+func containerUsage(containerID string) (VirtualMachineUsage, error) {
+	stats := dockerContainerStats{}
+	err := dockerAPIGetJSON("/containers/"+url.PathEscape(containerID)+"/stats?stream=false&one-shot=true", &stats)
+	if err != nil {
+		return VirtualMachineUsage{}, err
+	}
+	usage := usageFromDockerStats(stats)
+	usage.CPUPercent = cpuPercent(containerID, stats.CPUStats.CPUUsage.TotalUsage, time.Now())
+	return usage, nil
+}
+
+// isKVMProcess checks that pid is a KVM process in our pid namespace,
+// superd does not share the host pid namespace by default
+func isKVMProcess(pid int) bool {
+	fdPath := filepath.Join(PROC_PATH, strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(fdPath)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(fdPath, entry.Name()))
+		if err == nil && target == "anon_inode:kvm-vm" {
+			return true
+		}
+	}
+	return false
+}
+
+func procKeyValues(path string) map[string]uint64 {
+	values := map[string]uint64{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		if err == nil {
+			values[strings.TrimSpace(key)] = n
+		}
+	}
+	return values
+}
+
+func processUsage(pid int) (VirtualMachineUsage, bool) {
+	if !isKVMProcess(pid) {
+		return VirtualMachineUsage{}, false
+	}
+	procDir := filepath.Join(PROC_PATH, strconv.Itoa(pid))
+
+	data, err := os.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return VirtualMachineUsage{}, false
+	}
+	//the command name may contain spaces, fields start after it
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return VirtualMachineUsage{}, false
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return VirtualMachineUsage{}, false
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	nanos := (utime + stime) * uint64(time.Second/procClockTicks)
+
+	status := procKeyValues(filepath.Join(procDir, "status"))
+	io := procKeyValues(filepath.Join(procDir, "io"))
+
+	return VirtualMachineUsage{
+		Source:         "procfs",
+		CPUPercent:     cpuPercent("pid:"+strconv.Itoa(pid), nanos, time.Now()),
+		MemoryBytes:    status["VmRSS"] * 1024,
+		DiskReadBytes:  io["read_bytes"],
+		DiskWriteBytes: io["write_bytes"],
+	}, true
+}
+
+// isProjectContainer reports if a container belongs to the compose project
+// of superd or to a plugin compose file below its working directory
+func isProjectContainer(labels map[string]string, project string, workingDir string) bool {
+	if project != "" && labels["com.docker.compose.project"] == project {
+		return true
+	}
+	dir := labels["com.docker.compose.project.working_dir"]
+	workingDir = strings.TrimSuffix(workingDir, "/")
+	return dir != "" && workingDir != "" && (dir == workingDir || strings.HasPrefix(dir, workingDir+"/"))
+}
+
 func discoverVirtualMachines() VirtualMachineInventory {
 	inventory := VirtualMachineInventory{
 		Discovery:       "kvm-debugfs",
 		VirtualMachines: []VirtualMachineInfo{},
+		Containers:      []VirtualMachineInfo{},
 	}
 
+	//containers are reported without KVM as well
 	entries, err := os.ReadDir(KVM_DEBUGFS_PATH)
 	if err != nil {
 		inventory.Error = err.Error()
-		return inventory
+	} else {
+		inventory.KVMAvailable = true
 	}
-	inventory.KVMAvailable = true
 
 	vmIndexesByPID := map[int][]int{}
 	for _, entry := range entries {
@@ -101,6 +313,12 @@ func discoverVirtualMachines() VirtualMachineInventory {
 		vmIndexesByPID[pid] = append(vmIndexesByPID[pid], index)
 	}
 
+	//without the labels of superd no container is known to be in the project
+	superdLabels := dockerConfigLabels{}
+	dockerAPIGetJSON("/containers/superd/json", &superdLabels)
+	project := superdLabels.Config.Labels["com.docker.compose.project"]
+	workingDir := superdLabels.Config.Labels["com.docker.compose.project.working_dir"]
+
 	containers := []dockerContainerSummary{}
 	if err := dockerAPIGetJSON("/containers/json?all=0", &containers); err == nil {
 		inventory.ContainerMetadataAvailable = true
@@ -112,6 +330,24 @@ func discoverVirtualMachines() VirtualMachineInventory {
 			}
 
 			indexes := vmIndexesByPID[info.State.PID]
+			if len(indexes) == 0 && isProjectContainer(container.Labels, project, workingDir) {
+				entry := VirtualMachineInfo{
+					ID:          info.ID,
+					PID:         info.State.PID,
+					Name:        strings.TrimPrefix(info.Name, "/"),
+					State:       info.State.Status,
+					Container:   true,
+					ContainerID: info.ID,
+					Runtime:     info.HostConfig.Runtime,
+					Image:       info.Config.Image,
+					StartedAt:   info.State.StartedAt,
+					Health:      pluginHealthForContainer(info.ID),
+				}
+				if usage, err := containerUsage(info.ID); err == nil {
+					entry.Usage = &usage
+				}
+				inventory.Containers = append(inventory.Containers, entry)
+			}
 			for _, index := range indexes {
 				vm := &inventory.VirtualMachines[index]
 				vm.Name = strings.TrimPrefix(info.Name, "/")
@@ -123,20 +359,38 @@ func discoverVirtualMachines() VirtualMachineInventory {
 				vm.StartedAt = info.State.StartedAt
 				vm.CPUs = annotationInt(info.HostConfig.Annotations, "krun.cpus")
 				vm.MemoryMiB = annotationInt(info.HostConfig.Annotations, "krun.ram_mib")
+				if usage, err := containerUsage(info.ID); err == nil {
+					vm.Usage = &usage
+				}
+				vm.Health = pluginHealthForContainer(info.ID)
+			}
+		}
+	}
+
+	for i := range inventory.VirtualMachines {
+		vm := &inventory.VirtualMachines[i]
+		if vm.Usage == nil {
+			if usage, ok := processUsage(vm.PID); ok {
+				vm.Usage = &usage
 			}
 		}
 	}
 
-	sort.Slice(inventory.VirtualMachines, func(i, j int) bool {
-		left := strings.ToLower(inventory.VirtualMachines[i].Name)
-		right := strings.ToLower(inventory.VirtualMachines[j].Name)
+	sortVirtualMachines(inventory.VirtualMachines)
+	sortVirtualMachines(inventory.Containers)
+
+	return inventory
+}
+
+func sortVirtualMachines(vms []VirtualMachineInfo) {
+	sort.Slice(vms, func(i, j int) bool {
+		left := strings.ToLower(vms[i].Name)
+		right := strings.ToLower(vms[j].Name)
 		if left == right {
-			return inventory.VirtualMachines[i].ID < inventory.VirtualMachines[j].ID
+			return vms[i].ID < vms[j].ID
 		}
 		return left < right
 	})
-
-	return inventory
 }
 
 func virtual_machines(w http.ResponseWriter, r *http.Request) {
@@ -6,8 +6,34 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
+// serveDockerAPI points DockerSocketPath at handler for the test
+func serveDockerAPI(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	socketDir, err := os.MkdirTemp("/tmp", "spr-superd-vms-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(socketDir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+
+	originalDockerSocketPath := DockerSocketPath
+	DockerSocketPath = socketPath
+	t.Cleanup(func() {
+		DockerSocketPath = originalDockerSocketPath
+		server.Close()
+		os.RemoveAll(socketDir)
+	})
+}
+
 func TestDiscoverVirtualMachinesIncludesNativeAndContainerVMs(t *testing.T) {
 	debugfsPath := t.TempDir()
 	if err := os.Mkdir(filepath.Join(debugfsPath, "1234-7"), 0755); err != nil {
@@ -23,17 +49,7 @@ func TestDiscoverVirtualMachinesIncludesNativeAndContainerVMs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	socketDir, err := os.MkdirTemp("/tmp", "spr-superd-vms-")
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Cleanup(func() { os.RemoveAll(socketDir) })
-	socketPath := filepath.Join(socketDir, "docker.sock")
-	listener, err := net.Listen("unix", socketPath)
-	if err != nil {
-		t.Fatal(err)
-	}
-	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	serveDockerAPI(t, func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/containers/json":
 			w.Write([]byte(`[{"Id":"container-id"}]`))
@@ -48,18 +64,11 @@ func TestDiscoverVirtualMachinesIncludesNativeAndContainerVMs(t *testing.T) {
 		default:
 			http.NotFound(w, r)
 		}
-	})}
-	go server.Serve(listener)
+	})
 
 	originalDebugfsPath := KVM_DEBUGFS_PATH
-	originalDockerSocketPath := DockerSocketPath
 	KVM_DEBUGFS_PATH = debugfsPath
-	DockerSocketPath = socketPath
-	t.Cleanup(func() {
-		KVM_DEBUGFS_PATH = originalDebugfsPath
-		DockerSocketPath = originalDockerSocketPath
-		server.Close()
-	})
+	t.Cleanup(func() { KVM_DEBUGFS_PATH = originalDebugfsPath })
 
 	inventory := discoverVirtualMachines()
 	if !inventory.KVMAvailable {
@@ -91,6 +100,91 @@ func TestDiscoverVirtualMachinesIncludesNativeAndContainerVMs(t *testing.T) {
 	}
 }
 
+func TestDiscoverVirtualMachinesReportsProjectContainers(t *testing.T) {
+	serveDockerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/superd/json":
+			w.Write([]byte(`{"Config":{"Labels":{
+				"com.docker.compose.project":"super",
+				"com.docker.compose.project.working_dir":"/home/spr/super"}}}`))
+		case "/containers/json":
+			w.Write([]byte(`[
+				{"Id":"dns-id","Labels":{"com.docker.compose.project":"super"}},
+				{"Id":"dyndns-id","Labels":{"com.docker.compose.project":"dyndns",
+					"com.docker.compose.project.working_dir":"/home/spr/super/dyndns"}},
+				{"Id":"other-id","Labels":{"com.docker.compose.project":"other",
+					"com.docker.compose.project.working_dir":"/home/spr/super-other"}},
+				{"Id":"plain-id"}
+			]`))
+		case "/containers/dns-id/json":
+			w.Write([]byte(`{"Id":"dns-id","Name":"/superdns","Config":{"Image":"ghcr.io/spr-networks/super_dns"},
+				"State":{"Pid":2001,"Status":"running"},"HostConfig":{"Runtime":"runc"}}`))
+		case "/containers/dyndns-id/json":
+			w.Write([]byte(`{"Id":"dyndns-id","Name":"/superdyndns","State":{"Pid":2002,"Status":"running"}}`))
+		case "/containers/other-id/json", "/containers/plain-id/json":
+			w.Write([]byte(`{"Id":"other","Name":"/other","State":{"Pid":2003,"Status":"running"}}`))
+		case "/containers/dns-id/stats":
+			w.Write([]byte(`{
+				"cpu_stats":{"cpu_usage":{"total_usage":1000}},
+				"memory_stats":{"usage":4096,"limit":8192},
+				"blkio_stats":{"io_service_bytes_recursive":[{"op":"read","value":10},{"op":"write","value":20}]},
+				"networks":{"eth0":{"rx_bytes":30,"tx_bytes":40}}
+			}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	originalDebugfsPath := KVM_DEBUGFS_PATH
+	KVM_DEBUGFS_PATH = filepath.Join(t.TempDir(), "missing")
+	t.Cleanup(func() { KVM_DEBUGFS_PATH = originalDebugfsPath })
+
+	//containers are reported on hosts without KVM
+	inventory := discoverVirtualMachines()
+	if inventory.KVMAvailable || len(inventory.VirtualMachines) != 0 {
+		t.Fatalf("unexpected VMs %#v", inventory)
+	}
+	if got, want := len(inventory.Containers), 2; got != want {
+		t.Fatalf("len(Containers) = %d, want %d: %#v", got, want, inventory.Containers)
+	}
+
+	dns, dyndns := inventory.Containers[0], inventory.Containers[1]
+	if dns.Name != "superdns" || dns.PID != 2001 || dns.Runtime != "runc" || !dns.Container {
+		t.Fatalf("dns container = %#v", dns)
+	}
+	if dns.Usage == nil || dns.Usage.Source != "docker-stats" || dns.Usage.MemoryBytes != 4096 ||
+		dns.Usage.DiskReadBytes != 10 || dns.Usage.DiskWriteBytes != 20 ||
+		dns.Usage.NetRxBytes != 30 || dns.Usage.NetTxBytes != 40 {
+		t.Fatalf("dns usage = %#v", dns.Usage)
+	}
+	if dyndns.Name != "superdyndns" || dyndns.Usage != nil {
+		t.Fatalf("dyndns container = %#v", dyndns)
+	}
+}
+
+func TestIsProjectContainer(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"com.docker.compose.project": "super"}, true},
+		{map[string]string{"com.docker.compose.project.working_dir": "/home/spr/super"}, true},
+		{map[string]string{"com.docker.compose.project.working_dir": "/home/spr/super/plugins/user/spr-test"}, true},
+		{map[string]string{"com.docker.compose.project.working_dir": "/home/spr/super-old"}, false},
+		{map[string]string{"com.docker.compose.project": "other"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isProjectContainer(tt.labels, "super", "/home/spr/super/"); got != tt.want {
+			t.Errorf("isProjectContainer(%v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+
+	if isProjectContainer(map[string]string{"com.docker.compose.project": ""}, "", "") {
+		t.Error("without superd labels no container is in the project")
+	}
+}
+
 func TestDiscoverVirtualMachinesReportsUnavailableDebugfs(t *testing.T) {
 	originalDebugfsPath := KVM_DEBUGFS_PATH
 	KVM_DEBUGFS_PATH = filepath.Join(t.TempDir(), "missing")
@@ -106,4 +200,84 @@ func TestDiscoverVirtualMachinesReportsUnavailableDebugfs(t *testing.T) {
 	if inventory.VirtualMachines == nil {
 		t.Fatal("VirtualMachines is nil, want an empty JSON array")
 	}
+	if inventory.Containers == nil {
+		t.Fatal("Containers is nil, want an empty JSON array")
+	}
+}
+
+func TestUsageFromDockerStats(t *testing.T) {
+	stats := dockerContainerStats{}
+	stats.MemoryStats.Usage = 300 << 20
+	stats.MemoryStats.Limit = 512 << 20
+	stats.MemoryStats.Stats = map[string]uint64{"inactive_file": 100 << 20}
+	stats.BlkioStats.IOServiceBytesRecursive = []struct {
+		Op    string `json:"op"`
+		Value uint64 `json:"value"`
+	}{{"read", 10}, {"Read", 5}, {"write", 7}, {"total", 22}}
+	stats.Networks = map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	}{"eth0": {RxBytes: 1, TxBytes: 2}, "eth1": {RxBytes: 3, TxBytes: 4}}
+
+	usage := usageFromDockerStats(stats)
+	if usage.MemoryBytes != 200<<20 || usage.MemoryLimitBytes != 512<<20 {
+		t.Fatalf("memory usage = %#v", usage)
+	}
+	if usage.DiskReadBytes != 15 || usage.DiskWriteBytes != 7 {
+		t.Fatalf("disk usage = %#v", usage)
+	}
+	if usage.NetRxBytes != 4 || usage.NetTxBytes != 6 {
+		t.Fatalf("network usage = %#v", usage)
+	}
+}
+
+func TestCPUPercentFromSamples(t *testing.T) {
+	now := time.Now()
+	if got := cpuPercent("test-cpu", uint64(time.Second), now); got != 0 {
+		t.Fatalf("first sample = %v, want 0", got)
+	}
+	if got := cpuPercent("test-cpu", uint64(2*time.Second), now.Add(2*time.Second)); got != 50 {
+		t.Fatalf("cpuPercent = %v, want 50", got)
+	}
+	if got := cpuPercent("test-cpu", uint64(3*time.Second), now.Add(2*time.Second+100*time.Millisecond)); got != 50 {
+		t.Fatalf("close sample = %v, want the previous 50", got)
+	}
+}
+
+func TestProcessUsageRequiresKVMProcess(t *testing.T) {
+	procPath := t.TempDir()
+	pidDir := filepath.Join(procPath, "4321")
+	if err := os.MkdirAll(filepath.Join(pidDir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"stat":   "4321 (qemu system) S 1 4321 4321 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 4 0 100\n",
+		"status": "Name:\tqemu\nVmRSS:\t  2048 kB\n",
+		"io":     "rchar: 1\nread_bytes: 4096\nwrite_bytes: 8192\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(pidDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalProcPath := PROC_PATH
+	PROC_PATH = procPath
+	t.Cleanup(func() { PROC_PATH = originalProcPath })
+
+	if _, ok := processUsage(4321); ok {
+		t.Fatal("usage reported for a process without a KVM fd")
+	}
+
+	if err := os.Symlink("anon_inode:kvm-vm", filepath.Join(pidDir, "fd", "9")); err != nil {
+		t.Fatal(err)
+	}
+	usage, ok := processUsage(4321)
+	if !ok {
+		t.Fatal("no usage for KVM process")
+	}
+	if usage.Source != "procfs" || usage.MemoryBytes != 2048*1024 ||
+		usage.DiskReadBytes != 4096 || usage.DiskWriteBytes != 8192 {
+		t.Fatalf("process usage = %#v", usage)
+	}
 }
@@ -11,6 +11,7 @@ server4:
     - router: $LANIP
     - netmask: $TINYNETMASK
     - tiny_subnets: /state/dhcp/leases.txt $TINYNETSTART $TINYNETSTOP 730h0m0s
+    - spr_options:
     - execute: /scripts/dhcp_helper.sh
 
 END
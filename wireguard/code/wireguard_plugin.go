@@ -10,8 +10,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 import (
@@ -32,7 +36,44 @@ var ApiConfigPath = TEST_PREFIX + "/configs/base/api.json"
 var Configmtx sync.Mutex
 
 type SPRConfig struct {
-	Endpoints []string
+	Endpoints     []string
+	Interfaces    []InterfaceConfig `json:",omitempty"`
+	Sites         []SitePeer        `json:",omitempty"`
+	PeerHealth    PeerHealthConfig
+	DisabledPeers []DisabledPeer `json:",omitempty"`
+}
+
+// an additional wireguard interface besides wg0
+type InterfaceConfig struct {
+	Name       string
+	ListenPort int
+}
+
+// a remote router, that routes whole subnets through the tunnel
+type SitePeer struct {
+	Name                string
+	Interface           string
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string `json:",omitempty"`
+	Address             string
+	Subnets             []string
+	PersistentKeepalive int `json:",omitempty"`
+}
+
+// returned when a site is added, for configuring the remote router
+type SiteConfig struct {
+	Site       SitePeer
+	PublicKey  string
+	Endpoint   string
+	ListenPort int
+}
+
+type SiteStatus struct {
+	SitePeer
+	LatestHandshake uint64
+	TransferRx      uint64
+	TransferTx      uint64
 }
 
 type KeyPair struct {
@@ -129,6 +170,10 @@ func clientPeerFromDevice(p wgtypes.Peer) ClientPeer {
 }
 
 func getPeers() ([]ClientPeer, error) {
+	return getInterfacePeers(WireguardInterface)
+}
+
+func getInterfacePeers(iface string) ([]ClientPeer, error) {
 	peers := []ClientPeer{}
 
 	c, err := wgctrl.New()
@@ -138,7 +183,7 @@ func getPeers() ([]ClientPeer, error) {
 	}
 	defer c.Close()
 
-	dev, err := c.Device(WireguardInterface)
+	dev, err := c.Device(iface)
 	if err != nil {
 		fmt.Println("wg show failed", err)
 		return peers, err
@@ -205,13 +250,17 @@ func getEndpoint() (string, error) {
 
 // get the server public key from the wireguard interface
 func getPublicKey() (string, error) {
+	return getInterfacePublicKey(WireguardInterface)
+}
+
+func getInterfacePublicKey(iface string) (string, error) {
 	c, err := wgctrl.New()
 	if err != nil {
 		return "", err
 	}
 	defer c.Close()
 
-	dev, err := c.Device(WireguardInterface)
+	dev, err := c.Device(iface)
 	if err != nil {
 		return "", err
 	}
@@ -272,20 +321,31 @@ func buildWireguardConfig(dev *wgtypes.Device) string {
 }
 
 func saveConfig() error {
+	return saveInterfaceConfig(WireguardInterface)
+}
+
+func interfaceConfigFile(iface string) string {
+	if iface == WireguardInterface {
+		return WireguardConfigFile
+	}
+	return TEST_PREFIX + "/configs/wireguard/" + iface + ".conf"
+}
+
+func saveInterfaceConfig(iface string) error {
 	c, err := wgctrl.New()
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	dev, err := c.Device(WireguardInterface)
+	dev, err := c.Device(iface)
 	if err != nil {
 		return err
 	}
 
 	data := buildWireguardConfig(dev)
 
-	err = ioutil.WriteFile(WireguardConfigFile, []byte(data), 0600)
+	err = ioutil.WriteFile(interfaceConfigFile(iface), []byte(data), 0600)
 	if err != nil {
 		return err
 	}
@@ -491,6 +551,7 @@ type WireguardUpdate struct {
 	PublicKey string
 	Iface     string
 	Name      string
+	Subnets   []string `json:",omitempty"`
 }
 
 func updateWireguardAddress(update WireguardUpdate, doRemove bool) error {
@@ -521,12 +582,20 @@ func updateWireguardAddress(update WireguardUpdate, doRemove bool) error {
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode == 200 {
 		return nil
 	}
 
 	fmt.Println("wireguard-api error", resp.Status)
 
+	//the API explains rejected updates in the body
+	body, _ := ioutil.ReadAll(resp.Body)
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return errors.New("Failed to update API: " + msg)
+	}
+
 	return errors.New("Failed to update API: " + resp.Status)
 
 }
@@ -554,6 +623,21 @@ func pluginPeer(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		//stale peers may have been disabled already
+		spr := loadSprConfig()
+		for i, disabled := range spr.DisabledPeers {
+			if disabled.PublicKey == peer.PublicKey {
+				peerIP = strings.Split(disabled.AllowedIPs, "/")[0]
+				spr.DisabledPeers = append(spr.DisabledPeers[:i], spr.DisabledPeers[i+1:]...)
+				saveSprConfig(spr)
+				break
+			}
+		}
+
+		Healthmtx.Lock()
+		delete(gPeerHealth, peer.PublicKey)
+		Healthmtx.Unlock()
+
 		err = removePeer(peer)
 		if err != nil {
 			fmt.Println("DELETE peer err:", err)
@@ -832,6 +916,8 @@ func pluginUp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	restoreSites()
+
 	informPeersToApi()
 
 	w.Header().Set("Content-Type", "application/json")
@@ -850,6 +936,10 @@ func pluginDown(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, iface := range loadSprConfig().Interfaces {
+		exec.Command("ip", "link", "del", "dev", iface.Name).Run()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(true)
 }
@@ -903,85 +993,1153 @@ func getSetEndpoints(w http.ResponseWriter, r *http.Request) {
 	saveSprConfig(spr)
 }
 
-func logRequest(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if os.Getenv("DEBUGHTTP") != "" {
-			fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+var validSiteName = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,32}$`).MatchString
+
+// interface names need the wg prefix, so the API keeps their devices in groups
+var validInterfaceName = regexp.MustCompile(`^wg[0-9]{1,3}$`).MatchString
+
+type InterfaceStatus struct {
+	InterfaceConfig
+	PublicKey string
+}
+
+// parseSiteSubnets validates the networks routed to a site, and returns
+// them in canonical form
+func parseSiteSubnets(subnets []string) ([]string, error) {
+	parsed := []string{}
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(subnet))
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %s, expected an ipv4 network", subnet)
 		}
-		handler.ServeHTTP(w, r)
-	})
+		if ones, _ := ipnet.Mask.Size(); ones == 0 {
+			return nil, fmt.Errorf("a default route can not be routed to a site")
+		}
+		parsed = append(parsed, ipnet.String())
+	}
+	return parsed, nil
 }
 
-func informPeersToApi() {
-	//inform the API about each configured peer to keep verdict maps for zones
-	//up to date
-	peers, _ := getPeers()
-	for _, p := range peers {
-		IP := strings.Split(p.AllowedIPs, "/")[0]
-		updateWireguardAddress(WireguardUpdate{IP: IP,
-			PublicKey: p.PublicKey,
-			Iface:     WireguardInterface}, false)
+func subnetsOverlap(a string, b string) bool {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return false
 	}
+	return netA.Contains(netB.IP) || netB.Contains(netA.IP)
+}
 
+func siteUpdate(site SitePeer) WireguardUpdate {
+	return WireguardUpdate{IP: site.Address,
+		PublicKey: site.PublicKey,
+		Iface:     site.Interface,
+		Name:      site.Name,
+		Subnets:   site.Subnets}
 }
 
-func wireguardEnabledInConfig() bool {
-	data, err := ioutil.ReadFile(ApiConfigPath)
-	if err != nil {
+func interfaceConfigured(spr SPRConfig, name string) bool {
+	if name == WireguardInterface {
 		return true
 	}
+	for _, iface := range spr.Interfaces {
+		if iface.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	cfg := struct {
-		Plugins []struct {
-			Name    string
-			Enabled bool
+func interfaceListenPort(spr SPRConfig, name string) int {
+	for _, iface := range spr.Interfaces {
+		if iface.Name == name {
+			return iface.ListenPort
 		}
-	}{}
+	}
 
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return true
+	port, err := strconv.Atoi(os.Getenv("WIREGUARD_PORT"))
+	if err != nil {
+		return 51280
 	}
+	return port
+}
 
-	for _, p := range cfg.Plugins {
-		if p.Name == "wireguard" {
-			return p.Enabled
+// configureSitePeer installs a site as a peer, with the tunnel address
+// and the routed subnets as allowed ips
+func configureSitePeer(site SitePeer) error {
+	pk, err := wgtypes.ParseKey(site.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	psk, err := wgtypes.ParseKey(site.PresharedKey)
+	if err != nil {
+		return fmt.Errorf("invalid preshared key: %v", err)
+	}
+
+	nets, err := parseAllowedIPs(strings.Join(append([]string{site.Address}, site.Subnets...), ","))
+	if err != nil {
+		return err
+	}
+
+	keepalive := time.Duration(site.PersistentKeepalive) * time.Second
+	peer := wgtypes.PeerConfig{
+		PublicKey:                   pk,
+		PresharedKey:                &psk,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  nets,
+		PersistentKeepaliveInterval: &keepalive,
+	}
+
+	if site.Endpoint != "" {
+		endpoint, err := net.ResolveUDPAddr("udp", site.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %v", err)
 		}
+		peer.Endpoint = endpoint
 	}
 
-	return true
+	c, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.ConfigureDevice(site.Interface, wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
 }
 
-func main() {
-	if wireguardEnabledInConfig() {
-		if _, err := exec.Command("/scripts/up.sh").Output(); err != nil {
-			fmt.Println("wg up failed at startup", err)
+func removeSitePeer(site SitePeer) error {
+	publicKey, err := wgtypes.ParseKey(site.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.ConfigureDevice(site.Interface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, Remove: true}},
+	})
+}
+
+// wireguard does not install routes for allowed ips, route the subnets
+// to the interface
+func setSiteRoutes(iface string, subnets []string, add bool) {
+	for _, subnet := range subnets {
+		if add {
+			err := exec.Command("ip", "route", "replace", subnet, "dev", iface).Run()
+			if err != nil {
+				fmt.Println("failed to add site route", subnet, iface, err)
+			}
+		} else {
+			exec.Command("ip", "route", "del", subnet, "dev", iface).Run()
 		}
+	}
+}
 
-		if err := migrateLegacyMulticastAllowedIPs(); err != nil {
-			fmt.Println("failed to remove legacy multicast AllowedIPs", err)
+// bringUpInterface creates an additional interface, restoring its saved
+// configuration or generating a new private key
+func bringUpInterface(iface InterfaceConfig) error {
+	//fails when the link exists already
+	exec.Command("ip", "link", "add", "dev", iface.Name, "type", "wireguard").Run()
+
+	path := interfaceConfigFile(iface.Name)
+	if _, err := os.Stat(path); err == nil {
+		err = exec.Command("wg", "setconf", iface.Name, path).Run()
+		if err != nil {
+			return fmt.Errorf("wg setconf %s failed: %v", iface.Name, err)
 		}
 	}
 
-	unix_plugin_router := mux.NewRouter().StrictSlash(true)
+	c, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
 
-	unix_plugin_router.HandleFunc("/genkey", pluginGenKey).Methods("GET")
-	unix_plugin_router.HandleFunc("/config", pluginGetConfig).Methods("GET")
-	unix_plugin_router.HandleFunc("/status", pluginGetStatus).Methods("GET")
-	unix_plugin_router.HandleFunc("/peers", pluginGetPeers).Methods("GET")
-	unix_plugin_router.HandleFunc("/peer", pluginPeer).Methods("PUT", "DELETE")
+	dev, err := c.Device(iface.Name)
+	if err != nil {
+		return err
+	}
 
-	unix_plugin_router.HandleFunc("/up", pluginUp).Methods("PUT")
-	unix_plugin_router.HandleFunc("/down", pluginDown).Methods("PUT")
+	config := wgtypes.Config{ListenPort: &iface.ListenPort}
+	if dev.PrivateKey == (wgtypes.Key{}) {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		config.PrivateKey = &key
+	}
 
-	unix_plugin_router.HandleFunc("/endpoints", getSetEndpoints).Methods("GET", "PUT")
+	err = c.ConfigureDevice(iface.Name, config)
+	if err != nil {
+		return err
+	}
 
-	os.Remove(UNIX_PLUGIN_LISTENER)
-	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
+	exec.Command("ip", "link", "set", "dev", iface.Name, "multicast", "on").Run()
+	err = exec.Command("ip", "link", "set", "dev", iface.Name, "up").Run()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	informPeersToApi()
+	return saveInterfaceConfig(iface.Name)
+}
+
+// swapped out by tests
+var bringUpSiteInterface = bringUpInterface
+var installSitePeer = configureSitePeer
+var uninstallSitePeer = removeSitePeer
+var routeSiteSubnets = setSiteRoutes
+var saveSiteInterface = saveInterfaceConfig
+var siteInterfacePeers = getInterfacePeers
+var updateSiteAddress = updateWireguardAddress
+
+// restoreSites brings up additional interfaces and reinstalls site routes
+func restoreSites() {
+	spr := loadSprConfig()
+
+	for _, iface := range spr.Interfaces {
+		err := bringUpSiteInterface(iface)
+		if err != nil {
+			fmt.Println("failed to bring up", iface.Name, err)
+		}
+	}
+
+	for _, site := range spr.Sites {
+		routeSiteSubnets(site.Interface, site.Subnets, true)
+	}
+}
+
+func pluginGetSites(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	spr := loadSprConfig()
+
+	peers := map[string]ClientPeer{}
+	for _, iface := range append([]string{WireguardInterface}, configuredInterfaceNames(spr)...) {
+		ifacePeers, _ := getInterfacePeers(iface)
+		for _, p := range ifacePeers {
+			peers[p.PublicKey] = p
+		}
+	}
+
+	sites := []SiteStatus{}
+	for _, site := range spr.Sites {
+		status := SiteStatus{SitePeer: site}
+		if p, exists := peers[site.PublicKey]; exists {
+			status.LatestHandshake = p.LatestHandshake
+			status.TransferRx = p.TransferRx
+			status.TransferTx = p.TransferTx
+		}
+		sites = append(sites, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sites)
+}
+
+func configuredInterfaceNames(spr SPRConfig) []string {
+	names := []string{}
+	for _, iface := range spr.Interfaces {
+		names = append(names, iface.Name)
+	}
+	return names
+}
+
+func pluginSite(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	site := SitePeer{}
+	err := json.NewDecoder(r.Body).Decode(&site)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	spr := loadSprConfig()
+
+	if r.Method == http.MethodDelete {
+		for i, entry := range spr.Sites {
+			if entry.Name != site.Name && (site.PublicKey == "" || entry.PublicKey != site.PublicKey) {
+				continue
+			}
+
+			err = uninstallSitePeer(entry)
+			if err != nil {
+				fmt.Println("DELETE site err:", err)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			routeSiteSubnets(entry.Interface, entry.Subnets, false)
+			saveSiteInterface(entry.Interface)
+
+			spr.Sites = append(spr.Sites[:i], spr.Sites[i+1:]...)
+			saveSprConfig(spr)
+
+			updateSiteAddress(siteUpdate(entry), true)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(true)
+			return
+		}
+
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	if !validSiteName(site.Name) {
+		http.Error(w, "invalid site Name", 400)
+		return
+	}
+
+	if site.Interface == "" {
+		site.Interface = WireguardInterface
+	}
+	if !interfaceConfigured(spr, site.Interface) {
+		http.Error(w, "unknown interface "+site.Interface, 400)
+		return
+	}
+
+	if _, err = wgtypes.ParseKey(site.PublicKey); err != nil {
+		http.Error(w, "invalid PublicKey", 400)
+		return
+	}
+
+	if site.Endpoint != "" {
+		if _, _, err = net.SplitHostPort(site.Endpoint); err != nil {
+			http.Error(w, "Endpoint must be host:port", 400)
+			return
+		}
+		if site.PersistentKeepalive == 0 {
+			site.PersistentKeepalive = 25
+		}
+	}
+	if site.PersistentKeepalive < 0 || site.PersistentKeepalive > 3600 {
+		http.Error(w, "invalid PersistentKeepalive", 400)
+		return
+	}
+
+	site.Subnets, err = parseSiteSubnets(site.Subnets)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	index := -1
+	for i, entry := range spr.Sites {
+		if entry.Name == site.Name {
+			index = i
+			continue
+		}
+		if entry.PublicKey == site.PublicKey {
+			http.Error(w, "PublicKey is already used by site "+entry.Name, 400)
+			return
+		}
+		for _, subnet := range site.Subnets {
+			for _, other := range entry.Subnets {
+				if subnetsOverlap(subnet, other) {
+					http.Error(w, "subnet "+subnet+" overlaps with site "+entry.Name, 400)
+					return
+				}
+			}
+		}
+	}
+
+	previous := SitePeer{}
+	if index >= 0 {
+		previous = spr.Sites[index]
+	}
+
+	//the key must not belong to a client peer
+	if previous.PublicKey != site.PublicKey {
+		peers, _ := siteInterfacePeers(site.Interface)
+		for _, p := range peers {
+			if p.PublicKey == site.PublicKey {
+				http.Error(w, "PublicKey is already used by a peer", 400)
+				return
+			}
+		}
+	}
+
+	if site.PresharedKey == "" && previous.PublicKey == site.PublicKey {
+		site.PresharedKey = previous.PresharedKey
+	}
+	if site.PresharedKey == "" {
+		site.PresharedKey, err = genPresharedKey()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else if _, err = wgtypes.ParseKey(site.PresharedKey); err != nil {
+		http.Error(w, "invalid PresharedKey", 400)
+		return
+	}
+
+	if site.Address == "" && previous.PublicKey == site.PublicKey {
+		site.Address = previous.Address
+	}
+	if site.Address == "" {
+		address, err := getNewPeerAddress(site.PublicKey)
+		if err != nil {
+			fmt.Println("error:", err)
+			http.Error(w, "failed to assign an address", 400)
+			return
+		}
+		site.Address = strings.Split(address, "/")[0]
+	} else if ip := net.ParseIP(site.Address); ip == nil || ip.To4() == nil {
+		http.Error(w, "invalid Address", 400)
+		return
+	}
+
+	//the API rejects subnets that collide with local networks
+	err = updateSiteAddress(siteUpdate(site), false)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if index >= 0 {
+		if previous.PublicKey != site.PublicKey || previous.Interface != site.Interface {
+			uninstallSitePeer(previous)
+			saveSiteInterface(previous.Interface)
+			routeSiteSubnets(previous.Interface, previous.Subnets, false)
+		} else {
+			kept := map[string]bool{}
+			for _, subnet := range site.Subnets {
+				kept[subnet] = true
+			}
+			removed := []string{}
+			for _, subnet := range previous.Subnets {
+				if !kept[subnet] {
+					removed = append(removed, subnet)
+				}
+			}
+			routeSiteSubnets(previous.Interface, removed, false)
+		}
+
+		if previous.PublicKey != site.PublicKey {
+			updateSiteAddress(siteUpdate(previous), true)
+		}
+	}
+
+	err = installSitePeer(site)
+	if err != nil {
+		fmt.Println("wg set error:", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	routeSiteSubnets(site.Interface, site.Subnets, true)
+
+	err = saveSiteInterface(site.Interface)
+	if err != nil {
+		fmt.Println("failed to save config:", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if index >= 0 {
+		spr.Sites[index] = site
+	} else {
+		spr.Sites = append(spr.Sites, site)
+	}
+	saveSprConfig(spr)
+
+	//the remote router needs these to configure its side
+	config := SiteConfig{Site: site, ListenPort: interfaceListenPort(spr, site.Interface)}
+	config.PublicKey, _ = getInterfacePublicKey(site.Interface)
+	if ip, err := getNetworkIP(); err == nil {
+		config.Endpoint = net.JoinHostPort(ip, strconv.Itoa(config.ListenPort))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func pluginGetInterfaces(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	spr := loadSprConfig()
+
+	interfaces := []InterfaceStatus{}
+	for _, name := range append([]string{WireguardInterface}, configuredInterfaceNames(spr)...) {
+		status := InterfaceStatus{InterfaceConfig: InterfaceConfig{Name: name, ListenPort: interfaceListenPort(spr, name)}}
+		status.PublicKey, _ = getInterfacePublicKey(name)
+		interfaces = append(interfaces, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(interfaces)
+}
+
+func pluginInterface(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	iface := InterfaceConfig{}
+	err := json.NewDecoder(r.Body).Decode(&iface)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if !validInterfaceName(iface.Name) || iface.Name == WireguardInterface {
+		http.Error(w, "invalid interface Name", 400)
+		return
+	}
+
+	spr := loadSprConfig()
+
+	index := -1
+	for i, entry := range spr.Interfaces {
+		if entry.Name == iface.Name {
+			index = i
+			break
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		if index == -1 {
+			http.Error(w, "Not found", 404)
+			return
+		}
+
+		for _, site := range spr.Sites {
+			if site.Interface == iface.Name {
+				http.Error(w, "interface is used by site "+site.Name, 400)
+				return
+			}
+		}
+
+		exec.Command("ip", "link", "del", "dev", iface.Name).Run()
+		os.Remove(interfaceConfigFile(iface.Name))
+
+		spr.Interfaces = append(spr.Interfaces[:index], spr.Interfaces[index+1:]...)
+		saveSprConfig(spr)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+
+	if iface.ListenPort < 1 || iface.ListenPort > 65535 {
+		http.Error(w, "invalid ListenPort", 400)
+		return
+	}
+
+	for _, name := range append([]string{WireguardInterface}, configuredInterfaceNames(spr)...) {
+		if name != iface.Name && interfaceListenPort(spr, name) == iface.ListenPort {
+			http.Error(w, "ListenPort is already used by "+name, 400)
+			return
+		}
+	}
+
+	err = bringUpInterface(iface)
+	if err != nil {
+		fmt.Println("failed to bring up", iface.Name, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if index >= 0 {
+		spr.Interfaces[index] = iface
+	} else {
+		spr.Interfaces = append(spr.Interfaces, iface)
+	}
+	saveSprConfig(spr)
+
+	status := InterfaceStatus{InterfaceConfig: iface}
+	status.PublicKey, _ = getInterfacePublicKey(iface.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// peers with a handshake in the last 3 minutes are up, as wireguard
+// renews the session every 2 minutes while traffic flows
+const peerActiveSeconds = 180
+
+var defaultPeerHealthSampleSeconds = 30
+var defaultPeerHealthHistoryLength = 120
+
+var validStaleActions = []string{"", "disable", "expire"}
+
+// PeerHealthConfig controls peer sampling and what happens to stale peers.
+// Peers are stale after StaleSeconds without a handshake, 0 never goes stale.
+type PeerHealthConfig struct {
+	SampleSeconds int    `json:",omitempty"`
+	HistoryLength int    `json:",omitempty"`
+	StaleSeconds  int    `json:",omitempty"`
+	StaleAction   string `json:",omitempty"` //disable removes the peer, expire sets the API DeviceExpiration
+}
+
+// a peer that was removed from wg0 for being stale, kept to enable it again
+type DisabledPeer struct {
+	PublicKey    string
+	PresharedKey string
+	AllowedIPs   string
+	DisabledAt   int64
+}
+
+type PeerSample struct {
+	Time            int64
+	LatestHandshake int64
+	TransferRx      int64
+	TransferTx      int64
+	RxRate          float64 //bytes per second since the previous sample
+	TxRate          float64
+}
+
+type PeerHealth struct {
+	PublicKey       string
+	Interface       string
+	IP              string
+	Endpoint        string
+	Up              bool
+	Stale           bool
+	Disabled        bool
+	FirstSeen       int64
+	LatestHandshake int64
+	LastChange      int64
+	History         []PeerSample
+}
+
+// sent to the API when a peer goes up or down
+type WireguardPeerEvent struct {
+	PublicKey       string
+	IP              string
+	Iface           string
+	Endpoint        string
+	Status          string
+	LatestHandshake int64
+}
+
+var Healthmtx sync.Mutex
+var gPeerHealth = map[string]*PeerHealth{}
+
+func (c PeerHealthConfig) Validate() error {
+	if c.SampleSeconds < 0 || c.HistoryLength < 0 || c.StaleSeconds < 0 {
+		return errors.New("negative values are not allowed")
+	}
+	if c.SampleSeconds != 0 && c.SampleSeconds < 5 {
+		return errors.New("SampleSeconds should be at least 5")
+	}
+	if c.HistoryLength > 10000 {
+		return errors.New("HistoryLength is too large")
+	}
+	if c.StaleSeconds != 0 && c.StaleSeconds < peerActiveSeconds {
+		return fmt.Errorf("StaleSeconds should be at least %d", peerActiveSeconds)
+	}
+
+	valid := false
+	for _, action := range validStaleActions {
+		if c.StaleAction == action {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid StaleAction %s", c.StaleAction)
+	}
+	if c.StaleAction != "" && c.StaleSeconds == 0 {
+		return errors.New("StaleAction needs StaleSeconds")
+	}
+	return nil
+}
+
+func (c PeerHealthConfig) sampleInterval() time.Duration {
+	if c.SampleSeconds == 0 {
+		return time.Duration(defaultPeerHealthSampleSeconds) * time.Second
+	}
+	return time.Duration(c.SampleSeconds) * time.Second
+}
+
+func (c PeerHealthConfig) historyLength() int {
+	if c.HistoryLength == 0 {
+		return defaultPeerHealthHistoryLength
+	}
+	return c.HistoryLength
+}
+
+// peerAddress returns the /32 address of a peer, site peers also list
+// their routed subnets
+func peerAddress(allowedIPs []string) string {
+	for _, allowed := range allowedIPs {
+		if strings.HasSuffix(allowed, "/32") {
+			return strings.TrimSuffix(allowed, "/32")
+		}
+	}
+	return ""
+}
+
+// samplePeerHealth records a sample for every peer, returning the peers
+// that went up or down and the peers that became stale
+func samplePeerHealth(status map[string]wgStatusDevice, config PeerHealthConfig, now int64) ([]WireguardPeerEvent, []PeerHealth) {
+	Healthmtx.Lock()
+	defer Healthmtx.Unlock()
+
+	events := []WireguardPeerEvent{}
+	stale := []PeerHealth{}
+	seen := map[string]bool{}
+
+	for iface, dev := range status {
+		for pubkey, peer := range dev.Peers {
+			seen[pubkey] = true
+
+			health, exists := gPeerHealth[pubkey]
+			if !exists {
+				health = &PeerHealth{PublicKey: pubkey, FirstSeen: now, LastChange: now, History: []PeerSample{}}
+				gPeerHealth[pubkey] = health
+			}
+			health.Interface = iface
+			health.IP = peerAddress(peer.AllowedIPs)
+			health.Endpoint = peer.Endpoint
+			health.Disabled = false
+
+			sample := PeerSample{Time: now, LatestHandshake: peer.LatestHandshake,
+				TransferRx: peer.TransferRx, TransferTx: peer.TransferTx}
+			if n := len(health.History); n > 0 {
+				previous := health.History[n-1]
+				elapsed := float64(now - previous.Time)
+				//counters reset when the peer is configured again
+				if elapsed > 0 && sample.TransferRx >= previous.TransferRx && sample.TransferTx >= previous.TransferTx {
+					sample.RxRate = float64(sample.TransferRx-previous.TransferRx) / elapsed
+					sample.TxRate = float64(sample.TransferTx-previous.TransferTx) / elapsed
+				}
+			}
+			health.History = append(health.History, sample)
+			if extra := len(health.History) - config.historyLength(); extra > 0 {
+				health.History = health.History[extra:]
+			}
+
+			if peer.LatestHandshake > health.LatestHandshake {
+				//a handshake makes a stale peer healthy again
+				health.Stale = false
+			}
+			health.LatestHandshake = peer.LatestHandshake
+
+			up := peer.LatestHandshake != 0 && now-peer.LatestHandshake <= peerActiveSeconds
+			if up != health.Up {
+				health.Up = up
+				health.LastChange = now
+				status := "down"
+				if up {
+					status = "up"
+				}
+				events = append(events, WireguardPeerEvent{
+					PublicKey:       pubkey,
+					IP:              health.IP,
+					Iface:           iface,
+					Endpoint:        peer.Endpoint,
+					Status:          status,
+					LatestHandshake: peer.LatestHandshake,
+				})
+			}
+
+			if config.StaleSeconds > 0 && !health.Stale {
+				//peers that never connected age from when they were first seen
+				last := health.LatestHandshake
+				if last == 0 {
+					last = health.FirstSeen
+				}
+				if now-last > int64(config.StaleSeconds) {
+					health.Stale = true
+					stale = append(stale, *health)
+				}
+			}
+		}
+	}
+
+	//forget removed peers, disabled peers are tracked through the config
+	for pubkey := range gPeerHealth {
+		if !seen[pubkey] && !gPeerHealth[pubkey].Disabled {
+			delete(gPeerHealth, pubkey)
+		}
+	}
+
+	return events, stale
+}
+
+func informPeerEventToApi(event WireguardPeerEvent) error {
+	return putToApi("http://api-wireguard/wireguardPeerEvent", event)
+}
+
+// putToApi sends a request to the API over the plugin socket
+func putToApi(url string, data interface{}) error {
+	c := http.Client{Timeout: 20 * time.Second}
+	c.Transport = &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", api_path)
+		},
+	}
+
+	requestJson, _ := json.Marshal(data)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(requestJson))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("API error %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// swapped out by tests
+var listStalePeerCandidates = getPeers
+var removeStalePeer = removePeer
+
+// disableStalePeer removes a stale peer from wg0 and keeps its
+// configuration so that it can be enabled again
+func disableStalePeer(spr *SPRConfig, health PeerHealth, now int64) error {
+	peers, err := listStalePeerCandidates()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		if p.PublicKey != health.PublicKey {
+			continue
+		}
+
+		err = removeStalePeer(p)
+		if err != nil {
+			return err
+		}
+
+		spr.DisabledPeers = append(spr.DisabledPeers, DisabledPeer{
+			PublicKey:    p.PublicKey,
+			PresharedKey: p.PresharedKey,
+			AllowedIPs:   p.AllowedIPs,
+			DisabledAt:   now,
+		})
+		saveSprConfig(*spr)
+
+		Healthmtx.Lock()
+		if entry, exists := gPeerHealth[p.PublicKey]; exists {
+			entry.Disabled = true
+		}
+		Healthmtx.Unlock()
+		return nil
+	}
+
+	return errors.New("peer not found on " + WireguardInterface)
+}
+
+// handleStalePeer disables a stale peer right away. A peer to expire is
+// returned instead, the api call is made without holding Configmtx
+func handleStalePeer(spr *SPRConfig, health PeerHealth, now int64) *WireguardUpdate {
+	for _, site := range spr.Sites {
+		//sites are managed through their own configuration
+		if site.PublicKey == health.PublicKey {
+			return nil
+		}
+	}
+
+	switch spr.PeerHealth.StaleAction {
+	case "disable":
+		if health.Interface != WireguardInterface {
+			return nil
+		}
+		err := disableStalePeer(spr, health, now)
+		if err != nil {
+			fmt.Println("failed to disable stale peer", health.PublicKey, err)
+		}
+	case "expire":
+		return &WireguardUpdate{IP: health.IP,
+			PublicKey: health.PublicKey,
+			Iface:     health.Interface}
+	}
+	return nil
+}
+
+func peerHealthTick() time.Duration {
+	Configmtx.Lock()
+
+	spr := loadSprConfig()
+	interval := spr.PeerHealth.sampleInterval()
+
+	status, err := getStatus()
+	if err != nil {
+		Configmtx.Unlock()
+		fmt.Println("wg status failed", err)
+		return interval
+	}
+
+	now := time.Now().Unix()
+	events, stale := samplePeerHealth(status, spr.PeerHealth, now)
+
+	expire := []WireguardUpdate{}
+	for _, health := range stale {
+		if update := handleStalePeer(&spr, health, now); update != nil {
+			expire = append(expire, *update)
+		}
+	}
+
+	Configmtx.Unlock()
+
+	//the api may call back into the plugin, send without the lock
+	for _, event := range events {
+		err = informPeerEventToApi(event)
+		if err != nil {
+			fmt.Println("failed to inform peer event", event.PublicKey, event.Status, err)
+		}
+	}
+
+	for _, update := range expire {
+		err = putToApi("http://api-wireguard/wireguardExpire", update)
+		if err != nil {
+			fmt.Println("failed to expire stale peer", update.PublicKey, err)
+		}
+	}
+
+	return interval
+}
+
+func peerHealthLoop() {
+	for {
+		time.Sleep(peerHealthTick())
+	}
+}
+
+func pluginGetHealth(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	disabled := loadSprConfig().DisabledPeers
+	Configmtx.Unlock()
+
+	Healthmtx.Lock()
+	peers := []PeerHealth{}
+	for _, health := range gPeerHealth {
+		entry := *health
+		entry.History = append([]PeerSample{}, health.History...)
+		peers = append(peers, entry)
+	}
+	Healthmtx.Unlock()
+
+	known := map[string]bool{}
+	for _, health := range peers {
+		known[health.PublicKey] = true
+	}
+	for _, peer := range disabled {
+		if !known[peer.PublicKey] {
+			peers = append(peers, PeerHealth{
+				PublicKey:  peer.PublicKey,
+				Interface:  WireguardInterface,
+				IP:         strings.Split(peer.AllowedIPs, "/")[0],
+				Stale:      true,
+				Disabled:   true,
+				LastChange: peer.DisabledAt,
+				History:    []PeerSample{},
+			})
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Interface != peers[j].Interface {
+			return peers[i].Interface < peers[j].Interface
+		}
+		return peers[i].IP < peers[j].IP
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+func pluginHealthConfig(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	spr := loadSprConfig()
+
+	if r.Method == http.MethodPut {
+		config := PeerHealthConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = config.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		spr.PeerHealth = config
+		saveSprConfig(spr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spr.PeerHealth)
+}
+
+// pluginEnablePeer adds a peer that was disabled for being stale back to wg0
+func pluginEnablePeer(w http.ResponseWriter, r *http.Request) {
+	Configmtx.Lock()
+	defer Configmtx.Unlock()
+
+	peer := ClientPeer{}
+	err := json.NewDecoder(r.Body).Decode(&peer)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	spr := loadSprConfig()
+
+	for i, disabled := range spr.DisabledPeers {
+		if disabled.PublicKey != peer.PublicKey {
+			continue
+		}
+
+		err = addPeer(disabled.PublicKey, disabled.PresharedKey, disabled.AllowedIPs)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = saveConfig()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		spr.DisabledPeers = append(spr.DisabledPeers[:i], spr.DisabledPeers[i+1:]...)
+		saveSprConfig(spr)
+
+		//the peer starts aging again from now
+		Healthmtx.Lock()
+		delete(gPeerHealth, disabled.PublicKey)
+		Healthmtx.Unlock()
+
+		IP := strings.Split(disabled.AllowedIPs, "/")[0]
+		updateWireguardAddress(WireguardUpdate{IP: IP,
+			PublicKey: disabled.PublicKey,
+			Iface:     WireguardInterface}, false)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+
+	http.Error(w, "Not found", 404)
+}
+
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("DEBUGHTTP") != "" {
+			fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func informPeersToApi() {
+	//inform the API about each configured peer to keep verdict maps for zones
+	//up to date
+	sites := loadSprConfig().Sites
+	isSite := map[string]bool{}
+	for _, site := range sites {
+		isSite[site.PublicKey] = true
+	}
+
+	peers, _ := getPeers()
+	for _, p := range peers {
+		if isSite[p.PublicKey] {
+			continue
+		}
+		IP := strings.Split(p.AllowedIPs, "/")[0]
+		updateWireguardAddress(WireguardUpdate{IP: IP,
+			PublicKey: p.PublicKey,
+			Iface:     WireguardInterface}, false)
+	}
+
+	for _, site := range sites {
+		updateWireguardAddress(siteUpdate(site), false)
+	}
+}
+
+func wireguardEnabledInConfig() bool {
+	data, err := ioutil.ReadFile(ApiConfigPath)
+	if err != nil {
+		return true
+	}
+
+	cfg := struct {
+		Plugins []struct {
+			Name    string
+			Enabled bool
+		}
+	}{}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return true
+	}
+
+	for _, p := range cfg.Plugins {
+		if p.Name == "wireguard" {
+			return p.Enabled
+		}
+	}
+
+	return true
+}
+
+func main() {
+	if wireguardEnabledInConfig() {
+		if _, err := exec.Command("/scripts/up.sh").Output(); err != nil {
+			fmt.Println("wg up failed at startup", err)
+		}
+
+		if err := migrateLegacyMulticastAllowedIPs(); err != nil {
+			fmt.Println("failed to remove legacy multicast AllowedIPs", err)
+		}
+
+		restoreSites()
+	}
+
+	unix_plugin_router := mux.NewRouter().StrictSlash(true)
+
+	unix_plugin_router.HandleFunc("/genkey", pluginGenKey).Methods("GET")
+	unix_plugin_router.HandleFunc("/config", pluginGetConfig).Methods("GET")
+	unix_plugin_router.HandleFunc("/status", pluginGetStatus).Methods("GET")
+	unix_plugin_router.HandleFunc("/peers", pluginGetPeers).Methods("GET")
+	unix_plugin_router.HandleFunc("/peer", pluginPeer).Methods("PUT", "DELETE")
+
+	unix_plugin_router.HandleFunc("/up", pluginUp).Methods("PUT")
+	unix_plugin_router.HandleFunc("/down", pluginDown).Methods("PUT")
+
+	unix_plugin_router.HandleFunc("/endpoints", getSetEndpoints).Methods("GET", "PUT")
+
+	unix_plugin_router.HandleFunc("/sites", pluginGetSites).Methods("GET")
+	unix_plugin_router.HandleFunc("/site", pluginSite).Methods("PUT", "DELETE")
+	unix_plugin_router.HandleFunc("/interfaces", pluginGetInterfaces).Methods("GET")
+	unix_plugin_router.HandleFunc("/interface", pluginInterface).Methods("PUT", "DELETE")
+
+	unix_plugin_router.HandleFunc("/health", pluginGetHealth).Methods("GET")
+	unix_plugin_router.HandleFunc("/health/config", pluginHealthConfig).Methods("GET", "PUT")
+	unix_plugin_router.HandleFunc("/health/enable", pluginEnablePeer).Methods("PUT")
+
+	os.Remove(UNIX_PLUGIN_LISTENER)
+	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
+	if err != nil {
+		panic(err)
+	}
+
+	informPeersToApi()
+
+	go peerHealthLoop()
 
 	pluginServer := http.Server{Handler: logRequest(unix_plugin_router)}
 
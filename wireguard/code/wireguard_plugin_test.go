@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPeerA = "mUGrfPF+LmKfvGWk3xAcQ7YDHhUMgHRiXUOn6w1Fbls="
+const testPeerB = "4Bv3k1aMPyLqPkXqSPsnGHKzQ0BtfjCDLqN2a2QEvUA="
+const testPeerC = "K3E9t0Tq3UXnn6GvWqEMWqg6l0OlKQZ3fEq0jW8EjX0="
+
+func resetPeerHealth(t *testing.T, health map[string]*PeerHealth) {
+	t.Helper()
+	Healthmtx.Lock()
+	saved := gPeerHealth
+	gPeerHealth = health
+	Healthmtx.Unlock()
+	t.Cleanup(func() {
+		Healthmtx.Lock()
+		gPeerHealth = saved
+		Healthmtx.Unlock()
+	})
+}
+
+func TestSamplePeerHealth(t *testing.T) {
+	const now = 100000
+	config := PeerHealthConfig{StaleSeconds: 600}
+
+	tests := []struct {
+		name     string
+		previous map[string]*PeerHealth
+		peer     wgStatusPeer
+		events   []string
+		stale    bool
+		check    func(t *testing.T, health *PeerHealth)
+	}{
+		{
+			name:   "new peer with a recent handshake goes up",
+			peer:   wgStatusPeer{LatestHandshake: now - 10, AllowedIPs: []string{"192.168.3.2/32"}},
+			events: []string{"up"},
+			check: func(t *testing.T, health *PeerHealth) {
+				if !health.Up || health.IP != "192.168.3.2" || health.FirstSeen != now {
+					t.Errorf("unexpected health %+v", health)
+				}
+			},
+		},
+		{
+			name:     "handshake too old goes down",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Up: true, FirstSeen: now - 1000, LatestHandshake: now - 300}},
+			peer:     wgStatusPeer{LatestHandshake: now - 300},
+			events:   []string{"down"},
+		},
+		{
+			name:     "never connected ages from first seen",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, FirstSeen: now - 601}},
+			peer:     wgStatusPeer{},
+			stale:    true,
+		},
+		{
+			name:     "stale peers are only reported once",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Stale: true, FirstSeen: now - 2000}},
+			peer:     wgStatusPeer{},
+		},
+		{
+			name:     "a new handshake clears stale",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Stale: true, FirstSeen: now - 2000, LatestHandshake: now - 1000}},
+			peer:     wgStatusPeer{LatestHandshake: now - 5},
+			events:   []string{"up"},
+			check: func(t *testing.T, health *PeerHealth) {
+				if health.Stale {
+					t.Error("peer is still stale")
+				}
+			},
+		},
+		{
+			name: "rates come from the previous sample",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Up: true, FirstSeen: now - 100, LatestHandshake: now - 10,
+				History: []PeerSample{{Time: now - 10, TransferRx: 1000, TransferTx: 500}}}},
+			peer: wgStatusPeer{LatestHandshake: now - 10, TransferRx: 3000, TransferTx: 600},
+			check: func(t *testing.T, health *PeerHealth) {
+				sample := health.History[len(health.History)-1]
+				if sample.RxRate != 200 || sample.TxRate != 10 {
+					t.Errorf("unexpected rates %+v", sample)
+				}
+			},
+		},
+		{
+			name: "reset counters have no rate",
+			previous: map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Up: true, FirstSeen: now - 100, LatestHandshake: now - 10,
+				History: []PeerSample{{Time: now - 10, TransferRx: 1000, TransferTx: 500}}}},
+			peer: wgStatusPeer{LatestHandshake: now - 10, TransferRx: 10, TransferTx: 10},
+			check: func(t *testing.T, health *PeerHealth) {
+				sample := health.History[len(health.History)-1]
+				if sample.RxRate != 0 || sample.TxRate != 0 {
+					t.Errorf("unexpected rates %+v", sample)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := tt.previous
+			if previous == nil {
+				previous = map[string]*PeerHealth{}
+			}
+			resetPeerHealth(t, previous)
+
+			status := map[string]wgStatusDevice{"wg0": {Peers: map[string]wgStatusPeer{testPeerA: tt.peer}}}
+			events, stale := samplePeerHealth(status, config, now)
+
+			statuses := []string{}
+			for _, event := range events {
+				statuses = append(statuses, event.Status)
+			}
+			if fmt.Sprint(statuses) != fmt.Sprint(tt.events) {
+				t.Errorf("got events %v, want %v", statuses, tt.events)
+			}
+			if (len(stale) == 1) != tt.stale {
+				t.Errorf("got stale %+v, want %v", stale, tt.stale)
+			}
+
+			health := gPeerHealth[testPeerA]
+			if health == nil || health.Interface != "wg0" {
+				t.Fatalf("unexpected health %+v", health)
+			}
+			if tt.check != nil {
+				tt.check(t, health)
+			}
+		})
+	}
+}
+
+func TestSamplePeerHealthForgetsRemovedPeers(t *testing.T) {
+	resetPeerHealth(t, map[string]*PeerHealth{
+		testPeerA: {PublicKey: testPeerA},
+		testPeerB: {PublicKey: testPeerB, Disabled: true},
+	})
+
+	samplePeerHealth(map[string]wgStatusDevice{}, PeerHealthConfig{}, 1000)
+
+	if _, exists := gPeerHealth[testPeerA]; exists {
+		t.Error("removed peer was kept")
+	}
+	if _, exists := gPeerHealth[testPeerB]; !exists {
+		t.Error("disabled peer was forgotten")
+	}
+}
+
+func TestSamplePeerHealthHistoryLength(t *testing.T) {
+	resetPeerHealth(t, map[string]*PeerHealth{})
+
+	status := map[string]wgStatusDevice{"wg0": {Peers: map[string]wgStatusPeer{testPeerA: {}}}}
+	for i := int64(0); i < 5; i++ {
+		samplePeerHealth(status, PeerHealthConfig{HistoryLength: 3}, 1000+i)
+	}
+
+	history := gPeerHealth[testPeerA].History
+	if len(history) != 3 || history[0].Time != 1002 {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestDisableStalePeer(t *testing.T) {
+	oldList, oldRemove, oldConfig := listStalePeerCandidates, removeStalePeer, WireguardSPRConfigFile
+	t.Cleanup(func() {
+		listStalePeerCandidates, removeStalePeer, WireguardSPRConfigFile = oldList, oldRemove, oldConfig
+	})
+
+	peer := ClientPeer{PublicKey: testPeerA, PresharedKey: "psk", AllowedIPs: "192.168.3.2/32"}
+
+	tests := []struct {
+		name      string
+		peers     []ClientPeer
+		removeErr error
+		disabled  bool
+	}{
+		{name: "peer is removed and kept", peers: []ClientPeer{{PublicKey: testPeerB}, peer}, disabled: true},
+		{name: "peer not on wg0", peers: []ClientPeer{{PublicKey: testPeerB}}},
+		{name: "removal fails", peers: []ClientPeer{peer}, removeErr: errors.New("busy")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			WireguardSPRConfigFile = filepath.Join(t.TempDir(), "wg.json")
+			resetPeerHealth(t, map[string]*PeerHealth{testPeerA: {PublicKey: testPeerA, Stale: true}})
+
+			removed := []string{}
+			listStalePeerCandidates = func() ([]ClientPeer, error) { return tt.peers, nil }
+			removeStalePeer = func(p ClientPeer) error {
+				if tt.removeErr != nil {
+					return tt.removeErr
+				}
+				removed = append(removed, p.PublicKey)
+				return nil
+			}
+
+			spr := SPRConfig{}
+			err := disableStalePeer(&spr, PeerHealth{PublicKey: testPeerA}, 1234)
+
+			if (err == nil) != tt.disabled {
+				t.Fatalf("got error %v, want disabled %v", err, tt.disabled)
+			}
+			if gPeerHealth[testPeerA].Disabled != tt.disabled {
+				t.Errorf("health Disabled is %v", gPeerHealth[testPeerA].Disabled)
+			}
+
+			saved := loadSprConfig()
+			if !tt.disabled {
+				if len(spr.DisabledPeers) != 0 || len(saved.DisabledPeers) != 0 || len(removed) != 0 {
+					t.Errorf("peer was disabled: %+v %v", spr.DisabledPeers, removed)
+				}
+				return
+			}
+
+			want := []DisabledPeer{{PublicKey: testPeerA, PresharedKey: "psk", AllowedIPs: "192.168.3.2/32", DisabledAt: 1234}}
+			if !reflect.DeepEqual(spr.DisabledPeers, want) || !reflect.DeepEqual(saved.DisabledPeers, want) {
+				t.Errorf("got %+v saved %+v, want %+v", spr.DisabledPeers, saved.DisabledPeers, want)
+			}
+			if !reflect.DeepEqual(removed, []string{testPeerA}) {
+				t.Errorf("removed %v", removed)
+			}
+		})
+	}
+}
+
+func TestHandleStalePeerExpire(t *testing.T) {
+	health := PeerHealth{PublicKey: testPeerA, Interface: "wg0", IP: "192.168.3.2"}
+
+	spr := SPRConfig{PeerHealth: PeerHealthConfig{StaleAction: "expire"}}
+	update := handleStalePeer(&spr, health, 1000)
+	if update == nil || update.PublicKey != testPeerA || update.IP != "192.168.3.2" || update.Iface != "wg0" {
+		t.Errorf("unexpected update %+v", update)
+	}
+
+	// sites are left alone
+	spr.Sites = []SitePeer{{PublicKey: testPeerA}}
+	if update := handleStalePeer(&spr, health, 1000); update != nil {
+		t.Errorf("expired a site peer: %+v", update)
+	}
+}
+
+func TestParseSiteSubnets(t *testing.T) {
+	parsed, err := parseSiteSubnets([]string{"10.20.0.1/24", " 172.16.0.0/12 "})
+	if err != nil || !reflect.DeepEqual(parsed, []string{"10.20.0.0/24", "172.16.0.0/12"}) {
+		t.Errorf("got %v %v", parsed, err)
+	}
+
+	for _, subnet := range []string{"10.20.0.0", "fd00::/64", "0.0.0.0/0", "office"} {
+		if _, err := parseSiteSubnets([]string{"10.30.0.0/24", subnet}); err == nil {
+			t.Errorf("expected an error for %q", subnet)
+		}
+	}
+}
+
+func TestSubnetsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"10.20.0.0/24", "10.20.0.0/24", true},
+		{"10.20.0.0/16", "10.20.5.0/24", true},
+		{"10.20.5.0/24", "10.20.0.0/16", true},
+		{"10.20.0.0/24", "10.20.1.0/24", false},
+		{"10.20.0.0/24", "invalid", false},
+	}
+
+	for _, tt := range tests {
+		if got := subnetsOverlap(tt.a, tt.b); got != tt.overlap {
+			t.Errorf("subnetsOverlap(%s, %s) = %v", tt.a, tt.b, got)
+		}
+	}
+}
+
+type siteCalls struct {
+	brought     []string
+	installed   []SitePeer
+	uninstalled []string
+	routes      []string
+	updates     []string
+	updateErr   error
+}
+
+// stubSites replaces the parts of the site handlers that touch links,
+// routes and the API, and records what they were asked to do
+func stubSites(t *testing.T, spr SPRConfig) *siteCalls {
+	t.Helper()
+
+	oldBringUp, oldInstall, oldUninstall, oldRoute := bringUpSiteInterface, installSitePeer, uninstallSitePeer, routeSiteSubnets
+	oldSave, oldPeers, oldUpdate, oldConfig := saveSiteInterface, siteInterfacePeers, updateSiteAddress, WireguardSPRConfigFile
+	t.Cleanup(func() {
+		bringUpSiteInterface, installSitePeer, uninstallSitePeer, routeSiteSubnets = oldBringUp, oldInstall, oldUninstall, oldRoute
+		saveSiteInterface, siteInterfacePeers, updateSiteAddress, WireguardSPRConfigFile = oldSave, oldPeers, oldUpdate, oldConfig
+	})
+
+	WireguardSPRConfigFile = filepath.Join(t.TempDir(), "wg.json")
+	saveSprConfig(spr)
+
+	calls := &siteCalls{}
+	bringUpSiteInterface = func(iface InterfaceConfig) error {
+		calls.brought = append(calls.brought, iface.Name)
+		return nil
+	}
+	installSitePeer = func(site SitePeer) error {
+		calls.installed = append(calls.installed, site)
+		return nil
+	}
+	uninstallSitePeer = func(site SitePeer) error {
+		calls.uninstalled = append(calls.uninstalled, site.PublicKey)
+		return nil
+	}
+	routeSiteSubnets = func(iface string, subnets []string, add bool) {
+		for _, subnet := range subnets {
+			calls.routes = append(calls.routes, fmt.Sprintf("%v %s %s", add, iface, subnet))
+		}
+	}
+	saveSiteInterface = func(iface string) error { return nil }
+	siteInterfacePeers = func(iface string) ([]ClientPeer, error) {
+		return []ClientPeer{{PublicKey: testPeerB}}, nil
+	}
+	updateSiteAddress = func(update WireguardUpdate, doRemove bool) error {
+		if calls.updateErr != nil {
+			return calls.updateErr
+		}
+		calls.updates = append(calls.updates, fmt.Sprintf("%v %s %v", doRemove, update.PublicKey, update.Subnets))
+		return nil
+	}
+
+	return calls
+}
+
+func siteRequest(t *testing.T, method string, site SitePeer) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(site)
+	rr := httptest.NewRecorder()
+	pluginSite(rr, httptest.NewRequest(method, "/site", bytes.NewReader(body)))
+	return rr
+}
+
+func TestPluginSite(t *testing.T) {
+	calls := stubSites(t, SPRConfig{})
+
+	office := SitePeer{Name: "office", PublicKey: testPeerA, Address: "192.168.3.10", Subnets: []string{"10.20.0.1/24"}}
+	if rr := siteRequest(t, http.MethodPut, office); rr.Code != http.StatusOK {
+		t.Fatalf("add failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	saved := loadSprConfig().Sites
+	if len(saved) != 1 || saved[0].Interface != "wg0" || saved[0].PresharedKey == "" || !reflect.DeepEqual(saved[0].Subnets, []string{"10.20.0.0/24"}) {
+		t.Fatalf("unexpected sites %+v", saved)
+	}
+	if !reflect.DeepEqual(calls.routes, []string{"true wg0 10.20.0.0/24"}) || len(calls.installed) != 1 {
+		t.Errorf("routes %v installed %+v", calls.routes, calls.installed)
+	}
+	psk := saved[0].PresharedKey
+
+	rejected := []SitePeer{
+		{Name: "branch", PublicKey: "not a key", Address: "192.168.3.11"},
+		{Name: "branch", PublicKey: testPeerA, Address: "192.168.3.11"},
+		{Name: "branch", PublicKey: testPeerB, Address: "192.168.3.11"},
+		{Name: "branch", PublicKey: testPeerC, Address: "192.168.3.11", Subnets: []string{"10.20.0.128/25"}},
+		{Name: "branch", PublicKey: testPeerC, Address: "192.168.3.11", Subnets: []string{"0.0.0.0/0"}},
+		{Name: "branch", PublicKey: testPeerC, Address: "192.168.3.11", Interface: "wg7"},
+	}
+	for _, site := range rejected {
+		if rr := siteRequest(t, http.MethodPut, site); rr.Code != http.StatusBadRequest {
+			t.Errorf("%+v: got %d", site, rr.Code)
+		}
+	}
+
+	//the API refuses subnets that collide with local networks
+	calls.updateErr = errors.New("subnet 10.30.0.0/24 overlaps with the interface eth1 subnet 10.30.0.0/16")
+	branch := SitePeer{Name: "branch", PublicKey: testPeerC, Address: "192.168.3.11", Subnets: []string{"10.30.0.0/24"}}
+	if rr := siteRequest(t, http.MethodPut, branch); rr.Code != http.StatusBadRequest {
+		t.Errorf("got %d", rr.Code)
+	}
+	calls.updateErr = nil
+	if len(loadSprConfig().Sites) != 1 || len(calls.installed) != 1 {
+		t.Errorf("a rejected site was installed")
+	}
+
+	//updating keeps the preshared key and address, and drops old routes
+	calls.routes = nil
+	update := SitePeer{Name: "office", PublicKey: testPeerA, Subnets: []string{"10.21.0.0/24"}}
+	if rr := siteRequest(t, http.MethodPut, update); rr.Code != http.StatusOK {
+		t.Fatalf("update failed: %d %s", rr.Code, rr.Body.String())
+	}
+	saved = loadSprConfig().Sites
+	if len(saved) != 1 || saved[0].PresharedKey != psk || saved[0].Address != "192.168.3.10" {
+		t.Errorf("unexpected sites %+v", saved)
+	}
+	if !reflect.DeepEqual(calls.routes, []string{"false wg0 10.20.0.0/24", "true wg0 10.21.0.0/24"}) {
+		t.Errorf("routes %v", calls.routes)
+	}
+
+	calls.routes, calls.updates = nil, nil
+	if rr := siteRequest(t, http.MethodDelete, SitePeer{Name: "office"}); rr.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d", rr.Code)
+	}
+	if len(loadSprConfig().Sites) != 0 {
+		t.Errorf("site was not removed")
+	}
+	if !reflect.DeepEqual(calls.uninstalled, []string{testPeerA}) || !reflect.DeepEqual(calls.routes, []string{"false wg0 10.21.0.0/24"}) {
+		t.Errorf("uninstalled %v routes %v", calls.uninstalled, calls.routes)
+	}
+	if !reflect.DeepEqual(calls.updates, []string{"true " + testPeerA + " [10.21.0.0/24]"}) {
+		t.Errorf("updates %v", calls.updates)
+	}
+
+	if rr := siteRequest(t, http.MethodDelete, SitePeer{Name: "office"}); rr.Code != http.StatusNotFound {
+		t.Errorf("got %d deleting a missing site", rr.Code)
+	}
+}
+
+func TestRestoreSites(t *testing.T) {
+	calls := stubSites(t, SPRConfig{
+		Interfaces: []InterfaceConfig{{Name: "wg1", ListenPort: 51281}},
+		Sites: []SitePeer{
+			{Name: "office", Interface: "wg0", PublicKey: testPeerA, Subnets: []string{"10.20.0.0/24"}},
+			{Name: "branch", Interface: "wg1", PublicKey: testPeerB, Subnets: []string{"10.30.0.0/24", "10.31.0.0/24"}},
+		},
+	})
+
+	restoreSites()
+
+	if !reflect.DeepEqual(calls.brought, []string{"wg1"}) {
+		t.Errorf("brought up %v", calls.brought)
+	}
+	want := []string{"true wg0 10.20.0.0/24", "true wg1 10.30.0.0/24", "true wg1 10.31.0.0/24"}
+	if !reflect.DeepEqual(calls.routes, want) {
+		t.Errorf("routes %v, want %v", calls.routes, want)
+	}
+}